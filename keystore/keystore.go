@@ -18,24 +18,36 @@ package keystore
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"code.google.com/p/go.crypto/ripemd160"
+	"code.google.com/p/go.crypto/scrypt"
 
 	"github.com/conformal/btcec"
 	"github.com/conformal/btcnet"
@@ -54,6 +66,14 @@ const (
 	// Maximum length in bytes of a comment that can have a size represented
 	// as a uint16.
 	maxCommentLen = (1 << 16) - 1
+
+	// Maximum number of segments a chunked comment may be split into.
+	// The number of segments is serialized as a uint8.
+	maxCommentChunks = (1 << 8) - 1
+
+	// Maximum length in bytes of a comment that can be saved as a chunked
+	// comment entry.
+	maxChunkedCommentLen = maxCommentLen * maxCommentChunks
 )
 
 const (
@@ -61,6 +81,24 @@ const (
 	defaultKdfMaxMem      = 32 * 1024 * 1024
 )
 
+// Parameters of the scrypt derivation of the key of an encrypted envelope
+// written by WriteEncrypted.  The parameters are fixed rather than read
+// from the envelope, so an envelope can not require an unbounded amount
+// of work to open.
+const (
+	envelopeSaltSize = 32
+	envelopeScryptN  = 16384
+	envelopeScryptR  = 8
+	envelopeScryptP  = 1
+)
+
+// Rand is the source of entropy used when generating keys, salts, and
+// initialization vectors, and when signing.  It defaults to crypto/rand's
+// Reader, and may be replaced with another cryptographically secure source,
+// or a deterministic source for reproducible tests.  It must not be
+// modified while key stores are being used.
+var Rand io.Reader = rand.Reader
+
 // Possible errors when dealing with key stores.
 var (
 	ErrAddressNotFound  = errors.New("address not found")
@@ -71,18 +109,65 @@ var (
 	ErrWatchingOnly     = errors.New("keystore is watching-only")
 	ErrLocked           = errors.New("keystore is locked")
 	ErrWrongPassphrase  = errors.New("wrong passphrase")
+	ErrTampered         = errors.New("file MAC mismatch")
+	ErrCorruptChain     = errors.New("corrupt address chain")
+	ErrKeyAuthFailed    = errors.New("private key failed authentication")
+	ErrCommentTooLong   = errors.New("comment too long")
+	ErrInvalidComment   = errors.New("comment is not valid UTF-8")
+	ErrReorg            = errors.New("block does not connect to last seen block")
+	ErrKeypoolExhausted = errors.New("keypool exhausted")
+	ErrDestroyed        = errors.New("keystore is destroyed")
+	ErrNetworkMismatch  = errors.New("keystore is for a different network")
+	ErrLengthMismatch   = errors.New("appended entries length mismatch")
+	ErrNoPrivKey        = errors.New("no private key for address")
+	ErrCorruptIndex     = errors.New("highest used chain index out of range")
+	ErrAppTagTooLong    = errors.New("application tag too long")
+	ErrNewerVersion     = errors.New("file version is newer than supported")
+	ErrNoFileMAC        = errors.New("keystore file has no MAC")
 )
 
+// MaxCommentLen is the maximum length in bytes of address and transaction
+// comments and the key store label.  Longer comments are rejected with
+// ErrCommentTooLong when set.  It may be lowered to limit the size of key
+// store files, but raising it beyond the limits of the file format has no
+// effect.
+var MaxCommentLen = maxChunkedCommentLen
+
+// checkComment returns ErrCommentTooLong if c is longer than either
+// MaxCommentLen or the format limit formatMax, and ErrInvalidComment if c
+// is not valid UTF-8.
+func checkComment(c string, formatMax int) error {
+	if len(c) > MaxCommentLen || len(c) > formatMax {
+		return ErrCommentTooLong
+	}
+	if !utf8.ValidString(c) {
+		return ErrInvalidComment
+	}
+	return nil
+}
+
 var fileID = [8]byte{0xba, 'W', 'A', 'L', 'L', 'E', 'T', 0x00}
 
 type entryHeader byte
 
+// Appended entries are not length prefixed, so an entry with an unknown
+// header can not be skipped, and reading the key store fails.  Files holding
+// an entry type added after a build can therefore not be read by that build.
+// The file version is bumped with each new entry type, and reading fails with
+// ErrNewerVersion if an unknown entry is read from a file of a newer version.
 const (
 	addrCommentHeader entryHeader = 1 << iota
 	txCommentHeader
 	deletedHeader
 	scriptHeader
+	chunkedCommentHeader
+	macHeader
+	labelHeader
 	addrHeader entryHeader = 0
+
+	// encryptedCommentFlag is set in the header of a transaction comment
+	// entry whose comment is encrypted.
+	encryptedCommentFlag entryHeader = 1 << 7
 )
 
 // We want to use binaryRead and binaryWrite instead of binary.Read
@@ -122,13 +207,23 @@ func pubkeyFromPrivkey(privkey []byte, compress bool) (pubkey []byte) {
 	return pk.SerializeUncompressed()
 }
 
+// keyOneIter performs a single iteration of the key derivation function.
+// All intermediate buffers holding passphrase-derived material are zeroed
+// before returning, which reduces the time this material lingers in memory
+// that may later be reclaimed and reused.
 func keyOneIter(passphrase, salt []byte, memReqts uint64) []byte {
-	saltedpass := append(passphrase, salt...)
+	// Allocate a new slice rather than appending to passphrase, which
+	// could write to (and later zero) the caller's backing array.
+	saltedpass := make([]byte, 0, len(passphrase)+len(salt))
+	saltedpass = append(saltedpass, passphrase...)
+	saltedpass = append(saltedpass, salt...)
 	lutbl := make([]byte, memReqts)
 
 	// Seed for lookup table
 	seed := sha512.Sum512(saltedpass)
 	copy(lutbl[:sha512.Size], seed[:])
+	zero(saltedpass)
+	zero(seed[:])
 
 	for nByte := 0; nByte < (int(memReqts) - sha512.Size); nByte += sha512.Size {
 		hash := sha512.Sum512(lutbl[nByte : nByte+sha512.Size])
@@ -155,9 +250,13 @@ func keyOneIter(passphrase, salt []byte, memReqts uint64) []byte {
 		// Save new hash to x
 		hash := sha512.Sum512(x)
 		copy(x, hash[:])
+		zero(hash[:])
 	}
 
-	return x[:kdfOutputBytes]
+	key := make([]byte, kdfOutputBytes)
+	copy(key, x)
+	zero(lutbl)
+	return key
 }
 
 // kdf implements the key derivation function used by Armory
@@ -167,7 +266,13 @@ func keyOneIter(passphrase, salt []byte, memReqts uint64) []byte {
 func kdf(passphrase []byte, params *kdfParameters) []byte {
 	masterKey := passphrase
 	for i := uint32(0); i < params.nIter; i++ {
-		masterKey = keyOneIter(masterKey, params.salt[:], params.mem)
+		nextKey := keyOneIter(masterKey, params.salt[:], params.mem)
+
+		// Zero each intermediate key, but never the passphrase.
+		if i != 0 {
+			zero(masterKey)
+		}
+		masterKey = nextKey
 	}
 	return masterKey
 }
@@ -260,7 +365,11 @@ func chainedPubKey(pubkey, chaincode []byte) ([]byte, error) {
 	return newPk.SerializeUncompressed(), nil
 }
 
-type version struct {
+// FileVersion is the version of a key store file.  Key store files are
+// read according to the version they were written with, and are always
+// written with VersCurrent, so any key store with an earlier version is
+// upgraded the next time it is saved.
+type FileVersion struct {
 	major         byte
 	minor         byte
 	bugfix        byte
@@ -269,18 +378,20 @@ type version struct {
 
 // Enforce that version satisifies the io.ReaderFrom and
 // io.WriterTo interfaces.
-var _ io.ReaderFrom = &version{}
-var _ io.WriterTo = &version{}
+var _ io.ReaderFrom = &FileVersion{}
+var _ io.WriterTo = &FileVersion{}
 
 // readerFromVersion is an io.ReaderFrom and io.WriterTo that
 // can specify any particular key store file format for reading
 // depending on the key store file version.
 type readerFromVersion interface {
-	readFromVersion(version, io.Reader) (int64, error)
+	readFromVersion(FileVersion, io.Reader) (int64, error)
 	io.WriterTo
 }
 
-func (v version) String() string {
+// String returns the version in dotted form, omitting trailing zero
+// components after the minor version.
+func (v FileVersion) String() string {
 	str := fmt.Sprintf("%d.%d", v.major, v.minor)
 	if v.bugfix != 0x00 || v.autoincrement != 0x00 {
 		str += fmt.Sprintf(".%d", v.bugfix)
@@ -291,11 +402,16 @@ func (v version) String() string {
 	return str
 }
 
-func (v version) Uint32() uint32 {
-	return uint32(v.major)<<6 | uint32(v.minor)<<4 | uint32(v.bugfix)<<2 | uint32(v.autoincrement)
+// Uint32 returns the version packed into a single integer, with each
+// component in its own byte from the major version in the most significant
+// byte to the autoincrement in the least.  Distinct versions always pack to
+// distinct integers, and packed versions compare in version order.
+func (v FileVersion) Uint32() uint32 {
+	return uint32(v.major)<<24 | uint32(v.minor)<<16 |
+		uint32(v.bugfix)<<8 | uint32(v.autoincrement)
 }
 
-func (v *version) ReadFrom(r io.Reader) (int64, error) {
+func (v *FileVersion) ReadFrom(r io.Reader) (int64, error) {
 	// Read 4 bytes for the version.
 	var versBytes [4]byte
 	n, err := io.ReadFull(r, versBytes[:])
@@ -309,7 +425,7 @@ func (v *version) ReadFrom(r io.Reader) (int64, error) {
 	return int64(n), nil
 }
 
-func (v *version) WriteTo(w io.Writer) (int64, error) {
+func (v *FileVersion) WriteTo(w io.Writer) (int64, error) {
 	// Write 4 bytes for the version.
 	versBytes := []byte{
 		v.major,
@@ -322,27 +438,26 @@ func (v *version) WriteTo(w io.Writer) (int64, error) {
 }
 
 // LT returns whether v is an earlier version than v2.
-func (v version) LT(v2 version) bool {
+func (v FileVersion) LT(v2 FileVersion) bool {
+	// A less significant component is only considered when all more
+	// significant components are equal.
 	switch {
-	case v.major < v2.major:
-		return true
-
-	case v.minor < v2.minor:
-		return true
+	case v.major != v2.major:
+		return v.major < v2.major
 
-	case v.bugfix < v2.bugfix:
-		return true
+	case v.minor != v2.minor:
+		return v.minor < v2.minor
 
-	case v.autoincrement < v2.autoincrement:
-		return true
+	case v.bugfix != v2.bugfix:
+		return v.bugfix < v2.bugfix
 
 	default:
-		return false
+		return v.autoincrement < v2.autoincrement
 	}
 }
 
 // EQ returns whether v2 is an equal version to v.
-func (v version) EQ(v2 version) bool {
+func (v FileVersion) EQ(v2 FileVersion) bool {
 	switch {
 	case v.major != v2.major:
 		return false
@@ -362,33 +477,32 @@ func (v version) EQ(v2 version) bool {
 }
 
 // GT returns whether v is a later version than v2.
-func (v version) GT(v2 version) bool {
+func (v FileVersion) GT(v2 FileVersion) bool {
+	// A less significant component is only considered when all more
+	// significant components are equal.
 	switch {
-	case v.major > v2.major:
-		return true
-
-	case v.minor > v2.minor:
-		return true
+	case v.major != v2.major:
+		return v.major > v2.major
 
-	case v.bugfix > v2.bugfix:
-		return true
+	case v.minor != v2.minor:
+		return v.minor > v2.minor
 
-	case v.autoincrement > v2.autoincrement:
-		return true
+	case v.bugfix != v2.bugfix:
+		return v.bugfix > v2.bugfix
 
 	default:
-		return false
+		return v.autoincrement > v2.autoincrement
 	}
 }
 
 // Various versions.
 var (
 	// VersArmory is the latest version used by Armory.
-	VersArmory = version{1, 35, 0, 0}
+	VersArmory = FileVersion{1, 35, 0, 0}
 
 	// Vers20LastBlocks is the version where key store files now hold
 	// the 20 most recently seen block hashes.
-	Vers20LastBlocks = version{1, 36, 0, 0}
+	Vers20LastBlocks = FileVersion{1, 36, 0, 0}
 
 	// VersUnsetNeedsPrivkeyFlag is the bugfix version where the
 	// createPrivKeyNextUnlock address flag is correctly unset
@@ -398,15 +512,72 @@ var (
 	// encrypted address.  Key store versions at or before this
 	// version include a special case to allow the duplicate
 	// encrypt.
-	VersUnsetNeedsPrivkeyFlag = version{1, 36, 1, 0}
+	VersUnsetNeedsPrivkeyFlag = FileVersion{1, 36, 1, 0}
+
+	// VersChunkedComments is the version where address and transaction
+	// comments too large to fit in a single entry are split across
+	// multiple length-prefixed segments of a chunked comment entry.
+	VersChunkedComments = FileVersion{1, 36, 2, 0}
+
+	// VersPerAddressKeys is the version where address private keys may
+	// be encrypted with a subkey derived from the key store's AES key
+	// and the address hash, rather than the AES key itself.
+	VersPerAddressKeys = FileVersion{1, 36, 3, 0}
+
+	// VersFileMAC is the version where key store files may end with a
+	// trailer holding a MAC over the entire file, keyed by a key derived
+	// from the passphrase.
+	VersFileMAC = FileVersion{1, 36, 4, 0}
+
+	// VersGCM is the version where private keys may be encrypted with
+	// AES-GCM rather than AES-CFB.  Addresses encrypted with AES-GCM are
+	// serialized with the authentication tag following the address.
+	VersGCM = FileVersion{1, 36, 5, 0}
+
+	// VersLabel is the version where key store files may hold a display
+	// label in an appended entry, separate from the key store name.
+	VersLabel = FileVersion{1, 36, 6, 0}
+
+	// VersLastSync is the version where the time the key store was last
+	// known to be synced is saved in the unused space after the recently
+	// seen blocks.
+	VersLastSync = FileVersion{1, 36, 7, 0}
+
+	// VersEntriesLength is the version where the total length of the
+	// appended entries, excluding any file MAC, is saved in the unused
+	// space after the last sync time, so truncated or extended files can
+	// be detected.
+	VersEntriesLength = FileVersion{1, 36, 8, 0}
+
+	// VersAppTag is the version where an application-defined tag is saved
+	// in the unused space after the appended entries length.
+	VersAppTag = FileVersion{1, 36, 9, 0}
+
+	// VersEncryptedComments is the version where transaction comments may
+	// be encrypted, saved in entries with the encrypted comment flag set
+	// in the entry header.
+	VersEncryptedComments = FileVersion{1, 36, 10, 0}
 
 	// VersCurrent is the current key store file version.
-	VersCurrent = VersUnsetNeedsPrivkeyFlag
+	VersCurrent = VersEncryptedComments
 )
 
 type varEntries struct {
 	store   *Store
 	entries []io.WriterTo
+
+	// bodyHash, if non-nil, hashes every byte read before a file MAC.
+	bodyHash hash.Hash
+
+	// length is the number of bytes read for all entries before a file
+	// MAC.
+	length int64
+
+	// If recovering, an error reading an entry stops reading entries but
+	// is saved to errs rather than returned.  All entries read before
+	// the error are kept.
+	recovering bool
+	errs       []error
 }
 
 func (v *varEntries) WriteTo(w io.Writer) (n int64, err error) {
@@ -424,6 +595,18 @@ func (v *varEntries) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (v *varEntries) ReadFrom(r io.Reader) (n int64, err error) {
+	n, err = v.readEntries(r)
+	if err != nil && v.recovering {
+		// Entries are not length prefixed, so it is impossible to
+		// find the start of the next entry after a bad one.
+		v.errs = append(v.errs, fmt.Errorf("appended entry %d: %v",
+			len(v.entries), err))
+		err = nil
+	}
+	return n, err
+}
+
+func (v *varEntries) readEntries(r io.Reader) (n int64, err error) {
 	var read int64
 
 	// Remove any previous entries.
@@ -431,7 +614,12 @@ func (v *varEntries) ReadFrom(r io.Reader) (n int64, err error) {
 	wts := v.entries
 
 	// Keep reading entries until an EOF is reached.
+	var sawMAC bool
 	for {
+		if !sawMAC {
+			v.length = n
+		}
+
 		var header entryHeader
 		if read, err = binaryRead(r, binary.LittleEndian, &header); err != nil {
 			// EOF here is not an error.
@@ -442,6 +630,11 @@ func (v *varEntries) ReadFrom(r io.Reader) (n int64, err error) {
 		}
 		n += read
 
+		// The file MAC must be the last entry.
+		if sawMAC {
+			return n, errors.New("appended entry follows file MAC")
+		}
+
 		var wt io.WriterTo
 		switch header {
 		case addrHeader:
@@ -460,7 +653,52 @@ func (v *varEntries) ReadFrom(r io.Reader) (n int64, err error) {
 			}
 			n += read
 			wt = &entry
+		case addrCommentHeader:
+			var entry addrCommentEntry
+			if read, err = entry.ReadFrom(r); err != nil {
+				return n + read, err
+			}
+			n += read
+			wt = &entry
+		case txCommentHeader, txCommentHeader | encryptedCommentFlag:
+			entry := txCommentEntry{
+				encrypted: header&encryptedCommentFlag != 0,
+			}
+			if read, err = entry.ReadFrom(r); err != nil {
+				return n + read, err
+			}
+			n += read
+			wt = &entry
+		case labelHeader:
+			var entry labelEntry
+			if read, err = entry.ReadFrom(r); err != nil {
+				return n + read, err
+			}
+			n += read
+			wt = &entry
+		case chunkedCommentHeader:
+			var entry chunkedCommentEntry
+			if read, err = entry.ReadFrom(r); err != nil {
+				return n + read, err
+			}
+			n += read
+			wt = &entry
+		case macHeader:
+			var entry macEntry
+			if v.bodyHash != nil {
+				entry.bodyHash = v.bodyHash.Sum(nil)
+			}
+			if read, err = entry.ReadFrom(r); err != nil {
+				return n + read, err
+			}
+			n += read
+			wt = &entry
+			sawMAC = true
 		default:
+			// The entry may be of a type added by a newer version.
+			if v.store.vers.GT(VersCurrent) {
+				return n, ErrNewerVersion
+			}
 			return n, fmt.Errorf("unknown entry header: %d", uint8(header))
 		}
 		if wt != nil {
@@ -488,17 +726,26 @@ func (net *netParams) ReadFrom(r io.Reader) (int64, error) {
 		return n64, err
 	}
 
-	switch btcwire.BitcoinNet(binary.LittleEndian.Uint32(uint32Bytes)) {
+	params, err := paramsForNet(btcwire.BitcoinNet(binary.LittleEndian.Uint32(uint32Bytes)))
+	if err != nil {
+		return n64, ErrNetworkMismatch
+	}
+	*net = *params
+	return n64, nil
+}
+
+// paramsForNet returns the parameters of a network supported by key stores.
+func paramsForNet(net btcwire.BitcoinNet) (*netParams, error) {
+	switch net {
 	case btcwire.MainNet:
-		*net = (netParams)(btcnet.MainNetParams)
+		return (*netParams)(&btcnet.MainNetParams), nil
 	case btcwire.TestNet3:
-		*net = (netParams)(btcnet.TestNet3Params)
+		return (*netParams)(&btcnet.TestNet3Params), nil
 	case btcwire.SimNet:
-		*net = (netParams)(btcnet.SimNetParams)
+		return (*netParams)(&btcnet.SimNetParams), nil
 	default:
-		return n64, errors.New("unknown network")
+		return nil, errors.New("unknown network")
 	}
-	return n64, nil
 }
 
 func (net *netParams) WriteTo(w io.Writer) (int64, error) {
@@ -517,10 +764,62 @@ type transactionHashKey string
 
 type comment []byte
 
+// String returns the comment as a string for display.  Comments saved before
+// comments were required to be valid UTF-8 may hold invalid bytes, which are
+// replaced with the Unicode replacement character.
+func (c comment) String() string {
+	if utf8.Valid(c) {
+		return string(c)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(c)))
+	for _, r := range string(c) {
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
 func getAddressKey(addr btcutil.Address) addressKey {
 	return addressKey(addr.ScriptAddress())
 }
 
+// ReadFrom implements the io.ReaderFrom interface by reading a comment
+// from r in the format <2 bytes little endian length><comment bytes>.
+func (c *comment) ReadFrom(r io.Reader) (n int64, err error) {
+	var clen uint16
+	read, err := binaryRead(r, binary.LittleEndian, &clen)
+	n += read
+	if err != nil {
+		return n, err
+	}
+
+	b := make([]byte, clen)
+	nRead, err := io.ReadFull(r, b)
+	n += int64(nRead)
+	if err != nil {
+		return n, err
+	}
+
+	*c = b
+	return n, nil
+}
+
+// WriteTo implements the io.WriterTo interface by writing a comment to w
+// in the format <2 bytes little endian length><comment bytes>.
+func (c *comment) WriteTo(w io.Writer) (n int64, err error) {
+	if len(*c) > maxCommentLen {
+		return 0, ErrMalformedEntry
+	}
+
+	written, err := binaryWrite(w, binary.LittleEndian, uint16(len(*c)))
+	n += written
+	if err != nil {
+		return n, err
+	}
+
+	nWritten, err := w.Write(*c)
+	return n + int64(nWritten), err
+}
+
 // Store represents an key store in memory.  It implements the
 // io.ReaderFrom and io.WriterTo interfaces to read from and
 // write to any type of byte streams, including files.
@@ -533,21 +832,35 @@ type Store struct {
 	file  string
 
 	mtx          sync.RWMutex
-	vers         version
+	vers         FileVersion
 	net          *netParams
 	flags        walletFlags
 	createDate   int64
-	name         [32]byte
-	desc         [256]byte
+	name         [32]byte  // NUL-padded, not necessarily NUL-terminated
+	desc         [256]byte // NUL-padded, not necessarily NUL-terminated
 	highestUsed  int64
 	kdfParams    kdfParameters
 	keyGenerator btcAddress
 
+	// reserved holds the bytes of the reserved block between the KDF
+	// parameters and the root address.  This version does not use them,
+	// but they are written back unchanged so data stored there by a newer
+	// version is not lost.
+	reserved [256]byte
+
 	// These are non-standard and fit in the extra 1024 bytes between the
 	// root address and the appended entries.
-	recent recentBlocks
+	recent   recentBlocks
+	lastSync syncTime
+	appTag   appTag
 
-	addrMap map[addressKey]walletAddress
+	addrMap        map[addressKey]walletAddress
+	addrCommentMap map[addressKey]comment
+	txCommentMap   map[transactionHashKey]comment
+	label          comment
+
+	// Transaction comments in txCommentMap which are encrypted.
+	encryptedTxComments map[transactionHashKey]bool
 
 	// The rest of the fields in this struct are not serialized.
 	passphrase       []byte
@@ -556,26 +869,105 @@ type Store struct {
 	importedAddrs    []walletAddress
 	lastChainIdx     int64
 	missingKeysStart int64
+	keypoolPolicy    *KeypoolPolicy // nil for DefaultKeypoolPolicy
+	destroyed        bool
+
+	// Handlers registered with OnNewAddress and OnSyncChange.
+	newAddrHandlers    []func(WalletAddress)
+	syncChangeHandlers []func(*BlockStamp)
+
+	// fileBodyHash and fileMAC hold the hash of the key store file and
+	// the MAC read from its trailer, which are verified on the first
+	// unlock.  macKey is the key used to create the MAC.  It is derived
+	// from, but can not be used to recover, the AES key, and is not
+	// removed on lock so that locked key stores may still be written.
+	fileBodyHash []byte
+	fileMAC      []byte
+	macKey       []byte
 }
 
 // New creates and initializes a new Store.  name's and desc's byte length
-// must not exceed 32 and 256 bytes, respectively.  All address private keys
-// are encrypted with passphrase.  The key store is returned locked.
+// must not exceed 32 and 256 bytes, respectively, and neither may contain NUL
+// bytes, as they are stored NUL-padded.  All address private keys are
+// encrypted with passphrase.  The key store is returned locked.
 func New(dir string, desc string, passphrase []byte, net *btcnet.Params,
 	createdAt *BlockStamp) (*Store, error) {
 
-	// Check sizes of inputs.
-	if len(desc) > 256 {
-		return nil, errors.New("desc exceeds 256 byte maximum size")
-	}
-
 	// Randomly-generate rootkey and chaincode.
 	rootkey := make([]byte, 32)
-	if _, err := rand.Read(rootkey); err != nil {
+	if _, err := io.ReadFull(Rand, rootkey); err != nil {
 		return nil, err
 	}
 	chaincode := make([]byte, 32)
-	if _, err := rand.Read(chaincode); err != nil {
+	if _, err := io.ReadFull(Rand, chaincode); err != nil {
+		return nil, err
+	}
+
+	s, err := newFromRoot(dir, desc, rootkey, chaincode, passphrase, net,
+		createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// key store must be returned locked.
+	if err := s.Lock(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewFromRoot creates a key store as New does, but with the root private
+// key and chaincode provided rather than randomly generated.  This recreates
+// the address chain of a key store whose root key and chaincode were
+// recovered from another backup, such as a paper backup.  The root key pair
+// is verified, the root key is encrypted with passphrase using new key
+// derivation parameters, and the address chain is extended to hold
+// keypoolSize chained addresses.  The key store is returned locked.
+func NewFromRoot(dir string, desc string, rootKey, chaincode []byte,
+	passphrase []byte, net *btcnet.Params, createdAt *BlockStamp,
+	keypoolSize uint) (*Store, error) {
+
+	if len(rootKey) != 32 {
+		return nil, errors.New("root private key is not 32 bytes")
+	}
+	d := new(big.Int).SetBytes(rootKey)
+	if d.Sign() == 0 || d.Cmp(btcec.S256().N) >= 0 {
+		return nil, errors.New("invalid root private key")
+	}
+
+	s, err := newFromRoot(dir, desc, rootKey, chaincode, passphrase, net,
+		createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.extendTo(int64(keypoolSize)-1, createdAt); err != nil {
+		return nil, err
+	}
+
+	// key store must be returned locked.
+	if err := s.Lock(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newFromRoot creates an unlocked key store with the root private key
+// rootkey and chaincode.
+func newFromRoot(dir string, desc string, rootkey, chaincode []byte,
+	passphrase []byte, net *btcnet.Params, createdAt *BlockStamp) (*Store, error) {
+
+	// Check sizes of inputs.
+	if len(desc) > 256 {
+		return nil, errors.New("desc exceeds 256 byte maximum size")
+	}
+	if strings.IndexByte(desc, 0) != -1 {
+		return nil, errors.New("desc contains a NUL byte")
+	}
+
+	// Only create key stores which can be read back.
+	if _, err := paramsForNet(net.Net); err != nil {
 		return nil, err
 	}
 
@@ -607,10 +999,17 @@ func New(dir string, desc string, passphrase []byte, net *btcnet.Params,
 			},
 		},
 		addrMap:          make(map[addressKey]walletAddress),
+		addrCommentMap:   make(map[addressKey]comment),
+		txCommentMap:     make(map[transactionHashKey]comment),
 		chainIdxMap:      make(map[int64]btcutil.Address),
 		lastChainIdx:     rootKeyChainIdx,
 		missingKeysStart: rootKeyChainIdx,
 		secret:           aeskey,
+
+		encryptedTxComments: make(map[transactionHashKey]bool),
+
+		// A new key store has not been written.
+		dirty: true,
 	}
 	copy(s.desc[:], []byte(desc))
 
@@ -637,11 +1036,6 @@ func New(dir string, desc string, passphrase []byte, net *btcnet.Params,
 	s.addrMap[getAddressKey(rootAddr)] = &s.keyGenerator
 	s.chainIdxMap[rootKeyChainIdx] = rootAddr
 
-	// key store must be returned locked.
-	if err := s.Lock(); err != nil {
-		return nil, err
-	}
-
 	return s, nil
 }
 
@@ -651,316 +1045,4063 @@ func (s *Store) ReadFrom(r io.Reader) (n int64, err error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	var read int64
+	if s.destroyed {
+		return 0, ErrDestroyed
+	}
 
-	s.net = &netParams{}
-	s.addrMap = make(map[addressKey]walletAddress)
-	s.chainIdxMap = make(map[int64]btcutil.Address)
+	n, _, err = s.readFrom(r, false)
+	return n, err
+}
 
-	var id [8]byte
-	appendedEntries := varEntries{store: s}
-	s.keyGenerator.store = s
+// ReadFromLenient reads a key store from r as ReadFrom does, but accepts
+// key stores holding more than 20 recently seen block hashes, such as those
+// written by a later version which saves more blocks.  Only the most recent
+// 20 block hashes are kept.
+func ReadFromLenient(r io.Reader) (*Store, error) {
+	s := new(Store)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-	// Iterate through each entry needing to be read.  If data
-	// implements io.ReaderFrom, use its ReadFrom func.  Otherwise,
-	// data is a pointer to a fixed sized value.
-	datas := []interface{}{
-		&id,
-		&s.vers,
-		s.net,
-		&s.flags,
-		make([]byte, 6), // Bytes for Armory unique ID
-		&s.createDate,
-		&s.name,
-		&s.desc,
-		&s.highestUsed,
-		&s.kdfParams,
-		make([]byte, 256),
-		&s.keyGenerator,
-		newUnusedSpace(1024, &s.recent),
-		&appendedEntries,
+	s.recent.lenient = true
+	defer func() { s.recent.lenient = false }()
+
+	if _, _, err := s.readFrom(r, false); err != nil {
+		return nil, err
 	}
-	for _, data := range datas {
-		var err error
-		switch d := data.(type) {
-		case readerFromVersion:
-			read, err = d.readFromVersion(s.vers, r)
+	return s, nil
+}
 
-		case io.ReaderFrom:
-			read, err = d.ReadFrom(r)
+// ReadFromRequireMAC reads a key store from r as ReadFrom does, but returns
+// ErrNoFileMAC if the key store was not written with a file MAC (see
+// EnableFileMAC).  Whether a file has a MAC is recorded by an unauthenticated
+// header flag, so a caller which has enabled the file MAC should read the key
+// store with this function to detect the MAC being stripped.
+func ReadFromRequireMAC(r io.Reader) (*Store, error) {
+	s := new(Store)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-		default:
-			read, err = binaryRead(r, binary.LittleEndian, d)
-		}
-		n += read
-		if err != nil {
-			return n, err
-		}
+	if _, _, err := s.readFrom(r, false); err != nil {
+		return nil, err
+	}
+	if !s.flags.fileMAC {
+		return nil, ErrNoFileMAC
 	}
+	return s, nil
+}
 
-	if id != fileID {
-		return n, errors.New("unknown file ID")
+// ReadFromExpectNet reads a key store for the network expected from r.  The
+// network is checked as soon as it is read, and ErrNetworkMismatch is
+// returned without reading the remainder of the key store if the key store
+// is for any other network.
+func ReadFromExpectNet(r io.Reader, expected btcwire.BitcoinNet) (*Store, error) {
+	// The network follows the 8 byte file ID and 4 byte version.
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if btcwire.BitcoinNet(binary.LittleEndian.Uint32(header[12:])) != expected {
+		return nil, ErrNetworkMismatch
 	}
 
-	// Add root address to address map.
-	rootAddr := s.keyGenerator.Address()
-	s.addrMap[getAddressKey(rootAddr)] = &s.keyGenerator
-	s.chainIdxMap[rootKeyChainIdx] = rootAddr
-	s.lastChainIdx = rootKeyChainIdx
+	s := new(Store)
+	if _, err := s.ReadFrom(io.MultiReader(bytes.NewReader(header[:]), r)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	// Fill unserializied fields.
-	wts := appendedEntries.entries
-	for _, wt := range wts {
-		switch e := wt.(type) {
-		case *addrEntry:
-			addr := e.addr.Address()
-			s.addrMap[getAddressKey(addr)] = &e.addr
-			if e.addr.Imported() {
-				s.importedAddrs = append(s.importedAddrs, &e.addr)
-			} else {
-				s.chainIdxMap[e.addr.chainIndex] = addr
-				if s.lastChainIdx < e.addr.chainIndex {
-					s.lastChainIdx = e.addr.chainIndex
-				}
-			}
+// ReadFromContext reads a key store from r, aborting the read and returning
+// ctx.Err() if ctx is cancelled or its deadline passes before the entire key
+// store is read.  This allows loading a key store from a reader which may
+// stall, such as a network stream.  If the read is aborted, no key store is
+// returned, but a Read call blocked on r may continue in the background.
+func ReadFromContext(ctx context.Context, r io.Reader) (*Store, int64, error) {
+	s := new(Store)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-			// If the private keys have not been created yet, mark the
-			// earliest so all can be created on next key store unlock.
-			if e.addr.flags.createPrivKeyNextUnlock {
-				switch {
-				case s.missingKeysStart == rootKeyChainIdx:
-					fallthrough
-				case e.addr.chainIndex < s.missingKeysStart:
-					s.missingKeysStart = e.addr.chainIndex
-				}
-			}
+	n, _, err := s.readFrom(&contextReader{ctx: ctx, r: r}, false)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, n, ctxErr
+		}
+		return nil, n, err
+	}
+	return s, n, nil
+}
 
-		case *scriptEntry:
+// contextReader is an io.Reader which returns the context's error once the
+// context is done, even if a read from the wrapped reader is blocked.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Contexts which can never be done do not need to be waited on.
+	if cr.ctx.Done() == nil {
+		return cr.r.Read(p)
+	}
+
+	// Read into a separate buffer so p is not written to after an
+	// aborted read returns.
+	c := make(chan readResult, 1)
+	go func() {
+		b := make([]byte, len(p))
+		n, err := cr.r.Read(b)
+		c <- readResult{b[:n], err}
+	}()
+	select {
+	case <-cr.ctx.Done():
+		return 0, cr.ctx.Err()
+	case res := <-c:
+		return copy(p, res.b), res.err
+	}
+}
+
+// ReadFromRecover reads a key store from r, recovering from errors in the
+// appended address and comment entries.  The header, root address, and KDF
+// parameters are read strictly, and any error reading them is returned.
+// Errors in the appended entries are instead returned as a slice, along with
+// a key store holding every entry that could be read.  As entries are not
+// length prefixed, no entries after a malformed entry can be recovered.
+// If chained addresses are missing, the address chain is truncated before
+// the first missing index so the recovered key store remains usable.
+//
+// If any entries are skipped, a file MAC can not be verified and is ignored,
+// and the MAC is disabled: the recovered key store is written without a MAC
+// until EnableFileMAC is called again.
+func ReadFromRecover(r io.Reader) (*Store, []error, error) {
+	s := new(Store)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, errs, err := s.readFrom(r, true)
+	if err != nil {
+		return nil, errs, err
+	}
+	if len(errs) != 0 {
+		log.Warnf("Skipped %d unreadable key store entries", len(errs))
+		if s.flags.fileMAC {
+			log.Warnf("Disabling file MAC of recovered key store")
+		}
+		s.flags.fileMAC = false
+	}
+	return s, errs, nil
+}
+
+// WriteEncrypted serializes the key store to w, wrapped in an AES-GCM
+// envelope keyed by a transport passphrase, for sending a backup over an
+// insecure channel.  The envelope key is derived from transportPass with
+// scrypt, using a random salt written as a header.  The serialized key
+// store remains encrypted by its own passphrase.
+func (s *Store) WriteEncrypted(w io.Writer, transportPass []byte) error {
+	var plaintext bytes.Buffer
+	if _, err := s.WriteTo(&plaintext); err != nil {
+		return err
+	}
+
+	salt := make([]byte, envelopeSaltSize)
+	if _, err := io.ReadFull(Rand, salt); err != nil {
+		return err
+	}
+	key, err := envelopeKey(transportPass, salt)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(Rand, nonce); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		return err
+	}
+	_, err = w.Write(aead.Seal(nil, nonce, plaintext.Bytes(), nil))
+	return err
+}
+
+// ReadEncrypted reads a key store written by WriteEncrypted from r,
+// decrypting the envelope with transportPass.  ErrWrongPassphrase is
+// returned if the envelope can not be opened with transportPass.
+func ReadEncrypted(r io.Reader, transportPass []byte) (*Store, error) {
+	salt := make([]byte, envelopeSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+	key, err := envelopeKey(transportPass, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, err
+	}
+	ciphertext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	s := new(Store)
+	if _, err := s.ReadFrom(bytes.NewReader(plaintext)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// envelopeKey derives the AES key of an encrypted envelope from the
+// transport passphrase and the envelope salt.
+func envelopeKey(transportPass, salt []byte) ([]byte, error) {
+	return scrypt.Key(transportPass, salt, envelopeScryptN,
+		envelopeScryptR, envelopeScryptP, kdfOutputBytes)
+}
+
+// WriteRootBackup writes a compact backup of the key store holding only
+// what is needed to recreate every chained address: the network, flags,
+// creation date, key derivation parameters, and the encrypted root key and
+// chaincode.  Imported keys and scripts, comments, the label, and sync state
+// are not included.  A key store is recreated from the backup with
+// ReadRootBackup.
+func (s *Store) WriteRootBackup(w io.Writer) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	datas := []interface{}{
+		&fileID,
+		&VersCurrent,
+		s.net,
+		&s.flags,
+		&s.createDate,
+		&s.kdfParams,
+		&s.keyGenerator,
+	}
+	for _, data := range datas {
+		var err error
+		if wt, ok := data.(io.WriterTo); ok {
+			_, err = wt.WriteTo(w)
+		} else {
+			_, err = binaryWrite(w, binary.LittleEndian, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRootBackup recreates a key store from a backup written by
+// WriteRootBackup.  The root key is decrypted with passphrase, and the
+// address chain is extended to hold keypoolSize chained addresses.  The
+// recreated key store is marked unsynced from the block the root address
+// was created at, so a rescan will find the transactions of every chained
+// address.  The returned key store is locked.
+//
+// ErrNewerVersion is returned for backups written by a newer version.  As
+// with ReadFrom, the key store of an older backup keeps the backup's version
+// and is upgraded to VersCurrent when it is written.
+func ReadRootBackup(r io.Reader, passphrase []byte, keypoolSize int64) (*Store, error) {
+	s := &Store{
+		net:              &netParams{},
+		highestUsed:      rootKeyChainIdx,
+		addrMap:          make(map[addressKey]walletAddress),
+		addrCommentMap:   make(map[addressKey]comment),
+		txCommentMap:     make(map[transactionHashKey]comment),
+		chainIdxMap:      make(map[int64]btcutil.Address),
+		lastChainIdx:     rootKeyChainIdx,
+		missingKeysStart: rootKeyChainIdx,
+
+		encryptedTxComments: make(map[transactionHashKey]bool),
+	}
+	s.keyGenerator.store = s
+
+	var id [8]byte
+	if _, err := binaryRead(r, binary.LittleEndian, &id); err != nil {
+		return nil, err
+	}
+	if id != fileID {
+		return nil, errors.New("unknown file ID")
+	}
+
+	// The remaining fields of backups from newer versions may not be
+	// readable.  Older backups hold the same fields.
+	if _, err := s.vers.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if s.vers.GT(VersCurrent) {
+		return nil, ErrNewerVersion
+	}
+
+	datas := []interface{}{
+		s.net,
+		&s.flags,
+		&s.createDate,
+		&s.kdfParams,
+		&s.keyGenerator,
+	}
+	for _, data := range datas {
+		var err error
+		if rf, ok := data.(io.ReaderFrom); ok {
+			_, err = rf.ReadFrom(r)
+		} else {
+			_, err = binaryRead(r, binary.LittleEndian, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
+	}
+
+	rootAddr := s.keyGenerator.Address()
+	s.addrMap[getAddressKey(rootAddr)] = &s.keyGenerator
+	s.chainIdxMap[rootKeyChainIdx] = rootAddr
+
+	// Nothing after the root address has been seen.
+	firstBlock := s.keyGenerator.firstBlock
+	s.recent.lastHeight = firstBlock
+	s.keyGenerator.setSyncStatus(Unsynced(firstBlock))
+
+	// There is no file MAC to verify yet.  The MAC key is derived during
+	// unlock so a MAC is written with the recreated key store.
+	fileMAC := s.flags.fileMAC
+	s.flags.fileMAC = false
+	if err := s.unlock(passphrase); err != nil {
+		return nil, err
+	}
+	if fileMAC {
+		s.flags.fileMAC = true
+		s.macKey = fileMACKey(s.secret)
+	}
+
+	bs := &BlockStamp{Height: firstBlock}
+	if err := s.extendTo(keypoolSize-1, bs); err != nil {
+		return nil, err
+	}
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadFromAt reads a key store serialized at offset off of r, such as a
+// memory-mapped file or a key store stored after other data in an archive.
+// The key store must extend to the end of r, as appended entries are read
+// until EOF.  The header preceding the appended entries is not a fixed size,
+// as it depends on the format of the root public key and the encryption
+// mode, so it is read sequentially from off along with the entries.
+func ReadFromAt(r io.ReaderAt, off int64) (*Store, error) {
+	if off < 0 {
+		return nil, errors.New("negative offset")
+	}
+	s := new(Store)
+	if _, err := s.ReadFrom(io.NewSectionReader(r, off, math.MaxInt64-off)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// InspectKDF reads only the beginning of a serialized key store from r,
+// through the key derivation parameters, and returns the memory and
+// iteration counts used to derive the encryption key from the passphrase.
+// This allows weak parameters to be detected before a passphrase is
+// requested, without reading the entire key store.
+func InspectKDF(r io.Reader) (mem uint64, nIter uint32, err error) {
+	var (
+		id          [8]byte
+		vers        FileVersion
+		net         netParams
+		flags       walletFlags
+		createDate  int64
+		name        [32]byte
+		desc        [256]byte
+		highestUsed int64
+		kdfParams   kdfParameters
+	)
+	datas := []interface{}{
+		&id,
+		&vers,
+		&net,
+		&flags,
+		make([]byte, 6), // Bytes for Armory unique ID
+		&createDate,
+		&name,
+		&desc,
+		&highestUsed,
+		&kdfParams,
+	}
+	for _, data := range datas {
+		var err error
+		switch d := data.(type) {
+		case io.ReaderFrom:
+			_, err = d.ReadFrom(r)
+
+		default:
+			_, err = binaryRead(r, binary.LittleEndian, d)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if id != fileID {
+		return 0, 0, errors.New("unknown file ID")
+	}
+	return kdfParams.mem, kdfParams.nIter, nil
+}
+
+// WalletHeader holds the metadata saved at the beginning of a serialized key
+// store.
+type WalletHeader struct {
+	Version      FileVersion
+	Net          *btcnet.Params
+	WatchingOnly bool
+	CreateDate   int64 // Unix time
+	Name         string
+	Description  string
+}
+
+// ReadHeader reads only the fixed size metadata at the beginning of a
+// serialized key store from r, stopping before the key derivation parameters
+// and root address.  This is much cheaper than reading the entire key store,
+// and is intended for listing many key store files.  Name and description
+// padding is removed as with Description.
+func ReadHeader(r io.Reader) (*WalletHeader, error) {
+	var (
+		id         [8]byte
+		vers       FileVersion
+		net        netParams
+		flags      walletFlags
+		createDate int64
+		name       [32]byte
+		desc       [256]byte
+	)
+	datas := []interface{}{
+		&id,
+		&vers,
+		&net,
+		&flags,
+		make([]byte, 6), // Bytes for Armory unique ID
+		&createDate,
+		&name,
+		&desc,
+	}
+	for _, data := range datas {
+		var err error
+		switch d := data.(type) {
+		case io.ReaderFrom:
+			_, err = d.ReadFrom(r)
+
+		default:
+			_, err = binaryRead(r, binary.LittleEndian, d)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if id != fileID {
+		return nil, errors.New("unknown file ID")
+	}
+
+	trim := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i != -1 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	return &WalletHeader{
+		Version:      vers,
+		Net:          (*btcnet.Params)(&net),
+		WatchingOnly: flags.watchingOnly,
+		CreateDate:   createDate,
+		Name:         trim(name[:]),
+		Description:  trim(desc[:]),
+	}, nil
+}
+
+// EstimateUnlockTime estimates how long deriving the key store's encryption
+// key from a passphrase, as done by Unlock, will take on this machine.  A
+// single iteration of the key derivation function is timed using the key
+// store's memory parameter and multiplied by the number of iterations.  No
+// passphrase is required and no key is derived.
+func (s *Store) EstimateUnlockTime() time.Duration {
+	s.mtx.RLock()
+	params := s.kdfParams
+	s.mtx.RUnlock()
+
+	testKey := []byte("This is an example key to test KDF iteration speed")
+
+	before := time.Now()
+	_ = keyOneIter(testKey, params.salt[:], params.mem)
+	return time.Since(before) * time.Duration(params.nIter)
+}
+
+// readFrom reads a key store from r.  If recovering, errors in the appended
+// entries are returned in errs rather than causing the read to fail.  The
+// key store mutex must be held by the caller.
+func (s *Store) readFrom(r io.Reader, recovering bool) (n int64, errs []error, err error) {
+	var read int64
+
+	s.net = &netParams{}
+	s.addrMap = make(map[addressKey]walletAddress)
+	s.addrCommentMap = make(map[addressKey]comment)
+	s.txCommentMap = make(map[transactionHashKey]comment)
+	s.encryptedTxComments = make(map[transactionHashKey]bool)
+	s.chainIdxMap = make(map[int64]btcutil.Address)
+
+	// Hash everything read so a file MAC, if any, can be verified.
+	bodyHash := sha256.New()
+	r = io.TeeReader(r, bodyHash)
+
+	var id [8]byte
+	var entriesLen entriesLength
+	appendedEntries := varEntries{
+		store:      s,
+		bodyHash:   bodyHash,
+		recovering: recovering,
+	}
+	s.keyGenerator.store = s
+
+	// Iterate through each entry needing to be read.  If data
+	// implements io.ReaderFrom, use its ReadFrom func.  Otherwise,
+	// data is a pointer to a fixed sized value.
+	datas := []interface{}{
+		&id,
+		&s.vers,
+		s.net,
+		&s.flags,
+		make([]byte, 6), // Bytes for Armory unique ID
+		&s.createDate,
+		&s.name,
+		&s.desc,
+		&s.highestUsed,
+		&s.kdfParams,
+		&s.reserved,
+		&s.keyGenerator,
+		newUnusedSpace(1024, &s.recent, &s.lastSync, &entriesLen,
+			&s.appTag),
+		&appendedEntries,
+	}
+	for _, data := range datas {
+		var err error
+		switch d := data.(type) {
+		case readerFromVersion:
+			read, err = d.readFromVersion(s.vers, r)
+
+		case io.ReaderFrom:
+			read, err = d.ReadFrom(r)
+
+		default:
+			read, err = binaryRead(r, binary.LittleEndian, d)
+		}
+		n += read
+		if err != nil {
+			return n, nil, err
+		}
+	}
+	errs = appendedEntries.errs
+
+	if id != fileID {
+		return n, errs, errors.New("unknown file ID")
+	}
+
+	// The root address must be at the root chain index, or the address
+	// chain can not be extended from it.
+	if s.keyGenerator.chainIndex != rootKeyChainIdx {
+		if !recovering {
+			return n, errs, ErrMalformedEntry
+		}
+		errs = append(errs, fmt.Errorf("root address has chain index %d",
+			s.keyGenerator.chainIndex))
+		s.keyGenerator.chainIndex = rootKeyChainIdx
+	}
+
+	// Add root address to address map.
+	rootAddr := s.keyGenerator.Address()
+	s.addrMap[getAddressKey(rootAddr)] = &s.keyGenerator
+	s.chainIdxMap[rootKeyChainIdx] = rootAddr
+	s.lastChainIdx = rootKeyChainIdx
+
+	// Fill unserializied fields.
+	wts := appendedEntries.entries
+	for _, wt := range wts {
+		switch e := wt.(type) {
+		case *addrEntry:
+			addr := e.addr.Address()
+
+			// The root address may not be replaced.
+			if getAddressKey(addr) == getAddressKey(rootAddr) {
+				if !recovering {
+					return n, errs, ErrMalformedEntry
+				}
+				errs = append(errs, fmt.Errorf("address %v "+
+					"replaces root address", addr))
+				continue
+			}
+
+			// Chained addresses must follow the root address, and
+			// each chain index may only be used once.
+			if !e.addr.Imported() {
+				if e.addr.chainIndex < rootKeyChainIdx {
+					if !recovering {
+						return n, errs, ErrCorruptChain
+					}
+					errs = append(errs, fmt.Errorf("address %v: "+
+						"invalid chain index %d", addr,
+						e.addr.chainIndex))
+					continue
+				}
+				if _, ok := s.chainIdxMap[e.addr.chainIndex]; ok {
+					if !recovering {
+						return n, errs, ErrCorruptChain
+					}
+					errs = append(errs, fmt.Errorf("address %v: "+
+						"duplicate chain index %d", addr,
+						e.addr.chainIndex))
+					continue
+				}
+			}
+
+			s.addrMap[getAddressKey(addr)] = &e.addr
+			if e.addr.Imported() {
+				s.importedAddrs = append(s.importedAddrs, &e.addr)
+			} else {
+				s.chainIdxMap[e.addr.chainIndex] = addr
+				if s.lastChainIdx < e.addr.chainIndex {
+					s.lastChainIdx = e.addr.chainIndex
+				}
+			}
+
+			// If the private keys have not been created yet, mark the
+			// earliest so all can be created on next key store unlock.
+			if e.addr.flags.createPrivKeyNextUnlock {
+				switch {
+				case s.missingKeysStart == rootKeyChainIdx:
+					fallthrough
+				case e.addr.chainIndex < s.missingKeysStart:
+					s.missingKeysStart = e.addr.chainIndex
+				}
+			}
+
+		case *scriptEntry:
 			addr := e.script.Address()
+			if getAddressKey(addr) == getAddressKey(rootAddr) {
+				if !recovering {
+					return n, errs, ErrMalformedEntry
+				}
+				errs = append(errs, fmt.Errorf("script %v "+
+					"replaces root address", addr))
+				continue
+			}
 			s.addrMap[getAddressKey(addr)] = &e.script
 			// script are always imported.
 			s.importedAddrs = append(s.importedAddrs, &e.script)
 
-		default:
-			return n, errors.New("unknown appended entry")
+		case *addrCommentEntry:
+			s.addrCommentMap[addressKey(e.pubKeyHash160[:])] = e.comment
+
+		case *txCommentEntry:
+			key := transactionHashKey(e.txHash[:])
+			s.txCommentMap[key] = e.comment
+			if e.encrypted {
+				s.encryptedTxComments[key] = true
+			}
+
+		case *chunkedCommentEntry:
+			switch e.kind {
+			case addrCommentHeader:
+				s.addrCommentMap[addressKey(e.key)] = e.comment
+			case txCommentHeader:
+				s.txCommentMap[transactionHashKey(e.key)] = e.comment
+			}
+
+		case *labelEntry:
+			s.label = e.label
+
+		case *macEntry:
+			s.fileBodyHash = e.bodyHash
+			s.fileMAC = e.mac[:]
+
+		default:
+			return n, errs, errors.New("unknown appended entry")
+		}
+	}
+
+	// Every chain index between the root and the last chained address
+	// must be present, or the chain can not be extended.
+	// When recovering, the chain is truncated before the first missing
+	// index.  Dropped addresses are derived again as the chain is
+	// extended.
+	for idx := int64(rootKeyChainIdx); idx <= s.lastChainIdx; idx++ {
+		if _, ok := s.chainIdxMap[idx]; !ok {
+			if !recovering {
+				return n, errs, ErrCorruptChain
+			}
+			errs = append(errs, fmt.Errorf("missing chain index %d, "+
+				"truncating chain at index %d", idx, idx-1))
+			s.truncateChain(idx - 1)
+			break
+		}
+	}
+
+	// The highest used address must be the root or a chained address, or
+	// the next chained address and active addresses can not be found.
+	if s.highestUsed < rootKeyChainIdx || s.highestUsed > s.lastChainIdx {
+		if !recovering {
+			return n, errs, ErrCorruptIndex
+		}
+		errs = append(errs, fmt.Errorf("highest used chain index %d "+
+			"out of range [%d, %d]", s.highestUsed, rootKeyChainIdx,
+			s.lastChainIdx))
+		if s.highestUsed < rootKeyChainIdx {
+			s.highestUsed = rootKeyChainIdx
+		} else {
+			s.highestUsed = s.lastChainIdx
+		}
+	}
+
+	// Check that no entries were removed or added since the key store was
+	// written.
+	if !s.vers.LT(VersEntriesLength) && int64(entriesLen) != appendedEntries.length {
+		if !recovering {
+			return n, errs, ErrLengthMismatch
+		}
+		errs = append(errs, fmt.Errorf("appended entries are %d bytes, "+
+			"expected %d", appendedEntries.length, entriesLen))
+	}
+
+	return n, errs, nil
+}
+
+// truncateChain removes all chained addresses after chain index last,
+// lowering the highest used index if it was removed.
+func (s *Store) truncateChain(last int64) {
+	for idx, addr := range s.chainIdxMap {
+		if idx <= last {
+			continue
+		}
+		key := getAddressKey(addr)
+		if a, ok := s.addrMap[key].(*btcAddress); ok && a.chainIndex == idx {
+			delete(s.addrMap, key)
+		}
+		delete(s.chainIdxMap, idx)
+	}
+	s.lastChainIdx = last
+	if s.highestUsed > last {
+		s.highestUsed = last
+	}
+	if s.missingKeysStart > last {
+		s.missingKeysStart = rootKeyChainIdx
+	}
+}
+
+// WriteTo serializes a key store and writes it to a io.Writer,
+// returning the number of bytes written and any errors encountered.  As w
+// need not be the key store file, writing does not clear the dirty flag;
+// only WriteIfDirty does.
+//
+// A key store read from a file with a MAC (see EnableFileMAC) can not create
+// a new MAC until the MAC key is derived on the first unlock, and ErrLocked is
+// returned until then.  Chained addresses can not be handed out before then,
+// so no used address is lost if the key store is never unlocked.
+func (s *Store) WriteTo(w io.Writer) (n int64, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return 0, ErrDestroyed
+	}
+
+	return s.writeTo(w)
+}
+
+func (s *Store) writeTo(w io.Writer) (n int64, err error) {
+	var wts []io.WriterTo
+	var chainedAddrs = make([]io.WriterTo, len(s.chainIdxMap)-1)
+	var importedAddrs []io.WriterTo
+
+	// Addresses are visited sorted by key so imported addresses and
+	// scripts are written in the same order every time.
+	keys := make([]string, 0, len(s.addrMap))
+	for key := range s.addrMap {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch btcAddr := s.addrMap[addressKey(key)].(type) {
+		case *btcAddress:
+			e := &addrEntry{
+				addr: *btcAddr,
+			}
+			copy(e.pubKeyHash160[:], btcAddr.AddrHash())
+			if btcAddr.Imported() {
+				importedAddrs = append(importedAddrs, e)
+			} else if btcAddr.chainIndex >= 0 {
+				// Chained addresses are sorted.  This is
+				// kind of nice but probably isn't necessary.
+				chainedAddrs[btcAddr.chainIndex] = e
+			}
+
+		case *scriptAddress:
+			e := &scriptEntry{
+				script: *btcAddr,
+			}
+			copy(e.scriptHash160[:], btcAddr.AddrHash())
+			// scripts are always imported
+			importedAddrs = append(importedAddrs, e)
+		}
+	}
+	wts = append(chainedAddrs, importedAddrs...)
+
+	// Comments are written sorted by key so the serialized key store does
+	// not depend on map iteration order.
+	addrKeys := make([]string, 0, len(s.addrCommentMap))
+	for key := range s.addrCommentMap {
+		addrKeys = append(addrKeys, string(key))
+	}
+	sort.Strings(addrKeys)
+	for _, k := range addrKeys {
+		key := addressKey(k)
+		c := s.addrCommentMap[key]
+		wts = append(wts, newCommentEntry(addrCommentHeader, []byte(key), c))
+	}
+	txKeys := make([]string, 0, len(s.txCommentMap))
+	for key := range s.txCommentMap {
+		txKeys = append(txKeys, string(key))
+	}
+	sort.Strings(txKeys)
+	for _, k := range txKeys {
+		key := transactionHashKey(k)
+		c := s.txCommentMap[key]
+		if s.encryptedTxComments[key] {
+			e := &txCommentEntry{comment: c, encrypted: true}
+			copy(e.txHash[:], key)
+			wts = append(wts, e)
+			continue
+		}
+		wts = append(wts, newCommentEntry(txCommentHeader, []byte(key), c))
+	}
+	if len(s.label) != 0 {
+		wts = append(wts, &labelEntry{label: s.label})
+	}
+	appendedEntries := varEntries{store: s, entries: wts}
+	entriesLen, err := appendedEntries.WriteTo(ioutil.Discard)
+	if err != nil {
+		return 0, err
+	}
+
+	// Iterate through each entry needing to be written.  If data
+	// implements io.WriterTo, use its WriteTo func.  Otherwise,
+	// data is a pointer to a fixed size value.
+	datas := []interface{}{
+		&fileID,
+		&VersCurrent,
+		s.net,
+		&s.flags,
+		make([]byte, 6), // Bytes for Armory unique ID
+		&s.createDate,
+		&s.name,
+		&s.desc,
+		&s.highestUsed,
+		&s.kdfParams,
+		&s.reserved,
+		&s.keyGenerator,
+		newUnusedSpace(1024, &s.recent, &s.lastSync,
+			(*entriesLength)(&entriesLen), &s.appTag),
+		&appendedEntries,
+	}
+
+	// The MAC covers every byte written before it, including the MAC
+	// entry header.
+	var bodyHash hash.Hash
+	if s.flags.fileMAC {
+		if s.macKey == nil {
+			return 0, ErrLocked
+		}
+		bodyHash = sha256.New()
+		w = io.MultiWriter(w, bodyHash)
+		datas = append(datas, macHeader)
+	}
+
+	var written int64
+	for _, data := range datas {
+		if s, ok := data.(io.WriterTo); ok {
+			written, err = s.WriteTo(w)
+		} else {
+			written, err = binaryWrite(w, binary.LittleEndian, data)
+		}
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if bodyHash != nil {
+		e := macEntry{bodyHash: bodyHash.Sum(nil)}
+		copy(e.mac[:], e.computeMAC(s.macKey))
+		written, err = e.WriteTo(w)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// SerializedSize returns the number of bytes written when serializing the
+// key store with WriteTo.
+func (s *Store) SerializedSize() (int64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return 0, ErrDestroyed
+	}
+
+	return s.writeTo(ioutil.Discard)
+}
+
+// WriteToWithProgress serializes the key store to w exactly as WriteTo does,
+// calling progress with the number of bytes written so far and the total
+// serialized size after every progressInterval bytes, and once after all
+// bytes are written.  As with WriteTo, the dirty flag is not cleared.
+// progress is called with the key store locked, and must not call any key
+// store methods.
+func (s *Store) WriteToWithProgress(w io.Writer, progress func(written, total int64)) (int64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return 0, ErrDestroyed
+	}
+
+	total, err := s.writeTo(ioutil.Discard)
+	if err != nil {
+		return 0, err
+	}
+	pw := &progressWriter{w: w, total: total, progress: progress}
+	n, err := s.writeTo(pw)
+	if err != nil {
+		return n, err
+	}
+	if pw.reported != pw.written {
+		progress(pw.written, total)
+	}
+	return n, nil
+}
+
+// progressInterval is the number of bytes written between each progress
+// report by WriteToWithProgress.
+const progressInterval = 4096
+
+// progressWriter wraps a writer, reporting the number of bytes written
+// every progressInterval bytes.
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	reported int64
+	total    int64
+	progress func(written, total int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if pw.written-pw.reported >= progressInterval {
+		pw.reported = pw.written
+		pw.progress(pw.written, pw.total)
+	}
+	return n, err
+}
+
+// MarkDirty marks the key store as changed since it was last written, so it
+// is written by the next WriteIfDirty.  Methods which modify the serialized
+// key store mark it dirty automatically, so this is only required to force
+// the next write, such as to upgrade the file version.
+func (s *Store) MarkDirty() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return
+	}
+	s.dirty = true
+}
+
+// IsDirty returns whether the key store has changed since it was last
+// written to its file with WriteIfDirty.  A key store read from a file is not
+// dirty until it is modified.
+func (s *Store) IsDirty() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.dirty
+}
+
+func (s *Store) WriteIfDirty() error {
+	// The write lock is held for the entire write, so no change can be
+	// made between writing the key store and clearing the dirty flag.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+	if !s.dirty {
+		return nil
+	}
+
+	// TempFile creates the file 0600, so no need to chmod it.
+	fi, err := ioutil.TempFile(s.dir, s.file)
+	if err != nil {
+		return err
+	}
+	fiPath := fi.Name()
+
+	_, err = s.writeTo(fi)
+	if err != nil {
+		fi.Close()
+		return err
+	}
+	err = fi.Sync()
+	if err != nil {
+		fi.Close()
+		return err
+	}
+	fi.Close()
+
+	err = rename.Atomic(fiPath, s.path)
+	if err == nil {
+		s.dirty = false
+	}
+	return err
+}
+
+// OpenDir opens a new key store from the specified directory.  If the file
+// does not exist, the error from the os package will be returned, and can
+// be checked with os.IsNotExist to differentiate missing file errors from
+// others (including deserialization).
+func OpenDir(dir string) (*Store, error) {
+	path := filepath.Join(dir, filename)
+	fi, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	store := new(Store)
+	_, err = store.ReadFrom(fi)
+	if err != nil {
+		return nil, err
+	}
+	store.path = path
+	store.dir = dir
+	store.file = filename
+	return store, nil
+}
+
+// Unlock derives an AES key from passphrase and key store's KDF
+// parameters and unlocks the root key of the key store.  If
+// the unlock was successful, the key store's secret key is saved,
+// allowing the decryption of any encrypted private key.  Any
+// addresses created while the key store was locked without private
+// keys are created at this time.
+func (s *Store) Unlock(passphrase []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	return s.unlock(passphrase)
+}
+
+// UnlockAndVerify unlocks the key store as Unlock does, and then decrypts
+// the private key of every address, checking each against its public key.
+// This verifies the integrity of every private key at once, rather than
+// when each key is first used.  If any private key fails to decrypt, the
+// key store is locked again and the returned error identifies the first
+// address which failed.
+func (s *Store) UnlockAndVerify(passphrase []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if err := s.unlock(passphrase); err != nil {
+		return err
+	}
+
+	wAddrs := s.allAddresses()
+
+	for _, wa := range wAddrs {
+		// Only btcAddresses curently have private keys.
+		a, ok := wa.(*btcAddress)
+		if !ok || !a.flags.hasPrivKey {
+			continue
+		}
+		privKeyCT, err := a.unlock(s.secret)
+		if err != nil {
+			_ = s.lock()
+			return fmt.Errorf("address %v: %v", a.address, err)
+		}
+		zero(privKeyCT)
+	}
+
+	return nil
+}
+
+// VerifyPassphrase checks whether passphrase is the passphrase of the key
+// store, returning true if it is.  Unlike Unlock, the key derived from the
+// passphrase is zeroed immediately and the locked state of the key store is
+// not changed.  A non-nil error is returned only if the passphrase could not
+// be checked.
+func (s *Store) VerifyPassphrase(passphrase []byte) (bool, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return false, ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return false, ErrWatchingOnly
+	}
+
+	key := kdf(passphrase, &s.kdfParams)
+	defer zero(key)
+
+	privkey, err := s.openRootPrivKey(key)
+	switch err {
+	case nil:
+		zero(privkey)
+		return true, nil
+	case ErrWrongPassphrase:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// fileMACMatches returns whether the MAC read from the key store file
+// matches the MAC computed with the MAC key derived from the AES key key.
+// The key store is not modified, so the key store mutex need only be held
+// for reads by the caller.
+func (s *Store) fileMACMatches(key []byte) bool {
+	if s.fileMAC == nil {
+		return false
+	}
+	macKey := fileMACKey(key)
+	defer zero(macKey)
+	e := macEntry{bodyHash: s.fileBodyHash}
+	return hmac.Equal(s.fileMAC, e.computeMAC(macKey))
+}
+
+// verifyFileMAC checks the MAC read from the key store file, if it has not
+// already been checked, using the MAC key derived from the AES key key.
+// ErrTampered is returned if the MAC does not match.  The key store mutex
+// must be held for writes by the caller.
+func (s *Store) verifyFileMAC(key []byte) error {
+	if !s.flags.fileMAC || s.macKey != nil {
+		return nil
+	}
+	if !s.fileMACMatches(key) {
+		log.Warnf("Key store file MAC does not match")
+		return ErrTampered
+	}
+	s.macKey = fileMACKey(key)
+	return nil
+}
+
+// unlock unlocks the key store with passphrase.  The key store mutex must
+// be held by the caller.
+func (s *Store) unlock(passphrase []byte) error {
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	// Derive key from KDF parameters and passphrase.
+	key := kdf(passphrase, &s.kdfParams)
+
+	// Unlock root address with derived key.  With AES-GCM, a wrong
+	// passphrase is detected as an authentication failure.
+	if _, err := s.keyGenerator.unlock(key); err != nil {
+		if err == ErrKeyAuthFailed {
+			return ErrWrongPassphrase
+		}
+		return err
+	}
+
+	// Verify the MAC of the key store file on the first unlock.
+	if err := s.verifyFileMAC(key); err != nil {
+		_ = s.keyGenerator.lock()
+		zero(key)
+		return err
+	}
+
+	// If unlock was successful, save the passphrase and aes key.
+	s.passphrase = passphrase
+	s.secret = key
+	log.Debugf("Key store unlocked")
+
+	return s.createMissingPrivateKeys()
+}
+
+// Lock performs a best try effort to remove and zero all secret keys
+// associated with the key store.
+func (s *Store) Lock() (err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	return s.lock()
+}
+
+// lock removes and zeros all secret keys.  The key store mutex must be held
+// by the caller.
+func (s *Store) lock() (err error) {
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	// Remove clear text passphrase from key store.
+	if s.isLocked() {
+		err = ErrLocked
+	} else {
+		zero(s.passphrase)
+		s.passphrase = nil
+		zero(s.secret)
+		s.secret = nil
+		log.Debugf("Key store locked")
+	}
+
+	// Remove clear text private keys from all address entries.
+	for _, addr := range s.addrMap {
+		if baddr, ok := addr.(*btcAddress); ok {
+			_ = baddr.lock()
+		}
+	}
+
+	return err
+}
+
+// Destroy locks the key store and removes all keys, addresses, and comments
+// from memory, including the KDF salt and MAC key.  After a key store is
+// destroyed, methods which return an error return ErrDestroyed, accessors
+// without an error return empty results, and it can not be used again.  The
+// key store file is not modified, and unsaved changes are discarded.
+func (s *Store) Destroy() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return
+	}
+	if !s.flags.watchingOnly {
+		_ = s.lock()
+	}
+
+	zero(s.kdfParams.salt[:])
+	zero(s.macKey)
+	s.macKey = nil
+	zero(s.keyGenerator.privKey[:])
+	zero(s.keyGenerator.chaincode[:])
+
+	s.addrMap = nil
+	s.addrCommentMap = nil
+	s.txCommentMap = nil
+	s.encryptedTxComments = nil
+	s.chainIdxMap = nil
+	s.importedAddrs = nil
+	s.label = nil
+	s.recent.hashes = nil
+	s.recent.lastHeight = -1
+	s.highestUsed = rootKeyChainIdx
+	s.lastChainIdx = rootKeyChainIdx
+	s.dirty = false
+	s.destroyed = true
+}
+
+// ChangePassphrase creates a new AES key from a new passphrase and
+// re-encrypts all encrypted private keys with the new key.
+func (s *Store) ChangePassphrase(new []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	oldkey := s.secret
+	newkey := kdf(new, &s.kdfParams)
+
+	for _, wa := range s.addrMap {
+		// Only btcAddresses curently have private keys.
+		a, ok := wa.(*btcAddress)
+		if !ok {
+			continue
+		}
+
+		if err := a.changeEncryptionKey(oldkey, newkey); err != nil {
+			return err
+		}
+	}
+
+	// zero old secrets.
+	zero(s.passphrase)
+	zero(s.secret)
+
+	// Save new secrets.
+	s.passphrase = new
+	s.secret = newkey
+	if s.flags.fileMAC {
+		zero(s.macKey)
+		s.macKey = fileMACKey(newkey)
+	}
+	s.dirty = true
+
+	return nil
+}
+
+// RotateSalt replaces the salt of the key derivation parameters with a
+// newly-generated salt and re-encrypts all private keys with the key derived
+// from passphrase and the new salt.  The memory and iteration parameters and
+// the passphrase are unchanged.  This is for when the salt may have been
+// exposed, such as in a leaked backup.  ErrWrongPassphrase is returned if
+// passphrase is not the key store's passphrase, and ErrTampered if the MAC
+// of the file the key store was read from does not match.  On errors, no
+// private keys are modified.  The locked state of the key store is not
+// changed.
+func (s *Store) RotateSalt(passphrase []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	oldkey := kdf(passphrase, &s.kdfParams)
+	defer zero(oldkey)
+	privkey, err := s.openRootPrivKey(oldkey)
+	if err != nil {
+		return err
+	}
+	zero(privkey)
+
+	// The file must be checked before it is written with a MAC using
+	// the new key, or a tampered file would be authenticated.
+	if err := s.verifyFileMAC(oldkey); err != nil {
+		return err
+	}
+
+	params := s.kdfParams
+	if _, err := io.ReadFull(Rand, params.salt[:]); err != nil {
+		return err
+	}
+	newkey := kdf(passphrase, &params)
+
+	// Re-encrypt copies of the addresses, so that on errors no address
+	// is left encrypted with the new key.
+	rotated := make(map[*btcAddress]btcAddress)
+	for _, wa := range s.addrMap {
+		// Only btcAddresses currently have private keys.  Private keys
+		// not yet created are encrypted with the new key on unlock.
+		a, ok := wa.(*btcAddress)
+		if !ok || !a.flags.hasPrivKey {
+			continue
+		}
+
+		aCpy := *a
+		aCpy.privKeyCT = nil
+		err := aCpy.changeEncryptionKey(oldkey, newkey)
+		rotated[a] = aCpy
+		if err != nil {
+			for _, aCpy := range rotated {
+				zero(aCpy.privKeyCT)
+			}
+			zero(newkey)
+			return err
+		}
+	}
+
+	locked := s.isLocked()
+	for a, aCpy := range rotated {
+		zero(a.privKeyCT)
+		*a = aCpy
+		if locked {
+			_ = a.lock()
+		}
+	}
+
+	zero(s.kdfParams.salt[:])
+	s.kdfParams = params
+	if s.flags.fileMAC {
+		zero(s.macKey)
+		s.macKey = fileMACKey(newkey)
+	}
+	if locked {
+		zero(newkey)
+	} else {
+		zero(s.secret)
+		s.secret = newkey
+	}
+	s.dirty = true
+	log.Infof("Rotated key derivation salt")
+
+	return nil
+}
+
+// ReencryptedCopy returns a copy of the key store with all private keys
+// re-encrypted with a key derived from newPassphrase using newly-generated
+// KDF parameters.  oldPassphrase must be the key store's current passphrase.
+// The original key store is not modified, and the copy is returned locked.
+// This is the non-destructive counterpart to ChangePassphrase.  ErrTampered
+// is returned if the key store was read from a file with a MAC which does
+// not match.
+func (s *Store) ReencryptedCopy(oldPassphrase, newPassphrase []byte) (*Store, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
+	}
+
+	c := s.duplicate()
+
+	// Unlock the root address of the copy to check the old passphrase.
+	oldkey := kdf(oldPassphrase, &c.kdfParams)
+	defer zero(oldkey)
+	if _, err := c.keyGenerator.unlock(oldkey); err != nil {
+		if err == ErrKeyAuthFailed {
+			return nil, ErrWrongPassphrase
+		}
+		return nil, err
+	}
+
+	// The copy is given a MAC key for the new passphrase, so the MAC of
+	// a file not yet checked by an unlock must be checked first, or a
+	// tampered file would be authenticated.
+	if s.flags.fileMAC && s.macKey == nil && !s.fileMACMatches(oldkey) {
+		log.Warnf("Key store file MAC does not match")
+		return nil, ErrTampered
+	}
+
+	kdfp, err := computeKdfParameters(defaultKdfComputeTime, defaultKdfMaxMem)
+	if err != nil {
+		return nil, err
+	}
+	newkey := kdf(newPassphrase, kdfp)
+	defer zero(newkey)
+
+	for _, wa := range c.addrMap {
+		// Only btcAddresses curently have private keys.
+		a, ok := wa.(*btcAddress)
+		if !ok {
+			continue
+		}
+
+		// Addresses without private keys will have them created,
+		// using the new key, on the next unlock.
+		if !a.flags.hasPrivKey {
+			continue
+		}
+
+		if err := a.changeEncryptionKey(oldkey, newkey); err != nil {
+			return nil, err
+		}
+		_ = a.lock()
+	}
+	c.kdfParams = *kdfp
+	if c.flags.fileMAC {
+		c.macKey = fileMACKey(newkey)
+	}
+
+	return c, nil
+}
+
+// duplicate returns a deep copy of the key store.  The copy does not share
+// any addresses or maps with the original, is not associated with any file,
+// and is locked.  As the copy has never been written, it is dirty.
+func (s *Store) duplicate() *Store {
+	c := &Store{
+		vers:         s.vers,
+		net:          s.net,
+		flags:        s.flags,
+		createDate:   s.createDate,
+		name:         s.name,
+		desc:         s.desc,
+		highestUsed:  s.highestUsed,
+		kdfParams:    s.kdfParams,
+		keyGenerator: s.keyGenerator,
+		reserved:     s.reserved,
+		recent: recentBlocks{
+			lastHeight: s.recent.lastHeight,
+		},
+		lastSync:         s.lastSync,
+		appTag:           s.appTag,
+		addrMap:          make(map[addressKey]walletAddress),
+		addrCommentMap:   make(map[addressKey]comment),
+		txCommentMap:     make(map[transactionHashKey]comment),
+		chainIdxMap:      make(map[int64]btcutil.Address),
+		lastChainIdx:     s.lastChainIdx,
+		missingKeysStart: s.missingKeysStart,
+		dirty:            true,
+
+		encryptedTxComments: make(map[transactionHashKey]bool),
+	}
+	if s.macKey != nil {
+		c.macKey = append([]byte(nil), s.macKey...)
+	}
+	c.keyGenerator.store = c
+	c.keyGenerator.privKeyCT = nil
+
+	if len(s.recent.hashes) != 0 {
+		c.recent.hashes = make([]*btcwire.ShaHash, 0, len(s.recent.hashes))
+		for _, hash := range s.recent.hashes {
+			hashCpy := *hash
+			c.recent.hashes = append(c.recent.hashes, &hashCpy)
+		}
+	}
+
+	for key, wa := range s.addrMap {
+		switch a := wa.(type) {
+		case *btcAddress:
+			if a == &s.keyGenerator {
+				c.addrMap[key] = &c.keyGenerator
+				continue
+			}
+			aCpy := *a
+			aCpy.store = c
+			aCpy.privKeyCT = nil
+			c.addrMap[key] = &aCpy
+
+		case *scriptAddress:
+			aCpy := *a
+			aCpy.store = c
+			aCpy.script = append(p2SHScript(nil), a.script...)
+			c.addrMap[key] = &aCpy
+		}
+	}
+	for idx, addr := range s.chainIdxMap {
+		c.chainIdxMap[idx] = addr
+	}
+	for _, a := range s.importedAddrs {
+		c.importedAddrs = append(c.importedAddrs,
+			c.addrMap[getAddressKey(a.Address())])
+	}
+	for key, cmt := range s.addrCommentMap {
+		c.addrCommentMap[key] = append(comment(nil), cmt...)
+	}
+	for key, cmt := range s.txCommentMap {
+		c.txCommentMap[key] = append(comment(nil), cmt...)
+	}
+	for key, encrypted := range s.encryptedTxComments {
+		c.encryptedTxComments[key] = encrypted
+	}
+	c.label = append(comment(nil), s.label...)
+
+	return c
+}
+
+// ChangeNetwork returns a copy of the key store for the network net, holding
+// the same keys and address chain.  As the encoding of an address depends on
+// its network, every address of the copy encodes to a different string than
+// the same address of the original.  The copy is locked and is not associated
+// with any file.
+func (s *Store) ChangeNetwork(net btcwire.BitcoinNet) (*Store, error) {
+	params, err := paramsForNet(net)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	c := s.duplicate()
+	c.net = params
+
+	// Address map keys are hashes, which do not depend on the network, so
+	// only the addresses themselves must be recreated.
+	for _, wa := range c.addrMap {
+		switch a := wa.(type) {
+		case *btcAddress:
+			addr, err := btcutil.NewAddressPubKeyHash(
+				a.address.ScriptAddress(), c.netParams())
+			if err != nil {
+				return nil, err
+			}
+			a.address = addr
+
+		case *scriptAddress:
+			addr, err := btcutil.NewAddressScriptHashFromHash(
+				a.address.ScriptAddress(), c.netParams())
+			if err != nil {
+				return nil, err
+			}
+			a.address = addr
+		}
+	}
+	for idx, addr := range c.chainIdxMap {
+		c.chainIdxMap[idx] = c.addrMap[getAddressKey(addr)].Address()
+	}
+
+	return c, nil
+}
+
+// Equal returns whether two key stores hold the same serialized contents.
+// Transient state, such as the passphrase, AES key, and decrypted private
+// keys, is ignored.
+func (s *Store) Equal(other *Store) bool {
+	return len(s.Diff(other)) == 0
+}
+
+// Diff returns a description of each difference between the serialized
+// contents of two key stores, or nil if they are equal.  This is intended
+// for debugging failed round trips and backup verification.  Differences
+// between addresses and comments are sorted.
+func (s *Store) Diff(other *Store) []string {
+	if s == other {
+		return nil
+	}
+
+	// Each key store is copied while holding only its own lock, so a.Diff(b)
+	// and b.Diff(a) can not deadlock.
+	s.mtx.RLock()
+	a := s.duplicate()
+	s.mtx.RUnlock()
+	other.mtx.RLock()
+	b := other.duplicate()
+	other.mtx.RUnlock()
+
+	return a.diff(b)
+}
+
+// diff returns the differences between two key stores which are not shared
+// with any other goroutine, and so need not be locked.
+func (s *Store) diff(other *Store) []string {
+	var diffs []string
+	if s.vers != other.vers {
+		diffs = append(diffs, fmt.Sprintf("version %v != %v", s.vers, other.vers))
+	}
+	if !serializedEqual(s.net, other.net) {
+		diffs = append(diffs, fmt.Sprintf("network %v != %v",
+			s.netParams().Name, other.netParams().Name))
+	}
+	if s.flags != other.flags {
+		diffs = append(diffs, "flags differ")
+	}
+	if s.createDate != other.createDate {
+		diffs = append(diffs, fmt.Sprintf("creation date %d != %d",
+			s.createDate, other.createDate))
+	}
+	if s.name != other.name {
+		diffs = append(diffs, "name differs")
+	}
+	if s.desc != other.desc {
+		diffs = append(diffs, "description differs")
+	}
+	if !bytes.Equal(s.label, other.label) {
+		diffs = append(diffs, "label differs")
+	}
+	if s.highestUsed != other.highestUsed {
+		diffs = append(diffs, fmt.Sprintf("highest used chain index %d != %d",
+			s.highestUsed, other.highestUsed))
+	}
+	if s.kdfParams != other.kdfParams {
+		diffs = append(diffs, "KDF parameters differ")
+	}
+	if s.lastSync != other.lastSync {
+		diffs = append(diffs, fmt.Sprintf("last sync time %d != %d",
+			s.lastSync, other.lastSync))
+	}
+	if s.appTag != other.appTag {
+		diffs = append(diffs, "application tag differs")
+	}
+	if s.reserved != other.reserved {
+		diffs = append(diffs, "reserved block differs")
+	}
+	if !serializedEqual(&s.keyGenerator, &other.keyGenerator) {
+		diffs = append(diffs, "root address differs")
+	}
+	if !serializedEqual(&s.recent, &other.recent) {
+		diffs = append(diffs, "recent blocks differ")
+	}
+
+	// Map differences are sorted so the result does not depend on map
+	// iteration order.
+	var mapDiffs []string
+	for key, wa := range s.addrMap {
+		otherWA, ok := other.addrMap[key]
+		switch {
+		case !ok:
+			mapDiffs = append(mapDiffs, fmt.Sprintf("address %v missing from other",
+				wa.Address()))
+		case !serializedEqual(wa, otherWA):
+			mapDiffs = append(mapDiffs, fmt.Sprintf("address %v differs",
+				wa.Address()))
+		}
+	}
+	for key, wa := range other.addrMap {
+		if _, ok := s.addrMap[key]; !ok {
+			mapDiffs = append(mapDiffs, fmt.Sprintf("address %v missing",
+				wa.Address()))
+		}
+	}
+	sort.Strings(mapDiffs)
+	diffs = append(diffs, mapDiffs...)
+
+	mapDiffs = mapDiffs[:0]
+	for key, c := range s.addrCommentMap {
+		if otherC, ok := other.addrCommentMap[key]; !ok || !bytes.Equal(c, otherC) {
+			mapDiffs = append(mapDiffs, fmt.Sprintf("address comment for %x differs",
+				[]byte(key)))
+		}
+	}
+	for key := range other.addrCommentMap {
+		if _, ok := s.addrCommentMap[key]; !ok {
+			mapDiffs = append(mapDiffs, fmt.Sprintf("address comment for %x differs",
+				[]byte(key)))
+		}
+	}
+	sort.Strings(mapDiffs)
+	diffs = append(diffs, mapDiffs...)
+
+	mapDiffs = mapDiffs[:0]
+	for key, c := range s.txCommentMap {
+		otherC, ok := other.txCommentMap[key]
+		if !ok || !bytes.Equal(c, otherC) ||
+			s.encryptedTxComments[key] != other.encryptedTxComments[key] {
+			mapDiffs = append(mapDiffs, fmt.Sprintf("tx comment for %x differs",
+				[]byte(key)))
+		}
+	}
+	for key := range other.txCommentMap {
+		if _, ok := s.txCommentMap[key]; !ok {
+			mapDiffs = append(mapDiffs, fmt.Sprintf("tx comment for %x differs",
+				[]byte(key)))
+		}
+	}
+	sort.Strings(mapDiffs)
+	return append(diffs, mapDiffs...)
+}
+
+// serializedEqual returns whether two values serialize to the same bytes.
+func serializedEqual(a, b io.WriterTo) bool {
+	var bufA, bufB bytes.Buffer
+	if _, err := a.WriteTo(&bufA); err != nil {
+		return false
+	}
+	if _, err := b.WriteTo(&bufB); err != nil {
+		return false
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
+
+// EnablePerAddressKeys switches the key store to encrypt each private key
+// with a subkey derived from the key store's AES key and the address hash,
+// rather than with the AES key directly.  All existing private keys are
+// re-encrypted with their subkeys, and new private keys will be encrypted
+// the same way.  A key store may contain a mix of both kinds of addresses,
+// so reading a key store still succeeds if this is interrupted.  The key
+// store must be unlocked.
+func (s *Store) EnablePerAddressKeys() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	s.flags.perAddressKeys = true
+	s.dirty = true
+	for _, wa := range s.addrMap {
+		// Only btcAddresses curently have private keys.
+		a, ok := wa.(*btcAddress)
+		if !ok || !a.flags.hasPrivKey || a.flags.perAddressKey {
+			continue
+		}
+
+		if err := a.changeEncryptionKey(s.secret, s.secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnableGCM switches the key store to encrypt private keys with AES-GCM
+// rather than AES-CFB, so a modified encrypted private key fails to decrypt
+// with ErrKeyAuthFailed.  All existing private keys are re-encrypted, and new
+// private keys will be encrypted the same way.  The key store must be
+// unlocked.
+func (s *Store) EnableGCM() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	s.flags.gcm = true
+	s.dirty = true
+	for _, wa := range s.addrMap {
+		// Only btcAddresses curently have private keys.
+		a, ok := wa.(*btcAddress)
+		if !ok || !a.flags.hasPrivKey || a.flags.gcm {
+			continue
+		}
+
+		if err := a.changeEncryptionKey(s.secret, s.secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnableFileMAC enables writing a trailer holding a MAC over the entire
+// serialized key store, keyed by a key derived from the passphrase.  The MAC
+// is verified on the first unlock after reading the key store, and unlocking
+// fails with ErrTampered if the file was modified by anything that does not
+// know the passphrase.  The key store must be unlocked.
+//
+// Whether a file has a MAC is recorded by a header flag which the MAC can not
+// itself protect.  A file modified to clear the flag and remove the MAC is
+// read as a key store without a MAC, and unlocks without error.  Callers
+// must detect this downgrade by checking HasFileMAC after reading, or by
+// reading with ReadFromRequireMAC.
+//
+// Until the first unlock after reading a key store with a MAC, the key store
+// can not be written (see WriteTo).  A key store recovered by ReadFromRecover
+// with skipped entries has the MAC disabled and is written without one, so
+// EnableFileMAC must be called again to protect the recovered file.
+func (s *Store) EnableFileMAC() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	s.flags.fileMAC = true
+	s.dirty = true
+	if s.macKey == nil {
+		s.macKey = fileMACKey(s.secret)
+	}
+	return nil
+}
+
+// HasFileMAC returns whether the key store is written with a file MAC (see
+// EnableFileMAC).  For a key store read from a file, this is whether the file
+// was written with a MAC.
+func (s *Store) HasFileMAC() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.flags.fileMAC
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// IsLocked returns whether a key store is unlocked (in which case the
+// key is saved in memory), or locked.
+func (s *Store) IsLocked() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.isLocked()
+}
+
+func (s *Store) isLocked() bool {
+	return len(s.secret) != 32
+}
+
+// NextChainedAddress attempts to get the next chained address.  If the key
+// store is unlocked, the next pubkey and private key of the address chain are
+// derived.  If the key store is locke, only the next pubkey is derived, and
+// the private key will be generated on next unlock.
+//
+// A key store read from a file with a MAC (see EnableFileMAC) returns
+// ErrLocked until its first unlock, as it can not be written before then and
+// the address would not be saved as used.
+func (s *Store) NextChainedAddress(bs *BlockStamp) (btcutil.Address, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	return s.nextChainedAddress(bs)
+}
+
+func (s *Store) nextChainedAddress(bs *BlockStamp) (btcutil.Address, error) {
+	addr, err := s.nextChainedBtcAddress(bs)
+	if err != nil {
+		return nil, err
+	}
+	s.notifyNewAddress(addr)
+	return addr.Address(), nil
+}
+
+// ChangeAddress returns the next chained address from the key store, marking
+// the address for a change transaction output.  As with NextChainedAddress,
+// ErrLocked is returned before the first unlock of a key store read from a
+// file with a MAC.
+func (s *Store) ChangeAddress(bs *BlockStamp) (btcutil.Address, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	addr, err := s.nextChainedBtcAddress(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	addr.flags.change = true
+	s.notifyNewAddress(addr)
+
+	// Create and return payment address for address hash.
+	return addr.Address(), nil
+}
+
+// NextUnusedAddress returns the next chained address, as NextChainedAddress
+// does, but skips any chained addresses in used, which are addresses seen
+// used on the chain that must not be handed out again.  Skipped addresses
+// are marked used, so the highest used index is advanced to the returned
+// address and addresses are always returned in chain order.  used may be
+// nil.
+func (s *Store) NextUnusedAddress(bs *BlockStamp, used []btcutil.Address) (WalletAddress, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	usedKeys := make(map[addressKey]struct{}, len(used))
+	for _, a := range used {
+		usedKeys[getAddressKey(a)] = struct{}{}
+	}
+
+	for {
+		addr, err := s.nextChainedBtcAddress(bs)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := usedKeys[getAddressKey(addr.Address())]; ok {
+			log.Debugf("Skipping used chained address %v",
+				addr.Address())
+			continue
+		}
+		s.notifyNewAddress(addr)
+		return addr, nil
+	}
+}
+
+// HighestUsedIndex returns the chain index of the most recently used
+// chained address, or -1 if only the root address has been used.
+func (s *Store) HighestUsedIndex() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.highestUsed
+}
+
+// RemainingKeypool returns the number of chained addresses which have
+// already been derived but not yet used.  When no addresses remain, the
+// next chained address must be derived, and if the key store is locked,
+// its private key is not created until the next unlock.
+func (s *Store) RemainingKeypool() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.lastChainIdx - s.highestUsed
+}
+
+func (s *Store) nextChainedBtcAddress(bs *BlockStamp) (*btcAddress, error) {
+	// A key store read from a file with a MAC can not be written until
+	// the MAC is verified on the first unlock.  An address handed out
+	// before then could be lost from the file, and handed out again
+	// after a restart.
+	if s.flags.fileMAC && s.macKey == nil {
+		return nil, ErrLocked
+	}
+
+	// The next chain index must be representable as an int64.
+	if s.highestUsed == math.MaxInt64 {
+		return nil, errors.New("next chain index overflows int64")
+	}
+
+	// Extend the address chain as required by the keypool policy, either
+	// because the keypool is exhausted or to keep the target number of
+	// unused addresses available after this address is used.
+	// Addresses are only ever added to the end of the address chain, so
+	// the next address can not be created if the highest used index is
+	// beyond the end of the address chain.
+	if s.highestUsed > s.lastChainIdx {
+		return nil, fmt.Errorf("next chain index %d exceeds "+
+			"last chain index %d", s.highestUsed+1, s.lastChainIdx)
+	}
+
+	policy := s.keypool()
+	if next := s.highestUsed + 1; policy.TargetSize > math.MaxInt64-next ||
+		policy.BatchSize > math.MaxInt64-next {
+		return nil, errors.New("keypool extension overflows chain index")
+	}
+	_, ok := s.chainIdxMap[s.highestUsed+1]
+	if !ok && !policy.AutoExtend {
+		return nil, ErrKeypoolExhausted
+	}
+	if policy.AutoExtend {
+		last := s.highestUsed + 1 + policy.TargetSize
+		if !ok && s.highestUsed+policy.BatchSize > last {
+			last = s.highestUsed + policy.BatchSize
+		}
+		if err := s.extendTo(last, bs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Attempt to get address hash of next chained address.
+	nextAPKH, ok := s.chainIdxMap[s.highestUsed+1]
+	if !ok {
+		return nil, errors.New("chain index map inproperly updated")
+	}
+
+	// Look up address.
+	addr, ok := s.addrMap[getAddressKey(nextAPKH)]
+	if !ok {
+		return nil, errors.New("cannot find generated address")
+	}
+
+	btcAddr, ok := addr.(*btcAddress)
+	if !ok {
+		return nil, errors.New("found non-pubkey chained address")
+	}
+
+	s.highestUsed++
+	s.dirty = true
+
+	return btcAddr, nil
+}
+
+// extendTo extends the address chain until the last chained address has
+// the chain index last.  If the key store is locked, the private keys of the
+// new addresses are created on the next unlock.
+func (s *Store) extendTo(last int64, bs *BlockStamp) error {
+	for s.lastChainIdx < last {
+		var err error
+		if s.isLocked() {
+			// Chain pubkeys.
+			err = s.extendLocked(bs)
+		} else {
+			// Chain private and pubkeys.
+			err = s.extendUnlocked(bs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeypoolPolicy describes when and by how much the address chain is
+// extended beyond the highest used address.  Addresses created while the key
+// store is locked do not have private keys until the next unlock.
+type KeypoolPolicy struct {
+	// TargetSize is the number of unused chained addresses to keep
+	// available after each new address is used, and to create with
+	// TopUpKeypool.
+	TargetSize int64
+
+	// BatchSize is the number of addresses created when the keypool is
+	// exhausted.
+	BatchSize int64
+
+	// AutoExtend is whether NextChainedAddress and ChangeAddress may
+	// extend the address chain.  If false, ErrKeypoolExhausted is
+	// returned when no unused chained addresses remain.
+	AutoExtend bool
+}
+
+// DefaultKeypoolPolicy is the keypool policy of a key store until changed
+// with SetKeypoolPolicy.  A single address is created each time the keypool
+// is exhausted.
+var DefaultKeypoolPolicy = KeypoolPolicy{
+	TargetSize: 0,
+	BatchSize:  1,
+	AutoExtend: true,
+}
+
+// SetKeypoolPolicy sets the keypool policy of the key store.  The policy is
+// not saved with the key store.
+func (s *Store) SetKeypoolPolicy(p KeypoolPolicy) error {
+	if p.TargetSize < 0 || p.BatchSize < 1 {
+		return errors.New("invalid keypool policy sizes")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	s.keypoolPolicy = &p
+	return nil
+}
+
+// KeypoolPolicy returns the keypool policy of the key store.
+func (s *Store) KeypoolPolicy() KeypoolPolicy {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.keypool()
+}
+
+func (s *Store) keypool() KeypoolPolicy {
+	if s.keypoolPolicy == nil {
+		return DefaultKeypoolPolicy
+	}
+	return *s.keypoolPolicy
+}
+
+// TopUpKeypool extends the address chain until the keypool policy's target
+// number of unused chained addresses are available.  This allows private
+// keys to be created while the key store is unlocked, rather than on the next
+// unlock after the keypool is exhausted.
+func (s *Store) TopUpKeypool(bs *BlockStamp) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	target := s.keypool().TargetSize
+	if s.highestUsed > 0 && target > math.MaxInt64-s.highestUsed {
+		return errors.New("keypool extension overflows chain index")
+	}
+	return s.extendTo(s.highestUsed+target, bs)
+}
+
+// PurgeKeypool removes unused chained addresses more than keepAhead
+// addresses past the highest used address, shrinking the key store file.
+// Used addresses are never removed, and the remaining address chain is
+// contiguous, so it can be extended again later.  Removed addresses are
+// deterministically derived from the root key, and are recreated if the
+// chain is extended to them again.
+func (s *Store) PurgeKeypool(keepAhead uint) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if uint64(keepAhead) >= uint64(s.lastChainIdx-s.highestUsed) {
+		return nil
+	}
+	last := s.highestUsed + int64(keepAhead)
+
+	for idx := s.lastChainIdx; idx > last; idx-- {
+		a, ok := s.chainIdxMap[idx]
+		if !ok {
+			continue
+		}
+		key := getAddressKey(a)
+		delete(s.addrMap, key)
+		delete(s.addrCommentMap, key)
+		delete(s.chainIdxMap, idx)
+	}
+	log.Debugf("Purged address chain from index %d to %d", s.lastChainIdx,
+		last)
+	s.lastChainIdx = last
+	if s.missingKeysStart > last {
+		s.missingKeysStart = rootKeyChainIdx
+	}
+	s.dirty = true
+	return nil
+}
+
+// GapReport returns the largest number of unused chained addresses between
+// any two used chained addresses, or before the first used address, given
+// the chain indexes of addresses seen used on the chain.  Negative indexes,
+// used for the root address and imported addresses, are ignored.  ok is
+// whether the largest gap is within the keypool policy's target size.  If
+// not, a restore which only searched for addresses within the target size
+// past the last used address may have missed used addresses, and must be
+// repeated with a wider gap.
+func (s *Store) GapReport(usedIndices []int64) (maxGap int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	used := make([]int64, 0, len(usedIndices))
+	for _, idx := range usedIndices {
+		if idx >= 0 {
+			used = append(used, idx)
+		}
+	}
+	sort.Sort(int64Slice(used))
+
+	prev := int64(rootKeyChainIdx)
+	for _, idx := range used {
+		if gap := idx - prev - 1; gap > maxGap {
+			maxGap = gap
+		}
+		prev = idx
+	}
+	return maxGap, maxGap <= s.keypool().TargetSize
+}
+
+// int64Slice implements sort.Interface to sort a slice of int64s in
+// increasing order.
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// MaxDeriveAddresses is the maximum number of addresses DeriveAddressRange
+// may return, and the maximum number of addresses it may derive past the end
+// of the address chain.  It is also the maximum gap of GenerateGapAddresses.
+// Each derived address requires an elliptic curve point multiplication, so
+// this bounds the time and memory of a single call.
+const MaxDeriveAddresses = 10000
+
+// DeriveAddressRange returns the chained addresses with chain indexes start
+// through end, inclusive.  Addresses past the end of the address chain are
+// derived from the public key of the last chained address, so this works
+// while the key store is locked, but they are not added to the key store and
+// the key store is not modified.  Derived addresses have no private keys.
+// An error is returned if more than MaxDeriveAddresses addresses would be
+// returned or derived.
+func (s *Store) DeriveAddressRange(start, end int64) ([]WalletAddress, error) {
+	if start < 0 || end < start {
+		return nil, errors.New("invalid chain index range")
+	}
+	if end-start >= MaxDeriveAddresses {
+		return nil, fmt.Errorf("chain index range exceeds %d addresses",
+			MaxDeriveAddresses)
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	last, ok := s.addrMap[getAddressKey(s.chainIdxMap[s.lastChainIdx])]
+	if !ok {
+		return nil, errors.New("expected last chained address not found")
+	}
+	prev, ok := last.(*btcAddress)
+	if !ok {
+		return nil, errors.New("found non-pubkey chained address")
+	}
+	if end-s.lastChainIdx > MaxDeriveAddresses {
+		return nil, fmt.Errorf("chain index %d is more than %d addresses "+
+			"past the end of the address chain", end, MaxDeriveAddresses)
+	}
+	bs := &BlockStamp{Height: s.recent.lastHeight}
+
+	var addrs []WalletAddress
+	for idx := start; idx <= end; idx++ {
+		if idx <= s.lastChainIdx {
+			wa, ok := s.addrMap[getAddressKey(s.chainIdxMap[idx])]
+			if !ok {
+				return nil, ErrCorruptChain
+			}
+			addrs = append(addrs, wa)
+			continue
+		}
+
+		for prev.chainIndex < idx {
+			cc := prev.chaincode[:]
+			pubKey, err := chainedPubKey(prev.pubKeyBytes(), cc)
+			if err != nil {
+				return nil, err
+			}
+			next, err := newBtcAddressWithoutPrivkey(s, pubKey, nil, bs)
+			if err != nil {
+				return nil, err
+			}
+			next.chainIndex = prev.chainIndex + 1
+			copy(next.chaincode[:], cc)
+			prev = next
+		}
+		addrs = append(addrs, prev)
+	}
+	return addrs, nil
+}
+
+// LastChainedAddress returns the most recently requested chained
+// address from calling NextChainedAddress, or the root address if
+// no chained addresses have been requested.
+func (s *Store) LastChainedAddress() btcutil.Address {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.chainIdxMap[s.highestUsed]
+}
+
+// AddressAtIndex returns the chained address at the chain index idx.  The
+// root address has a chain index of -1.  This may be any address in the
+// address chain, including unused addresses in the key pool.
+// ErrAddressNotFound is returned if no chained address exists at idx.
+func (s *Store) AddressAtIndex(idx int64) (WalletAddress, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	if idx < rootKeyChainIdx || idx > s.lastChainIdx {
+		return nil, ErrAddressNotFound
+	}
+	a, ok := s.chainIdxMap[idx]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	return wa, nil
+}
+
+// extendUnlocked grows address chain for an unlocked keystore.
+func (s *Store) extendUnlocked(bs *BlockStamp) error {
+	// Get last chained address.  New chained addresses will be
+	// chained off of this address's chaincode and private key.
+	a := s.chainIdxMap[s.lastChainIdx]
+	waddr, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return errors.New("expected last chained address not found")
+	}
+
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	lastAddr, ok := waddr.(*btcAddress)
+	if !ok {
+		return errors.New("found non-pubkey chained address")
+	}
+
+	privkey, err := lastAddr.unlock(s.secret)
+	if err != nil {
+		return err
+	}
+	cc := lastAddr.chaincode[:]
+
+	privkey, err = chainedPrivKey(privkey, lastAddr.pubKeyBytes(), cc)
+	if err != nil {
+		return err
+	}
+	newAddr, err := newBtcAddress(s, privkey, nil, bs, true)
+	if err != nil {
+		return err
+	}
+	if err := newAddr.verifyKeypairs(); err != nil {
+		return err
+	}
+	if err = newAddr.encrypt(s.secret); err != nil {
+		return err
+	}
+	a = newAddr.Address()
+	s.addrMap[getAddressKey(a)] = newAddr
+	newAddr.chainIndex = lastAddr.chainIndex + 1
+	s.chainIdxMap[newAddr.chainIndex] = a
+	s.lastChainIdx++
+	s.dirty = true
+	copy(newAddr.chaincode[:], cc)
+	log.Debugf("Extended address chain to index %d", s.lastChainIdx)
+
+	return nil
+}
+
+// extendLocked creates one new address without a private key (allowing for
+// extending the address chain from a locked key store) chained from the
+// last used chained address and adds the address to the key store's internal
+// bookkeeping structures.
+func (s *Store) extendLocked(bs *BlockStamp) error {
+	a := s.chainIdxMap[s.lastChainIdx]
+	waddr, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return errors.New("expected last chained address not found")
+	}
+
+	addr, ok := waddr.(*btcAddress)
+	if !ok {
+		return errors.New("found non-pubkey chained address")
+	}
+
+	cc := addr.chaincode[:]
+
+	nextPubkey, err := chainedPubKey(addr.pubKeyBytes(), cc)
+	if err != nil {
+		return err
+	}
+	newaddr, err := newBtcAddressWithoutPrivkey(s, nextPubkey, nil, bs)
+	if err != nil {
+		return err
+	}
+	a = newaddr.Address()
+	s.addrMap[getAddressKey(a)] = newaddr
+	newaddr.chainIndex = addr.chainIndex + 1
+	s.chainIdxMap[newaddr.chainIndex] = a
+	s.lastChainIdx++
+	s.dirty = true
+	copy(newaddr.chaincode[:], cc)
+
+	if s.missingKeysStart == rootKeyChainIdx {
+		s.missingKeysStart = newaddr.chainIndex
+	}
+	log.Debugf("Extended address chain to index %d without private key",
+		s.lastChainIdx)
+
+	return nil
+}
+
+func (s *Store) createMissingPrivateKeys() error {
+	idx := s.missingKeysStart
+	if idx == rootKeyChainIdx {
+		return nil
+	}
+
+	// Lookup previous address.
+	apkh, ok := s.chainIdxMap[idx-1]
+	if !ok {
+		return errors.New("missing previous chained address")
+	}
+	prevWAddr := s.addrMap[getAddressKey(apkh)]
+	if s.isLocked() {
+		return ErrLocked
+	}
+
+	prevAddr, ok := prevWAddr.(*btcAddress)
+	if !ok {
+		return errors.New("found non-pubkey chained address")
+	}
+
+	prevPrivKey, err := prevAddr.unlock(s.secret)
+	if err != nil {
+		return err
+	}
+
+	for i := idx; ; i++ {
+		// Get the next private key for the ith address in the address chain.
+		ithPrivKey, err := chainedPrivKey(prevPrivKey,
+			prevAddr.pubKeyBytes(), prevAddr.chaincode[:])
+		if err != nil {
+			return err
+		}
+
+		// Get the address with the missing private key, set, and
+		// encrypt.
+		apkh, ok := s.chainIdxMap[i]
+		if !ok {
+			// Finished.
+			break
+		}
+		waddr := s.addrMap[getAddressKey(apkh)]
+		addr, ok := waddr.(*btcAddress)
+		if !ok {
+			return errors.New("found non-pubkey chained address")
+		}
+		addr.privKeyCT = ithPrivKey
+		if err := addr.encrypt(s.secret); err != nil {
+			// Avoid bug: see comment for VersUnsetNeedsPrivkeyFlag.
+			if err != ErrAlreadyEncrypted || s.vers.LT(VersUnsetNeedsPrivkeyFlag) {
+				return err
+			}
+		}
+		addr.flags.createPrivKeyNextUnlock = false
+
+		// Set previous address and private key for next iteration.
+		prevAddr = addr
+		prevPrivKey = ithPrivKey
+	}
+
+	s.missingKeysStart = rootKeyChainIdx
+	s.dirty = true
+	return nil
+}
+
+// Address returns an walletAddress structure for an address in a key store.
+// This address may be typecast into other interfaces (like PubKeyAddress
+// and ScriptAddress) if specific information e.g. keys is required.
+func (s *Store) Address(a btcutil.Address) (WalletAddress, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	// Look up address by address hash.
+	btcaddr, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+
+	return btcaddr, nil
+}
+
+// AddressFirstSeen returns the time an address was first seen by the key
+// store, which is the time it was created or imported.
+func (s *Store) AddressFirstSeen(a btcutil.Address) (time.Time, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return time.Time{}, ErrDestroyed
+	}
+
+	firstSeen, _, err := s.seenTimes(a)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(firstSeen, 0), nil
+}
+
+// AddressLastSeen returns the time an address was last seen by the key
+// store.  If the address has never been seen, the zero time is returned.
+// This may be checked with the IsZero method of time.Time.
+func (s *Store) AddressLastSeen(a btcutil.Address) (time.Time, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return time.Time{}, ErrDestroyed
+	}
+
+	_, lastSeen, err := s.seenTimes(a)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if lastSeen == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(lastSeen, 0), nil
+}
+
+// seenTimes returns the first and last seen Unix times of an address.
+func (s *Store) seenTimes(a btcutil.Address) (firstSeen, lastSeen int64, err error) {
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return 0, 0, ErrAddressNotFound
+	}
+
+	switch wa := wa.(type) {
+	case *btcAddress:
+		return wa.firstSeen, wa.lastSeen, nil
+	case *scriptAddress:
+		return wa.firstSeen, wa.lastSeen, nil
+	}
+	return 0, 0, nil
+}
+
+// ChainIndexOf returns the chain index of an address managed by the key
+// store, and whether the address was found.  The root address has a chain
+// index of -1, and imported keys and scripts, which are not part of the
+// address chain, have a chain index of -2.
+func (s *Store) ChainIndexOf(a btcutil.Address) (int64, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return 0, false
+	}
+	if btcaddr, ok := wa.(*btcAddress); ok {
+		return btcaddr.chainIndex, true
+	}
+	return importedKeyChainIdx, true
+}
+
+// CanChainAddress returns whether an address is part of the key store's
+// deterministic address chain.  Imported keys and scripts are not derived
+// from the chaincode and can never be moved into the chain, so for these
+// addresses, and addresses not in the key store, false is returned with a
+// reason suitable for display to the user.
+func (s *Store) CanChainAddress(a btcutil.Address) (bool, string) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return false, "address is not in the key store"
+	}
+	if _, ok := wa.(*scriptAddress); ok {
+		return false, "imported scripts are not derived from the " +
+			"key store's root key and can not be added to the " +
+			"address chain"
+	}
+	if wa.Imported() {
+		return false, "imported keys are not derived from the key " +
+			"store's root key and can not be added to the address " +
+			"chain; send the funds to a new address instead"
+	}
+	return true, ""
+}
+
+// PrivKeyBytes returns the raw 32 byte private key for an address in the key
+// store.  The key store must be unlocked.  The returned slice is a copy
+// which remains valid after the key store is locked, and should be zeroed
+// by the caller when no longer needed.
+func (s *Store) PrivKeyBytes(a btcutil.Address) ([]byte, error) {
+	// A write lock is required since decrypting the private key caches
+	// the clear text key in the address.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	btcaddr, ok := wa.(*btcAddress)
+	if !ok {
+		return nil, ErrNoPrivKey
+	}
+	return btcaddr.privKeyBytes()
+}
+
+// ChainBreakError describes a chained address whose key does not follow
+// from the key of the previous address in the address chain.  The value is
+// the chain index of the address.
+type ChainBreakError int64
+
+// Error implements the error interface.
+func (e ChainBreakError) Error() string {
+	return fmt.Sprintf("address chain broken at index %d", int64(e))
+}
+
+// VerifyChainContinuity derives the private key of each chained address from
+// the root private key, decrypted with passphrase, and checks that each
+// derived key matches the public key saved for the address.  A
+// ChainBreakError is returned for the first address which does not match.
+// This detects corruption or tampering of chained addresses which is not
+// caught by the checksums of each address.  The key store's locked state is
+// not changed.
+func (s *Store) VerifyChainContinuity(passphrase []byte) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	key := kdf(passphrase, &s.kdfParams)
+	defer zero(key)
+	return s.verifyChainContinuity(key)
+}
+
+// openRootPrivKey decrypts the root private key with the key derived from
+// the passphrase, returning ErrWrongPassphrase if it is not the root's key.
+func (s *Store) openRootPrivKey(key []byte) ([]byte, error) {
+	privkey, err := s.keyGenerator.openPrivKey(key)
+	if err != nil {
+		if err == ErrKeyAuthFailed {
+			return nil, ErrWrongPassphrase
+		}
+		return nil, err
+	}
+	if !pubKeyMatches(s.keyGenerator.pubKey, privkey) {
+		zero(privkey)
+		return nil, ErrWrongPassphrase
+	}
+	return privkey, nil
+}
+
+// verifyChainContinuity performs the checks of VerifyChainContinuity with
+// the key derived from the passphrase.  The key store mutex must be held by
+// the caller.
+func (s *Store) verifyChainContinuity(key []byte) error {
+	privkey, err := s.openRootPrivKey(key)
+	if err != nil {
+		return err
+	}
+	defer func() { zero(privkey) }()
+
+	prev := &s.keyGenerator
+	for idx := int64(0); idx <= s.lastChainIdx; idx++ {
+		a, ok := s.chainIdxMap[idx]
+		if !ok {
+			return ChainBreakError(idx)
+		}
+		cur, ok := s.addrMap[getAddressKey(a)].(*btcAddress)
+		if !ok {
+			return ChainBreakError(idx)
+		}
+
+		next, err := chainedPrivKey(privkey, prev.pubKeyBytes(),
+			prev.chaincode[:])
+		zero(privkey)
+		privkey = next
+		if err != nil {
+			return err
+		}
+		if !pubKeyMatches(cur.pubKey, privkey) {
+			return ChainBreakError(idx)
+		}
+		prev = cur
+	}
+	return nil
+}
+
+// IntegrityCheck is the result of a single check of an IntegrityReport.
+type IntegrityCheck struct {
+	Name    string
+	Passed  bool
+	Skipped bool
+	Details []string
+}
+
+// IntegrityReport holds the results of every key store integrity check.
+type IntegrityReport struct {
+	Checks []IntegrityCheck
+}
+
+// Passed returns whether no check failed.  Skipped checks are not failures.
+func (r *IntegrityReport) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed && !c.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// IntegrityReport runs every available key store integrity check and
+// returns the results of each.  The checks are:
+//
+//   - chain indexes: every chain index from the root to the last chained
+//     address is used by exactly one address
+//   - round trip: the key store in memory is serialized and read back,
+//     verifying that it is consistent enough to be saved and reopened
+//   - recent blocks: the recently seen blocks are consistent with the last
+//     seen block height
+//   - file MAC: the MAC read from the key store file matches the file (see
+//     EnableFileMAC)
+//   - chain continuity: as VerifyChainContinuity
+//   - keypairs: every private key decrypts and matches its public key
+//
+// The last three checks require passphrase, and are skipped if passphrase is
+// nil or the key store is watching-only.  The file MAC check is also skipped
+// if the key store has no file MAC, or was not read from a file.
+// ErrWrongPassphrase is returned if passphrase does not decrypt the root
+// private key.
+func (s *Store) IntegrityReport(passphrase []byte) (*IntegrityReport, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	var key []byte
+	if passphrase != nil && !s.flags.watchingOnly {
+		key = kdf(passphrase, &s.kdfParams)
+		defer zero(key)
+		privkey, err := s.openRootPrivKey(key)
+		if err != nil {
+			return nil, err
+		}
+		zero(privkey)
+	}
+
+	// The key store can not be serialized if the chain indexes are
+	// inconsistent.
+	chainIndexes := s.checkChainIndexes()
+	roundTrip := IntegrityCheck{
+		Name:    "round trip",
+		Skipped: true,
+		Details: []string{"chain indexes are inconsistent"},
+	}
+	if chainIndexes.Passed {
+		roundTrip = s.checkRoundTrip()
+	}
+	report := &IntegrityReport{
+		Checks: []IntegrityCheck{
+			chainIndexes,
+			roundTrip,
+			s.checkRecentBlocks(),
+		},
+	}
+
+	fileMAC := IntegrityCheck{Name: "file MAC", Passed: true}
+	switch {
+	case !s.flags.fileMAC:
+		fileMAC.Skipped = true
+		fileMAC.Details = []string{"key store has no file MAC"}
+	case s.fileMAC == nil && s.macKey != nil:
+		// The MAC was enabled after the key store was created or
+		// read, and has not yet been written.
+		fileMAC.Skipped = true
+		fileMAC.Details = []string{"file MAC has not been written"}
+	case key == nil:
+		fileMAC.Skipped = true
+	case !s.fileMACMatches(key):
+		fileMAC.Passed = false
+		fileMAC.Details = []string{"file MAC does not match"}
+	}
+	report.Checks = append(report.Checks, fileMAC)
+
+	continuity := IntegrityCheck{Name: "chain continuity", Passed: true}
+	keypairs := IntegrityCheck{Name: "keypairs", Passed: true}
+	if key == nil {
+		continuity.Skipped = true
+		keypairs.Skipped = true
+	} else {
+		if err := s.verifyChainContinuity(key); err != nil {
+			continuity.Passed = false
+			continuity.Details = append(continuity.Details, err.Error())
+		}
+		for _, wa := range s.addrMap {
+			a, ok := wa.(*btcAddress)
+			if !ok || !a.flags.hasPrivKey || !a.flags.encrypted {
+				continue
+			}
+			privkey, err := a.openPrivKey(key)
+			if err == nil && !pubKeyMatches(a.pubKey, privkey) {
+				err = errors.New("private key does not match public key")
+			}
+			zero(privkey)
+			if err != nil {
+				keypairs.Passed = false
+				keypairs.Details = append(keypairs.Details,
+					fmt.Sprintf("address %v: %v", a.address, err))
+			}
+		}
+	}
+	report.Checks = append(report.Checks, continuity, keypairs)
+
+	return report, nil
+}
+
+// checkRoundTrip serializes the key store and reads it back.  This is a
+// consistency check of the key store in memory, not of the file it was read
+// from: the file's checksums were already verified when it was read, and a
+// field which failed them was either rejected or recovered.  The check
+// instead detects in-memory state which would write a file that can not be
+// read again.
+func (s *Store) checkRoundTrip() IntegrityCheck {
+	c := IntegrityCheck{Name: "round trip", Passed: true}
+
+	// A key store with a file MAC can not be written until the MAC key
+	// is derived by the first unlock.
+	if s.flags.fileMAC && s.macKey == nil {
+		c.Skipped = true
+		c.Details = []string{"key store has not been unlocked"}
+		return c
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := s.writeTo(buf); err != nil {
+		c.Passed = false
+		c.Details = []string{fmt.Sprintf("write: %v", err)}
+		return c
+	}
+	if _, err := new(Store).ReadFrom(buf); err != nil {
+		c.Passed = false
+		c.Details = []string{fmt.Sprintf("read: %v", err)}
+	}
+	return c
+}
+
+// checkRecentBlocks checks that the recently seen blocks are consistent with
+// the last seen block height.
+func (s *Store) checkRecentBlocks() IntegrityCheck {
+	c := IntegrityCheck{Name: "recent blocks", Passed: true}
+	fail := func(format string, args ...interface{}) {
+		c.Passed = false
+		c.Details = append(c.Details, fmt.Sprintf(format, args...))
+	}
+
+	n := len(s.recent.hashes)
+	if n > 20 {
+		fail("%d recent blocks exceeds maximum of 20", n)
+	}
+	if n != 0 && s.recent.lastHeight < int32(n-1) {
+		fail("%d recent blocks end at height %d", n, s.recent.lastHeight)
+	}
+	for i, hash := range s.recent.hashes {
+		if hash == nil {
+			fail("recent block %d has no hash", i)
+		}
+	}
+	return c
+}
+
+// checkChainIndexes checks that every chain index from the root to the last
+// chained address is used by exactly one address.
+func (s *Store) checkChainIndexes() IntegrityCheck {
+	c := IntegrityCheck{Name: "chain indexes", Passed: true}
+	fail := func(format string, args ...interface{}) {
+		c.Passed = false
+		c.Details = append(c.Details, fmt.Sprintf(format, args...))
+	}
+
+	for idx := int64(rootKeyChainIdx); idx <= s.lastChainIdx; idx++ {
+		a, ok := s.chainIdxMap[idx]
+		if !ok {
+			fail("missing chain index %d", idx)
+			continue
+		}
+		wa, ok := s.addrMap[getAddressKey(a)]
+		if !ok {
+			fail("chain index %d: address %v not found", idx, a)
+			continue
+		}
+		if a, ok := wa.(*btcAddress); !ok || a.chainIndex != idx {
+			fail("chain index %d: address %v has wrong index", idx,
+				wa.Address())
+		}
+	}
+
+	used := make(map[int64]btcutil.Address)
+	for _, wa := range s.addrMap {
+		a, ok := wa.(*btcAddress)
+		if !ok || a.Imported() {
+			continue
+		}
+		if prev, ok := used[a.chainIndex]; ok {
+			fail("chain index %d: used by both %v and %v",
+				a.chainIndex, prev, a.address)
+		}
+		used[a.chainIndex] = a.address
+		if a.chainIndex > s.lastChainIdx {
+			fail("chain index %d: past last chain index %d",
+				a.chainIndex, s.lastChainIdx)
+		}
+	}
+	return c
+}
+
+// pubKeyMatches returns whether privkey is the private key of pubKey.
+func pubKeyMatches(pubKey *btcec.PublicKey, privkey []byte) bool {
+	x, y := btcec.S256().ScalarBaseMult(privkey)
+	return x.Cmp(pubKey.X) == 0 && y.Cmp(pubKey.Y) == 0
+}
+
+// AddressWIF pairs a key store address with its exported private key.
+type AddressWIF struct {
+	Address btcutil.Address
+	WIF     *btcutil.WIF
+}
+
+// DumpAllPrivKeys exports the private key of every active address with a
+// private key, ordered by chain index followed by imported addresses in
+// import order.  Addresses without private keys, such as imported scripts,
+// are skipped.  The key store must be unlocked.
+func (s *Store) DumpAllPrivKeys() ([]AddressWIF, error) {
+	// A write lock is required since decrypting the private keys caches
+	// the clear text keys in the addresses.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
+	}
+	if s.isLocked() {
+		return nil, ErrLocked
+	}
+
+	var dump []AddressWIF
+	err := s.forEachActiveAddress(func(wa WalletAddress) error {
+		a, ok := wa.(*btcAddress)
+		if !ok || !a.flags.hasPrivKey {
+			return nil
+		}
+		wif, err := a.ExportPrivKey()
+		if err != nil {
+			return err
+		}
+		dump = append(dump, AddressWIF{Address: a.Address(), WIF: wif})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// TryDecryptAddress attempts to decrypt the private key of an address with
+// candidateKey, a possible output of the key derivation function, returning
+// the clear text private key only if it matches the address's public key.
+// This is intended for recovering a key store with damaged KDF parameters,
+// and neither requires nor modifies the key store's unlocked state.
+func (s *Store) TryDecryptAddress(a btcutil.Address, candidateKey []byte) (privKeyCT []byte, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if len(candidateKey) != 32 {
+		return nil, false
+	}
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, false
+	}
+	btcaddr, ok := wa.(*btcAddress)
+	if !ok || !btcaddr.flags.hasPrivKey || !btcaddr.flags.encrypted {
+		return nil, false
+	}
+
+	privkey, err := btcaddr.openPrivKey(candidateKey)
+	if err != nil {
+		return nil, false
+	}
+	if !pubKeyMatches(btcaddr.pubKey, privkey) {
+		zero(privkey)
+		return nil, false
+	}
+	return privkey, true
+}
+
+// ownershipMessagePrefix is prepended to a challenge before it is hashed and
+// signed by ProveOwnership, so an ownership proof can not be used as a
+// signature for any other purpose.
+const ownershipMessagePrefix = "btcwallet ownership proof:\n"
+
+// ownershipHash returns the hash signed to prove ownership of an address.
+func ownershipHash(challenge []byte) []byte {
+	msg := make([]byte, 0, len(ownershipMessagePrefix)+len(challenge))
+	msg = append(msg, ownershipMessagePrefix...)
+	msg = append(msg, challenge...)
+	return btcwire.DoubleSha256(msg)
+}
+
+// ProveOwnership signs challenge with the private key of a pubkey address
+// in the key store, returning a compact signature which may be checked with
+// VerifyOwnership to prove control of the address without revealing its
+// private key.  The key store must be unlocked.
+func (s *Store) ProveOwnership(a btcutil.Address, challenge []byte) ([]byte, error) {
+	// A write lock is required since decrypting the private key caches
+	// the clear text key in the address.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	return s.signCompact(a, ownershipHash(challenge))
+}
+
+// bitcoindMessageMagic is prepended to a message before it is hashed and
+// signed by SignMessageCompact, matching bitcoind's signmessage.
+const bitcoindMessageMagic = "Bitcoin Signed Message:\n"
+
+// bitcoindMessageHash returns the hash signed by bitcoind's signmessage for
+// message.  Both the magic and the message are serialized as variable
+// length strings before hashing.
+func bitcoindMessageHash(message string) []byte {
+	var buf bytes.Buffer
+	_ = btcwire.WriteVarString(&buf, 0, bitcoindMessageMagic)
+	_ = btcwire.WriteVarString(&buf, 0, message)
+	return btcwire.DoubleSha256(buf.Bytes())
+}
+
+// SignMessageCompact signs message with the private key of an address,
+// returning the base64 encoding of a 65 byte compact recoverable signature.
+// The signature is compatible with bitcoind's signmessage and may be checked
+// with its verifymessage.  The key store must be unlocked.
+func (s *Store) SignMessageCompact(a btcutil.Address, message string) (string, error) {
+	// A write lock is required since decrypting the private key caches
+	// the clear text key in the address.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return "", ErrDestroyed
+	}
+
+	sig, err := s.signCompact(a, bitcoindMessageHash(message))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// signCompact signs hash with the private key of an address, returning a
+// compact signature from which the public key may be recovered.  The header
+// byte of the signature records whether the address uses a compressed public
+// key.  The key store mutex must be held for writes by the caller.
+func (s *Store) signCompact(a btcutil.Address, hash []byte) ([]byte, error) {
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	btcaddr, ok := wa.(*btcAddress)
+	if !ok {
+		return nil, ErrNoPrivKey
+	}
+	privKeyCT, err := btcaddr.privKeyBytes()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(privKeyCT)
+
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKeyCT)
+	return btcec.SignCompact(btcec.S256(), privKey, hash,
+		btcaddr.Compressed())
+}
+
+// SignHash signs a 32 byte hash with the private key of an address, returning
+// the raw ECDSA signature.  Unlike ProveOwnership, the hash is signed as is,
+// without any message prefix, so the caller is responsible for ensuring the
+// hash can not be mistaken for the hash of a transaction or other message.
+// The key store must be unlocked.  ErrAddressNotFound is returned if the
+// address is not in the key store, and ErrNoPrivKey if the key store does not
+// hold a private key for the address.
+func (s *Store) SignHash(a btcutil.Address, hash []byte) (*big.Int, *big.Int, error) {
+	if len(hash) != 32 {
+		return nil, nil, errors.New("hash must be 32 bytes")
+	}
+
+	// A write lock is required since decrypting the private key caches
+	// the clear text key in the address.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, nil, ErrDestroyed
+	}
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, nil, ErrAddressNotFound
+	}
+	btcaddr, ok := wa.(*btcAddress)
+	if !ok {
+		return nil, nil, ErrNoPrivKey
+	}
+	privKeyCT, err := btcaddr.privKeyBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zero(privKeyCT)
+
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKeyCT)
+	return ecdsa.Sign(Rand, privKey.ToECDSA(), hash)
+}
+
+// VerifyOwnership checks that proof, created by ProveOwnership, is a
+// signature of challenge by the private key of a pay-to-pubkey or
+// pay-to-pubkey-hash address.  The public key is recovered from the proof,
+// so no key store is required.
+func VerifyOwnership(a btcutil.Address, challenge, proof []byte) (bool, error) {
+	pk, wasCompressed, err := btcec.RecoverCompact(btcec.S256(), proof,
+		ownershipHash(challenge))
+	if err != nil {
+		return false, err
+	}
+
+	var serializedPK []byte
+	if wasCompressed {
+		serializedPK = pk.SerializeCompressed()
+	} else {
+		serializedPK = pk.SerializeUncompressed()
+	}
+
+	switch a := a.(type) {
+	case *btcutil.AddressPubKeyHash:
+		return bytes.Equal(btcutil.Hash160(serializedPK), a.ScriptAddress()), nil
+	case *btcutil.AddressPubKey:
+		return bytes.Equal(serializedPK, a.ScriptAddress()), nil
+	default:
+		return false, errors.New("address type not supported")
+	}
+}
+
+// ChainParams returns copies of the serialized root public key and the
+// chaincode used to derive chained addresses.  Neither is secret, and they
+// allow an external service to derive the key store's chained public keys
+// without access to the key store file.
+func (s *Store) ChainParams() (rootPubKey []byte, chainCode []byte) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	rootPubKey = s.keyGenerator.pubKeyBytes()
+	chainCode = make([]byte, len(s.keyGenerator.chaincode))
+	copy(chainCode, s.keyGenerator.chaincode[:])
+	return rootPubKey, chainCode
+}
+
+// RootFingerprint returns the first four bytes of the Hash160 of the
+// serialized root public key, similar to a BIP0032 key fingerprint.  As the
+// root key determines every chained address, a key store restored from a
+// backup can be checked against a fingerprint recorded at backup time.
+func (s *Store) RootFingerprint() [4]byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var fp [4]byte
+	copy(fp[:], btcutil.Hash160(s.keyGenerator.pubKeyBytes()))
+	return fp
+}
+
+// KDFFingerprint returns the first eight bytes of the SHA256 hash of the key
+// derivation parameters: the memory and iteration counts and the salt.  Key
+// stores with the same fingerprint derive the same key from the same
+// passphrase, so backups can be compared without revealing the salt.  The
+// fingerprint changes when the passphrase is changed with new parameters or
+// the salt is rotated with RotateSalt.
+func (s *Store) KDFFingerprint() [8]byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.kdfParams.fingerprint()
+}
+
+// AddressForScript returns the key store address paid to by a standard
+// pay-to-pubkey-hash output script.  ErrAddressNotFound is returned if the
+// script pays to an address not in the key store.
+func (s *Store) AddressForScript(pkScript []byte) (btcutil.Address, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	class, addrs, _, err := btcscript.ExtractPkScriptAddrs(pkScript,
+		s.netParams())
+	if err != nil {
+		return nil, err
+	}
+	if class != btcscript.PubKeyHashTy || len(addrs) != 1 {
+		return nil, errors.New("script is not pay-to-pubkey-hash")
+	}
+
+	wa, ok := s.addrMap[getAddressKey(addrs[0])]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	return wa.Address(), nil
+}
+
+// PayToAddrScript returns the output script paying to a key store address:
+// a pay-to-pubkey-hash script for a pubkey address, or a pay-to-script-hash
+// script for an imported script.  ErrAddressNotFound is returned if a is not
+// in the key store, so outputs created with this script, such as change, can
+// only pay to addresses the key store controls.
+func (s *Store) PayToAddrScript(a btcutil.Address) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return nil, ErrAddressNotFound
+	}
+	return btcscript.PayToAddrScript(wa.Address())
+}
+
+// Net returns the bitcoin network parameters for this key store.
+func (s *Store) Net() *btcnet.Params {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.netParams()
+}
+
+func (s *Store) netParams() *btcnet.Params {
+	return (*btcnet.Params)(s.net)
+}
+
+// AddressParams holds the network-specific version bytes used to encode
+// addresses and private keys for a key store's network.
+type AddressParams struct {
+	Net              btcwire.BitcoinNet
+	PubKeyHashAddrID byte // First byte of a P2PKH address
+	ScriptHashAddrID byte // First byte of a P2SH address
+	PrivateKeyID     byte // First byte of a WIF private key
+}
+
+// AddressParams returns the version bytes used to encode addresses and
+// private keys for the key store's network.
+func (s *Store) AddressParams() AddressParams {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return AddressParams{
+		Net:              s.net.Net,
+		PubKeyHashAddrID: s.net.PubKeyHashAddrID,
+		ScriptHashAddrID: s.net.ScriptHashAddrID,
+		PrivateKeyID:     s.net.PrivateKeyID,
+	}
+}
+
+// IsMainNet returns whether the key store is for the main bitcoin network.
+func (s *Store) IsMainNet() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.net.Net == btcwire.MainNet
+}
+
+// IsTestNet returns whether the key store is for the public test network
+// (version 3).
+func (s *Store) IsTestNet() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.net.Net == btcwire.TestNet3
+}
+
+// NetworkName returns the name of the key store's network, such as
+// "mainnet" or "testnet3".
+func (s *Store) NetworkName() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.net.Name
+}
+
+// SetSyncStatus sets the sync status for a single key store address.  This
+// may error if the address is not found in the key store.
+//
+// When marking an address as unsynced, only the type Unsynced matters.
+// The value is ignored.
+func (s *Store) SetSyncStatus(a btcutil.Address, ss SyncStatus) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return ErrAddressNotFound
+	}
+	wa.setSyncStatus(ss)
+	s.dirty = true
+	return nil
+}
+
+// FirstBlockHistogram counts the key store addresses by the first block they
+// may be seen in, grouping first blocks into ranges of bucketSize blocks.
+// Each range is keyed by its lowest height, a multiple of bucketSize.  This
+// allows a rescan to skip ranges of blocks in which no addresses were
+// created.  A nil map is returned if bucketSize is not positive.
+func (s *Store) FirstBlockHistogram(bucketSize int32) map[int32]int {
+	if bucketSize <= 0 {
+		return nil
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	histogram := make(map[int32]int)
+	for _, wa := range s.addrMap {
+		bucket := wa.FirstBlock() / bucketSize * bucketSize
+		histogram[bucket]++
+	}
+	return histogram
+}
+
+// SetAddressFirstBlock lowers the first block height recorded for a key
+// store address, such as when the first transaction of an imported key is
+// discovered after the import.  As the blocks between the new and previous
+// first block have not been searched for the address, it is marked unsynced
+// from the new height.  Heights which are not lower than the recorded first
+// block are ignored.  This may error if the address is not found in the key
+// store.
+func (s *Store) SetAddressFirstBlock(a btcutil.Address, height int32) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	wa, ok := s.addrMap[getAddressKey(a)]
+	if !ok {
+		return ErrAddressNotFound
+	}
+	if height < 0 || height >= wa.FirstBlock() {
+		return nil
+	}
+	wa.setFirstBlock(height)
+	wa.setSyncStatus(Unsynced(height))
+	s.dirty = true
+	return nil
+}
+
+// OnNewAddress registers a handler which is called with each address
+// added to the key store by NextChainedAddress, ChangeAddress,
+// ExtendActiveAddresses, or an import.  Handlers are called while the key
+// store is locked, and must not call key store methods.
+func (s *Store) OnNewAddress(handler func(WalletAddress)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.newAddrHandlers = append(s.newAddrHandlers, handler)
+}
+
+// OnSyncChange registers a handler which is called with the block passed to
+// each call of SetSyncedWith or successful call of ConnectBlock.  Handlers
+// are called while the key store is locked, and must not call key store
+// methods.
+func (s *Store) OnSyncChange(handler func(*BlockStamp)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.syncChangeHandlers = append(s.syncChangeHandlers, handler)
+}
+
+func (s *Store) notifyNewAddress(wa WalletAddress) {
+	for _, handler := range s.newAddrHandlers {
+		handler(wa)
+	}
+}
+
+func (s *Store) notifySyncChange(bs *BlockStamp) {
+	for _, handler := range s.syncChangeHandlers {
+		handler(bs)
+	}
+}
+
+// SetSyncedWith marks already synced addresses in the key store to be in
+// sync with the recently-seen block described by the blockstamp.
+// Unsynced addresses are unaffected by this method and must be marked
+// as in sync with MarkAddressSynced or MarkAllSynced to be considered
+// in sync with bs.
+//
+// If bs is nil, the entire key store is marked unsynced.
+func (s *Store) SetSyncedWith(bs *BlockStamp) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return
+	}
+
+	// Handlers are called before the mutex is unlocked.
+	defer s.notifySyncChange(bs)
+
+	s.dirty = true
+	if bs == nil {
+		s.recent.hashes = s.recent.hashes[:0]
+		s.recent.lastHeight = s.keyGenerator.firstBlock
+		s.keyGenerator.setSyncStatus(Unsynced(s.keyGenerator.firstBlock))
+		return
+	}
+
+	// Check if we're trying to rollback the last seen history.
+	// If so, and this bs is already saved, remove anything
+	// after and return.  Otherwire, remove previous hashes.
+	if bs.Height < s.recent.lastHeight {
+		maybeIdx := len(s.recent.hashes) - 1 - int(s.recent.lastHeight-bs.Height)
+		if maybeIdx >= 0 && maybeIdx < len(s.recent.hashes) &&
+			*s.recent.hashes[maybeIdx] == *bs.Hash {
+
+			s.recent.lastHeight = bs.Height
+			// subslice out the removed hashes.
+			s.recent.hashes = s.recent.hashes[:maybeIdx]
+			return
+		}
+		s.recent.hashes = nil
+	}
+
+	if bs.Height != s.recent.lastHeight+1 {
+		s.recent.hashes = nil
+	}
+
+	s.recent.push(bs)
+}
+
+// ResetSyncState returns the key store to a never synced state, forcing a
+// full rescan.  All recently seen blocks are forgotten, the last seen block
+// height is set to -1, and every address is marked unsynced from its first
+// block.  Keys and addresses are unchanged.
+func (s *Store) ResetSyncState() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return
+	}
+
+	s.recent.hashes = nil
+	s.recent.lastHeight = -1
+	s.keyGenerator.setSyncStatus(Unsynced(s.keyGenerator.firstBlock))
+	for _, wa := range s.addrMap {
+		wa.setSyncStatus(Unsynced(wa.FirstBlock()))
+	}
+	s.dirty = true
+}
+
+// ConnectBlock marks the key store as synced with bs, which must be the
+// block following the most recently seen block.  Unlike SetSyncedWith, the
+// recently seen blocks are never cleared.  If bs does not directly follow
+// the last seen block, or prevHash does not match the hash of the last seen
+// block, ErrReorg is returned and the key store is unchanged, and the caller
+// should rewind to the fork point with SetSyncedWith before connecting
+// blocks of the new chain.  If no blocks have been seen, bs is always
+// connected.
+func (s *Store) ConnectBlock(bs *BlockStamp, prevHash btcwire.ShaHash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if n := len(s.recent.hashes); n != 0 {
+		if bs.Height != s.recent.lastHeight+1 ||
+			*s.recent.hashes[n-1] != prevHash {
+			return ErrReorg
+		}
+	}
+
+	s.recent.push(bs)
+	s.dirty = true
+	s.notifySyncChange(bs)
+	return nil
+}
+
+// SyncHeight returns details about the block that a wallet is marked at least
+// synced through.  The height is the height that rescans should start at when
+// syncing a wallet back to the best chain.
+//
+// NOTE: If the hash of the synced block is not known, hash will be nil, and
+// must be obtained from elsewhere.   This must be explicitly checked before
+// dereferencing the pointer.
+func (s *Store) SyncedTo() (hash *btcwire.ShaHash, height int32) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	switch h, ok := s.keyGenerator.SyncStatus().(PartialSync); {
+	case ok && int32(h) > s.recent.lastHeight:
+		height = int32(h)
+	default:
+		height = s.recent.lastHeight
+		if n := len(s.recent.hashes); n != 0 {
+			hash = s.recent.hashes[n-1]
+		}
+	}
+	for _, a := range s.addrMap {
+		var syncHeight int32
+		switch e := a.SyncStatus().(type) {
+		case Unsynced:
+			syncHeight = int32(e)
+		case PartialSync:
+			syncHeight = int32(e)
+		case FullSync:
+			continue
+		}
+		if syncHeight < height {
+			height = syncHeight
+			hash = nil
+
+			// Can't go lower than 0.
+			if height == 0 {
+				return
+			}
 		}
 	}
+	return
+}
 
-	return n, nil
+// FileVersion returns the version of the key store file the key store was
+// read from, or VersCurrent for a newly created key store.  If this is
+// earlier than VersCurrent, the file will be upgraded when the key store is
+// next written.
+func (s *Store) FileVersion() FileVersion {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.vers
 }
 
-// WriteTo serializes a key store and writes it to a io.Writer,
-// returning the number of bytes written and any errors encountered.
-func (s *Store) WriteTo(w io.Writer) (n int64, err error) {
+// SyncHeight returns the height of the most recently seen block, or -1 if
+// the last seen block is unknown.  Unlike SyncedTo, this does not consider
+// the sync status of each address and does not return the block hash, so it
+// is a cheaper alternative for callers that only need the height.
+func (s *Store) SyncHeight() int32 {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	return s.writeTo(w)
+	return s.recent.lastHeight
 }
 
-func (s *Store) writeTo(w io.Writer) (n int64, err error) {
-	var wts []io.WriterTo
-	var chainedAddrs = make([]io.WriterTo, len(s.chainIdxMap)-1)
-	var importedAddrs []io.WriterTo
-	for _, wAddr := range s.addrMap {
-		switch btcAddr := wAddr.(type) {
-		case *btcAddress:
-			e := &addrEntry{
-				addr: *btcAddr,
-			}
-			copy(e.pubKeyHash160[:], btcAddr.AddrHash())
-			if btcAddr.Imported() {
-				// No order for imported addresses.
-				importedAddrs = append(importedAddrs, e)
-			} else if btcAddr.chainIndex >= 0 {
-				// Chained addresses are sorted.  This is
-				// kind of nice but probably isn't necessary.
-				chainedAddrs[btcAddr.chainIndex] = e
-			}
+// ConfirmationsAt returns the number of confirmations of a transaction mined
+// in the block at height seenHeight, counting the block itself, relative to
+// the most recently seen block.  Zero is returned for unmined transactions
+// (a negative seenHeight), for heights past the most recently seen block,
+// and when the last seen block is unknown.
+func (s *Store) ConfirmationsAt(seenHeight int32) int32 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-		case *scriptAddress:
-			e := &scriptEntry{
-				script: *btcAddr,
-			}
-			copy(e.scriptHash160[:], btcAddr.AddrHash())
-			// scripts are always imported
-			importedAddrs = append(importedAddrs, e)
-		}
+	tip := s.recent.lastHeight
+	if tip == -1 || seenHeight < 0 || seenHeight > tip {
+		return 0
 	}
-	wts = append(chainedAddrs, importedAddrs...)
-	appendedEntries := varEntries{store: s, entries: wts}
+	return tip - seenHeight + 1
+}
 
-	// Iterate through each entry needing to be written.  If data
-	// implements io.WriterTo, use its WriteTo func.  Otherwise,
-	// data is a pointer to a fixed size value.
-	datas := []interface{}{
-		&fileID,
-		&VersCurrent,
-		s.net,
-		&s.flags,
-		make([]byte, 6), // Bytes for Armory unique ID
-		&s.createDate,
-		&s.name,
-		&s.desc,
-		&s.highestUsed,
-		&s.kdfParams,
-		make([]byte, 256),
-		&s.keyGenerator,
-		newUnusedSpace(1024, &s.recent),
-		&appendedEntries,
+// Touch records the current time as the last time the key store was known
+// to be synced, without modifying the recently seen blocks.  This is used
+// when the chain tip is unchanged since the key store was last synced.
+func (s *Store) Touch() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return
 	}
-	var written int64
-	for _, data := range datas {
-		if s, ok := data.(io.WriterTo); ok {
-			written, err = s.WriteTo(w)
-		} else {
-			written, err = binaryWrite(w, binary.LittleEndian, data)
-		}
-		n += written
-		if err != nil {
-			return n, err
-		}
+
+	s.lastSync = syncTime(time.Now().Unix())
+	s.dirty = true
+}
+
+// LastSyncTime returns the time recorded by the last call to Touch, or the
+// zero time if the key store has never been touched.
+func (s *Store) LastSyncTime() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.lastSync == 0 {
+		return time.Time{}
 	}
+	return time.Unix(int64(s.lastSync), 0)
+}
 
-	return n, nil
+// NewIterateRecentBlocks returns an iterator for recently-seen blocks.
+// The iterator starts at the most recently-added block, and Prev should
+// be used to access earlier blocks.
+func (s *Store) NewIterateRecentBlocks() *BlockIterator {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.recent.iter(s)
 }
 
-// TODO: set this automatically.
-func (s *Store) MarkDirty() {
+// RecentBlockHashAtHeight returns the hash of the recently seen block at
+// height, and whether the height is within the window of recorded blocks.
+func (s *Store) RecentBlockHashAtHeight(height int32) (*btcwire.ShaHash, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	rb := &s.recent
+	if rb.lastHeight == -1 || len(rb.hashes) == 0 {
+		return nil, false
+	}
+	index := len(rb.hashes) - 1 - int(rb.lastHeight-height)
+	if height > rb.lastHeight || index < 0 {
+		return nil, false
+	}
+	hash := *rb.hashes[index]
+	return &hash, true
+}
+
+// ImportPrivateKey imports a WIF private key into the keystore.  The imported
+// address is created using either a compressed or uncompressed serialized
+// public key, depending on the CompressPubKey bool of the WIF.
+func (s *Store) ImportPrivateKey(wif *btcutil.WIF, bs *BlockStamp) (btcutil.Address, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	s.dirty = true
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	return s.importPrivateKey(wif, bs)
 }
 
-func (s *Store) WriteIfDirty() error {
-	s.mtx.RLock()
-	if !s.dirty {
-		s.mtx.RUnlock()
-		return nil
+// ImportPrivateKeyLabeled imports a WIF private key into the keystore and
+// sets label as the comment for the imported address.  The label is
+// checked before the key is imported, and if it is longer than
+// MaxCommentLen, ErrCommentTooLong is returned and nothing is imported.
+func (s *Store) ImportPrivateKeyLabeled(wif *btcutil.WIF, label string, bs *BlockStamp) (btcutil.Address, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
 	}
 
-	// TempFile creates the file 0600, so no need to chmod it.
-	fi, err := ioutil.TempFile(s.dir, s.file)
+	if err := checkComment(label, maxChunkedCommentLen); err != nil {
+		return nil, err
+	}
+	addr, err := s.importPrivateKey(wif, bs)
 	if err != nil {
-		s.mtx.RUnlock()
-		return err
+		return nil, err
 	}
-	fiPath := fi.Name()
+	if label != "" {
+		s.addrCommentMap[getAddressKey(addr)] = comment(label)
+	}
+	return addr, nil
+}
 
-	_, err = s.writeTo(fi)
-	if err != nil {
-		s.mtx.RUnlock()
-		fi.Close()
-		return err
+// ImportMiniPrivKey imports a private key encoded in the Casascius mini
+// private key format used by physical coins and some paper wallets.  A mini
+// private key is a 22, 26, or 30 character base58 string beginning with 'S',
+// which is valid only if the SHA256 hash of the key followed by '?' begins
+// with a zero byte.  The private key is the SHA256 hash of the mini private
+// key, and the imported address is created using a compressed or
+// uncompressed public key as specified by compressed.
+func (s *Store) ImportMiniPrivKey(mini string, compressed bool, bs *BlockStamp) (btcutil.Address, error) {
+	switch len(mini) {
+	case 22, 26, 30:
+	default:
+		return nil, errors.New("mini private key has invalid length")
 	}
-	err = fi.Sync()
-	if err != nil {
-		s.mtx.RUnlock()
-		fi.Close()
-		return err
+	if mini[0] != 'S' {
+		return nil, errors.New("mini private key does not begin with 'S'")
+	}
+	if len(btcutil.Base58Decode(mini)) == 0 {
+		return nil, errors.New("mini private key is not base58 encoded")
+	}
+	chk := sha256.Sum256([]byte(mini + "?"))
+	if chk[0] != 0x00 {
+		return nil, errors.New("mini private key has bad checksum")
 	}
-	fi.Close()
 
-	err = rename.Atomic(fiPath, s.path)
-	s.mtx.RUnlock()
+	privKeyBytes := sha256.Sum256([]byte(mini))
+	defer zero(privKeyBytes[:])
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKeyBytes[:])
 
-	if err == nil {
-		s.mtx.Lock()
-		s.dirty = false
-		s.mtx.Unlock()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	wif, err := btcutil.NewWIF(privKey, s.netParams(), compressed)
+	if err != nil {
+		return nil, err
 	}
+	return s.importPrivateKey(wif, bs)
+}
 
-	return err
+// ImportPrivateKeys imports each WIF private key into the key store,
+// continuing past keys which fail to import.  The returned address and
+// error slices are parallel to wifs: for each key, either the imported
+// address or the error (for example, ErrDuplicate) which prevented its
+// import is set.  The key store must be unlocked, and the lock is held for
+// the entire batch.
+func (s *Store) ImportPrivateKeys(wifs []*btcutil.WIF, bs *BlockStamp) ([]btcutil.Address, []error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	addrs := make([]btcutil.Address, len(wifs))
+	errs := make([]error, len(wifs))
+	for i, wif := range wifs {
+		addrs[i], errs[i] = s.importPrivateKey(wif, bs)
+	}
+	return addrs, errs
 }
 
-// OpenDir opens a new key store from the specified directory.  If the file
-// does not exist, the error from the os package will be returned, and can
-// be checked with os.IsNotExist to differentiate missing file errors from
-// others (including deserialization).
-func OpenDir(dir string) (*Store, error) {
-	path := filepath.Join(dir, filename)
-	fi, err := os.OpenFile(path, os.O_RDONLY, 0)
+// importPrivateKey imports a WIF private key into the key store.  The
+// key store mutex must be held by the caller.
+func (s *Store) importPrivateKey(wif *btcutil.WIF, bs *BlockStamp) (btcutil.Address, error) {
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
+	}
+
+	// First, must check that the key being imported will not result
+	// in a duplicate address.
+	pkh := btcutil.Hash160(wif.SerializePubKey())
+	if _, ok := s.addrMap[addressKey(pkh)]; ok {
+		return nil, ErrDuplicate
+	}
+
+	// The key store must be unlocked to encrypt the imported private key.
+	if s.isLocked() {
+		return nil, ErrLocked
+	}
+
+	// Create new address with this private key.
+	privKey := wif.PrivKey.Serialize()
+	btcaddr, err := newBtcAddress(s, privKey, nil, bs, wif.CompressPubKey)
 	if err != nil {
 		return nil, err
 	}
-	defer fi.Close()
-	store := new(Store)
-	_, err = store.ReadFrom(fi)
-	if err != nil {
+	btcaddr.chainIndex = importedKeyChainIdx
+
+	// Mark as unsynced if import height is below currently-synced
+	// height.
+	if len(s.recent.hashes) != 0 && bs.Height < s.recent.lastHeight {
+		btcaddr.flags.unsynced = true
+	}
+
+	// Encrypt imported address with the derived AES key.
+	if err = btcaddr.encrypt(s.secret); err != nil {
 		return nil, err
 	}
-	store.path = path
-	store.dir = dir
-	store.file = filename
-	return store, nil
+
+	addr := btcaddr.Address()
+	// Add address to key store's bookkeeping structures.  Adding to
+	// the map will result in the imported address being serialized
+	// on the next WriteTo call.
+	s.addrMap[getAddressKey(addr)] = btcaddr
+	s.importedAddrs = append(s.importedAddrs, btcaddr)
+	s.dirty = true
+	log.Debugf("Imported private key for address %v", addr)
+	s.notifyNewAddress(btcaddr)
+
+	// Create and return address.
+	return addr, nil
 }
 
-// Unlock derives an AES key from passphrase and key store's KDF
-// parameters and unlocks the root key of the key store.  If
-// the unlock was successful, the key store's secret key is saved,
-// allowing the decryption of any encrypted private key.  Any
-// addresses created while the key store was locked without private
-// keys are created at this time.
-func (s *Store) Unlock(passphrase []byte) error {
+// ImportPrivateKeyReplace imports a private key as ImportPrivateKey does,
+// but if the key was already imported, the existing imported address is
+// updated rather than returning ErrDuplicate.  If bs is below the address's
+// first block, the first block is lowered and the address is marked unsynced
+// from bs, as with SetAddressFirstBlock.  The private key is re-encrypted
+// from the imported key with a new initialization vector.  This allows a
+// restore to be safely repeated.  Chained addresses are never replaced, and
+// ErrDuplicate is returned for them.  As the compression of a key changes its
+// address, importing a key with the other compression imports a separate
+// address.
+func (s *Store) ImportPrivateKeyReplace(wif *btcutil.WIF, bs *BlockStamp) (btcutil.Address, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	pkh := btcutil.Hash160(wif.SerializePubKey())
+	wa, ok := s.addrMap[addressKey(pkh)]
+	if !ok {
+		return s.importPrivateKey(wif, bs)
+	}
+	a, ok := wa.(*btcAddress)
+	if !ok || !a.Imported() {
+		return nil, ErrDuplicate
+	}
+
 	if s.flags.watchingOnly {
-		return ErrWatchingOnly
+		return nil, ErrWatchingOnly
+	}
+	if s.isLocked() {
+		return nil, ErrLocked
 	}
 
-	// Derive key from KDF parameters and passphrase.
-	key := kdf(passphrase, &s.kdfParams)
+	newIV := make([]byte, len(a.initVector))
+	if _, err := io.ReadFull(Rand, newIV); err != nil {
+		return nil, err
+	}
+	privKeyCT := wif.PrivKey.Serialize()
+	a.flags.perAddressKey = s.flags.perAddressKeys
+	a.flags.gcm = s.flags.gcm
+	copy(a.initVector[:], newIV)
+	if err := a.sealPrivKey(s.secret, privKeyCT); err != nil {
+		zero(privKeyCT)
+		return nil, err
+	}
+	zero(a.privKeyCT)
+	a.privKeyCT = privKeyCT
+	a.flags.hasPrivKey = true
+	a.flags.encrypted = true
 
-	// Unlock root address with derived key.
-	if _, err := s.keyGenerator.unlock(key); err != nil {
-		return err
+	if bs.Height >= 0 && bs.Height < a.firstBlock {
+		a.setFirstBlock(bs.Height)
+		a.setSyncStatus(Unsynced(bs.Height))
 	}
+	s.dirty = true
+	log.Debugf("Replaced imported private key for address %v", a.address)
 
-	// If unlock was successful, save the passphrase and aes key.
-	s.passphrase = passphrase
-	s.secret = key
+	return a.address, nil
+}
 
-	return s.createMissingPrivateKeys()
+// hdPrivateKeyIDs maps each network to the version bytes of a serialized
+// BIP0032 extended private key for that network.
+var hdPrivateKeyIDs = map[btcwire.BitcoinNet][4]byte{
+	btcwire.MainNet:  {0x04, 0x88, 0xad, 0xe4}, // xprv
+	btcwire.TestNet:  {0x04, 0x35, 0x83, 0x94}, // tprv
+	btcwire.TestNet3: {0x04, 0x35, 0x83, 0x94}, // tprv
+	btcwire.SimNet:   {0x04, 0x20, 0xb9, 0x00}, // sprv
 }
 
-// Lock performs a best try effort to remove and zero all secret keys
-// associated with the key store.
-func (s *Store) Lock() (err error) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+// serializedExtendedKeyLen is the length of a serialized BIP0032 extended
+// key, excluding the checksum: 4 bytes of version, 1 byte of depth, 4 bytes
+// of parent fingerprint, 4 bytes of child number, 32 bytes of chaincode, and
+// 33 bytes of key.
+const serializedExtendedKeyLen = 4 + 1 + 4 + 4 + 32 + 33
 
-	if s.flags.watchingOnly {
-		return ErrWatchingOnly
+// parseExtendedPrivKey parses a base58 encoded BIP0032 extended private key
+// for the network net, returning the private key and chaincode.
+func parseExtendedPrivKey(xprv string, net btcwire.BitcoinNet) (privKey, chaincode []byte, err error) {
+	decoded := btcutil.Base58Decode(xprv)
+	if len(decoded) != serializedExtendedKeyLen+4 {
+		return nil, nil, errors.New("malformed extended key")
 	}
-
-	// Remove clear text passphrase from key store.
-	if s.isLocked() {
-		err = ErrLocked
-	} else {
-		zero(s.passphrase)
-		s.passphrase = nil
-		zero(s.secret)
-		s.secret = nil
+	payload := decoded[:serializedExtendedKeyLen]
+	checksum := btcwire.DoubleSha256(payload)[:4]
+	if !bytes.Equal(checksum, decoded[serializedExtendedKeyLen:]) {
+		return nil, nil, ErrChecksumMismatch
 	}
 
-	// Remove clear text private keys from all address entries.
-	for _, addr := range s.addrMap {
-		if baddr, ok := addr.(*btcAddress); ok {
-			_ = baddr.lock()
-		}
+	id, ok := hdPrivateKeyIDs[net]
+	if !ok || !bytes.Equal(payload[:4], id[:]) {
+		return nil, nil, errors.New("extended key is not a private key " +
+			"for the key store's network")
 	}
+	chaincode = payload[13:45]
 
-	return err
+	// Private keys are serialized with a leading zero byte.
+	if payload[45] != 0 {
+		return nil, nil, errors.New("malformed extended private key")
+	}
+	privKey = payload[46:]
+	k := new(big.Int).SetBytes(privKey)
+	if k.Sign() == 0 || k.Cmp(btcec.S256().N) >= 0 {
+		return nil, nil, errors.New("invalid extended private key")
+	}
+	return privKey, chaincode, nil
 }
 
-// ChangePassphrase creates a new AES key from a new passphrase and
-// re-encrypts all encrypted private keys with the new key.
-func (s *Store) ChangePassphrase(new []byte) error {
+// ImportExtendedKey replaces the root address of a key store with the private
+// key and chaincode of a base58 encoded BIP0032 extended private key, such as
+// an xprv for the main network.  The extended key's network must match the
+// key store's.  This is only possible before any chained addresses have been
+// created, as they would have been derived from the previous root.  The key
+// store must be unlocked to encrypt the new root private key.
+//
+// The previous root address and its private key are discarded, so anything
+// sent to the previous root address can no longer be spent from the key
+// store.  Encrypted transaction comments are encrypted with a key derived
+// from the root private key, and would no longer be readable, so the import
+// is refused if the key store holds any.
+//
+// Addresses are derived from the imported key and chaincode using the key
+// store's existing chaining, not BIP0032 child key derivation, so the chained
+// addresses differ from those of an HD wallet using the same extended key.
+func (s *Store) ImportExtendedKey(xprv string, bs *BlockStamp) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
 	if s.flags.watchingOnly {
 		return ErrWatchingOnly
 	}
@@ -969,526 +5110,729 @@ func (s *Store) ChangePassphrase(new []byte) error {
 		return ErrLocked
 	}
 
-	oldkey := s.secret
-	newkey := kdf(new, &s.kdfParams)
-
-	for _, wa := range s.addrMap {
-		// Only btcAddresses curently have private keys.
-		a, ok := wa.(*btcAddress)
-		if !ok {
-			continue
-		}
-
-		if err := a.changeEncryptionKey(oldkey, newkey); err != nil {
-			return err
-		}
+	if s.lastChainIdx != rootKeyChainIdx {
+		return errors.New("address chain has already been extended " +
+			"from the existing root")
+	}
+	if len(s.encryptedTxComments) != 0 {
+		return errors.New("encrypted transaction comments require " +
+			"the existing root")
 	}
 
-	// zero old secrets.
-	zero(s.passphrase)
-	zero(s.secret)
-
-	// Save new secrets.
-	s.passphrase = new
-	s.secret = newkey
-
-	return nil
-}
-
-func zero(b []byte) {
-	for i := range b {
-		b[i] = 0
+	privKey, chaincode, err := parseExtendedPrivKey(xprv, s.net.Net)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.addrMap[addressKey(btcutil.Hash160(
+		pubkeyFromPrivkey(privKey, true)))]; ok {
+		return ErrDuplicate
 	}
-}
 
-// IsLocked returns whether a key store is unlocked (in which case the
-// key is saved in memory), or locked.
-func (s *Store) IsLocked() bool {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
+	privKeyCT := make([]byte, len(privKey))
+	copy(privKeyCT, privKey)
+	root, err := newRootBtcAddress(s, privKeyCT, nil, chaincode, bs)
+	if err != nil {
+		return err
+	}
+	if err := root.verifyKeypairs(); err != nil {
+		return err
+	}
+	if err := root.encrypt(s.secret); err != nil {
+		return err
+	}
 
-	return s.isLocked()
-}
+	// Replace the previous root address.
+	oldKey := getAddressKey(s.keyGenerator.Address())
+	delete(s.addrMap, oldKey)
+	delete(s.addrCommentMap, oldKey)
+	zero(s.keyGenerator.privKeyCT)
+	s.keyGenerator = *root
+	rootAddr := s.keyGenerator.Address()
+	s.addrMap[getAddressKey(rootAddr)] = &s.keyGenerator
+	s.chainIdxMap[rootKeyChainIdx] = rootAddr
+	s.dirty = true
 
-func (s *Store) isLocked() bool {
-	return len(s.secret) != 32
+	return nil
 }
 
-// NextChainedAddress attempts to get the next chained address.  If the key
-// store is unlocked, the next pubkey and private key of the address chain are
-// derived.  If the key store is locke, only the next pubkey is derived, and
-// the private key will be generated on next unlock.
-func (s *Store) NextChainedAddress(bs *BlockStamp) (btcutil.Address, error) {
+// ImportScript creates a new scriptAddress with a user-provided script
+// and adds it to the key store.
+func (s *Store) ImportScript(script []byte, bs *BlockStamp) (btcutil.Address, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	return s.nextChainedAddress(bs)
-}
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
 
-func (s *Store) nextChainedAddress(bs *BlockStamp) (btcutil.Address, error) {
-	addr, err := s.nextChainedBtcAddress(bs)
-	if err != nil {
-		return nil, err
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
 	}
-	return addr.Address(), nil
-}
 
-// ChangeAddress returns the next chained address from the key store, marking
-// the address for a change transaction output.
-func (s *Store) ChangeAddress(bs *BlockStamp) (btcutil.Address, error) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	if _, ok := s.addrMap[addressKey(btcutil.Hash160(script))]; ok {
+		return nil, ErrDuplicate
+	}
 
-	addr, err := s.nextChainedBtcAddress(bs)
+	// Create new address with this private key.
+	scriptaddr, err := newScriptAddress(s, script, bs)
 	if err != nil {
 		return nil, err
 	}
 
-	addr.flags.change = true
+	// Mark as unsynced if import height is below currently-synced
+	// height.
+	if len(s.recent.hashes) != 0 && bs.Height < s.recent.lastHeight {
+		scriptaddr.flags.unsynced = true
+	}
 
-	// Create and return payment address for address hash.
-	return addr.Address(), nil
+	// Add address to key store's bookkeeping structures.  Adding to
+	// the map will result in the imported address being serialized
+	// on the next WriteTo call.
+	addr := scriptaddr.Address()
+	s.addrMap[getAddressKey(addr)] = scriptaddr
+	s.importedAddrs = append(s.importedAddrs, scriptaddr)
+	s.dirty = true
+	log.Debugf("Imported script for address %v", addr)
+	s.notifyNewAddress(scriptaddr)
+
+	// Create and return address.
+	return addr, nil
 }
 
-func (s *Store) nextChainedBtcAddress(bs *BlockStamp) (*btcAddress, error) {
-	// Attempt to get address hash of next chained address.
-	nextAPKH, ok := s.chainIdxMap[s.highestUsed+1]
-	if !ok {
-		if s.isLocked() {
-			// Chain pubkeys.
-			if err := s.extendLocked(bs); err != nil {
-				return nil, err
-			}
-		} else {
-			// Chain private and pubkeys.
-			if err := s.extendUnlocked(bs); err != nil {
-				return nil, err
-			}
-		}
+// RedeemScript returns a copy of the script imported with ImportScript for
+// a pay-to-script-hash address.  ErrAddressNotFound is returned if the
+// address is not in the key store.
+func (s *Store) RedeemScript(a btcutil.Address) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-		// Should be added to the internal maps, try lookup again.
-		nextAPKH, ok = s.chainIdxMap[s.highestUsed+1]
-		if !ok {
-			return nil, errors.New("chain index map inproperly updated")
-		}
+	if s.destroyed {
+		return nil, ErrDestroyed
 	}
 
-	// Look up address.
-	addr, ok := s.addrMap[getAddressKey(nextAPKH)]
+	wa, ok := s.addrMap[getAddressKey(a)]
 	if !ok {
-		return nil, errors.New("cannot find generated address")
+		return nil, ErrAddressNotFound
 	}
-
-	btcAddr, ok := addr.(*btcAddress)
+	sa, ok := wa.(*scriptAddress)
 	if !ok {
-		return nil, errors.New("found non-pubkey chained address")
+		return nil, errors.New("address is not a script address")
 	}
-
-	s.highestUsed++
-
-	return btcAddr, nil
+	return append([]byte(nil), sa.script...), nil
 }
 
-// LastChainedAddress returns the most recently requested chained
-// address from calling NextChainedAddress, or the root address if
-// no chained addresses have been requested.
-func (s *Store) LastChainedAddress() btcutil.Address {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-
-	return s.chainIdxMap[s.highestUsed]
-}
+// SetAddressComment sets the comment for an address managed by the key
+// store.  Comments too large to be saved in a single entry are transparently
+// split into a chunked comment entry when the key store is serialized, and
+// comments longer than MaxCommentLen are rejected with ErrCommentTooLong.
+// Comments must be valid UTF-8, or ErrInvalidComment is returned.  An empty
+// comment removes any previously set comment for the address.
+func (s *Store) SetAddressComment(a btcutil.Address, c string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-// extendUnlocked grows address chain for an unlocked keystore.
-func (s *Store) extendUnlocked(bs *BlockStamp) error {
-	// Get last chained address.  New chained addresses will be
-	// chained off of this address's chaincode and private key.
-	a := s.chainIdxMap[s.lastChainIdx]
-	waddr, ok := s.addrMap[getAddressKey(a)]
-	if !ok {
-		return errors.New("expected last chained address not found")
+	if s.destroyed {
+		return ErrDestroyed
 	}
 
-	if s.isLocked() {
-		return ErrLocked
+	key := getAddressKey(a)
+	if _, ok := s.addrMap[key]; !ok {
+		return ErrAddressNotFound
+	}
+	if err := checkComment(c, maxChunkedCommentLen); err != nil {
+		return err
 	}
 
-	lastAddr, ok := waddr.(*btcAddress)
-	if !ok {
-		return errors.New("found non-pubkey chained address")
+	s.dirty = true
+	if c == "" {
+		delete(s.addrCommentMap, key)
+		return nil
 	}
+	s.addrCommentMap[key] = comment(c)
+	return nil
+}
 
-	privkey, err := lastAddr.unlock(s.secret)
-	if err != nil {
-		return err
+// AppendAddressComment appends note to the comment for an address managed by
+// the key store, separated from any existing comment by a newline.  If the
+// combined comment would be longer than MaxCommentLen, ErrCommentTooLong is
+// returned and the existing comment is unchanged.
+func (s *Store) AppendAddressComment(a btcutil.Address, note string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
 	}
-	cc := lastAddr.chaincode[:]
 
-	privkey, err = chainedPrivKey(privkey, lastAddr.pubKeyBytes(), cc)
-	if err != nil {
-		return err
+	key := getAddressKey(a)
+	if _, ok := s.addrMap[key]; !ok {
+		return ErrAddressNotFound
 	}
-	newAddr, err := newBtcAddress(s, privkey, nil, bs, true)
-	if err != nil {
-		return err
+
+	c := note
+	if prev, ok := s.addrCommentMap[key]; ok {
+		c = prev.String() + "\n" + note
 	}
-	if err := newAddr.verifyKeypairs(); err != nil {
+	if err := checkComment(c, maxChunkedCommentLen); err != nil {
 		return err
 	}
-	if err = newAddr.encrypt(s.secret); err != nil {
-		return err
+	if c == "" {
+		return nil
 	}
-	a = newAddr.Address()
-	s.addrMap[getAddressKey(a)] = newAddr
-	newAddr.chainIndex = lastAddr.chainIndex + 1
-	s.chainIdxMap[newAddr.chainIndex] = a
-	s.lastChainIdx++
-	copy(newAddr.chaincode[:], cc)
-
+	s.addrCommentMap[key] = comment(c)
+	s.dirty = true
 	return nil
 }
 
-// extendLocked creates one new address without a private key (allowing for
-// extending the address chain from a locked key store) chained from the
-// last used chained address and adds the address to the key store's internal
-// bookkeeping structures.
-func (s *Store) extendLocked(bs *BlockStamp) error {
-	a := s.chainIdxMap[s.lastChainIdx]
-	waddr, ok := s.addrMap[getAddressKey(a)]
-	if !ok {
-		return errors.New("expected last chained address not found")
-	}
-
-	addr, ok := waddr.(*btcAddress)
-	if !ok {
-		return errors.New("found non-pubkey chained address")
-	}
-
-	cc := addr.chaincode[:]
+// AddressComment returns the comment for an address managed by the key
+// store, or an empty string if no comment has been set.
+func (s *Store) AddressComment(a btcutil.Address) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	nextPubkey, err := chainedPubKey(addr.pubKeyBytes(), cc)
-	if err != nil {
-		return err
-	}
-	newaddr, err := newBtcAddressWithoutPrivkey(s, nextPubkey, nil, bs)
-	if err != nil {
-		return err
+	if s.destroyed {
+		return "", ErrDestroyed
 	}
-	a = newaddr.Address()
-	s.addrMap[getAddressKey(a)] = newaddr
-	newaddr.chainIndex = addr.chainIndex + 1
-	s.chainIdxMap[newaddr.chainIndex] = a
-	s.lastChainIdx++
-	copy(newaddr.chaincode[:], cc)
 
-	if s.missingKeysStart == rootKeyChainIdx {
-		s.missingKeysStart = newaddr.chainIndex
+	key := getAddressKey(a)
+	if _, ok := s.addrMap[key]; !ok {
+		return "", ErrAddressNotFound
 	}
+	return s.addrCommentMap[key].String(), nil
+}
 
-	return nil
+// AddressMetadata describes a key store address and its comment.
+type AddressMetadata struct {
+	Comment    string
+	Compressed bool
+	Imported   bool
+	Change     bool
+	FirstBlock int32
 }
 
-func (s *Store) createMissingPrivateKeys() error {
-	idx := s.missingKeysStart
-	if idx == rootKeyChainIdx {
-		return nil
-	}
+// AddressMetadata returns the metadata of every key store address, including
+// unused addresses in the keypool, keyed by the encoded address.
+func (s *Store) AddressMetadata() map[string]AddressMetadata {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	// Lookup previous address.
-	apkh, ok := s.chainIdxMap[idx-1]
-	if !ok {
-		return errors.New("missing previous chained address")
-	}
-	prevWAddr := s.addrMap[getAddressKey(apkh)]
-	if s.isLocked() {
-		return ErrLocked
+	m := make(map[string]AddressMetadata, len(s.addrMap))
+	for key, wa := range s.addrMap {
+		m[wa.Address().EncodeAddress()] = AddressMetadata{
+			Comment:    s.addrCommentMap[key].String(),
+			Compressed: wa.Compressed(),
+			Imported:   wa.Imported(),
+			Change:     wa.Change(),
+			FirstBlock: wa.FirstBlock(),
+		}
 	}
+	return m
+}
 
-	prevAddr, ok := prevWAddr.(*btcAddress)
-	if !ok {
-		return errors.New("found non-pubkey chained address")
-	}
+// DebugDump writes a snapshot of the key store's state to w, suitable for
+// including in a bug report.  This includes the file version, network,
+// flags, sync state, and counts of addresses and comments, and the chain
+// index, flags, and sync status of each address.  No private keys, encrypted
+// or not, nor the key store secret, passphrase, or KDF salt are written, and
+// addresses and comments are omitted for privacy.
+func (s *Store) DebugDump(w io.Writer) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	prevPrivKey, err := prevAddr.unlock(s.secret)
-	if err != nil {
-		return err
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	var buf bytes.Buffer
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format+"\n", args...)
+	}
+
+	p("version: %v", s.vers)
+	p("network: %v", s.netParams().Name)
+	p("flags: %s", flagNames(map[string]bool{
+		"encrypted":        s.flags.useEncryption,
+		"watching-only":    s.flags.watchingOnly,
+		"per-address-keys": s.flags.perAddressKeys,
+		"file-mac":         s.flags.fileMAC,
+		"gcm":              s.flags.gcm,
+	}))
+	p("created: %s", time.Unix(s.createDate, 0).UTC().Format(time.RFC3339))
+	p("locked: %v", s.isLocked())
+	p("kdf: mem=%d iterations=%d fingerprint=%x", s.kdfParams.mem,
+		s.kdfParams.nIter, s.kdfParams.fingerprint())
+	p("highest used index: %d", s.highestUsed)
+	p("last chain index: %d", s.lastChainIdx)
+	p("missing keys start: %d", s.missingKeysStart)
+	p("imported addresses: %d", len(s.importedAddrs))
+	p("address comments: %d", len(s.addrCommentMap))
+	p("tx comments: %d (%d encrypted)", len(s.txCommentMap),
+		len(s.encryptedTxComments))
+	p("label: %v", len(s.label) != 0)
+	p("last block height: %d", s.recent.lastHeight)
+	p("recent blocks: %d", len(s.recent.hashes))
+	if n := len(s.recent.hashes); n != 0 {
+		p("last block hash: %v", s.recent.hashes[n-1])
+	}
+	if s.lastSync == 0 {
+		p("last sync: never")
+	} else {
+		p("last sync: %s",
+			time.Unix(int64(s.lastSync), 0).UTC().Format(time.RFC3339))
 	}
 
-	for i := idx; ; i++ {
-		// Get the next private key for the ith address in the address chain.
-		ithPrivKey, err := chainedPrivKey(prevPrivKey,
-			prevAddr.pubKeyBytes(), prevAddr.chaincode[:])
-		if err != nil {
-			return err
-		}
+	wAddrs := s.allAddresses()
 
-		// Get the address with the missing private key, set, and
-		// encrypt.
-		apkh, ok := s.chainIdxMap[i]
-		if !ok {
-			// Finished.
-			break
-		}
-		waddr := s.addrMap[getAddressKey(apkh)]
-		addr, ok := waddr.(*btcAddress)
-		if !ok {
-			return errors.New("found non-pubkey chained address")
+	p("addresses: %d", len(wAddrs))
+	for _, wa := range wAddrs {
+		switch a := wa.(type) {
+		case *btcAddress:
+			p("  pubkey index=%d flags=%s first-block=%d sync=%s",
+				a.chainIndex, flagNames(map[string]bool{
+					"has-privkey":     a.flags.hasPrivKey,
+					"has-pubkey":      a.flags.hasPubKey,
+					"encrypted":       a.flags.encrypted,
+					"create-privkey":  a.flags.createPrivKeyNextUnlock,
+					"compressed":      a.flags.compressed,
+					"change":          a.flags.change,
+					"per-address-key": a.flags.perAddressKey,
+					"gcm":             a.flags.gcm,
+				}), a.firstBlock, syncStatusString(a.SyncStatus()))
+		case *scriptAddress:
+			p("  script index=%d flags=%s first-block=%d sync=%s",
+				importedKeyChainIdx, flagNames(map[string]bool{
+					"has-script": a.flags.hasScript,
+					"change":     a.flags.change,
+				}), a.firstBlock, syncStatusString(a.SyncStatus()))
 		}
-		addr.privKeyCT = ithPrivKey
-		if err := addr.encrypt(s.secret); err != nil {
-			// Avoid bug: see comment for VersUnsetNeedsPrivkeyFlag.
-			if err != ErrAlreadyEncrypted || s.vers.LT(VersUnsetNeedsPrivkeyFlag) {
-				return err
-			}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// flagNames returns the sorted, comma separated names of the set flags, or
+// "none" if no flags are set.
+func flagNames(flags map[string]bool) string {
+	var names []string
+	for name, set := range flags {
+		if set {
+			names = append(names, name)
 		}
-		addr.flags.createPrivKeyNextUnlock = false
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
 
-		// Set previous address and private key for next iteration.
-		prevAddr = addr
-		prevPrivKey = ithPrivKey
+// syncStatusString returns a short description of a sync status.
+func syncStatusString(ss SyncStatus) string {
+	switch ss := ss.(type) {
+	case Unsynced:
+		return fmt.Sprintf("unsynced:%d", int32(ss))
+	case PartialSync:
+		return fmt.Sprintf("partial:%d", int32(ss))
+	case FullSync:
+		return "full"
+	default:
+		return "unknown"
 	}
+}
 
-	s.missingKeysStart = rootKeyChainIdx
-	return nil
+// MaxCommentBytes returns the maximum length in bytes of address and
+// transaction comments which may be set on the key store.  This is the
+// lesser of MaxCommentLen and the limit of the file format.
+func (s *Store) MaxCommentBytes() int {
+	if MaxCommentLen < maxChunkedCommentLen {
+		return MaxCommentLen
+	}
+	return maxChunkedCommentLen
 }
 
-// Address returns an walletAddress structure for an address in a key store.
-// This address may be typecast into other interfaces (like PubKeyAddress
-// and ScriptAddress) if specific information e.g. keys is required.
-func (s *Store) Address(a btcutil.Address) (WalletAddress, error) {
+// AddressCommentBytesLeft returns the number of bytes which may be appended
+// to the comment of an address with AppendAddressComment.  If the address
+// already has a comment, this accounts for the newline separating the
+// existing comment and the appended note.
+func (s *Store) AddressCommentBytesLeft(a btcutil.Address) (int, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	// Look up address by address hash.
-	btcaddr, ok := s.addrMap[getAddressKey(a)]
-	if !ok {
-		return nil, ErrAddressNotFound
+	if s.destroyed {
+		return 0, ErrDestroyed
 	}
 
-	return btcaddr, nil
+	key := getAddressKey(a)
+	if _, ok := s.addrMap[key]; !ok {
+		return 0, ErrAddressNotFound
+	}
+
+	left := s.MaxCommentBytes()
+	if prev, ok := s.addrCommentMap[key]; ok {
+		left -= len(prev.String()) + 1
+	}
+	if left < 0 {
+		left = 0
+	}
+	return left, nil
 }
 
-// Net returns the bitcoin network parameters for this key store.
-func (s *Store) Net() *btcnet.Params {
+// HasAddressComment returns whether a comment has been set for an address.
+func (s *Store) HasAddressComment(a btcutil.Address) bool {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	return s.netParams()
-}
-
-func (s *Store) netParams() *btcnet.Params {
-	return (*btcnet.Params)(s.net)
+	_, ok := s.addrCommentMap[getAddressKey(a)]
+	return ok
 }
 
-// SetSyncStatus sets the sync status for a single key store address.  This
-// may error if the address is not found in the key store.
-//
-// When marking an address as unsynced, only the type Unsynced matters.
-// The value is ignored.
-func (s *Store) SetSyncStatus(a btcutil.Address, ss SyncStatus) error {
+// SetTxComment sets the comment for a transaction.  Comments too large to
+// be saved in a single entry are transparently split into a chunked comment
+// entry when the key store is serialized, and comments longer than
+// MaxCommentLen are rejected with ErrCommentTooLong.  Comments must be valid
+// UTF-8, or ErrInvalidComment is returned.  An empty comment removes any
+// previously set comment for the transaction.
+func (s *Store) SetTxComment(txSha *btcwire.ShaHash, c string) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	wa, ok := s.addrMap[getAddressKey(a)]
-	if !ok {
-		return ErrAddressNotFound
+	if s.destroyed {
+		return ErrDestroyed
 	}
-	wa.setSyncStatus(ss)
+
+	if err := checkComment(c, maxChunkedCommentLen); err != nil {
+		return err
+	}
+
+	key := transactionHashKey(txSha[:])
+	delete(s.encryptedTxComments, key)
+	s.dirty = true
+	if c == "" {
+		delete(s.txCommentMap, key)
+		return nil
+	}
+	s.txCommentMap[key] = comment(c)
 	return nil
 }
 
-// SetSyncedWith marks already synced addresses in the key store to be in
-// sync with the recently-seen block described by the blockstamp.
-// Unsynced addresses are unaffected by this method and must be marked
-// as in sync with MarkAddressSynced or MarkAllSynced to be considered
-// in sync with bs.
-//
-// If bs is nil, the entire key store is marked unsynced.
-func (s *Store) SetSyncedWith(bs *BlockStamp) {
+// EncryptedCommentPlaceholder is returned by TxComment in place of an
+// encrypted comment which can not be decrypted, such as when the key store
+// is locked.
+const EncryptedCommentPlaceholder = "(encrypted comment)"
+
+// SetEncryptedTxComment sets the comment for a transaction as
+// SetTxComment does, but saves the comment encrypted with a key derived
+// from the root private key of the key store, so it is not readable from
+// the key store file alone.  The key store must be unlocked.  Since the
+// encryption key does not depend on the passphrase, encrypted comments
+// remain readable after the passphrase is changed, but they can not be read
+// by watching-only key stores.  Encrypted comments are saved in a single
+// entry, so they may not be longer than MaxEncryptedCommentLen.  An empty
+// comment removes any previously set comment for the transaction.
+func (s *Store) SetEncryptedTxComment(txSha *btcwire.ShaHash, c string) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	if bs == nil {
-		s.recent.hashes = s.recent.hashes[:0]
-		s.recent.lastHeight = s.keyGenerator.firstBlock
-		s.keyGenerator.setSyncStatus(Unsynced(s.keyGenerator.firstBlock))
-		return
+	if s.destroyed {
+		return ErrDestroyed
 	}
 
-	// Check if we're trying to rollback the last seen history.
-	// If so, and this bs is already saved, remove anything
-	// after and return.  Otherwire, remove previous hashes.
-	if bs.Height < s.recent.lastHeight {
-		maybeIdx := len(s.recent.hashes) - 1 - int(s.recent.lastHeight-bs.Height)
-		if maybeIdx >= 0 && maybeIdx < len(s.recent.hashes) &&
-			*s.recent.hashes[maybeIdx] == *bs.Hash {
+	if err := checkComment(c, MaxEncryptedCommentLen); err != nil {
+		return err
+	}
 
-			s.recent.lastHeight = bs.Height
-			// subslice out the removed hashes.
-			s.recent.hashes = s.recent.hashes[:maybeIdx]
-			return
-		}
-		s.recent.hashes = nil
+	key := transactionHashKey(txSha[:])
+	if c == "" {
+		delete(s.txCommentMap, key)
+		delete(s.encryptedTxComments, key)
+		s.dirty = true
+		return nil
 	}
 
-	if bs.Height != s.recent.lastHeight+1 {
-		s.recent.hashes = nil
+	commentKey, err := s.commentKey()
+	if err != nil {
+		return err
 	}
+	defer zero(commentKey)
+	sealed, err := sealComment(commentKey, txSha[:], []byte(c))
+	if err != nil {
+		return err
+	}
+	s.txCommentMap[key] = sealed
+	s.encryptedTxComments[key] = true
+	s.dirty = true
+	return nil
+}
 
-	s.recent.lastHeight = bs.Height
+// TxCommentError describes a transaction comment which could not be set.
+type TxCommentError struct {
+	Hash btcwire.ShaHash
+	Err  error
+}
 
-	if len(s.recent.hashes) == 20 {
-		// Make room for the most recent hash.
-		copy(s.recent.hashes, s.recent.hashes[1:])
+// Error implements the error interface.
+func (e *TxCommentError) Error() string {
+	return fmt.Sprintf("comment for transaction %v: %v", &e.Hash, e.Err)
+}
 
-		// Set new block in the last position.
-		s.recent.hashes[19] = bs.Hash
-	} else {
-		s.recent.hashes = append(s.recent.hashes, bs.Hash)
+// SetTxComments sets the comments for many transactions at once.  Every
+// comment is checked before any are set, and if any comment is longer than
+// MaxCommentLen, a *TxCommentError with the hash of an offending transaction
+// and an Err of ErrCommentTooLong is returned and no comments are changed.
+// As with SetTxComment, an empty comment removes any previously set comment
+// for the transaction.
+func (s *Store) SetTxComments(comments map[btcwire.ShaHash]string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	for txSha, c := range comments {
+		if err := checkComment(c, maxChunkedCommentLen); err != nil {
+			return &TxCommentError{Hash: txSha, Err: err}
+		}
+	}
+
+	if len(comments) != 0 {
+		s.dirty = true
+	}
+	for txSha, c := range comments {
+		key := transactionHashKey(txSha[:])
+		delete(s.encryptedTxComments, key)
+		if c == "" {
+			delete(s.txCommentMap, key)
+			continue
+		}
+		s.txCommentMap[key] = comment(c)
 	}
+	return nil
 }
 
-// SyncHeight returns details about the block that a wallet is marked at least
-// synced through.  The height is the height that rescans should start at when
-// syncing a wallet back to the best chain.
-//
-// NOTE: If the hash of the synced block is not known, hash will be nil, and
-// must be obtained from elsewhere.   This must be explicitly checked before
-// dereferencing the pointer.
-func (s *Store) SyncedTo() (hash *btcwire.ShaHash, height int32) {
+// TxComment returns the comment for a transaction, or an empty string if no
+// comment has been set.  Encrypted comments are decrypted if the key store is
+// unlocked, and EncryptedCommentPlaceholder is returned otherwise.
+func (s *Store) TxComment(txSha *btcwire.ShaHash) string {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	switch h, ok := s.keyGenerator.SyncStatus().(PartialSync); {
-	case ok && int32(h) > s.recent.lastHeight:
-		height = int32(h)
-	default:
-		height = s.recent.lastHeight
-		if n := len(s.recent.hashes); n != 0 {
-			hash = s.recent.hashes[n-1]
-		}
+	key := transactionHashKey(txSha[:])
+	c := s.txCommentMap[key]
+	if !s.encryptedTxComments[key] {
+		return c.String()
 	}
-	for _, a := range s.addrMap {
-		var syncHeight int32
-		switch e := a.SyncStatus().(type) {
-		case Unsynced:
-			syncHeight = int32(e)
-		case PartialSync:
-			syncHeight = int32(e)
-		case FullSync:
-			continue
-		}
-		if syncHeight < height {
-			height = syncHeight
-			hash = nil
 
-			// Can't go lower than 0.
-			if height == 0 {
-				return
-			}
-		}
+	commentKey, err := s.commentKey()
+	if err != nil {
+		return EncryptedCommentPlaceholder
 	}
-	return
+	defer zero(commentKey)
+	plaintext, err := openComment(commentKey, txSha[:], c)
+	if err != nil {
+		return EncryptedCommentPlaceholder
+	}
+	return comment(plaintext).String()
 }
 
-// NewIterateRecentBlocks returns an iterator for recently-seen blocks.
-// The iterator starts at the most recently-added block, and Prev should
-// be used to access earlier blocks.
-func (s *Store) NewIterateRecentBlocks() *BlockIterator {
+// IsTxCommentEncrypted returns whether the comment for a transaction is
+// encrypted.
+func (s *Store) IsTxCommentEncrypted(txSha *btcwire.ShaHash) bool {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	return s.recent.iter(s)
+	return s.encryptedTxComments[transactionHashKey(txSha[:])]
 }
 
-// ImportPrivateKey imports a WIF private key into the keystore.  The imported
-// address is created using either a compressed or uncompressed serialized
-// public key, depending on the CompressPubKey bool of the WIF.
-func (s *Store) ImportPrivateKey(wif *btcutil.WIF, bs *BlockStamp) (btcutil.Address, error) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+// HasTxComment returns whether a comment has been set for a transaction.
+func (s *Store) HasTxComment(txSha *btcwire.ShaHash) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	if s.flags.watchingOnly {
-		return nil, ErrWatchingOnly
-	}
+	_, ok := s.txCommentMap[transactionHashKey(txSha[:])]
+	return ok
+}
 
-	// First, must check that the key being imported will not result
-	// in a duplicate address.
-	pkh := btcutil.Hash160(wif.SerializePubKey())
-	if _, ok := s.addrMap[addressKey(pkh)]; ok {
-		return nil, ErrDuplicate
+// CommentedTxHashes returns the hashes of all transactions with a comment,
+// sorted by the bytes of each hash.
+func (s *Store) CommentedTxHashes() []btcwire.ShaHash {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	keys := make([]string, 0, len(s.txCommentMap))
+	for k := range s.txCommentMap {
+		keys = append(keys, string(k))
 	}
+	sort.Strings(keys)
 
-	// The key store must be unlocked to encrypt the imported private key.
-	if s.isLocked() {
-		return nil, ErrLocked
+	hashes := make([]btcwire.ShaHash, len(keys))
+	for i, k := range keys {
+		copy(hashes[i][:], k)
 	}
+	return hashes
+}
 
-	// Create new address with this private key.
-	privKey := wif.PrivKey.Serialize()
-	btcaddr, err := newBtcAddress(s, privKey, nil, bs, wif.CompressPubKey)
-	if err != nil {
-		return nil, err
+// TxCommentMatch is a transaction comment found by SearchTxComments.
+type TxCommentMatch struct {
+	TxHash  btcwire.ShaHash
+	Comment string
+}
+
+// SearchTxComments returns every transaction comment containing substring,
+// ignoring case, sorted by the bytes of each transaction hash.  Encrypted
+// comments are only searched if the key store is unlocked.
+func (s *Store) SearchTxComments(substring string) []TxCommentMatch {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	commentKey, err := s.commentKey()
+	if err == nil {
+		defer zero(commentKey)
 	}
-	btcaddr.chainIndex = importedKeyChainIdx
 
-	// Mark as unsynced if import height is below currently-synced
-	// height.
-	if len(s.recent.hashes) != 0 && bs.Height < s.recent.lastHeight {
-		btcaddr.flags.unsynced = true
+	substring = strings.ToLower(substring)
+	var matches []TxCommentMatch
+	for key, c := range s.txCommentMap {
+		text := c.String()
+		if s.encryptedTxComments[key] {
+			if commentKey == nil {
+				continue
+			}
+			plaintext, err := openComment(commentKey, []byte(key), c)
+			if err != nil {
+				continue
+			}
+			text = comment(plaintext).String()
+		}
+		if !strings.Contains(strings.ToLower(text), substring) {
+			continue
+		}
+
+		m := TxCommentMatch{Comment: text}
+		copy(m.TxHash[:], key)
+		matches = append(matches, m)
 	}
+	sort.Sort(txCommentMatches(matches))
+	return matches
+}
 
-	// Encrypt imported address with the derived AES key.
-	if err = btcaddr.encrypt(s.secret); err != nil {
-		return nil, err
+// txCommentMatches implements sort.Interface to sort matches by the bytes of
+// each transaction hash.
+type txCommentMatches []TxCommentMatch
+
+func (m txCommentMatches) Len() int      { return len(m) }
+func (m txCommentMatches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m txCommentMatches) Less(i, j int) bool {
+	return bytes.Compare(m[i].TxHash[:], m[j].TxHash[:]) < 0
+}
+
+// AddressCommentMatch is an address comment found by SearchAddressComments.
+type AddressCommentMatch struct {
+	Address btcutil.Address
+	Comment string
+}
+
+// SearchAddressComments returns every address comment containing substring,
+// ignoring case.  Matches are ordered by chain index, followed by imported
+// addresses in import order.
+func (s *Store) SearchAddressComments(substring string) []AddressCommentMatch {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	wAddrs := s.allAddresses()
+
+	substring = strings.ToLower(substring)
+	var matches []AddressCommentMatch
+	for _, wa := range wAddrs {
+		c, ok := s.addrCommentMap[getAddressKey(wa.Address())]
+		if !ok {
+			continue
+		}
+		text := c.String()
+		if strings.Contains(strings.ToLower(text), substring) {
+			matches = append(matches, AddressCommentMatch{
+				Address: wa.Address(),
+				Comment: text,
+			})
+		}
 	}
+	return matches
+}
 
-	addr := btcaddr.Address()
-	// Add address to key store's bookkeeping structures.  Adding to
-	// the map will result in the imported address being serialized
-	// on the next WriteTo call.
-	s.addrMap[getAddressKey(addr)] = btcaddr
-	s.importedAddrs = append(s.importedAddrs, btcaddr)
+// Description returns the key store description.  The description is stored
+// padded with NUL bytes, which are removed.  A description filling the entire
+// 256 bytes is returned whole.
+func (s *Store) Description() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	// Create and return address.
-	return addr, nil
+	desc := s.desc[:]
+	if i := bytes.IndexByte(desc, 0); i != -1 {
+		desc = desc[:i]
+	}
+	return string(desc)
 }
 
-// ImportScript creates a new scriptAddress with a user-provided script
-// and adds it to the key store.
-func (s *Store) ImportScript(script []byte, bs *BlockStamp) (btcutil.Address, error) {
+// SetLabel sets a display label for the key store.  Unlike the name, which
+// identifies the account, the label is only intended to be shown to users
+// and may hold arbitrary text.  An empty label removes the label.
+func (s *Store) SetLabel(label string) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	if s.flags.watchingOnly {
-		return nil, ErrWatchingOnly
+	if s.destroyed {
+		return ErrDestroyed
 	}
 
-	if _, ok := s.addrMap[addressKey(btcutil.Hash160(script))]; ok {
-		return nil, ErrDuplicate
+	if err := checkComment(label, maxCommentLen); err != nil {
+		return err
 	}
+	s.label = comment(label)
+	s.dirty = true
+	return nil
+}
 
-	// Create new address with this private key.
-	scriptaddr, err := newScriptAddress(s, script, bs)
-	if err != nil {
-		return nil, err
+// Label returns the display label of the key store, or an empty string if
+// no label has been set.
+func (s *Store) Label() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.label.String()
+}
+
+// SetAppTag sets an opaque application-defined tag for the key store, which
+// may be used to distinguish key store files without parsing the name or
+// description.  The tag is at most 16 bytes, or ErrAppTagTooLong is returned.
+// An empty tag removes the tag.
+func (s *Store) SetAppTag(tag []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
 	}
 
-	// Mark as unsynced if import height is below currently-synced
-	// height.
-	if len(s.recent.hashes) != 0 && bs.Height < s.recent.lastHeight {
-		scriptaddr.flags.unsynced = true
+	if len(tag) > len(s.appTag) {
+		return ErrAppTagTooLong
 	}
+	s.appTag = appTag{}
+	copy(s.appTag[:], tag)
+	s.dirty = true
+	return nil
+}
 
-	// Add address to key store's bookkeeping structures.  Adding to
-	// the map will result in the imported address being serialized
-	// on the next WriteTo call.
-	addr := scriptaddr.Address()
-	s.addrMap[getAddressKey(addr)] = scriptaddr
-	s.importedAddrs = append(s.importedAddrs, scriptaddr)
+// AppTag returns a copy of the application-defined tag of the key store.
+// The tag is stored padded with NUL bytes, so any trailing NUL bytes of the
+// tag that was set are removed.  If no tag has been set, the returned tag is
+// empty.
+func (s *Store) AppTag() []byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 
-	// Create and return address.
-	return addr, nil
+	tag := bytes.TrimRight(s.appTag[:], "\x00")
+	return append([]byte(nil), tag...)
 }
 
 // CreateDate returns the Unix time of the key store creation time.  This
@@ -1501,6 +5845,26 @@ func (s *Store) CreateDate() int64 {
 	return s.createDate
 }
 
+// SetCreateDate sets the Unix time of the key store creation time.  This
+// allows a key store restored from a backup to use its original creation
+// time, rather than the time of the restore, when determining where rescans
+// should begin.  Times in the future are rejected.
+func (s *Store) SetCreateDate(unix int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	if unix > time.Now().Unix() {
+		return errors.New("creation date is in the future")
+	}
+	s.createDate = unix
+	s.dirty = true
+	return nil
+}
+
 // ExportWatchingWallet creates and returns a new key store with the same
 // addresses in w, but as a watching-only key store without any private keys.
 // New addresses created by the watching key store will match the new addresses
@@ -1510,6 +5874,10 @@ func (s *Store) ExportWatchingWallet() (*Store, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
 	// Don't continue if key store is already watching-only.
 	if s.flags.watchingOnly {
 		return nil, ErrWatchingOnly
@@ -1531,8 +5899,16 @@ func (s *Store) ExportWatchingWallet() (*Store, error) {
 		recent: recentBlocks{
 			lastHeight: s.recent.lastHeight,
 		},
+		lastSync: s.lastSync,
+		appTag:   s.appTag,
+		reserved: s.reserved,
+		dirty:    true,
+
+		addrMap:        make(map[addressKey]walletAddress),
+		addrCommentMap: make(map[addressKey]comment),
+		txCommentMap:   make(map[transactionHashKey]comment),
 
-		addrMap: make(map[addressKey]walletAddress),
+		encryptedTxComments: make(map[transactionHashKey]bool),
 
 		// todo oga make me a list
 		chainIdxMap:  make(map[int64]btcutil.Address),
@@ -1566,10 +5942,77 @@ func (s *Store) ExportWatchingWallet() (*Store, error) {
 			ws.importedAddrs = append(ws.importedAddrs, addr.watchingCopy(ws))
 		}
 	}
+	for key, c := range s.addrCommentMap {
+		ws.addrCommentMap[key] = append(comment(nil), c...)
+	}
+	for key, c := range s.txCommentMap {
+		ws.txCommentMap[key] = append(comment(nil), c...)
+	}
+	for key, encrypted := range s.encryptedTxComments {
+		ws.encryptedTxComments[key] = encrypted
+	}
+	if len(s.label) != 0 {
+		ws.label = append(comment(nil), s.label...)
+	}
 
 	return ws, nil
 }
 
+// StripPrivateKeys converts the key store to a watching-only key store in
+// place, removing every private key and the key store's encryption key.
+// This can not be undone, so the private keys must first be backed up
+// elsewhere, and confirm must be true to acknowledge this.  Any file MAC is
+// removed, as it can no longer be verified without the passphrase.
+func (s *Store) StripPrivateKeys(confirm bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+	if !confirm {
+		return errors.New("stripping private keys must be confirmed")
+	}
+	if s.flags.watchingOnly {
+		return ErrWatchingOnly
+	}
+
+	for _, wa := range s.addrMap {
+		a, ok := wa.(*btcAddress)
+		if !ok {
+			continue
+		}
+		zero(a.privKey[:])
+		zero(a.initVector[:])
+		zero(a.gcmTag[:])
+		zero(a.privKeyCT)
+		a.privKeyCT = nil
+		a.flags.hasPrivKey = false
+		a.flags.encrypted = false
+		a.flags.createPrivKeyNextUnlock = false
+		a.flags.perAddressKey = false
+		a.flags.gcm = false
+	}
+	s.missingKeysStart = rootKeyChainIdx
+
+	zero(s.passphrase)
+	s.passphrase = nil
+	zero(s.secret)
+	s.secret = nil
+	zero(s.macKey)
+	s.macKey = nil
+	s.fileMAC = nil
+	s.fileBodyHash = nil
+	s.kdfParams = kdfParameters{}
+	s.flags = walletFlags{
+		useEncryption: false,
+		watchingOnly:  true,
+	}
+	s.dirty = true
+	log.Infof("Removed all private keys from key store")
+	return nil
+}
+
 // SyncStatus is the interface type for all sync variants.
 type SyncStatus interface {
 	ImplementsSyncStatus()
@@ -1630,19 +6073,109 @@ func (s *Store) SortedActiveAddresses() []WalletAddress {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
+	return s.sortedActiveAddresses()
+}
+
+func (s *Store) sortedActiveAddresses() []WalletAddress {
 	addrs := make([]WalletAddress, 0,
 		s.highestUsed+int64(len(s.importedAddrs))+1)
+	_ = s.forEachActiveAddress(func(wa WalletAddress) error {
+		addrs = append(addrs, wa)
+		return nil
+	})
+	return addrs
+}
+
+// FindReused returns the key store addresses which have received funds more
+// than once, given the number of payments received by each address.
+// Addresses in counts which are not managed by the key store are ignored.
+// The returned addresses are ordered by chain index, followed by imported
+// addresses in import order.
+func (s *Store) FindReused(counts map[btcutil.Address]int) []btcutil.Address {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	// Different btcutil.Address values may encode the same address, so
+	// total the counts by address key.
+	totals := make(map[addressKey]int, len(counts))
+	for a, n := range counts {
+		key := getAddressKey(a)
+		if _, ok := s.addrMap[key]; ok {
+			totals[key] += n
+		}
+	}
+
+	var reused []btcutil.Address
+	check := func(a btcutil.Address) {
+		if totals[getAddressKey(a)] > 1 {
+			reused = append(reused, a)
+		}
+	}
+	for idx := int64(rootKeyChainIdx); idx <= s.lastChainIdx; idx++ {
+		if a, ok := s.chainIdxMap[idx]; ok {
+			check(a)
+		}
+	}
+	for _, wa := range s.importedAddrs {
+		check(wa.Address())
+	}
+	return reused
+}
+
+// ForEachActiveAddress calls fn for each key store address that has been
+// requested to be generated, in the same order as SortedActiveAddresses,
+// without creating a slice of all addresses.  If fn returns an error,
+// iteration stops and the error is returned.  The key store is read locked
+// while iterating, so fn must not call key store methods which modify the
+// key store.
+func (s *Store) ForEachActiveAddress(fn func(WalletAddress) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	return s.forEachActiveAddress(fn)
+}
+
+// allAddresses returns every address in the key store, ordered by chain
+// index from the root address, followed by imported addresses in import
+// order.  The key store mutex must be held by the caller.
+func (s *Store) allAddresses() []walletAddress {
+	wAddrs := make([]walletAddress, 0, len(s.addrMap))
+	for i := int64(rootKeyChainIdx); i <= s.lastChainIdx; i++ {
+		a, ok := s.chainIdxMap[i]
+		if !ok {
+			continue
+		}
+		if wa, ok := s.addrMap[getAddressKey(a)]; ok {
+			wAddrs = append(wAddrs, wa)
+		}
+	}
+	return append(wAddrs, s.importedAddrs...)
+}
+
+func (s *Store) forEachActiveAddress(fn func(WalletAddress) error) error {
 	for i := int64(rootKeyChainIdx); i <= s.highestUsed; i++ {
-		a := s.chainIdxMap[i]
+		a, ok := s.chainIdxMap[i]
+		if !ok {
+			continue
+		}
 		info, ok := s.addrMap[getAddressKey(a)]
-		if ok {
-			addrs = append(addrs, info)
+		if !ok {
+			continue
+		}
+		if err := fn(info); err != nil {
+			return err
 		}
 	}
 	for _, addr := range s.importedAddrs {
-		addrs = append(addrs, addr)
+		if err := fn(addr); err != nil {
+			return err
+		}
 	}
-	return addrs
+	return nil
 }
 
 // ActiveAddresses returns a map between active payment addresses
@@ -1653,15 +6186,65 @@ func (s *Store) ActiveAddresses() map[btcutil.Address]WalletAddress {
 	defer s.mtx.RUnlock()
 
 	addrs := make(map[btcutil.Address]WalletAddress)
-	for i := int64(rootKeyChainIdx); i <= s.highestUsed; i++ {
-		a := s.chainIdxMap[i]
-		addr := s.addrMap[getAddressKey(a)]
-		addrs[addr.Address()] = addr
+	_ = s.forEachActiveAddress(func(wa WalletAddress) error {
+		addrs[wa.Address()] = wa
+		return nil
+	})
+	return addrs
+}
+
+// UTXOSource provides the unspent output amounts for addresses, so balances
+// can be calculated without the key store tracking chain data.
+type UTXOSource interface {
+	// Unspent returns the total amount of all unspent outputs paying to
+	// addr.
+	Unspent(addr btcutil.Address) (btcutil.Amount, error)
+}
+
+// TotalBalance returns the sum of the unspent amounts, as reported by src,
+// of every active address with a private key.  This includes addresses
+// whose private keys will be created on the next unlock.
+func (s *Store) TotalBalance(src UTXOSource) (btcutil.Amount, error) {
+	return s.balance(src, true)
+}
+
+// WatchedBalance returns the sum of the unspent amounts, as reported by
+// src, of every active address without a private key, such as imported
+// scripts and the addresses of a watching-only key store.
+func (s *Store) WatchedBalance(src UTXOSource) (btcutil.Amount, error) {
+	return s.balance(src, false)
+}
+
+// balance sums the unspent amounts of either all spendable or all watched
+// active addresses.  The key store mutex is not held while querying src.
+func (s *Store) balance(src UTXOSource, spendable bool) (btcutil.Amount, error) {
+	s.mtx.RLock()
+	if s.destroyed {
+		s.mtx.RUnlock()
+		return 0, ErrDestroyed
+	}
+	var addrs []btcutil.Address
+	for _, wa := range s.sortedActiveAddresses() {
+		var hasPrivKey bool
+		if a, ok := wa.(*btcAddress); ok {
+			hasPrivKey = a.flags.hasPrivKey ||
+				a.flags.createPrivKeyNextUnlock
+		}
+		if hasPrivKey == spendable {
+			addrs = append(addrs, wa.Address())
+		}
 	}
-	for _, addr := range s.importedAddrs {
-		addrs[addr.Address()] = addr
+	s.mtx.RUnlock()
+
+	var total btcutil.Amount
+	for _, addr := range addrs {
+		amt, err := src.Unspent(addr)
+		if err != nil {
+			return 0, err
+		}
+		total += amt
 	}
-	return addrs
+	return total, nil
 }
 
 // ExtendActiveAddresses gets or creates the next n addresses from the
@@ -1676,6 +6259,10 @@ func (s *Store) ExtendActiveAddresses(n int) ([]btcutil.Address, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
 	last := s.addrMap[getAddressKey(s.chainIdxMap[s.highestUsed])]
 	bs := &BlockStamp{Height: last.FirstBlock()}
 
@@ -1690,9 +6277,102 @@ func (s *Store) ExtendActiveAddresses(n int) ([]btcutil.Address, error) {
 	return addrs, nil
 }
 
+// GenerateGapAddresses ensures that gap chained addresses exist beyond the
+// highest used address, extending the address chain as necessary, and
+// returns those addresses ordered by chain index.  Unlike NextChainedAddress,
+// the returned addresses are not marked as used, as they are only intended
+// to be watched as a look-ahead when scanning for address usage.  An error is
+// returned if gap is more than MaxDeriveAddresses.
+func (s *Store) GenerateGapAddresses(gap uint, bs *BlockStamp) ([]WalletAddress, error) {
+	if gap > MaxDeriveAddresses {
+		return nil, fmt.Errorf("gap exceeds %d addresses",
+			MaxDeriveAddresses)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	if uint64(gap) > uint64(math.MaxInt64-s.highestUsed) {
+		return nil, errors.New("gap addresses overflow chain index")
+	}
+	last := s.highestUsed + int64(gap)
+	if err := s.extendTo(last, bs); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]WalletAddress, 0, gap)
+	for idx := s.highestUsed + 1; idx <= last; idx++ {
+		a, ok := s.chainIdxMap[idx]
+		if !ok {
+			return nil, errors.New("chain index map inproperly updated")
+		}
+		wa, ok := s.addrMap[getAddressKey(a)]
+		if !ok {
+			return nil, errors.New("cannot find generated address")
+		}
+		addrs = append(addrs, wa)
+	}
+	return addrs, nil
+}
+
+// WriteAddressesCSV writes a CSV record for each active address to w,
+// ordered as returned by SortedActiveAddresses.  The first record is a
+// header naming each column: the encoded address, whether the address is
+// compressed, whether the address was imported, the first block the
+// address could be seen in, the time the address was created (formatted
+// using RFC3339), and the address comment.  No private keys are written.
+func (s *Store) WriteAddressesCSV(w io.Writer) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.destroyed {
+		return ErrDestroyed
+	}
+
+	cw := csv.NewWriter(w)
+	header := []string{"address", "compressed", "imported", "first-block",
+		"first-seen", "comment"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, wa := range s.sortedActiveAddresses() {
+		var firstSeen int64
+		switch a := wa.(type) {
+		case *btcAddress:
+			firstSeen = a.firstSeen
+		case *scriptAddress:
+			firstSeen = a.firstSeen
+		}
+
+		addr := wa.Address()
+		record := []string{
+			addr.EncodeAddress(),
+			strconv.FormatBool(wa.Compressed()),
+			strconv.FormatBool(wa.Imported()),
+			strconv.FormatInt(int64(wa.FirstBlock()), 10),
+			time.Unix(firstSeen, 0).UTC().Format(time.RFC3339),
+			s.addrCommentMap[getAddressKey(addr)].String(),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
 type walletFlags struct {
-	useEncryption bool
-	watchingOnly  bool
+	useEncryption  bool
+	watchingOnly   bool
+	perAddressKeys bool
+	fileMAC        bool
+	gcm            bool
 }
 
 func (wf *walletFlags) ReadFrom(r io.Reader) (int64, error) {
@@ -1704,6 +6384,9 @@ func (wf *walletFlags) ReadFrom(r io.Reader) (int64, error) {
 
 	wf.useEncryption = b[0]&(1<<0) != 0
 	wf.watchingOnly = b[0]&(1<<1) != 0
+	wf.perAddressKeys = b[0]&(1<<2) != 0
+	wf.fileMAC = b[0]&(1<<3) != 0
+	wf.gcm = b[0]&(1<<4) != 0
 
 	return int64(n), nil
 }
@@ -1716,6 +6399,15 @@ func (wf *walletFlags) WriteTo(w io.Writer) (int64, error) {
 	if wf.watchingOnly {
 		b[0] |= 1 << 1
 	}
+	if wf.perAddressKeys {
+		b[0] |= 1 << 2
+	}
+	if wf.fileMAC {
+		b[0] |= 1 << 3
+	}
+	if wf.gcm {
+		b[0] |= 1 << 4
+	}
 	n, err := w.Write(b[:])
 	return int64(n), err
 }
@@ -1729,6 +6421,8 @@ type addrFlags struct {
 	change                  bool
 	unsynced                bool
 	partialSync             bool
+	perAddressKey           bool
+	gcm                     bool
 }
 
 func (af *addrFlags) ReadFrom(r io.Reader) (int64, error) {
@@ -1746,6 +6440,8 @@ func (af *addrFlags) ReadFrom(r io.Reader) (int64, error) {
 	af.change = b[0]&(1<<5) != 0
 	af.unsynced = b[0]&(1<<6) != 0
 	af.partialSync = b[0]&(1<<7) != 0
+	af.perAddressKey = b[1]&(1<<0) != 0
+	af.gcm = b[1]&(1<<1) != 0
 
 	// Currently (at least until watching-only key stores are implemented)
 	// btcwallet shall refuse to open any unencrypted addresses.  This
@@ -1789,6 +6485,12 @@ func (af *addrFlags) WriteTo(w io.Writer) (int64, error) {
 	if af.partialSync {
 		b[0] |= 1 << 7
 	}
+	if af.perAddressKey {
+		b[1] |= 1 << 0
+	}
+	if af.gcm {
+		b[1] |= 1 << 1
+	}
 
 	n, err := w.Write(b[:])
 	return int64(n), err
@@ -1799,9 +6501,13 @@ func (af *addrFlags) WriteTo(w io.Writer) (int64, error) {
 type recentBlocks struct {
 	hashes     []*btcwire.ShaHash
 	lastHeight int32
+
+	// If lenient, reading more than 20 block hashes keeps only the most
+	// recent 20 rather than erroring.
+	lenient bool
 }
 
-func (rb *recentBlocks) readFromVersion(v version, r io.Reader) (int64, error) {
+func (rb *recentBlocks) readFromVersion(v FileVersion, r io.Reader) (int64, error) {
 	if !v.LT(Vers20LastBlocks) {
 		// Use current version.
 		return rb.ReadFrom(r)
@@ -1854,7 +6560,7 @@ func (rb *recentBlocks) ReadFrom(r io.Reader) (int64, error) {
 		return read, err
 	}
 	nBlocks := binary.LittleEndian.Uint32(nBlockBytes[:])
-	if nBlocks > 20 {
+	if nBlocks > 20 && !rb.lenient {
 		return read, errors.New("number of last seen blocks exceeds maximum of 20")
 	}
 
@@ -1880,7 +6586,8 @@ func (rb *recentBlocks) ReadFrom(r io.Reader) (int64, error) {
 	// Read nBlocks block hashes.  Hashes are expected to be in
 	// order of oldest to newest, but there's no way to check
 	// that here.
-	rb.hashes = make([]*btcwire.ShaHash, 0, nBlocks)
+	// If lenient, only the most recent 20 are kept.
+	rb.hashes = make([]*btcwire.ShaHash, 0, 20)
 	for i := uint32(0); i < nBlocks; i++ {
 		var blockSha btcwire.ShaHash
 		n, err := io.ReadFull(r, blockSha[:])
@@ -1888,6 +6595,10 @@ func (rb *recentBlocks) ReadFrom(r io.Reader) (int64, error) {
 		if err != nil {
 			return read, err
 		}
+		if len(rb.hashes) == 20 {
+			copy(rb.hashes, rb.hashes[1:])
+			rb.hashes = rb.hashes[:19]
+		}
 		rb.hashes = append(rb.hashes, &blockSha)
 	}
 
@@ -1934,6 +6645,58 @@ func (rb *recentBlocks) WriteTo(w io.Writer) (int64, error) {
 	return written, nil
 }
 
+// syncTime is the Unix time the key store was last known to be synced, or 0
+// if unknown.
+type syncTime int64
+
+func (t *syncTime) readFromVersion(v FileVersion, r io.Reader) (int64, error) {
+	if v.LT(VersLastSync) {
+		// Old file versions did not save a sync time.
+		*t = 0
+		return 0, nil
+	}
+	return binaryRead(r, binary.LittleEndian, t)
+}
+
+func (t *syncTime) WriteTo(w io.Writer) (int64, error) {
+	return binaryWrite(w, binary.LittleEndian, t)
+}
+
+// entriesLength is the total length of the appended entries, excluding any
+// file MAC.
+type entriesLength int64
+
+func (l *entriesLength) readFromVersion(v FileVersion, r io.Reader) (int64, error) {
+	if v.LT(VersEntriesLength) {
+		// Old file versions did not save the entries length.
+		*l = 0
+		return 0, nil
+	}
+	return binaryRead(r, binary.LittleEndian, l)
+}
+
+func (l *entriesLength) WriteTo(w io.Writer) (int64, error) {
+	return binaryWrite(w, binary.LittleEndian, l)
+}
+
+// appTag is an opaque application-defined tag, padded with NUL bytes.
+type appTag [16]byte
+
+func (t *appTag) readFromVersion(v FileVersion, r io.Reader) (int64, error) {
+	if v.LT(VersAppTag) {
+		// Old file versions did not save an application tag.
+		*t = appTag{}
+		return 0, nil
+	}
+	n, err := io.ReadFull(r, t[:])
+	return int64(n), err
+}
+
+func (t *appTag) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(t[:])
+	return int64(n), err
+}
+
 // BlockIterator allows for the forwards and backwards iteration of recently
 // seen blocks.
 type BlockIterator struct {
@@ -1943,6 +6706,22 @@ type BlockIterator struct {
 	rb       *recentBlocks
 }
 
+// push adds bs as the most recently seen block, removing the oldest block if
+// the maximum number of blocks are already saved.
+func (rb *recentBlocks) push(bs *BlockStamp) {
+	rb.lastHeight = bs.Height
+
+	if len(rb.hashes) == 20 {
+		// Make room for the most recent hash.
+		copy(rb.hashes, rb.hashes[1:])
+
+		// Set new block in the last position.
+		rb.hashes[19] = bs.Hash
+	} else {
+		rb.hashes = append(rb.hashes, bs.Hash)
+	}
+}
+
 func (rb *recentBlocks) iter(s *Store) *BlockIterator {
 	if rb.lastHeight == -1 || len(rb.hashes) == 0 {
 		return nil
@@ -2002,7 +6781,7 @@ func newUnusedSpace(nBytes int, rfvs ...readerFromVersion) *unusedSpace {
 	}
 }
 
-func (u *unusedSpace) readFromVersion(v version, r io.Reader) (int64, error) {
+func (u *unusedSpace) readFromVersion(v FileVersion, r io.Reader) (int64, error) {
 	var read int64
 
 	for _, rfv := range u.rfvs {
@@ -2050,6 +6829,7 @@ type walletAddress interface {
 	WalletAddress
 	watchingCopy(*Store) walletAddress
 	setSyncStatus(SyncStatus)
+	setFirstBlock(int32)
 }
 
 type btcAddress struct {
@@ -2065,8 +6845,9 @@ type btcAddress struct {
 	firstSeen         int64
 	lastSeen          int64
 	firstBlock        int32
-	partialSyncHeight int32  // This is reappropriated from armory's `lastBlock` field.
-	privKeyCT         []byte // non-nil if unlocked.
+	partialSyncHeight int32    // This is reappropriated from armory's `lastBlock` field.
+	gcmTag            [16]byte // only serialized if encrypted with AES-GCM.
+	privKeyCT         []byte   // non-nil if unlocked.
 }
 
 const (
@@ -2181,7 +6962,7 @@ func newBtcAddressWithoutPrivkey(s *Store, pubkey, iv []byte, bs *BlockStamp) (a
 	}
 	if len(iv) == 0 {
 		iv = make([]byte, 16)
-		if _, err := rand.Read(iv); err != nil {
+		if _, err := io.ReadFull(Rand, iv); err != nil {
 			return nil, err
 		}
 	} else if len(iv) != 16 {
@@ -2258,7 +7039,7 @@ func (a *btcAddress) verifyKeypairs() error {
 	}
 
 	data := "String to sign."
-	r, s, err := ecdsa.Sign(rand.Reader, privkey, []byte(data))
+	r, s, err := ecdsa.Sign(Rand, privkey, []byte(data))
 	if err != nil {
 		return err
 	}
@@ -2315,6 +7096,13 @@ func (a *btcAddress) ReadFrom(r io.Reader) (n int64, err error) {
 		}
 		n += read
 	}
+	if a.flags.gcm {
+		read, err = binaryRead(r, binary.LittleEndian, &a.gcmTag)
+		if err != nil {
+			return n + read, err
+		}
+		n += read
+	}
 
 	// Verify checksums, correct errors where possible.
 	checks := []struct {
@@ -2377,6 +7165,9 @@ func (a *btcAddress) WriteTo(w io.Writer) (n int64, err error) {
 		&a.firstBlock,
 		&a.partialSyncHeight,
 	}
+	if a.flags.gcm {
+		datas = append(datas, &a.gcmTag)
+	}
 	for _, data := range datas {
 		if wt, ok := data.(io.WriterTo); ok {
 			written, err = wt.WriteTo(w)
@@ -2402,19 +7193,103 @@ func (a *btcAddress) encrypt(key []byte) error {
 		return errors.New("invalid clear text private key")
 	}
 
+	a.flags.perAddressKey = a.store.flags.perAddressKeys
+	a.flags.gcm = a.store.flags.gcm
+	if err := a.sealPrivKey(key, a.privKeyCT); err != nil {
+		return err
+	}
+
+	a.flags.hasPrivKey = true
+	a.flags.encrypted = true
+	return nil
+}
+
+// sealPrivKey encrypts privKeyCT with the address's encryption key derived
+// from key and the current initialization vector, saving the result as the
+// address's encrypted private key.  If the address uses AES-GCM, the first
+// 12 bytes of the initialization vector are used as the nonce, the address
+// hash is authenticated as additional data, and the authentication tag is
+// saved as well.  Otherwise, AES-CFB is used.
+func (a *btcAddress) sealPrivKey(key, privKeyCT []byte) error {
+	key = a.encryptionKey(key)
+	if a.flags.perAddressKey {
+		defer zero(key)
+	}
+
 	aesBlockEncrypter, err := aes.NewCipher(key)
 	if err != nil {
 		return err
 	}
-	aesEncrypter := cipher.NewCFBEncrypter(aesBlockEncrypter, a.initVector[:])
 
-	aesEncrypter.XORKeyStream(a.privKey[:], a.privKeyCT)
+	if !a.flags.gcm {
+		aesEncrypter := cipher.NewCFBEncrypter(aesBlockEncrypter, a.initVector[:])
+		aesEncrypter.XORKeyStream(a.privKey[:], privKeyCT)
+		return nil
+	}
 
-	a.flags.hasPrivKey = true
-	a.flags.encrypted = true
+	aead, err := cipher.NewGCM(aesBlockEncrypter)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, a.initVector[:aead.NonceSize()], privKeyCT,
+		a.address.ScriptAddress())
+	copy(a.privKey[:], sealed)
+	copy(a.gcmTag[:], sealed[len(a.privKey):])
 	return nil
 }
 
+// openPrivKey decrypts and returns the address's clear text private key
+// using the address's encryption key derived from key.  If the address uses
+// AES-GCM and the encrypted key or authenticated data were modified, or key
+// is incorrect, ErrKeyAuthFailed is returned.
+func (a *btcAddress) openPrivKey(key []byte) ([]byte, error) {
+	key = a.encryptionKey(key)
+	if a.flags.perAddressKey {
+		defer zero(key)
+	}
+
+	aesBlockDecrypter, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.flags.gcm {
+		aesDecrypter := cipher.NewCFBDecrypter(aesBlockDecrypter, a.initVector[:])
+		privkey := make([]byte, 32)
+		aesDecrypter.XORKeyStream(privkey, a.privKey[:])
+		return privkey, nil
+	}
+
+	aead, err := cipher.NewGCM(aesBlockDecrypter)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(a.privKey)+len(a.gcmTag))
+	sealed = append(sealed, a.privKey[:]...)
+	sealed = append(sealed, a.gcmTag[:]...)
+	privkey, err := aead.Open(nil, a.initVector[:aead.NonceSize()], sealed,
+		a.address.ScriptAddress())
+	if err != nil {
+		return nil, ErrKeyAuthFailed
+	}
+	return privkey, nil
+}
+
+// encryptionKey returns the AES key used to encrypt and decrypt the
+// address's private key.  If the address uses a per-address key, this is a
+// subkey derived as HMAC-SHA256(key, address hash), so that the leak of a
+// single subkey does not expose every private key in the key store.
+// Otherwise, key is returned unchanged.
+func (a *btcAddress) encryptionKey(key []byte) []byte {
+	if !a.flags.perAddressKey {
+		return key
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(a.address.ScriptAddress())
+	return mac.Sum(nil)
+}
+
 // lock removes the reference this address holds to its clear text
 // private key.  This function fails if the address is not encrypted.
 func (a *btcAddress) lock() error {
@@ -2438,13 +7313,10 @@ func (a *btcAddress) unlock(key []byte) (privKeyCT []byte, err error) {
 	}
 
 	// Decrypt private key with AES key.
-	aesBlockDecrypter, err := aes.NewCipher(key)
+	privkey, err := a.openPrivKey(key)
 	if err != nil {
 		return nil, err
 	}
-	aesDecrypter := cipher.NewCFBDecrypter(aesBlockDecrypter, a.initVector[:])
-	privkey := make([]byte, 32)
-	aesDecrypter.XORKeyStream(privkey, a.privKey[:])
 
 	// If secret is already saved, simply compare the bytes.
 	if len(a.privKeyCT) == 32 {
@@ -2484,19 +7356,17 @@ func (a *btcAddress) changeEncryptionKey(oldkey, newkey []byte) error {
 		return err
 	}
 
-	aesBlockEncrypter, err := aes.NewCipher(newkey)
-	if err != nil {
-		return err
-	}
+	// Re-encrypting also migrates the address to or from per-address
+	// keys and AES-GCM, depending on the key store's settings.
+	a.flags.perAddressKey = a.store.flags.perAddressKeys
+	a.flags.gcm = a.store.flags.gcm
+
 	newIV := make([]byte, len(a.initVector))
-	if _, err := rand.Read(newIV); err != nil {
+	if _, err := io.ReadFull(Rand, newIV); err != nil {
 		return err
 	}
 	copy(a.initVector[:], newIV)
-	aesEncrypter := cipher.NewCFBEncrypter(aesBlockEncrypter, a.initVector[:])
-	aesEncrypter.XORKeyStream(a.privKey[:], privKeyCT)
-
-	return nil
+	return a.sealPrivKey(newkey, privKeyCT)
 }
 
 // Address returns the pub key address, implementing AddressInfo.
@@ -2569,12 +7439,26 @@ func (a *btcAddress) ExportPubKey() string {
 // PrivKey implements PubKeyAddress by returning the private key, or an error
 // if the key store is locked, watching only or the private key is missing.
 func (a *btcAddress) PrivKey() (*ecdsa.PrivateKey, error) {
+	privKeyCT, err := a.privKeyBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PrivateKey{
+		PublicKey: *a.pubKey.ToECDSA(),
+		D:         new(big.Int).SetBytes(privKeyCT),
+	}, nil
+}
+
+// privKeyBytes returns a copy of the clear text 32 byte private key of the
+// address.
+func (a *btcAddress) privKeyBytes() ([]byte, error) {
 	if a.store.flags.watchingOnly {
 		return nil, ErrWatchingOnly
 	}
 
 	if !a.flags.hasPrivKey {
-		return nil, errors.New("no private key for address")
+		return nil, ErrNoPrivKey
 	}
 
 	// Key store must be unlocked to decrypt the private key.
@@ -2585,15 +7469,7 @@ func (a *btcAddress) PrivKey() (*ecdsa.PrivateKey, error) {
 	// Unlock address with key store secret.  unlock returns a copy of
 	// the clear text private key, and may be used safely even
 	// during an address lock.
-	privKeyCT, err := a.unlock(a.store.secret)
-	if err != nil {
-		return nil, err
-	}
-
-	return &ecdsa.PrivateKey{
-		PublicKey: *a.pubKey.ToECDSA(),
-		D:         new(big.Int).SetBytes(privKeyCT),
-	}, nil
+	return a.unlock(a.store.secret)
 }
 
 // ExportPrivKey exports the private key as a WIF for encoding as a string
@@ -2642,6 +7518,12 @@ func (a *btcAddress) watchingCopy(s *Store) walletAddress {
 	}
 }
 
+// setFirstBlock sets the height of the first block the address may be
+// seen in.
+func (a *btcAddress) setFirstBlock(height int32) {
+	a.firstBlock = height
+}
+
 // setSyncStatus sets the address flags and possibly the partial sync height
 // depending on the type of s.
 func (a *btcAddress) setSyncStatus(s SyncStatus) {
@@ -2997,6 +7879,12 @@ func (sa *scriptAddress) SyncStatus() SyncStatus {
 	}
 }
 
+// setFirstBlock sets the height of the first block the address may be
+// seen in.
+func (sa *scriptAddress) setFirstBlock(height int32) {
+	sa.firstBlock = height
+}
+
 // setSyncStatus sets the address flags and possibly the partial sync height
 // depending on the type of s.
 func (sa *scriptAddress) setSyncStatus(s SyncStatus) {
@@ -3059,12 +7947,26 @@ type kdfParameters struct {
 	salt  [32]byte
 }
 
+// fingerprint returns the first eight bytes of the SHA256 hash of the
+// parameters, serialized as little endian integers followed by the salt.
+func (params *kdfParameters) fingerprint() [8]byte {
+	var buf [8 + 4 + 32]byte
+	binary.LittleEndian.PutUint64(buf[0:8], params.mem)
+	binary.LittleEndian.PutUint32(buf[8:12], params.nIter)
+	copy(buf[12:], params.salt[:])
+
+	var fp [8]byte
+	h := sha256.Sum256(buf[:])
+	copy(fp[:], h[:])
+	return fp
+}
+
 // computeKdfParameters returns best guess parameters to the
 // memory-hard key derivation function to make the computation last
 // targetSec seconds, while using no more than maxMem bytes of memory.
 func computeKdfParameters(targetSec float64, maxMem uint64) (*kdfParameters, error) {
 	params := &kdfParameters{}
-	if _, err := rand.Read(params.salt[:]); err != nil {
+	if _, err := io.ReadFull(Rand, params.salt[:]); err != nil {
 		return nil, err
 	}
 
@@ -3097,6 +7999,17 @@ func computeKdfParameters(targetSec float64, maxMem uint64) (*kdfParameters, err
 	return params, nil
 }
 
+// Serialized sizes of the KDF parameters.  The checksummed bytes hold the
+// memory requirement, the number of iterations, and the salt, and are
+// followed by a 4 byte checksum and padding to fill the fixed size block.
+// As these are constants, a padding length made negative by adding
+// parameters fails to compile rather than corrupting the file layout.
+const (
+	kdfParamsSize        = 256
+	kdfParamsChkedSize   = 8 + 4 + 32
+	kdfParamsPaddingSize = kdfParamsSize - kdfParamsChkedSize - 4
+)
+
 func (params *kdfParameters) WriteTo(w io.Writer) (n int64, err error) {
 	var written int64
 
@@ -3112,7 +8025,7 @@ func (params *kdfParameters) WriteTo(w io.Writer) (n int64, err error) {
 		&params.nIter,
 		&params.salt,
 		walletHash(chkedBytes),
-		make([]byte, 256-(binary.Size(params)+4)), // padding
+		make([]byte, kdfParamsPaddingSize),
 	}
 	for _, data := range datas {
 		if written, err = binaryWrite(w, binary.LittleEndian, data); err != nil {
@@ -3128,9 +8041,9 @@ func (params *kdfParameters) ReadFrom(r io.Reader) (n int64, err error) {
 	var read int64
 
 	// These must be read in but are not saved directly to params.
-	chkedBytes := make([]byte, 44)
+	chkedBytes := make([]byte, kdfParamsChkedSize)
 	var chk uint32
-	padding := make([]byte, 256-(binary.Size(params)+4))
+	padding := make([]byte, kdfParamsPaddingSize)
 
 	datas := []interface{}{
 		chkedBytes,
@@ -3244,6 +8157,364 @@ func (e *scriptEntry) ReadFrom(r io.Reader) (n int64, err error) {
 	return n + read, err
 }
 
+// newCommentEntry creates the appended entry used to serialize a comment.
+// header must be either addrCommentHeader or txCommentHeader, and key must
+// be the address hash or transaction hash the comment is saved for.
+// Comments that exceed maxCommentLen are saved using a chunked comment
+// entry.
+func newCommentEntry(header entryHeader, key []byte, c comment) io.WriterTo {
+	if len(c) > maxCommentLen {
+		e := &chunkedCommentEntry{
+			kind:    header,
+			key:     make([]byte, len(key)),
+			comment: c,
+		}
+		copy(e.key, key)
+		return e
+	}
+
+	switch header {
+	case addrCommentHeader:
+		e := &addrCommentEntry{comment: c}
+		copy(e.pubKeyHash160[:], key)
+		return e
+	default:
+		e := &txCommentEntry{comment: c}
+		copy(e.txHash[:], key)
+		return e
+	}
+}
+
+// addrCommentEntry is the entry type for an address comment.
+type addrCommentEntry struct {
+	pubKeyHash160 [ripemd160.Size]byte
+	comment       comment
+}
+
+// WriteTo implements io.WriterTo by writing the entry to w.
+func (e *addrCommentEntry) WriteTo(w io.Writer) (n int64, err error) {
+	var written int64
+
+	// Comments shall not overflow their entry.
+	if len(e.comment) > maxCommentLen {
+		return n, ErrMalformedEntry
+	}
+
+	// Write header
+	if written, err = binaryWrite(w, binary.LittleEndian, addrCommentHeader); err != nil {
+		return n + written, err
+	}
+	n += written
+
+	// Write hash
+	if written, err = binaryWrite(w, binary.LittleEndian, &e.pubKeyHash160); err != nil {
+		return n + written, err
+	}
+	n += written
+
+	// Write comment
+	written, err = e.comment.WriteTo(w)
+	return n + written, err
+}
+
+// ReadFrom implements io.ReaderFrom by reading the entry from r.
+func (e *addrCommentEntry) ReadFrom(r io.Reader) (n int64, err error) {
+	var read int64
+
+	if read, err = binaryRead(r, binary.LittleEndian, &e.pubKeyHash160); err != nil {
+		return n + read, err
+	}
+	n += read
+
+	read, err = e.comment.ReadFrom(r)
+	return n + read, err
+}
+
+// txCommentEntry is the entry type for a transaction comment.  If the
+// comment is encrypted, the encrypted comment flag is set in the header.
+type txCommentEntry struct {
+	txHash    [btcwire.HashSize]byte
+	comment   comment
+	encrypted bool // not serialized, part of header
+}
+
+// WriteTo implements io.WriterTo by writing the entry to w.
+func (e *txCommentEntry) WriteTo(w io.Writer) (n int64, err error) {
+	var written int64
+
+	// Comments shall not overflow their entry.
+	if len(e.comment) > maxCommentLen {
+		return n, ErrMalformedEntry
+	}
+
+	// Write header
+	header := txCommentHeader
+	if e.encrypted {
+		header |= encryptedCommentFlag
+	}
+	if written, err = binaryWrite(w, binary.LittleEndian, header); err != nil {
+		return n + written, err
+	}
+	n += written
+
+	// Write hash
+	if written, err = binaryWrite(w, binary.LittleEndian, &e.txHash); err != nil {
+		return n + written, err
+	}
+	n += written
+
+	// Write comment
+	written, err = e.comment.WriteTo(w)
+	return n + written, err
+}
+
+// ReadFrom implements io.ReaderFrom by reading the entry from r.
+func (e *txCommentEntry) ReadFrom(r io.Reader) (n int64, err error) {
+	var read int64
+
+	if read, err = binaryRead(r, binary.LittleEndian, &e.txHash); err != nil {
+		return n + read, err
+	}
+	n += read
+
+	read, err = e.comment.ReadFrom(r)
+	return n + read, err
+}
+
+// chunkedCommentEntry is the entry type for an address or transaction
+// comment that is too large to be saved in a single addrCommentEntry or
+// txCommentEntry.  It is serialized in the format
+// <1 byte kind><address or tx hash><1 byte segment count> followed by each
+// segment, and each segment is serialized like a single comment.
+type chunkedCommentEntry struct {
+	kind    entryHeader // addrCommentHeader or txCommentHeader
+	key     []byte
+	comment comment
+}
+
+// chunkedCommentKeySize returns the size of the hash saved with a chunked
+// comment of the given kind.
+func chunkedCommentKeySize(kind entryHeader) (int, error) {
+	switch kind {
+	case addrCommentHeader:
+		return ripemd160.Size, nil
+	case txCommentHeader:
+		return btcwire.HashSize, nil
+	default:
+		return 0, ErrMalformedEntry
+	}
+}
+
+// WriteTo implements io.WriterTo by writing the entry to w.
+func (e *chunkedCommentEntry) WriteTo(w io.Writer) (n int64, err error) {
+	var written int64
+
+	keySize, err := chunkedCommentKeySize(e.kind)
+	if err != nil {
+		return n, err
+	}
+	if len(e.key) != keySize || len(e.comment) > maxChunkedCommentLen {
+		return n, ErrMalformedEntry
+	}
+	nChunks := (len(e.comment) + maxCommentLen - 1) / maxCommentLen
+
+	datas := []interface{}{
+		chunkedCommentHeader,
+		e.kind,
+		e.key,
+		uint8(nChunks),
+	}
+	for _, data := range datas {
+		if written, err = binaryWrite(w, binary.LittleEndian, data); err != nil {
+			return n + written, err
+		}
+		n += written
+	}
+
+	for c := e.comment; len(c) != 0; {
+		chunk := c
+		if len(chunk) > maxCommentLen {
+			chunk = chunk[:maxCommentLen]
+		}
+		c = c[len(chunk):]
+
+		if written, err = chunk.WriteTo(w); err != nil {
+			return n + written, err
+		}
+		n += written
+	}
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom by reading the entry from r.
+func (e *chunkedCommentEntry) ReadFrom(r io.Reader) (n int64, err error) {
+	var read int64
+
+	if read, err = binaryRead(r, binary.LittleEndian, &e.kind); err != nil {
+		return n + read, err
+	}
+	n += read
+
+	keySize, err := chunkedCommentKeySize(e.kind)
+	if err != nil {
+		return n, err
+	}
+	e.key = make([]byte, keySize)
+	if read, err = binaryRead(r, binary.LittleEndian, e.key); err != nil {
+		return n + read, err
+	}
+	n += read
+
+	var nChunks uint8
+	if read, err = binaryRead(r, binary.LittleEndian, &nChunks); err != nil {
+		return n + read, err
+	}
+	n += read
+
+	// Reassemble the comment from each segment.
+	e.comment = nil
+	for i := uint8(0); i < nChunks; i++ {
+		var chunk comment
+		if read, err = chunk.ReadFrom(r); err != nil {
+			return n + read, err
+		}
+		n += read
+		e.comment = append(e.comment, chunk...)
+	}
+	return n, nil
+}
+
+// labelEntry is the entry type for the key store's display label.
+type labelEntry struct {
+	label comment
+}
+
+// WriteTo implements io.WriterTo by writing the entry to w.
+func (e *labelEntry) WriteTo(w io.Writer) (n int64, err error) {
+	var written int64
+
+	// Labels shall not overflow their entry.
+	if len(e.label) > maxCommentLen {
+		return n, ErrMalformedEntry
+	}
+
+	// Write header
+	if written, err = binaryWrite(w, binary.LittleEndian, labelHeader); err != nil {
+		return n + written, err
+	}
+	n += written
+
+	// Write label
+	written, err = e.label.WriteTo(w)
+	return n + written, err
+}
+
+// ReadFrom implements io.ReaderFrom by reading the entry from r.
+func (e *labelEntry) ReadFrom(r io.Reader) (n int64, err error) {
+	return e.label.ReadFrom(r)
+}
+
+// encryptedCommentOverhead is the number of bytes an encrypted comment adds
+// to the comment: a 12 byte AES-GCM nonce and a 16 byte authentication tag.
+const encryptedCommentOverhead = 12 + 16
+
+// MaxEncryptedCommentLen is the maximum length in bytes of an encrypted
+// transaction comment.  Encrypted comments are never split into chunks, so
+// the comment and encryption overhead must fit in a single entry.
+const MaxEncryptedCommentLen = maxCommentLen - encryptedCommentOverhead
+
+// commentKey derives the key used to encrypt transaction comments from the
+// root private key.  The key store must be unlocked, or ErrLocked is
+// returned.  The key store mutex must be held by the caller.
+func (s *Store) commentKey() ([]byte, error) {
+	if s.flags.watchingOnly {
+		return nil, ErrWatchingOnly
+	}
+	if s.isLocked() || len(s.keyGenerator.privKeyCT) != 32 {
+		return nil, ErrLocked
+	}
+
+	mac := hmac.New(sha256.New, s.keyGenerator.privKeyCT)
+	mac.Write([]byte("btcwallet comment key"))
+	return mac.Sum(nil), nil
+}
+
+// sealComment encrypts a comment with AES-GCM using key and a random nonce,
+// authenticating the transaction hash as additional data so an encrypted
+// comment can not be moved to another transaction.  The nonce is prepended
+// to the result.
+func sealComment(key, txHash, plaintext []byte) (comment, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(Rand, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, txHash), nil
+}
+
+// openComment decrypts a comment encrypted by sealComment.
+func openComment(key, txHash []byte, sealed comment) ([]byte, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrKeyAuthFailed
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, txHash)
+	if err != nil {
+		return nil, ErrKeyAuthFailed
+	}
+	return plaintext, nil
+}
+
+// fileMACKey derives the key used to create the MAC of a key store file from
+// the key store's AES key.
+func fileMACKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("btcwallet file MAC"))
+	return mac.Sum(nil)
+}
+
+// macEntry is the entry type for the MAC over an entire key store file.
+// When present, this is always the last entry, and the header is followed
+// by the 32 byte MAC.  The MAC is computed over the SHA256 hash of every
+// byte of the file preceding the MAC, including the entry header.
+type macEntry struct {
+	bodyHash []byte // not serialized
+	mac      [sha256.Size]byte
+}
+
+// computeMAC returns the MAC of the entry's body hash using macKey.
+func (e *macEntry) computeMAC(macKey []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(e.bodyHash)
+	return mac.Sum(nil)
+}
+
+// WriteTo implements io.WriterTo by writing the MAC to w.  The entry header
+// must already be written, as it is covered by the MAC.
+func (e *macEntry) WriteTo(w io.Writer) (n int64, err error) {
+	return binaryWrite(w, binary.LittleEndian, &e.mac)
+}
+
+// ReadFrom implements io.ReaderFrom by reading the MAC from r.
+func (e *macEntry) ReadFrom(r io.Reader) (n int64, err error) {
+	return binaryRead(r, binary.LittleEndian, &e.mac)
+}
+
 // BlockStamp defines a block (by height and a unique hash) and is
 // used to mark a point in the blockchain that a key store element is
 // synced to.
@@ -18,11 +18,24 @@ package keystore
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/big"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/conformal/btcec"
 	"github.com/conformal/btcnet"
@@ -44,6 +57,49 @@ func makeBS(height int32) *BlockStamp {
 	}
 }
 
+func TestKdf(t *testing.T) {
+	var salt [32]byte
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	tests := []struct {
+		passphrase string
+		params     kdfParameters
+		key        string
+	}{
+		{
+			"banana",
+			kdfParameters{mem: 1024, nIter: 3, salt: salt},
+			"d379ad2f06bec6bde8d8a5e7aa6be87d654c25e14caaa4da3e42ad4843eacf1d",
+		},
+		{
+			"",
+			kdfParameters{mem: 64 * 1024, nIter: 1},
+			"37bda5885939ad25f93004eb2983d693804cf07eec6d99c8ef21a27e4779f552",
+		},
+	}
+	for i, test := range tests {
+		// Extra capacity must not let the salt be appended to, and then
+		// zeroed in, the passphrase's backing array.
+		passphrase := make([]byte, len(test.passphrase), len(test.passphrase)+64)
+		copy(passphrase, test.passphrase)
+		spare := passphrase[:cap(passphrase)]
+		for j := len(passphrase); j < len(spare); j++ {
+			spare[j] = 0xff
+		}
+
+		key := kdf(passphrase, &test.params)
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("Test %d: derived key %x does not match expected %s",
+				i, key, test.key)
+		}
+		if string(passphrase) != test.passphrase ||
+			!bytes.Equal(spare[len(passphrase):], bytes.Repeat([]byte{0xff}, 64)) {
+			t.Errorf("Test %d: passphrase was modified", i)
+		}
+	}
+}
+
 func TestBtcAddressSerializer(t *testing.T) {
 	fakeWallet := &Store{net: (*netParams)(tstNetParams)}
 	kdfp := &kdfParameters{
@@ -170,6 +226,328 @@ func TestWalletCreationSerialization(t *testing.T) {
 	//	}
 }
 
+func TestDescription(t *testing.T) {
+	createdAt := makeBS(0)
+	if _, err := New(dummyDir, "A wallet\x00 for testing.",
+		[]byte("banana"), tstNetParams, createdAt); err == nil {
+		t.Error("Creating wallet with NUL byte in description did not fail")
+		return
+	}
+
+	tests := []string{
+		"",
+		"A wallet for testing.",
+		strings.Repeat("d", 256),
+	}
+	for _, desc := range tests {
+		w1, err := New(dummyDir, desc, []byte("banana"), tstNetParams, createdAt)
+		if err != nil {
+			t.Error("Error creating new wallet: " + err.Error())
+			return
+		}
+		buf := new(bytes.Buffer)
+		if _, err := w1.WriteTo(buf); err != nil {
+			t.Error("Error writing new wallet: " + err.Error())
+			return
+		}
+		w2 := new(Store)
+		if _, err := w2.ReadFrom(buf); err != nil {
+			t.Error("Error reading newly written wallet: " + err.Error())
+			return
+		}
+		if d := w2.Description(); d != desc {
+			t.Errorf("Description %q does not match expected %q", d, desc)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if l := w.Label(); l != "" {
+		t.Errorf("New wallet has label %q", l)
+		return
+	}
+	if err := w.SetLabel(strings.Repeat("l", maxCommentLen+1)); err != ErrCommentTooLong {
+		t.Errorf("Setting too long label did not fail correctly: %v", err)
+		return
+	}
+
+	label := "Savings for a rainy day"
+	if err := w.SetLabel(label); err != nil {
+		t.Errorf("Cannot set label: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Error("Error writing new wallet: " + err.Error())
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Error("Error reading newly written wallet: " + err.Error())
+		return
+	}
+	if l := w2.Label(); l != label {
+		t.Errorf("Label %q does not match expected %q", l, label)
+		return
+	}
+
+	// Removing the label must not write a label entry.
+	if err := w2.SetLabel(""); err != nil {
+		t.Errorf("Cannot remove label: %v", err)
+		return
+	}
+	buf.Reset()
+	if _, err := w2.WriteTo(buf); err != nil {
+		t.Error("Error writing wallet: " + err.Error())
+		return
+	}
+	w3 := new(Store)
+	if _, err := w3.ReadFrom(buf); err != nil {
+		t.Error("Error reading wallet: " + err.Error())
+		return
+	}
+	if l := w3.Label(); l != "" {
+		t.Errorf("Removed label read back as %q", l)
+	}
+}
+
+func TestSetCreateDate(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	if err := w.SetCreateDate(future); err == nil {
+		t.Error("Setting a future creation date did not fail")
+		return
+	}
+
+	past := time.Now().Add(-24 * time.Hour).Unix()
+	if err := w.SetCreateDate(past); err != nil {
+		t.Errorf("Cannot set creation date: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Error("Error writing new wallet: " + err.Error())
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Error("Error reading newly written wallet: " + err.Error())
+		return
+	}
+	if d := w2.CreateDate(); d != past {
+		t.Errorf("Creation date %d does not match expected %d", d, past)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if !w.LastSyncTime().IsZero() {
+		t.Errorf("New wallet has last sync time %v", w.LastSyncTime())
+		return
+	}
+
+	// Fill the recently seen blocks so the sync time is saved after the
+	// largest possible block history.
+	for i := int32(1); i <= 20; i++ {
+		w.SetSyncedWith(makeBS(i))
+	}
+	before := time.Now().Unix()
+	w.Touch()
+	touched := w.LastSyncTime()
+	if touched.Unix() < before || touched.Unix() > time.Now().Unix() {
+		t.Errorf("Last sync time %v is not the current time", touched)
+		return
+	}
+	if _, h := w.SyncedTo(); h != 20 {
+		t.Errorf("Touch changed sync height to %d", h)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Error("Error writing new wallet: " + err.Error())
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Error("Error reading newly written wallet: " + err.Error())
+		return
+	}
+	if !w2.LastSyncTime().Equal(touched) {
+		t.Errorf("Last sync time %v does not match expected %v",
+			w2.LastSyncTime(), touched)
+	}
+}
+
+// constReader is an io.Reader which reads an infinite stream of a single
+// byte.
+type constReader byte
+
+func (r constReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestRand(t *testing.T) {
+	defer func(r io.Reader) { Rand = r }(Rand)
+	Rand = constReader(1)
+
+	var addrs [2]btcutil.Address
+	for i := range addrs {
+		w, err := New(dummyDir, "A wallet for testing.",
+			[]byte("banana"), tstNetParams, makeBS(0))
+		if err != nil {
+			t.Error("Error creating new wallet: " + err.Error())
+			return
+		}
+		addrs[i] = w.chainIdxMap[rootKeyChainIdx]
+	}
+	if addrs[0].EncodeAddress() != addrs[1].EncodeAddress() {
+		t.Errorf("Root addresses %v and %v created with the same entropy differ",
+			addrs[0], addrs[1])
+	}
+}
+
+func TestChangeNetwork(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	if _, err := w.ImportScript(script, makeBS(0)); err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	privKey, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+
+	if _, err := w.ChangeNetwork(btcwire.TestNet); err == nil {
+		t.Error("Changing to an unsupported network did not fail")
+		return
+	}
+	tw, err := w.ChangeNetwork(btcwire.TestNet3)
+	if err != nil {
+		t.Errorf("Cannot change network: %v", err)
+		return
+	}
+	if !tw.IsTestNet() || w.IsTestNet() {
+		t.Error("Network was not changed on only the copy")
+		return
+	}
+
+	// Every address is re-encoded for the new network.
+	addrs := w.SortedActiveAddresses()
+	taddrs := tw.SortedActiveAddresses()
+	if len(addrs) != len(taddrs) {
+		t.Errorf("Copy has %d addresses, expected %d", len(taddrs), len(addrs))
+		return
+	}
+	for i := range addrs {
+		a, ta := addrs[i].Address(), taddrs[i].Address()
+		if !bytes.Equal(a.ScriptAddress(), ta.ScriptAddress()) {
+			t.Errorf("Address %d hash differs", i)
+			return
+		}
+		if a.EncodeAddress() == ta.EncodeAddress() {
+			t.Errorf("Address %d was not re-encoded", i)
+			return
+		}
+		if !ta.IsForNet(&btcnet.TestNet3Params) {
+			t.Errorf("Address %v is not for testnet", ta)
+			return
+		}
+	}
+
+	// The copy round trips and unlocks the same keys.
+	buf := new(bytes.Buffer)
+	if _, err := tw.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write copy: %v", err)
+		return
+	}
+	tw2 := new(Store)
+	if _, err := tw2.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read copy: %v", err)
+		return
+	}
+	if err := tw2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock copy: %v", err)
+		return
+	}
+	taddr, err := btcutil.NewAddressPubKeyHash(addr.ScriptAddress(),
+		&btcnet.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tPrivKey, err := tw2.PrivKeyBytes(taddr)
+	if err != nil {
+		t.Errorf("Cannot get private key from copy: %v", err)
+		return
+	}
+	if !bytes.Equal(privKey, tPrivKey) {
+		t.Error("Copy private key differs")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		params *btcnet.Params
+		main   bool
+		test   bool
+		name   string
+	}{
+		{&btcnet.MainNetParams, true, false, "mainnet"},
+		{&btcnet.TestNet3Params, false, true, "testnet3"},
+		{&btcnet.SimNetParams, false, false, "simnet"},
+	}
+	for _, test := range tests {
+		w, err := New(dummyDir, "A wallet for testing.",
+			[]byte("banana"), test.params, makeBS(0))
+		if err != nil {
+			t.Error("Error creating new wallet: " + err.Error())
+			return
+		}
+		if w.IsMainNet() != test.main || w.IsTestNet() != test.test ||
+			w.NetworkName() != test.name {
+			t.Errorf("%s: network predicates (%v, %v, %q) do not match expected",
+				test.name, w.IsMainNet(), w.IsTestNet(), w.NetworkName())
+		}
+	}
+}
+
 func TestChaining(t *testing.T) {
 	tests := []struct {
 		name                       string
@@ -337,893 +715,6668 @@ func TestChaining(t *testing.T) {
 	}
 }
 
-func TestWalletPubkeyChaining(t *testing.T) {
+func TestChainParams(t *testing.T) {
 	w, err := New(dummyDir, "A wallet for testing.",
 		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
 		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-	if !w.IsLocked() {
-		t.Error("New wallet is not locked.")
-	}
 
-	// Get next chained address.  The wallet is locked, so this will chain
-	// off the last pubkey, not privkey.
-	addrWithoutPrivkey, err := w.NextChainedAddress(makeBS(0))
-	if err != nil {
-		t.Errorf("Failed to extend address chain from pubkey: %v", err)
+	rootPubKey, chainCode := w.ChainParams()
+
+	// Modifying the returned slices must not modify the key store.
+	rootPubKey[0] ^= 0xff
+	chainCode[0] ^= 0xff
+	rootPubKey2, chainCode2 := w.ChainParams()
+	if bytes.Equal(rootPubKey, rootPubKey2) || bytes.Equal(chainCode, chainCode2) {
+		t.Error("ChainParams did not return copies")
 		return
 	}
 
-	// Lookup address info.  This should succeed even without the private
-	// key available.
-	info, err := w.Address(addrWithoutPrivkey)
+	// The first chained address must be derivable from the parameters.
+	nextPubKey, err := chainedPubKey(rootPubKey2, chainCode2)
 	if err != nil {
-		t.Errorf("Failed to get info about address without private key: %v", err)
+		t.Errorf("Cannot chain public key: %v", err)
 		return
 	}
-
-	pkinfo := info.(PubKeyAddress)
-	// sanity checks
-	if !info.Compressed() {
-		t.Errorf("Pubkey should be compressed.")
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-	if info.Imported() {
-		t.Errorf("Should not be marked as imported.")
+	wa, err := w.AddressAtIndex(0)
+	if err != nil {
+		t.Errorf("Cannot get address at index 0: %v", err)
 		return
 	}
-
-	pka := info.(PubKeyAddress)
-
-	// Try to lookup it's private key.  This should fail.
-	_, err = pka.PrivKey()
-	if err == nil {
-		t.Errorf("Incorrectly returned nil error for looking up private key for address without one saved.")
-		return
+	if !bytes.Equal(nextPubKey, wa.(*btcAddress).pubKeyBytes()) {
+		t.Error("Chained public key does not match first chained address")
 	}
+}
 
-	// Deserialize w and serialize into a new wallet.  The rest of the checks
-	// in this test test against both a fresh, as well as an "opened and closed"
-	// wallet with the missing private key.
-	serializedWallet := new(bytes.Buffer)
-	_, err = w.WriteTo(serializedWallet)
+func TestReadCorruptChain(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Error writing wallet with missing private key: %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-	w2 := new(Store)
-	_, err = w2.ReadFrom(serializedWallet)
-	if err != nil {
-		t.Errorf("Error reading wallet with missing private key: %v", err)
-		return
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
 	}
-
-	// Unlock wallet.  This should trigger creating the private key for
-	// the address.
-	if err = w.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Can't unlock original wallet: %v", err)
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
-	if err = w2.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Can't unlock re-read wallet: %v", err)
-		return
+	serialized := buf.Bytes()
+
+	// entryAt returns an appended address entry for the address at chain
+	// index idx, serialized with the chain index changed to newIdx.
+	entryAt := func(idx, newIdx int64) []byte {
+		wa, err := w.AddressAtIndex(idx)
+		if err != nil {
+			t.Fatalf("Cannot get address at index %d: %v", idx, err)
+		}
+		e := &addrEntry{addr: *wa.(*btcAddress)}
+		e.addr.chainIndex = newIdx
+		copy(e.pubKeyHash160[:], e.addr.AddrHash())
+		buf := new(bytes.Buffer)
+		if _, err := e.WriteTo(buf); err != nil {
+			t.Fatalf("Cannot write address entry: %v", err)
+		}
+		return buf.Bytes()
 	}
 
-	// Same address, better variable name.
-	addrWithPrivKey := addrWithoutPrivkey
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"duplicate", entryAt(0, 0)},
+		{"gap", entryAt(2, 5)},
+	}
+	for _, test := range tests {
+		file := append(append([]byte(nil), serialized...), test.entry...)
+		if _, err := new(Store).ReadFrom(bytes.NewReader(file)); err != ErrCorruptChain {
+			t.Errorf("%s: reading corrupt chain did not fail correctly: %v",
+				test.name, err)
+		}
+	}
 
-	// Try a private key lookup again.  The private key should now be available.
-	key1, err := pka.PrivKey()
-	if err != nil {
-		t.Errorf("Private key for original wallet was not created! %v", err)
+	// A chained address moved before the root must not hide the gap it
+	// leaves, even though the number of chain indexes is unchanged.
+	orig, moved := entryAt(1, 1), entryAt(1, -5)
+	i := bytes.Index(serialized, orig)
+	if i < 0 {
+		t.Error("Cannot find address entry in serialized wallet")
 		return
 	}
+	file := append([]byte(nil), serialized...)
+	copy(file[i:], moved)
+	if _, err := new(Store).ReadFrom(bytes.NewReader(file)); err != ErrCorruptChain {
+		t.Errorf("Reading chain index before root did not fail correctly: %v",
+			err)
+	}
 
-	info2, err := w.Address(addrWithPrivKey)
-	if err != nil {
-		t.Errorf("no address in re-read wallet")
+	// The unmodified file must still be readable.
+	if _, err := new(Store).ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
 	}
-	pka2 := info2.(PubKeyAddress)
-	key2, err := pka2.PrivKey()
+}
+
+func TestRemainingKeypool(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Private key for re-read wallet was not created! %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if i, n := w.HighestUsedIndex(), w.RemainingKeypool(); i != -1 || n != 0 {
+		t.Errorf("New wallet: highest used %d, remaining %d", i, n)
 		return
 	}
 
-	// Keys returned by both wallets must match.
-	if !reflect.DeepEqual(key1, key2) {
-		t.Errorf("Private keys for address originally created without one mismtach between original and re-read wallet.")
+	if _, err := w.GenerateGapAddresses(5, makeBS(0)); err != nil {
+		t.Errorf("Cannot generate gap addresses: %v", err)
+		return
+	}
+	if i, n := w.HighestUsedIndex(), w.RemainingKeypool(); i != -1 || n != 5 {
+		t.Errorf("After gap: highest used %d, remaining %d", i, n)
 		return
 	}
 
-	// Sign some data with the private key, then verify signature with the pubkey.
-	hash := []byte("hash to sign")
-	r, s, err := ecdsa.Sign(rand.Reader, key1, hash)
+	for j := 0; j < 2; j++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	if i, n := w.HighestUsedIndex(), w.RemainingKeypool(); i != 1 || n != 3 {
+		t.Errorf("After use: highest used %d, remaining %d", i, n)
+	}
+}
+
+func TestKeypoolPolicy(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Unable to sign hash with the created private key: %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-	pubKey := pkinfo.PubKey()
-	ok := ecdsa.Verify(pubKey.ToECDSA(), hash, r, s)
-	if !ok {
-		t.Errorf("ECDSA verification failed; address's pubkey mismatches the privkey.")
+	if w.KeypoolPolicy() != DefaultKeypoolPolicy {
+		t.Errorf("New wallet has keypool policy %+v", w.KeypoolPolicy())
+		return
+	}
+	if err := w.SetKeypoolPolicy(KeypoolPolicy{BatchSize: 0}); err == nil {
+		t.Error("Setting an invalid keypool policy did not fail")
 		return
 	}
 
-	nextAddr, err := w.NextChainedAddress(makeBS(0))
-	if err != nil {
-		t.Errorf("Unable to create next address after finding the privkey: %v", err)
+	tests := []struct {
+		name      string
+		policy    KeypoolPolicy
+		remaining int64
+	}{
+		{"default", DefaultKeypoolPolicy, 0},
+		{"batch", KeypoolPolicy{BatchSize: 10, AutoExtend: true}, 9},
+		{"batch remaining", KeypoolPolicy{BatchSize: 10, AutoExtend: true}, 8},
+		{"target", KeypoolPolicy{TargetSize: 20, BatchSize: 1, AutoExtend: true}, 20},
+	}
+	for _, test := range tests {
+		if err := w.SetKeypoolPolicy(test.policy); err != nil {
+			t.Errorf("%s: cannot set keypool policy: %v", test.name, err)
+			return
+		}
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("%s: cannot get next chained address: %v", test.name, err)
+			return
+		}
+		if n := w.RemainingKeypool(); n != test.remaining {
+			t.Errorf("%s: remaining keypool %d, expected %d", test.name,
+				n, test.remaining)
+			return
+		}
+	}
+
+	// Without auto-extension, the keypool is only extended explicitly.
+	policy := KeypoolPolicy{TargetSize: 2, BatchSize: 1, AutoExtend: false}
+	if err := w.SetKeypoolPolicy(policy); err != nil {
+		t.Errorf("Cannot set keypool policy: %v", err)
+		return
+	}
+	for n := w.RemainingKeypool(); n > 0; n-- {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != ErrKeypoolExhausted {
+		t.Errorf("Exhausted keypool did not fail correctly: %v", err)
+		return
+	}
+	if err := w.TopUpKeypool(makeBS(0)); err != nil {
+		t.Errorf("Cannot top up keypool: %v", err)
 		return
 	}
+	if n := w.RemainingKeypool(); n != 2 {
+		t.Errorf("Remaining keypool %d after top up, expected 2", n)
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+	}
+}
 
-	nextInfo, err := w.Address(nextAddr)
+func TestGenerateGapAddresses(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Couldn't get info about the next address in the chain: %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-	nextPkInfo := nextInfo.(PubKeyAddress)
-	nextKey, err := nextPkInfo.PrivKey()
+
+	gap, err := w.GenerateGapAddresses(5, makeBS(0))
 	if err != nil {
-		t.Errorf("Couldn't get private key for the next address in the chain: %v", err)
+		t.Errorf("Cannot generate gap addresses: %v", err)
+		return
+	}
+	if len(gap) != 5 {
+		t.Errorf("Generated %d gap addresses, expected 5", len(gap))
 		return
 	}
+	for i, wa := range gap {
+		if idx := wa.(*btcAddress).chainIndex; idx != int64(i) {
+			t.Errorf("Gap address %d has chain index %d", i, idx)
+			return
+		}
+	}
 
-	// Do an ECDSA signature check here as well, this time for the next
-	// address after the one made without the private key.
-	r, s, err = ecdsa.Sign(rand.Reader, nextKey, hash)
+	// Gap addresses must not be marked as used.
+	addr, err := w.NextChainedAddress(makeBS(0))
 	if err != nil {
-		t.Errorf("Unable to sign hash with the created private key: %v", err)
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-	pubKey = nextPkInfo.PubKey()
-	ok = ecdsa.Verify(pubKey.ToECDSA(), hash, r, s)
-	if !ok {
-		t.Errorf("ECDSA verification failed; next address's keypair does not match.")
+	if addr.EncodeAddress() != gap[0].Address().EncodeAddress() {
+		t.Errorf("Next chained address %v does not match first gap address %v",
+			addr, gap[0].Address())
 		return
 	}
 
-	// Check that the serialized wallet correctly unmarked the 'needs private
-	// keys later' flag.
-	buf := new(bytes.Buffer)
-	w2.WriteTo(buf)
-	w2.ReadFrom(buf)
-	err = w2.Unlock([]byte("banana"))
+	// Existing addresses are returned without extending the chain.
+	gap2, err := w.GenerateGapAddresses(3, makeBS(0))
 	if err != nil {
-		t.Errorf("Unlock after serialize/deserialize failed: %v", err)
+		t.Errorf("Cannot generate gap addresses: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(gap2, gap[1:4]) {
+		t.Error("Gap addresses do not match previously generated addresses")
+		return
+	}
+	if w.lastChainIdx != 4 {
+		t.Errorf("Last chain index %d, expected 4", w.lastChainIdx)
+		return
+	}
+
+	// Too large a gap is an error and does not extend the chain.
+	if _, err := w.GenerateGapAddresses(MaxDeriveAddresses+1, makeBS(0)); err == nil {
+		t.Error("Generating too many gap addresses did not fail")
 		return
 	}
+	if w.lastChainIdx != 4 {
+		t.Errorf("Last chain index %d after failed gap, expected 4",
+			w.lastChainIdx)
+	}
 }
 
-func TestWatchingWalletExport(t *testing.T) {
-	createdAt := makeBS(0)
+func TestReadFromRecover(t *testing.T) {
 	w, err := New(dummyDir, "A wallet for testing.",
-		[]byte("banana"), tstNetParams, createdAt)
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
 		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	// Maintain a set of the active addresses in the wallet.
-	activeAddrs := make(map[addressKey]struct{})
-
-	// Add root address.
-	activeAddrs[getAddressKey(w.LastChainedAddress())] = struct{}{}
-
-	// Create watching wallet from w.
-	ww, err := w.ExportWatchingWallet()
+	addr, err := w.NextChainedAddress(makeBS(0))
 	if err != nil {
-		t.Errorf("Could not create watching wallet: %v", err)
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-
-	// Verify correctness of wallet flags.
-	if ww.flags.useEncryption {
-		t.Errorf("Watching wallet marked as using encryption (but nothing to encrypt).")
+	if err := w.SetAddressComment(addr, "A comment."); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
 		return
 	}
-	if !ww.flags.watchingOnly {
-		t.Errorf("Wallet should be watching-only but is not marked so.")
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
+	serialized := buf.Bytes()
 
-	// Verify that all flags are set as expected.
-	if ww.keyGenerator.flags.encrypted {
-		t.Errorf("Watching root address should not be encrypted (nothing to encrypt)")
+	// A well formed key store is recovered without errors.
+	r, errs, err := ReadFromRecover(bytes.NewReader(serialized))
+	if err != nil || len(errs) != 0 {
+		t.Errorf("Cannot recover valid wallet: %v %v", err, errs)
 		return
 	}
-	if ww.keyGenerator.flags.hasPrivKey {
-		t.Errorf("Watching root address marked as having a private key.")
+	if !w.Equal(r) {
+		t.Errorf("Recovered wallet differs: %v", w.Diff(r))
 		return
 	}
-	if !ww.keyGenerator.flags.hasPubKey {
-		t.Errorf("Watching root address marked as missing a public key.")
+
+	// Append an entry with an unknown header.  Reading strictly must
+	// fail, but all previous entries must be recovered.
+	corrupt := append(append([]byte(nil), serialized...), 0xff, 0x01, 0x02)
+	if _, err := new(Store).ReadFrom(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Reading corrupt wallet did not fail")
 		return
 	}
-	if ww.keyGenerator.flags.createPrivKeyNextUnlock {
-		t.Errorf("Watching root address marked as needing a private key to be generated later.")
+	r, errs, err = ReadFromRecover(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Errorf("Cannot recover corrupt wallet: %v", err)
 		return
 	}
-	for apkh, waddr := range ww.addrMap {
-		switch addr := waddr.(type) {
-		case *btcAddress:
-			if addr.flags.encrypted {
-				t.Errorf("Chained address should not be encrypted (nothing to encrypt)")
-				return
-			}
-			if addr.flags.hasPrivKey {
-				t.Errorf("Chained address marked as having a private key.")
-				return
-			}
-			if !addr.flags.hasPubKey {
-				t.Errorf("Chained address marked as missing a public key.")
-				return
-			}
-			if addr.flags.createPrivKeyNextUnlock {
-				t.Errorf("Chained address marked as needing a private key to be generated later.")
-				return
-			}
-		case *scriptAddress:
-			t.Errorf("Chained address was a script!")
-			return
-		default:
-			t.Errorf("Chained address unknown type!")
-			return
-		}
-
-		if _, ok := activeAddrs[apkh]; !ok {
-			t.Errorf("Address from watching wallet not found in original wallet.")
-			return
-		}
-		delete(activeAddrs, apkh)
+	if len(errs) != 1 {
+		t.Errorf("Recovered with %d errors, expected 1: %v", len(errs), errs)
+		return
 	}
-	if len(activeAddrs) != 0 {
-		t.Errorf("%v address(es) were not exported to watching wallet.", len(activeAddrs))
+	if !w.Equal(r) {
+		t.Errorf("Recovered wallet differs: %v", w.Diff(r))
 		return
 	}
 
-	// Check that the new addresses created by each wallet match.  The
-	// original wallet is unlocked so addresses are chained with privkeys.
-	if err := w.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Unlocking original wallet failed: %v", err)
+	// A corrupt header can not be recovered.
+	corrupt = append([]byte(nil), serialized...)
+	corrupt[0] ^= 0xff
+	if _, _, err := ReadFromRecover(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Recovering wallet with corrupt header did not fail")
 	}
+}
 
-	// Test that ExtendActiveAddresses for the watching wallet match
-	// manually requested addresses of the original wallet.
-	var newAddrs []btcutil.Address
-	for i := 0; i < 10; i++ {
-		addr, err := w.NextChainedAddress(createdAt)
-		if err != nil {
-			t.Errorf("Cannot get next chained address for original wallet: %v", err)
-			return
-		}
-		newAddrs = append(newAddrs, addr)
-	}
-	newWWAddrs, err := ww.ExtendActiveAddresses(10)
+func TestRecoverChainGap(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Cannot extend active addresses for watching wallet: %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-	for i := range newAddrs {
-		if newAddrs[i].EncodeAddress() != newWWAddrs[i].EncodeAddress() {
-			t.Errorf("Extended active addresses do not match manually requested addresses.")
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
 			return
 		}
 	}
-
-	// Test ExtendActiveAddresses for the original wallet after manually
-	// requesting addresses for the watching wallet.
-	newWWAddrs = nil
-	for i := 0; i < 10; i++ {
-		addr, err := ww.NextChainedAddress(createdAt)
-		if err != nil {
-			t.Errorf("Cannot get next chained address for watching wallet: %v", err)
-			return
-		}
-		newWWAddrs = append(newWWAddrs, addr)
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
 	}
-	newAddrs, err = w.ExtendActiveAddresses(10)
+	serialized := buf.Bytes()
+
+	// Remove the entry for the address at chain index 1, leaving a gap.
+	wa, err := w.AddressAtIndex(1)
 	if err != nil {
-		t.Errorf("Cannot extend active addresses for original wallet: %v", err)
+		t.Errorf("Cannot get address at index 1: %v", err)
 		return
 	}
-	for i := range newAddrs {
-		if newAddrs[i].EncodeAddress() != newWWAddrs[i].EncodeAddress() {
-			t.Errorf("Extended active addresses do not match manually requested addresses.")
-			return
-		}
+	e := &addrEntry{addr: *wa.(*btcAddress)}
+	copy(e.pubKeyHash160[:], e.addr.AddrHash())
+	buf = new(bytes.Buffer)
+	if _, err := e.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write address entry: %v", err)
+		return
 	}
+	entry := buf.Bytes()
+	i := bytes.Index(serialized, entry)
+	if i < 0 {
+		t.Error("Cannot find address entry in serialized wallet")
+		return
+	}
+	gap := append(append([]byte(nil), serialized[:i]...),
+		serialized[i+len(entry):]...)
 
-	// Test (de)serialization of watching wallet.
-	buf := new(bytes.Buffer)
-	_, err = ww.WriteTo(buf)
+	r, errs, err := ReadFromRecover(bytes.NewReader(gap))
 	if err != nil {
-		t.Errorf("Cannot write watching wallet: %v", err)
+		t.Errorf("Cannot recover wallet: %v", err)
 		return
 	}
-	ww2 := new(Store)
-	_, err = ww2.ReadFrom(buf)
-	if err != nil {
-		t.Errorf("Cannot read watching wallet: %v", err)
+	if len(errs) == 0 {
+		t.Error("Recovering wallet with a chain gap returned no errors")
 		return
 	}
 
-	// Check that (de)serialized watching wallet matches the exported wallet.
-	if !reflect.DeepEqual(ww, ww2) {
-		t.Error("Exported and read-in watching wallets do not match.")
+	// The chain must be truncated before the gap.
+	if r.lastChainIdx != 0 || r.highestUsed != 0 {
+		t.Errorf("Recovered last chain index %d and highest used %d, "+
+			"expected 0 and 0", r.lastChainIdx, r.highestUsed)
+		return
+	}
+	if _, err := r.AddressAtIndex(2); err == nil {
+		t.Error("Address after the gap was not removed")
 		return
 	}
 
-	// Verify that nonsensical functions fail with correct error.
-	if err := ww.Lock(); err != ErrWatchingOnly {
-		t.Errorf("Nonsensical func Lock returned no or incorrect error: %v", err)
+	// The recovered key store must be usable.
+	buf = new(bytes.Buffer)
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write recovered wallet: %v", err)
 		return
 	}
-	if err := ww.Unlock([]byte("banana")); err != ErrWatchingOnly {
-		t.Errorf("Nonsensical func Unlock returned no or incorrect error: %v", err)
+	if _, err := new(Store).ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("Cannot read written recovered wallet: %v", err)
 		return
 	}
-	generator, err := ww.Address(w.keyGenerator.Address())
-	if err != nil {
-		t.Errorf("generator isnt' present in wallet")
+	if err := r.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock recovered wallet: %v", err)
+		return
 	}
-	gpk := generator.(PubKeyAddress)
-	if _, err := gpk.PrivKey(); err != ErrWatchingOnly {
-		t.Errorf("Nonsensical func AddressKey returned no or incorrect error: %v", err)
+	if err := r.DebugDump(ioutil.Discard); err != nil {
+		t.Errorf("Cannot dump recovered wallet: %v", err)
 		return
 	}
-	if _, err := ww.ExportWatchingWallet(); err != ErrWatchingOnly {
-		t.Errorf("Nonsensical func ExportWatchingWallet returned no or incorrect error: %v", err)
+
+	// Extending the chain derives the dropped address again.
+	addr, err := r.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-	pk, _ := btcec.PrivKeyFromBytes(btcec.S256(), make([]byte, 32))
-	wif, err := btcutil.NewWIF(pk, tstNetParams, true)
+	if addr.EncodeAddress() != wa.Address().EncodeAddress() {
+		t.Errorf("Next chained address %v, expected %v", addr, wa.Address())
+	}
+}
+
+// serializeExtendedKey returns the base58 encoding of a BIP0032 extended
+// private key with the given version, private key, and chaincode.
+func serializeExtendedKey(version [4]byte, privKey, chaincode []byte) string {
+	payload := make([]byte, 0, serializedExtendedKeyLen+4)
+	payload = append(payload, version[:]...)
+	payload = append(payload, make([]byte, 1+4+4)...) // depth, parent, child
+	payload = append(payload, chaincode...)
+	payload = append(payload, 0)
+	payload = append(payload, privKey...)
+	payload = append(payload, btcwire.DoubleSha256(payload)[:4]...)
+	return btcutil.Base58Encode(payload)
+}
+
+func TestImportExtendedKey(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Fatal(err)
+		t.Error("Error creating new wallet: " + err.Error())
+		return
 	}
-	if _, err := ww.ImportPrivateKey(wif, createdAt); err != ErrWatchingOnly {
-		t.Errorf("Nonsensical func ImportPrivateKey returned no or incorrect error: %v", err)
+
+	privKey := bytes.Repeat([]byte{0x11}, 32)
+	chaincode := bytes.Repeat([]byte{0x22}, 32)
+	xprv := serializeExtendedKey(hdPrivateKeyIDs[btcwire.MainNet], privKey, chaincode)
+	tprv := serializeExtendedKey(hdPrivateKeyIDs[btcwire.TestNet3], privKey, chaincode)
+
+	if err := w.ImportExtendedKey(xprv, makeBS(0)); err != ErrLocked {
+		t.Errorf("Importing into a locked wallet did not fail correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	if err := w.ImportExtendedKey(tprv, makeBS(0)); err == nil {
+		t.Error("Importing a key for another network did not fail")
+		return
+	}
+	corrupt := []byte(xprv)
+	corrupt[len(corrupt)-1] ^= 1
+	if err := w.ImportExtendedKey(string(corrupt), makeBS(0)); err == nil {
+		t.Error("Importing a corrupt key did not fail")
+		return
+	}
+
+	// Encrypted comments can only be read with the existing root.
+	var txSha btcwire.ShaHash
+	if err := w.SetEncryptedTxComment(&txSha, "comment"); err != nil {
+		t.Errorf("Cannot set encrypted comment: %v", err)
+		return
+	}
+	if err := w.ImportExtendedKey(xprv, makeBS(0)); err == nil {
+		t.Error("Importing with encrypted comments did not fail")
+		return
+	}
+	if c := w.TxComment(&txSha); c != "comment" {
+		t.Errorf("Encrypted comment %q does not match", c)
+		return
+	}
+	if err := w.SetEncryptedTxComment(&txSha, ""); err != nil {
+		t.Errorf("Cannot remove encrypted comment: %v", err)
+		return
+	}
+
+	// The previous root address and its private key are discarded.
+	oldRoot := w.chainIdxMap[rootKeyChainIdx]
+	if err := w.ImportExtendedKey(xprv, makeBS(0)); err != nil {
+		t.Errorf("Cannot import extended key: %v", err)
+		return
+	}
+	if _, err := w.Address(oldRoot); err != ErrAddressNotFound {
+		t.Errorf("Previous root address was not removed: %v", err)
+		return
+	}
+	if _, err := w.PrivKeyBytes(oldRoot); err != ErrAddressNotFound {
+		t.Errorf("Previous root private key was not removed: %v", err)
+		return
+	}
+	rootPubKey, rootChaincode := w.ChainParams()
+	if !bytes.Equal(rootPubKey, pubkeyFromPrivkey(privKey, true)) ||
+		!bytes.Equal(rootChaincode, chaincode) {
+		t.Error("Root address does not use the imported key and chaincode")
+		return
+	}
+
+	// Chained addresses must be derived from the imported root, and the
+	// root must survive serialization.
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	nextPrivKey, err := chainedPrivKey(privKey, rootPubKey, chaincode)
+	if err != nil {
+		t.Errorf("Cannot chain private key: %v", err)
+		return
+	}
+	b, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key bytes: %v", err)
+		return
+	}
+	if !bytes.Equal(b, nextPrivKey) {
+		t.Error("Chained address was not derived from the imported root")
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w2.UnlockAndVerify([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock read wallet: %v", err)
 		return
 	}
+
+	// Importing after the chain was extended must fail.
+	if err := w.ImportExtendedKey(xprv, makeBS(0)); err == nil {
+		t.Error("Importing after extending the address chain did not fail")
+	}
 }
 
-func TestImportPrivateKey(t *testing.T) {
-	createHeight := int32(100)
-	createdAt := makeBS(createHeight)
+func TestWalletPubkeyChaining(t *testing.T) {
 	w, err := New(dummyDir, "A wallet for testing.",
-		[]byte("banana"), tstNetParams, createdAt)
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
 		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
+	if !w.IsLocked() {
+		t.Error("New wallet is not locked.")
+	}
+
+	// Get next chained address.  The wallet is locked, so this will chain
+	// off the last pubkey, not privkey.
+	addrWithoutPrivkey, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Failed to extend address chain from pubkey: %v", err)
+		return
+	}
+
+	// Lookup address info.  This should succeed even without the private
+	// key available.
+	info, err := w.Address(addrWithoutPrivkey)
+	if err != nil {
+		t.Errorf("Failed to get info about address without private key: %v", err)
+		return
+	}
+
+	pkinfo := info.(PubKeyAddress)
+	// sanity checks
+	if !info.Compressed() {
+		t.Errorf("Pubkey should be compressed.")
+		return
+	}
+	if info.Imported() {
+		t.Errorf("Should not be marked as imported.")
+		return
+	}
+
+	pka := info.(PubKeyAddress)
+
+	// Try to lookup it's private key.  This should fail.
+	_, err = pka.PrivKey()
+	if err == nil {
+		t.Errorf("Incorrectly returned nil error for looking up private key for address without one saved.")
+		return
+	}
+
+	// Deserialize w and serialize into a new wallet.  The rest of the checks
+	// in this test test against both a fresh, as well as an "opened and closed"
+	// wallet with the missing private key.
+	serializedWallet := new(bytes.Buffer)
+	_, err = w.WriteTo(serializedWallet)
+	if err != nil {
+		t.Errorf("Error writing wallet with missing private key: %v", err)
+		return
+	}
+	w2 := new(Store)
+	_, err = w2.ReadFrom(serializedWallet)
+	if err != nil {
+		t.Errorf("Error reading wallet with missing private key: %v", err)
+		return
+	}
 
+	// Unlock wallet.  This should trigger creating the private key for
+	// the address.
 	if err = w.Unlock([]byte("banana")); err != nil {
 		t.Errorf("Can't unlock original wallet: %v", err)
 		return
 	}
+	if err = w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock re-read wallet: %v", err)
+		return
+	}
 
-	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	// Same address, better variable name.
+	addrWithPrivKey := addrWithoutPrivkey
+
+	// Try a private key lookup again.  The private key should now be available.
+	key1, err := pka.PrivKey()
 	if err != nil {
-		t.Error("Error generating private key: " + err.Error())
+		t.Errorf("Private key for original wallet was not created! %v", err)
 		return
 	}
 
-	// verify that the entire wallet's sync height matches the
-	// expected createHeight.
-	if _, h := w.SyncedTo(); h != createHeight {
-		t.Errorf("Initial sync height %v does not match expected %v.", h, createHeight)
+	info2, err := w.Address(addrWithPrivKey)
+	if err != nil {
+		t.Errorf("no address in re-read wallet")
+	}
+	pka2 := info2.(PubKeyAddress)
+	key2, err := pka2.PrivKey()
+	if err != nil {
+		t.Errorf("Private key for re-read wallet was not created! %v", err)
 		return
 	}
 
-	// import priv key
-	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, false)
+	// Keys returned by both wallets must match.
+	if !reflect.DeepEqual(key1, key2) {
+		t.Errorf("Private keys for address originally created without one mismtach between original and re-read wallet.")
+		return
+	}
+
+	// Sign some data with the private key, then verify signature with the pubkey.
+	hash := []byte("hash to sign")
+	r, s, err := ecdsa.Sign(rand.Reader, key1, hash)
 	if err != nil {
-		t.Fatal(err)
+		t.Errorf("Unable to sign hash with the created private key: %v", err)
+		return
 	}
-	importHeight := int32(50)
-	importedAt := makeBS(importHeight)
-	address, err := w.ImportPrivateKey(wif, importedAt)
+	pubKey := pkinfo.PubKey()
+	ok := ecdsa.Verify(pubKey.ToECDSA(), hash, r, s)
+	if !ok {
+		t.Errorf("ECDSA verification failed; address's pubkey mismatches the privkey.")
+		return
+	}
+
+	nextAddr, err := w.NextChainedAddress(makeBS(0))
 	if err != nil {
-		t.Error("importing private key: " + err.Error())
+		t.Errorf("Unable to create next address after finding the privkey: %v", err)
+		return
+	}
+
+	nextInfo, err := w.Address(nextAddr)
+	if err != nil {
+		t.Errorf("Couldn't get info about the next address in the chain: %v", err)
+		return
+	}
+	nextPkInfo := nextInfo.(PubKeyAddress)
+	nextKey, err := nextPkInfo.PrivKey()
+	if err != nil {
+		t.Errorf("Couldn't get private key for the next address in the chain: %v", err)
+		return
+	}
+
+	// Do an ECDSA signature check here as well, this time for the next
+	// address after the one made without the private key.
+	r, s, err = ecdsa.Sign(rand.Reader, nextKey, hash)
+	if err != nil {
+		t.Errorf("Unable to sign hash with the created private key: %v", err)
+		return
+	}
+	pubKey = nextPkInfo.PubKey()
+	ok = ecdsa.Verify(pubKey.ToECDSA(), hash, r, s)
+	if !ok {
+		t.Errorf("ECDSA verification failed; next address's keypair does not match.")
+		return
+	}
+
+	// Check that the serialized wallet correctly unmarked the 'needs private
+	// keys later' flag.
+	buf := new(bytes.Buffer)
+	w2.WriteTo(buf)
+	w2.ReadFrom(buf)
+	err = w2.Unlock([]byte("banana"))
+	if err != nil {
+		t.Errorf("Unlock after serialize/deserialize failed: %v", err)
+		return
+	}
+}
+
+func TestWatchingWalletExport(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	// Maintain a set of the active addresses in the wallet.
+	activeAddrs := make(map[addressKey]struct{})
+
+	// Add root address.
+	activeAddrs[getAddressKey(w.LastChainedAddress())] = struct{}{}
+
+	// Create watching wallet from w.
+	ww, err := w.ExportWatchingWallet()
+	if err != nil {
+		t.Errorf("Could not create watching wallet: %v", err)
+		return
+	}
+
+	// Verify correctness of wallet flags.
+	if ww.flags.useEncryption {
+		t.Errorf("Watching wallet marked as using encryption (but nothing to encrypt).")
+		return
+	}
+	if !ww.flags.watchingOnly {
+		t.Errorf("Wallet should be watching-only but is not marked so.")
 		return
 	}
 
-	addr, err := w.Address(address)
-	if err != nil {
-		t.Error("privkey just imported missing: " + err.Error())
+	// Verify that all flags are set as expected.
+	if ww.keyGenerator.flags.encrypted {
+		t.Errorf("Watching root address should not be encrypted (nothing to encrypt)")
+		return
+	}
+	if ww.keyGenerator.flags.hasPrivKey {
+		t.Errorf("Watching root address marked as having a private key.")
+		return
+	}
+	if !ww.keyGenerator.flags.hasPubKey {
+		t.Errorf("Watching root address marked as missing a public key.")
+		return
+	}
+	if ww.keyGenerator.flags.createPrivKeyNextUnlock {
+		t.Errorf("Watching root address marked as needing a private key to be generated later.")
+		return
+	}
+	for apkh, waddr := range ww.addrMap {
+		switch addr := waddr.(type) {
+		case *btcAddress:
+			if addr.flags.encrypted {
+				t.Errorf("Chained address should not be encrypted (nothing to encrypt)")
+				return
+			}
+			if addr.flags.hasPrivKey {
+				t.Errorf("Chained address marked as having a private key.")
+				return
+			}
+			if !addr.flags.hasPubKey {
+				t.Errorf("Chained address marked as missing a public key.")
+				return
+			}
+			if addr.flags.createPrivKeyNextUnlock {
+				t.Errorf("Chained address marked as needing a private key to be generated later.")
+				return
+			}
+		case *scriptAddress:
+			t.Errorf("Chained address was a script!")
+			return
+		default:
+			t.Errorf("Chained address unknown type!")
+			return
+		}
+
+		if _, ok := activeAddrs[apkh]; !ok {
+			t.Errorf("Address from watching wallet not found in original wallet.")
+			return
+		}
+		delete(activeAddrs, apkh)
+	}
+	if len(activeAddrs) != 0 {
+		t.Errorf("%v address(es) were not exported to watching wallet.", len(activeAddrs))
+		return
+	}
+
+	// Check that the new addresses created by each wallet match.  The
+	// original wallet is unlocked so addresses are chained with privkeys.
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Unlocking original wallet failed: %v", err)
+	}
+
+	// Test that ExtendActiveAddresses for the watching wallet match
+	// manually requested addresses of the original wallet.
+	var newAddrs []btcutil.Address
+	for i := 0; i < 10; i++ {
+		addr, err := w.NextChainedAddress(createdAt)
+		if err != nil {
+			t.Errorf("Cannot get next chained address for original wallet: %v", err)
+			return
+		}
+		newAddrs = append(newAddrs, addr)
+	}
+	newWWAddrs, err := ww.ExtendActiveAddresses(10)
+	if err != nil {
+		t.Errorf("Cannot extend active addresses for watching wallet: %v", err)
+		return
+	}
+	for i := range newAddrs {
+		if newAddrs[i].EncodeAddress() != newWWAddrs[i].EncodeAddress() {
+			t.Errorf("Extended active addresses do not match manually requested addresses.")
+			return
+		}
+	}
+
+	// Test ExtendActiveAddresses for the original wallet after manually
+	// requesting addresses for the watching wallet.
+	newWWAddrs = nil
+	for i := 0; i < 10; i++ {
+		addr, err := ww.NextChainedAddress(createdAt)
+		if err != nil {
+			t.Errorf("Cannot get next chained address for watching wallet: %v", err)
+			return
+		}
+		newWWAddrs = append(newWWAddrs, addr)
+	}
+	newAddrs, err = w.ExtendActiveAddresses(10)
+	if err != nil {
+		t.Errorf("Cannot extend active addresses for original wallet: %v", err)
+		return
+	}
+	for i := range newAddrs {
+		if newAddrs[i].EncodeAddress() != newWWAddrs[i].EncodeAddress() {
+			t.Errorf("Extended active addresses do not match manually requested addresses.")
+			return
+		}
+	}
+
+	// Test (de)serialization of watching wallet.
+	buf := new(bytes.Buffer)
+	_, err = ww.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write watching wallet: %v", err)
+		return
+	}
+	ww2 := new(Store)
+	_, err = ww2.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read watching wallet: %v", err)
+		return
+	}
+
+	// The exported wallet has never been written to its file, but the
+	// read-in copy is not dirty until modified.
+	if !ww.IsDirty() || ww2.IsDirty() {
+		t.Error("Exported or read-in watching wallet has wrong dirty flag.")
+		return
+	}
+	ww2.dirty = true
+
+	// Check that (de)serialized watching wallet matches the exported wallet.
+	if !reflect.DeepEqual(ww, ww2) {
+		t.Error("Exported and read-in watching wallets do not match.")
+		return
+	}
+
+	// Verify that nonsensical functions fail with correct error.
+	if err := ww.Lock(); err != ErrWatchingOnly {
+		t.Errorf("Nonsensical func Lock returned no or incorrect error: %v", err)
+		return
+	}
+	if err := ww.Unlock([]byte("banana")); err != ErrWatchingOnly {
+		t.Errorf("Nonsensical func Unlock returned no or incorrect error: %v", err)
+		return
+	}
+	generator, err := ww.Address(w.keyGenerator.Address())
+	if err != nil {
+		t.Errorf("generator isnt' present in wallet")
+	}
+	gpk := generator.(PubKeyAddress)
+	if _, err := gpk.PrivKey(); err != ErrWatchingOnly {
+		t.Errorf("Nonsensical func AddressKey returned no or incorrect error: %v", err)
+		return
+	}
+	if _, err := ww.ExportWatchingWallet(); err != ErrWatchingOnly {
+		t.Errorf("Nonsensical func ExportWatchingWallet returned no or incorrect error: %v", err)
+		return
+	}
+	pk, _ := btcec.PrivKeyFromBytes(btcec.S256(), make([]byte, 32))
+	wif, err := btcutil.NewWIF(pk, tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ww.ImportPrivateKey(wif, createdAt); err != ErrWatchingOnly {
+		t.Errorf("Nonsensical func ImportPrivateKey returned no or incorrect error: %v", err)
+		return
+	}
+}
+
+func TestFirstBlockHistogram(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(5))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	for _, height := range []int32{5, 120, 150, 199, 200, 1000} {
+		if _, err := w.NextChainedAddress(makeBS(height)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+
+	// The root address was created at height 5.
+	want := map[int32]int{0: 2, 100: 3, 200: 1, 1000: 1}
+	if h := w.FirstBlockHistogram(100); !reflect.DeepEqual(h, want) {
+		t.Errorf("Histogram %v does not match expected %v", h, want)
+		return
+	}
+	if h := w.FirstBlockHistogram(0); h != nil {
+		t.Errorf("Histogram with zero bucket size is %v", h)
+	}
+}
+
+func TestSetAddressFirstBlock(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(100))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err = w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := w.ImportPrivateKey(wif, makeBS(80))
+	if err != nil {
+		t.Error("importing private key: " + err.Error())
+		return
+	}
+	if err := w.SetSyncStatus(address, FullSync{}); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+
+	if err := w.SetAddressFirstBlock(address, 30); err != nil {
+		t.Errorf("Cannot set first block: %v", err)
+		return
+	}
+	wa, err := w.Address(address)
+	if err != nil {
+		t.Errorf("Cannot get address: %v", err)
+		return
+	}
+	if wa.FirstBlock() != 30 {
+		t.Errorf("First block %d does not match expected 30", wa.FirstBlock())
+		return
+	}
+	if ss, ok := wa.SyncStatus().(Unsynced); !ok || int32(ss) != 30 {
+		t.Errorf("Unexpected sync status %#v", wa.SyncStatus())
+		return
+	}
+	if _, h := w.SyncedTo(); h != 30 {
+		t.Errorf("Sync height %d does not match expected 30", h)
+		return
+	}
+
+	// The first block is never raised.
+	if err := w.SetAddressFirstBlock(address, 60); err != nil {
+		t.Errorf("Cannot set first block: %v", err)
+		return
+	}
+	if wa.FirstBlock() != 30 {
+		t.Errorf("First block was raised to %d", wa.FirstBlock())
+		return
+	}
+
+	pk2, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	missing, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160((*btcec.PublicKey)(&pk2.PublicKey).SerializeCompressed()),
+		tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAddressFirstBlock(missing, 10); err != ErrAddressNotFound {
+		t.Errorf("Setting first block of missing address: %v", err)
+	}
+}
+
+func TestImportPrivateKey(t *testing.T) {
+	createHeight := int32(100)
+	createdAt := makeBS(createHeight)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	if err = w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock original wallet: %v", err)
+		return
+	}
+
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+
+	// verify that the entire wallet's sync height matches the
+	// expected createHeight.
+	if _, h := w.SyncedTo(); h != createHeight {
+		t.Errorf("Initial sync height %v does not match expected %v.", h, createHeight)
+		return
+	}
+
+	// import priv key
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importHeight := int32(50)
+	importedAt := makeBS(importHeight)
+	address, err := w.ImportPrivateKey(wif, importedAt)
+	if err != nil {
+		t.Error("importing private key: " + err.Error())
+		return
+	}
+
+	addr, err := w.Address(address)
+	if err != nil {
+		t.Error("privkey just imported missing: " + err.Error())
+		return
+	}
+	pka := addr.(PubKeyAddress)
+
+	// lookup address
+	pk2, err := pka.PrivKey()
+	if err != nil {
+		t.Error("error looking up key: " + err.Error())
+	}
+
+	if !reflect.DeepEqual(pk, pk2) {
+		t.Error("original and looked-up private keys do not match.")
+		return
+	}
+
+	// verify that the sync height now match the (smaller) import height.
+	if _, h := w.SyncedTo(); h != importHeight {
+		t.Errorf("After import sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// serialise and deseralise and check still there.
+
+	// Test (de)serialization of wallet.
+	buf := new(bytes.Buffer)
+	_, err = w.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	_, err = w2.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Verify that the  sync height match expected after the reserialization.
+	if _, h := w2.SyncedTo(); h != importHeight {
+		t.Errorf("After reserialization sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// Mark imported address as partially synced with a block somewhere inbetween
+	// the import height and the chain height.
+	partialHeight := (createHeight-importHeight)/2 + importHeight
+	if err := w2.SetSyncStatus(address, PartialSync(partialHeight)); err != nil {
+		t.Errorf("Cannot mark address partially synced: %v", err)
+		return
+	}
+	if _, h := w2.SyncedTo(); h != partialHeight {
+		t.Errorf("After address partial sync, sync height %v does not match expected %v.", h, partialHeight)
+		return
+	}
+
+	// Test serialization with the partial sync.
+	buf.Reset()
+	_, err = w2.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w3 := new(Store)
+	_, err = w3.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Test correct partial height after serialization.
+	if _, h := w3.SyncedTo(); h != partialHeight {
+		t.Errorf("After address partial sync and reserialization, sync height %v does not match expected %v.",
+			h, partialHeight)
+		return
+	}
+
+	// Mark imported address as not synced at all, and verify sync height is now
+	// the import height.
+	if err := w3.SetSyncStatus(address, Unsynced(0)); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+	if _, h := w3.SyncedTo(); h != importHeight {
+		t.Errorf("After address unsync, sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// Mark imported address as synced with the recently-seen blocks, and verify
+	// that the sync height now equals the most recent block (the one at wallet
+	// creation).
+	if err := w3.SetSyncStatus(address, FullSync{}); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+	if _, h := w3.SyncedTo(); h != createHeight {
+		t.Errorf("After address sync, sync height %v does not match expected %v.", h, createHeight)
+		return
+	}
+
+	if err = w3.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock deserialised wallet: %v", err)
+		return
+	}
+
+	addr3, err := w3.Address(address)
+	if err != nil {
+		t.Error("privkey in deserialised wallet missing : " +
+			err.Error())
+		return
+	}
+	pka3 := addr3.(PubKeyAddress)
+
+	// lookup address
+	pk2, err = pka3.PrivKey()
+	if err != nil {
+		t.Error("error looking up key in deserialized wallet: " + err.Error())
+	}
+
+	if !reflect.DeepEqual(pk, pk2) {
+		t.Error("original and deserialized private keys do not match.")
+		return
+	}
+
+}
+
+func TestImportMiniPrivKey(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+
+	invalid := []string{
+		"S6c56bnXQiBjk9mqSYE7ykVQ7NzrRz", // bad checksum
+		"S6c56bnXQiBjk9mqSYE7ykVQ7NzrR",  // bad length
+		"A6c56bnXQiBjk9mqSYE7ykVQ7NzrRy", // bad prefix
+		"S6c56bnXQiBjk9mqSYE7ykVQ7NzrR0", // not base58
+	}
+	for _, mini := range invalid {
+		if _, err := w.ImportMiniPrivKey(mini, false, makeBS(0)); err == nil {
+			t.Errorf("Importing invalid mini key %s did not fail", mini)
+			return
+		}
+	}
+
+	addr, err := w.ImportMiniPrivKey("S6c56bnXQiBjk9mqSYE7ykVQ7NzrRy", false,
+		makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import mini private key: %v", err)
+		return
+	}
+	privKey, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	want := "4c7a9640c72dc2099f23715d0c8a0d8a35f8906e3cab61dd3f78b67bf887c9ab"
+	if hex.EncodeToString(privKey) != want {
+		t.Errorf("Private key %x does not match expected %s", privKey, want)
+		return
+	}
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot get address: %v", err)
+		return
+	}
+	if wa.Compressed() || !wa.Imported() {
+		t.Error("Mini private key address is compressed or not imported")
+	}
+}
+
+func TestImportPrivateKeys(t *testing.T) {
+	createdAt := makeBS(100)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	wifs := make([]*btcutil.WIF, 3)
+	for i := range wifs {
+		pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+		if err != nil {
+			t.Error("Error generating private key: " + err.Error())
+			return
+		}
+		wifs[i], err = btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All imports must fail while locked.
+	_, errs := w.ImportPrivateKeys(wifs, createdAt)
+	for i, err := range errs {
+		if err != ErrLocked {
+			t.Errorf("Import %d to locked wallet did not fail correctly: %v", i, err)
+			return
+		}
+	}
+
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+
+	// Import the middle key first so it is a duplicate in the batch.
+	if _, err := w.ImportPrivateKey(wifs[1], createdAt); err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	addrs, errs := w.ImportPrivateKeys(wifs, createdAt)
+	if len(addrs) != len(wifs) || len(errs) != len(wifs) {
+		t.Errorf("Results not parallel to keys: %d addresses, %d errors", len(addrs), len(errs))
+		return
+	}
+	for i := range wifs {
+		if i == 1 {
+			if addrs[i] != nil || errs[i] != ErrDuplicate {
+				t.Errorf("Duplicate import did not fail correctly: %v", errs[i])
+				return
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("Cannot import key %d: %v", i, errs[i])
+			return
+		}
+		if _, err := w.Address(addrs[i]); err != nil {
+			t.Errorf("Imported address %d missing: %v", i, err)
+			return
+		}
+	}
+}
+
+func TestDumpAllPrivKeys(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.DumpAllPrivKeys(); err != ErrLocked {
+		t.Errorf("Dumping keys while locked did not fail correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ImportPrivateKey(wif, makeBS(0)); err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	if _, err := w.ImportScript(script, makeBS(0)); err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+
+	dump, err := w.DumpAllPrivKeys()
+	if err != nil {
+		t.Errorf("Cannot dump private keys: %v", err)
+		return
+	}
+
+	// Every active address except the script is dumped, in order.
+	var want []btcutil.Address
+	for _, wa := range w.SortedActiveAddresses() {
+		if _, ok := wa.(PubKeyAddress); ok {
+			want = append(want, wa.Address())
+		}
+	}
+	if len(dump) != len(want) {
+		t.Errorf("Dumped %d keys, expected %d", len(dump), len(want))
+		return
+	}
+	for i, d := range dump {
+		if d.Address.EncodeAddress() != want[i].EncodeAddress() {
+			t.Errorf("Dumped address %d is %v, expected %v", i,
+				d.Address, want[i])
+			return
+		}
+		privKey, err := w.PrivKeyBytes(d.Address)
+		if err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+		if !bytes.Equal(d.WIF.PrivKey.Serialize(), privKey) {
+			t.Errorf("Dumped key %d does not match", i)
+			return
+		}
+	}
+	if last := dump[len(dump)-1].WIF; last.String() != wif.String() {
+		t.Errorf("Imported key dumped as %v, expected %v", last, wif)
+	}
+}
+
+func TestVerifyChainContinuity(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.GenerateGapAddresses(5, makeBS(0)); err != nil {
+		t.Errorf("Cannot generate addresses: %v", err)
+		return
+	}
+
+	if err := w.VerifyChainContinuity([]byte("banana")); err != nil {
+		t.Errorf("Cannot verify chain: %v", err)
+		return
+	}
+	if !w.IsLocked() {
+		t.Error("Verifying chain unlocked the wallet")
+		return
+	}
+	if err := w.VerifyChainContinuity([]byte("apple")); err != ErrWrongPassphrase {
+		t.Errorf("Verifying with wrong passphrase did not fail correctly: %v", err)
+		return
+	}
+
+	// Replace the public key of a chained address.
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	a := w.addrMap[getAddressKey(w.chainIdxMap[3])].(*btcAddress)
+	a.pubKey = (*btcec.PublicKey)(&pk.PublicKey)
+	err = w.VerifyChainContinuity([]byte("banana"))
+	if err != ChainBreakError(3) {
+		t.Errorf("Broken chain did not fail correctly: %v", err)
+	}
+}
+
+func TestTryDecryptAddress(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	want, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock: %v", err)
+		return
+	}
+
+	key := kdf([]byte("banana"), &w.kdfParams)
+	privKeyCT, ok := w.TryDecryptAddress(addr, key)
+	if !ok {
+		t.Error("Cannot decrypt address with correct key")
+		return
+	}
+	if !bytes.Equal(privKeyCT, want) {
+		t.Error("Decrypted private key does not match")
+		return
+	}
+	if !w.IsLocked() {
+		t.Error("Decrypting an address unlocked the wallet")
+		return
+	}
+
+	wrongKey := kdf([]byte("apple"), &w.kdfParams)
+	if _, ok := w.TryDecryptAddress(addr, wrongKey); ok {
+		t.Error("Decrypted address with wrong key")
+		return
+	}
+	if _, ok := w.TryDecryptAddress(addr, key[:16]); ok {
+		t.Error("Decrypted address with short key")
+	}
+}
+
+func TestOwnershipProof(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	other, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	challenge := []byte("sign this nonce")
+	proof, err := w.ProveOwnership(addr, challenge)
+	if err != nil {
+		t.Errorf("Cannot prove ownership: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name      string
+		addr      btcutil.Address
+		challenge []byte
+		ok        bool
+	}{
+		{"owned address", addr, challenge, true},
+		{"other address", other, challenge, false},
+		{"other challenge", addr, []byte("another nonce"), false},
+	}
+	for _, test := range tests {
+		ok, err := VerifyOwnership(test.addr, test.challenge, proof)
+		if err != nil {
+			t.Errorf("%s: cannot verify ownership: %v", test.name, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: verified %v, expected %v", test.name, ok, test.ok)
+		}
+	}
+
+	// A pubkey address verifies as well.
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot get address: %v", err)
+		return
+	}
+	pka, err := btcutil.NewAddressPubKey(wa.(PubKeyAddress).PubKey().SerializeCompressed(),
+		tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyOwnership(pka, challenge, proof); err != nil || !ok {
+		t.Errorf("Cannot verify pubkey address ownership: %v %v", ok, err)
+		return
+	}
+
+	if _, err := VerifyOwnership(addr, challenge, proof[1:]); err == nil {
+		t.Error("Verifying a malformed proof did not fail")
+		return
+	}
+
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock: %v", err)
+		return
+	}
+	if _, err := w.ProveOwnership(addr, challenge); err != ErrLocked {
+		t.Errorf("Proving ownership while locked: %v", err)
+	}
+}
+
+func TestPrivKeyBytes(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	b, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key bytes: %v", err)
+		return
+	}
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot find address: %v", err)
+		return
+	}
+	pk, err := wa.(PubKeyAddress).PrivKey()
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	if len(b) != 32 || new(big.Int).SetBytes(b).Cmp(pk.D) != 0 {
+		t.Errorf("Private key bytes do not match private key")
+		return
+	}
+
+	// The returned bytes are a copy which survives locking.
+	saved := append([]byte(nil), b...)
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock: %v", err)
+		return
+	}
+	if !bytes.Equal(b, saved) {
+		t.Errorf("Private key bytes modified by lock")
+	}
+	if _, err := w.PrivKeyBytes(addr); err != ErrLocked {
+		t.Errorf("PrivKeyBytes on locked wallet did not fail correctly: %v", err)
+		return
+	}
+
+	unknownAddr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Errorf("Cannot create address: %v", err)
+		return
+	}
+	if _, err := w.PrivKeyBytes(unknownAddr); err != ErrAddressNotFound {
+		t.Errorf("PrivKeyBytes for unknown address did not fail correctly: %v", err)
+	}
+}
+
+// mapUTXOSource is a UTXOSource backed by a map of encoded addresses to
+// unspent amounts.
+type mapUTXOSource map[string]btcutil.Amount
+
+func (m mapUTXOSource) Unspent(addr btcutil.Address) (btcutil.Amount, error) {
+	return m[addr.EncodeAddress()], nil
+}
+
+func TestBalances(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	scriptAddr, err := w.ImportScript(script, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+
+	// Unused addresses in the key pool must not be counted.
+	unused, err := w.GenerateGapAddresses(1, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot generate gap addresses: %v", err)
+		return
+	}
+
+	src := mapUTXOSource{
+		w.chainIdxMap[rootKeyChainIdx].EncodeAddress(): 1,
+		addr.EncodeAddress():                           10,
+		scriptAddr.EncodeAddress():                     100,
+		unused[0].Address().EncodeAddress():            1000,
+	}
+	total, err := w.TotalBalance(src)
+	if err != nil {
+		t.Errorf("Cannot get total balance: %v", err)
+		return
+	}
+	if total != 11 {
+		t.Errorf("Total balance %v does not match expected 11", total)
+	}
+	watched, err := w.WatchedBalance(src)
+	if err != nil {
+		t.Errorf("Cannot get watched balance: %v", err)
+		return
+	}
+	if watched != 100 {
+		t.Errorf("Watched balance %v does not match expected 100", watched)
+	}
+}
+
+func TestAddressForScript(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	pkScript, err := btcscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Errorf("Cannot create output script: %v", err)
+		return
+	}
+	found, err := w.AddressForScript(pkScript)
+	if err != nil {
+		t.Errorf("Cannot find address for script: %v", err)
+		return
+	}
+	if found.EncodeAddress() != addr.EncodeAddress() {
+		t.Errorf("Found address %v does not match expected %v", found, addr)
+		return
+	}
+
+	unknownAddr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Errorf("Cannot create address: %v", err)
+		return
+	}
+	pkScript, err = btcscript.PayToAddrScript(unknownAddr)
+	if err != nil {
+		t.Errorf("Cannot create output script: %v", err)
+		return
+	}
+	if _, err := w.AddressForScript(pkScript); err != ErrAddressNotFound {
+		t.Errorf("Script paying to unknown address did not fail correctly: %v", err)
+		return
+	}
+
+	nonstandard := []byte{btcscript.OP_TRUE}
+	if _, err := w.AddressForScript(nonstandard); err == nil {
+		t.Error("Non pay-to-pubkey-hash script did not fail")
+	}
+}
+
+func TestPayToAddrScript(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	pkScript, err := w.PayToAddrScript(addr)
+	if err != nil {
+		t.Errorf("Cannot create output script: %v", err)
+		return
+	}
+	found, err := w.AddressForScript(pkScript)
+	if err != nil {
+		t.Errorf("Cannot find address for script: %v", err)
+		return
+	}
+	if found.EncodeAddress() != addr.EncodeAddress() {
+		t.Errorf("Script pays to %v, expected %v", found, addr)
+		return
+	}
+
+	unknownAddr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Errorf("Cannot create address: %v", err)
+		return
+	}
+	if _, err := w.PayToAddrScript(unknownAddr); err != ErrAddressNotFound {
+		t.Errorf("Script for unknown address did not fail correctly: %v", err)
+	}
+}
+
+func TestForEachActiveAddress(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	if _, err := w.ImportScript(script, makeBS(0)); err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+
+	var visited []WalletAddress
+	err = w.ForEachActiveAddress(func(wa WalletAddress) error {
+		visited = append(visited, wa)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error iterating addresses: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(visited, w.SortedActiveAddresses()) {
+		t.Error("Iterated addresses do not match sorted active addresses")
+		return
+	}
+
+	// Iteration stops at the first error.
+	stop := errors.New("stop")
+	var n int
+	err = w.ForEachActiveAddress(func(wa WalletAddress) error {
+		n++
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("Iteration did not stop correctly: %v after %d addresses", err, n)
+	}
+}
+
+func TestImportScript(t *testing.T) {
+	createHeight := int32(100)
+	createdAt := makeBS(createHeight)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	if err = w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock original wallet: %v", err)
+		return
+	}
+
+	// verify that the entire wallet's sync height matches the
+	// expected createHeight.
+	if _, h := w.SyncedTo(); h != createHeight {
+		t.Errorf("Initial sync height %v does not match expected %v.", h, createHeight)
+		return
+	}
+
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	importHeight := int32(50)
+	stamp := makeBS(importHeight)
+	address, err := w.ImportScript(script, stamp)
+	if err != nil {
+		t.Error("error importing script: " + err.Error())
+		return
+	}
+
+	// lookup address
+	ainfo, err := w.Address(address)
+	if err != nil {
+		t.Error("error looking up script: " + err.Error())
+	}
+
+	sinfo := ainfo.(ScriptAddress)
+
+	if !bytes.Equal(script, sinfo.Script()) {
+		t.Error("original and looked-up script do not match.")
+		return
+	}
+
+	if sinfo.ScriptClass() != btcscript.NonStandardTy {
+		t.Error("script type incorrect.")
+		return
+	}
+
+	if sinfo.RequiredSigs() != 0 {
+		t.Error("required sigs funny number")
+		return
+	}
+
+	if len(sinfo.Addresses()) != 0 {
+		t.Error("addresses in bogus script.")
+		return
+	}
+
+	if sinfo.Address().EncodeAddress() != address.EncodeAddress() {
+		t.Error("script address doesn't match entry.")
+		return
+	}
+
+	if string(sinfo.Address().ScriptAddress()) != sinfo.AddrHash() {
+		t.Error("script hash doesn't match address.")
+		return
+	}
+
+	if sinfo.FirstBlock() != importHeight {
+		t.Error("funny first block")
+		return
+	}
+
+	if !sinfo.Imported() {
+		t.Error("imported script info not imported.")
+		return
+	}
+
+	if sinfo.Change() {
+		t.Error("imported script is change.")
+		return
+	}
+
+	if sinfo.Compressed() {
+		t.Error("imported script is compressed.")
+		return
+	}
+
+	// verify that the sync height now match the (smaller) import height.
+	if _, h := w.SyncedTo(); h != importHeight {
+		t.Errorf("After import sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// Check that it's included along with the active payment addresses.
+	found := false
+	for _, wa := range w.SortedActiveAddresses() {
+		if wa.Address() == address {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("Imported script address was not returned with sorted active payment addresses.")
+		return
+	}
+	if _, ok := w.ActiveAddresses()[address]; !ok {
+		t.Errorf("Imported script address was not returned with unsorted active payment addresses.")
+		return
+	}
+
+	// serialise and deseralise and check still there.
+
+	// Test (de)serialization of wallet.
+	buf := new(bytes.Buffer)
+	_, err = w.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	_, err = w2.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Verify that the sync height matches expected after the reserialization.
+	if _, h := w2.SyncedTo(); h != importHeight {
+		t.Errorf("After reserialization sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// lookup address
+	ainfo2, err := w2.Address(address)
+	if err != nil {
+		t.Error("error looking up info in deserialized wallet: " + err.Error())
+	}
+
+	sinfo2 := ainfo2.(ScriptAddress)
+	// Check all the same again. We can't use reflect.DeepEquals since
+	// the internals have pointers back to the wallet struct.
+	if sinfo2.Address().EncodeAddress() != address.EncodeAddress() {
+		t.Error("script address doesn't match entry.")
+		return
+	}
+
+	if string(sinfo2.Address().ScriptAddress()) != sinfo2.AddrHash() {
+		t.Error("script hash doesn't match address.")
+		return
+	}
+
+	if sinfo2.FirstBlock() != importHeight {
+		t.Error("funny first block")
+		return
+	}
+
+	if !sinfo2.Imported() {
+		t.Error("imported script info not imported.")
+		return
+	}
+
+	if sinfo2.Change() {
+		t.Error("imported script is change.")
+		return
+	}
+
+	if sinfo2.Compressed() {
+		t.Error("imported script is compressed.")
+		return
+	}
+
+	if !bytes.Equal(sinfo.Script(), sinfo2.Script()) {
+		t.Error("original and serailised scriptinfo scripts "+
+			"don't match %s != %s", spew.Sdump(sinfo.Script()),
+			spew.Sdump(sinfo2.Script()))
+	}
+
+	if sinfo.ScriptClass() != sinfo2.ScriptClass() {
+		t.Error("original and serailised scriptinfo class "+
+			"don't match: %s != %s", sinfo.ScriptClass(),
+			sinfo2.ScriptClass())
+		return
+	}
+
+	if !reflect.DeepEqual(sinfo.Addresses(), sinfo2.Addresses()) {
+		t.Error("original and serailised scriptinfo addresses "+
+			"don't match (%s) != (%s)", spew.Sdump(sinfo.Addresses),
+			spew.Sdump(sinfo2.Addresses()))
+		return
+	}
+
+	if sinfo.RequiredSigs() != sinfo.RequiredSigs() {
+		t.Errorf("original and serailised scriptinfo requiredsigs "+
+			"don't match %d != %d", sinfo.RequiredSigs(),
+			sinfo2.RequiredSigs())
+		return
+	}
+
+	// Check that it's included along with the active payment addresses.
+	found = false
+	for _, wa := range w.SortedActiveAddresses() {
+		if wa.Address() == address {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("After reserialiation, imported script address was not returned with sorted " +
+			"active payment addresses.")
+		return
+	}
+	if _, ok := w.ActiveAddresses()[address]; !ok {
+		t.Errorf("After reserialiation, imported script address was not returned with unsorted " +
+			"active payment addresses.")
+		return
+	}
+
+	// Mark imported address as partially synced with a block somewhere inbetween
+	// the import height and the chain height.
+	partialHeight := (createHeight-importHeight)/2 + importHeight
+	if err := w2.SetSyncStatus(address, PartialSync(partialHeight)); err != nil {
+		t.Errorf("Cannot mark address partially synced: %v", err)
+		return
+	}
+	if _, h := w2.SyncedTo(); h != partialHeight {
+		t.Errorf("After address partial sync, sync height %v does not match expected %v.", h, partialHeight)
+		return
+	}
+
+	// Test serialization with the partial sync.
+	buf.Reset()
+	_, err = w2.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w3 := new(Store)
+	_, err = w3.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Test correct partial height after serialization.
+	if _, h := w3.SyncedTo(); h != partialHeight {
+		t.Errorf("After address partial sync and reserialization, sync height %v does not match expected %v.",
+			h, partialHeight)
+		return
+	}
+
+	// Mark imported address as not synced at all, and verify sync height is now
+	// the import height.
+	if err := w3.SetSyncStatus(address, Unsynced(0)); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+	if _, h := w3.SyncedTo(); h != importHeight {
+		t.Errorf("After address unsync, sync height %v does not match expected %v.", h, importHeight)
+		return
+	}
+
+	// Mark imported address as synced with the recently-seen blocks, and verify
+	// that the sync height now equals the most recent block (the one at wallet
+	// creation).
+	if err := w3.SetSyncStatus(address, FullSync{}); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+	if _, h := w3.SyncedTo(); h != createHeight {
+		t.Errorf("After address sync, sync height %v does not match expected %v.", h, createHeight)
+		return
+	}
+
+	if err = w3.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock deserialised wallet: %v", err)
+		return
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	// Changing the passphrase with a locked wallet must fail with ErrWalletLocked.
+	if err := w.ChangePassphrase([]byte("potato")); err != ErrLocked {
+		t.Errorf("Changing passphrase on a locked wallet did not fail correctly: %v", err)
+		return
+	}
+
+	// Unlock wallet so the passphrase can be changed.
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+
+	// Get root address and its private key.  This is compared to the private
+	// key post passphrase change.
+	rootAddr := w.LastChainedAddress()
+
+	rootAddrInfo, err := w.Address(rootAddr)
+	if err != nil {
+		t.Error("can't find root address: " + err.Error())
+		return
+	}
+	rapka := rootAddrInfo.(PubKeyAddress)
+
+	rootPrivKey, err := rapka.PrivKey()
+	if err != nil {
+		t.Errorf("Cannot get root address' private key: %v", err)
+		return
+	}
+
+	// Change passphrase.
+	if err := w.ChangePassphrase([]byte("potato")); err != nil {
+		t.Errorf("Changing passhprase failed: %v", err)
+		return
+	}
+
+	// Wallet should still be unlocked.
+	if w.IsLocked() {
+		t.Errorf("Wallet should be unlocked after passphrase change.")
+		return
+	}
+
+	// Lock it.
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet after passphrase change: %v", err)
+		return
+	}
+
+	// Unlock with old passphrase.  This must fail with ErrWrongPassphrase.
+	if err := w.Unlock([]byte("banana")); err != ErrWrongPassphrase {
+		t.Errorf("Unlocking with old passphrases did not fail correctly: %v", err)
+		return
+	}
+
+	// Unlock with new passphrase.  This must succeed.
+	if err := w.Unlock([]byte("potato")); err != nil {
+		t.Errorf("Unlocking with new passphrase failed: %v", err)
+		return
+	}
+
+	// Get root address' private key again.
+	rootAddrInfo2, err := w.Address(rootAddr)
+	if err != nil {
+		t.Error("can't find root address: " + err.Error())
+		return
+	}
+	rapka2 := rootAddrInfo2.(PubKeyAddress)
+
+	rootPrivKey2, err := rapka2.PrivKey()
+	if err != nil {
+		t.Errorf("Cannot get root address' private key after passphrase change: %v", err)
+		return
+	}
+
+	// Private keys must match.
+	if !reflect.DeepEqual(rootPrivKey, rootPrivKey2) {
+		t.Errorf("Private keys before and after unlock differ.")
+		return
+	}
+}
+
+func TestComments(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	rootAddr := w.chainIdxMap[rootKeyChainIdx]
+
+	// Create comments that fit in a single entry and comments that must
+	// be split into multiple segments of a chunked comment entry.
+	shortComment := "A short comment."
+	longComment := string(bytes.Repeat([]byte("chunked "), maxCommentLen/4))
+	shortTx := btcwire.ShaHash{0x01}
+	longTx := btcwire.ShaHash{0x02}
+
+	if err := w.SetAddressComment(rootAddr, shortComment); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	if err := w.SetAddressComment(addr, longComment); err != nil {
+		t.Errorf("Cannot set long address comment: %v", err)
+		return
+	}
+	if err := w.SetTxComment(&shortTx, shortComment); err != nil {
+		t.Errorf("Cannot set tx comment: %v", err)
+		return
+	}
+	if err := w.SetTxComment(&longTx, longComment); err != nil {
+		t.Errorf("Cannot set long tx comment: %v", err)
+		return
+	}
+
+	// Comments for addresses not in the key store must fail.
+	pkh := make([]byte, 20)
+	unknownAddr, err := btcutil.NewAddressPubKeyHash(pkh, tstNetParams)
+	if err != nil {
+		t.Errorf("Cannot create address: %v", err)
+		return
+	}
+	if err := w.SetAddressComment(unknownAddr, shortComment); err != ErrAddressNotFound {
+		t.Errorf("Setting comment for unknown address did not fail correctly: %v", err)
+		return
+	}
+
+	// Serialize and deserialize the key store.  All comments must be
+	// reassembled.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock read wallet: %v", err)
+		return
+	}
+
+	addrTests := []struct {
+		addr    btcutil.Address
+		comment string
+	}{
+		{rootAddr, shortComment},
+		{addr, longComment},
+	}
+	for _, test := range addrTests {
+		c, err := w2.AddressComment(test.addr)
+		if err != nil {
+			t.Errorf("Cannot get address comment: %v", err)
+			return
+		}
+		if c != test.comment {
+			t.Errorf("Address comment does not match (length %d != %d)",
+				len(c), len(test.comment))
+		}
+	}
+	txTests := []struct {
+		tx      btcwire.ShaHash
+		comment string
+	}{
+		{shortTx, shortComment},
+		{longTx, longComment},
+	}
+	for _, test := range txTests {
+		if c := w2.TxComment(&test.tx); c != test.comment {
+			t.Errorf("Tx comment does not match (length %d != %d)",
+				len(c), len(test.comment))
+		}
+	}
+
+	// An empty comment removes the previous comment.
+	if err := w2.SetTxComment(&longTx, ""); err != nil {
+		t.Errorf("Cannot remove tx comment: %v", err)
+		return
+	}
+	if _, ok := w2.txCommentMap[transactionHashKey(longTx[:])]; ok {
+		t.Errorf("Removed tx comment is still saved")
+	}
+	if w2.HasTxComment(&longTx) || !w2.HasTxComment(&shortTx) {
+		t.Errorf("HasTxComment does not match set comments")
+	}
+
+	// Commented hashes must be listed in sorted order.
+	thirdTx := btcwire.ShaHash{0x00, 0xff}
+	if err := w2.SetTxComment(&thirdTx, shortComment); err != nil {
+		t.Errorf("Cannot set tx comment: %v", err)
+		return
+	}
+	hashes := w2.CommentedTxHashes()
+	if !reflect.DeepEqual(hashes, []btcwire.ShaHash{thirdTx, shortTx}) {
+		t.Errorf("Commented tx hashes %v do not match expected", hashes)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.SetAddressComment(addr, "A comment."); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Unlocking only changes transient state.
+	if err := w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	if diffs := w.Diff(w2); len(diffs) != 0 {
+		t.Errorf("Round tripped wallet differs: %v", diffs)
+		return
+	}
+	if !w.Equal(w2) || !w2.Equal(w) {
+		t.Error("Round tripped wallet is not equal")
+		return
+	}
+
+	if err := w2.SetAddressComment(addr, "Another comment."); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	if _, err := w2.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if w.Equal(w2) {
+		t.Error("Modified wallet is equal")
+		return
+	}
+	// The comment, highest used index, and new address must differ.
+	if diffs := w.Diff(w2); len(diffs) != 3 {
+		t.Errorf("Unexpected differences: %v", diffs)
+		return
+	}
+
+	// Differences between addresses are sorted, so the result does not
+	// change between calls.
+	for i := 0; i < 5; i++ {
+		if _, err := w2.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	diffs := w.Diff(w2)
+	for i := 0; i < 10; i++ {
+		if again := w.Diff(w2); !reflect.DeepEqual(again, diffs) {
+			t.Errorf("Differences changed from %v to %v", diffs, again)
+			return
+		}
+	}
+
+	// Diffing in both directions concurrently with writers must not
+	// deadlock.
+	done := make(chan struct{})
+	for _, pair := range [][2]*Store{{w, w2}, {w2, w}} {
+		a, b := pair[0], pair[1]
+		go func() {
+			for i := 0; i < 100; i++ {
+				a.Diff(b)
+				a.MarkDirty()
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Error("Concurrent diffs deadlocked")
+			return
+		}
+	}
+}
+
+func TestAppendAddressComment(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr := w.chainIdxMap[rootKeyChainIdx]
+
+	notes := []string{"2014-01-01 received refund", "2014-02-01 sent payment"}
+	for _, note := range notes {
+		if err := w.AppendAddressComment(addr, note); err != nil {
+			t.Errorf("Cannot append address comment: %v", err)
+			return
+		}
+	}
+	c, err := w.AddressComment(addr)
+	if err != nil {
+		t.Errorf("Cannot get address comment: %v", err)
+		return
+	}
+	if want := strings.Join(notes, "\n"); c != want {
+		t.Errorf("Address comment %q does not match expected %q", c, want)
+		return
+	}
+
+	// Notes which would overflow the limit are rejected without
+	// modifying the existing comment.
+	defer func(max int) { MaxCommentLen = max }(MaxCommentLen)
+	MaxCommentLen = len(c) + 5
+	if err := w.AppendAddressComment(addr, "12345"); err != ErrCommentTooLong {
+		t.Errorf("Appending too long note did not fail correctly: %v", err)
+		return
+	}
+	if c2, _ := w.AddressComment(addr); c2 != c {
+		t.Errorf("Rejected note modified comment to %q", c2)
+		return
+	}
+	if err := w.AppendAddressComment(addr, "1234"); err != nil {
+		t.Errorf("Cannot append note at the limit: %v", err)
+	}
+}
+
+func TestCommentTooLong(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr := w.chainIdxMap[rootKeyChainIdx]
+	tx := btcwire.ShaHash{0x01}
+
+	// Comments beyond the format limit are rejected by default.
+	tooLong := strings.Repeat("c", maxChunkedCommentLen+1)
+	if err := w.SetAddressComment(addr, tooLong); err != ErrCommentTooLong {
+		t.Errorf("Setting too long address comment did not fail correctly: %v", err)
+		return
+	}
+	if err := w.SetTxComment(&tx, tooLong); err != ErrCommentTooLong {
+		t.Errorf("Setting too long tx comment did not fail correctly: %v", err)
+		return
+	}
+
+	// A lowered limit is enforced when comments are set.
+	defer func(max int) { MaxCommentLen = max }(MaxCommentLen)
+	MaxCommentLen = 10
+	if err := w.SetAddressComment(addr, strings.Repeat("c", 11)); err != ErrCommentTooLong {
+		t.Errorf("Setting too long address comment did not fail correctly: %v", err)
+		return
+	}
+	if err := w.SetTxComment(&tx, strings.Repeat("c", 11)); err != ErrCommentTooLong {
+		t.Errorf("Setting too long tx comment did not fail correctly: %v", err)
+		return
+	}
+	if err := w.SetLabel(strings.Repeat("l", 11)); err != ErrCommentTooLong {
+		t.Errorf("Setting too long label did not fail correctly: %v", err)
+		return
+	}
+	if len(w.addrCommentMap) != 0 || len(w.txCommentMap) != 0 || len(w.label) != 0 {
+		t.Error("Rejected comments were saved")
+		return
+	}
+	if err := w.SetAddressComment(addr, strings.Repeat("c", 10)); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+	}
+}
+
+func TestReencryptedCopy(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	// Copying with the wrong passphrase must fail.
+	if _, err := w.ReencryptedCopy([]byte("potato"), []byte("potato")); err != ErrWrongPassphrase {
+		t.Errorf("Copying with wrong passphrase did not fail correctly: %v", err)
+		return
+	}
+
+	c, err := w.ReencryptedCopy([]byte("banana"), []byte("potato"))
+	if err != nil {
+		t.Errorf("Cannot create re-encrypted copy: %v", err)
+		return
+	}
+	if !c.IsLocked() {
+		t.Errorf("Re-encrypted copy is not locked")
+		return
+	}
+	if c.kdfParams.salt == w.kdfParams.salt {
+		t.Errorf("Re-encrypted copy did not generate new KDF parameters")
+		return
+	}
+
+	// The copy must only unlock with the new passphrase, and the original
+	// must only unlock with the old.
+	if err := c.Unlock([]byte("banana")); err != ErrWrongPassphrase {
+		t.Errorf("Unlocking copy with old passphrase did not fail correctly: %v", err)
+		return
+	}
+	if err := c.Unlock([]byte("potato")); err != nil {
+		t.Errorf("Cannot unlock copy with new passphrase: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock original with old passphrase: %v", err)
+		return
+	}
+
+	// Private keys of every address must match.
+	for _, addr := range w.SortedActiveAddresses() {
+		cAddr, err := c.Address(addr.Address())
+		if err != nil {
+			t.Errorf("Address missing from copy: %v", err)
+			return
+		}
+		pk, err := addr.(PubKeyAddress).PrivKey()
+		if err != nil {
+			t.Errorf("Cannot get original private key: %v", err)
+			return
+		}
+		cpk, err := cAddr.(PubKeyAddress).PrivKey()
+		if err != nil {
+			t.Errorf("Cannot get copied private key: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(pk, cpk) {
+			t.Errorf("Original and copied private keys differ")
+			return
+		}
+	}
+}
+
+func TestNextChainedAddressOverflow(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	tests := []struct {
+		name        string
+		highestUsed int64
+	}{
+		{"max int64", math.MaxInt64},
+		{"beyond last chain index", 1 << 40},
+	}
+	for _, test := range tests {
+		w.highestUsed = test.highestUsed
+		addr, err := w.NextChainedAddress(makeBS(0))
+		if err == nil {
+			t.Errorf("%s: NextChainedAddress did not fail", test.name)
+			continue
+		}
+		if addr != nil {
+			t.Errorf("%s: NextChainedAddress returned an address with "+
+				"error: %v", test.name, err)
+		}
+		if w.highestUsed != test.highestUsed {
+			t.Errorf("%s: highest used index changed from %d to %d",
+				test.name, test.highestUsed, w.highestUsed)
+		}
+	}
+}
+
+func TestWriteAddressesCSV(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	c := `An "escaped", comment`
+	if err := w.SetAddressComment(addr, c); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := w.WriteAddressesCSV(buf); err != nil {
+		t.Errorf("Cannot write CSV: %v", err)
+		return
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Errorf("Cannot read CSV: %v", err)
+		return
+	}
+
+	// Expect a header, the root address, and the chained address.
+	if len(records) != 3 {
+		t.Errorf("Unexpected number of records %d", len(records))
+		return
+	}
+	last := records[2]
+	if last[0] != addr.EncodeAddress() {
+		t.Errorf("Address %v does not match expected %v", last[0],
+			addr.EncodeAddress())
+	}
+	if last[5] != c {
+		t.Errorf("Comment %q does not match expected %q", last[5], c)
+	}
+}
+
+func TestPerAddressKeys(t *testing.T) {
+	createdAt := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, createdAt)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.EnablePerAddressKeys(); err != ErrLocked {
+		t.Errorf("Enabling per-address keys on a locked wallet did not fail correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	// Save the private keys of each address created before migrating.
+	privKeys := make(map[string]*ecdsa.PrivateKey)
+	for _, a := range w.SortedActiveAddresses() {
+		pk, err := a.(PubKeyAddress).PrivKey()
+		if err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+		privKeys[a.Address().EncodeAddress()] = pk
+	}
+
+	if err := w.EnablePerAddressKeys(); err != nil {
+		t.Errorf("Cannot enable per-address keys: %v", err)
+		return
+	}
+
+	// Addresses created after migrating must also use per-address keys.
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot find address: %v", err)
+		return
+	}
+	pk, err := wa.(PubKeyAddress).PrivKey()
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	privKeys[addr.EncodeAddress()] = pk
+
+	// Serialize and deserialize the key store, and check that every
+	// private key can still be decrypted.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock read wallet: %v", err)
+		return
+	}
+	for _, a := range w2.SortedActiveAddresses() {
+		btcAddr := a.(*btcAddress)
+		if !btcAddr.flags.perAddressKey {
+			t.Errorf("Address %v does not use a per-address key",
+				a.Address())
+		}
+		pk, err := btcAddr.PrivKey()
+		if err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(pk, privKeys[a.Address().EncodeAddress()]) {
+			t.Errorf("Private keys for address %v differ", a.Address())
+		}
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	w.Destroy()
+	w.Destroy()
+
+	if !w.IsLocked() {
+		t.Error("Destroyed wallet is unlocked")
+		return
+	}
+	if w.kdfParams.salt != [32]byte{} {
+		t.Error("KDF salt was not zeroed")
+		return
+	}
+	if w.addrMap != nil || w.chainIdxMap != nil {
+		t.Error("Address maps were not removed")
+		return
+	}
+
+	if err := w.Unlock([]byte("banana")); err != ErrDestroyed {
+		t.Errorf("Unlock: %v", err)
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != ErrDestroyed {
+		t.Errorf("NextChainedAddress: %v", err)
+	}
+	if _, err := w.Address(addr); err != ErrDestroyed {
+		t.Errorf("Address: %v", err)
+	}
+	if _, err := w.PrivKeyBytes(addr); err != ErrDestroyed {
+		t.Errorf("PrivKeyBytes: %v", err)
+	}
+	if err := w.SetAddressComment(addr, "comment"); err != ErrDestroyed {
+		t.Errorf("SetAddressComment: %v", err)
+	}
+	if _, err := w.WriteTo(new(bytes.Buffer)); err != ErrDestroyed {
+		t.Errorf("WriteTo: %v", err)
+	}
+	if len(w.SortedActiveAddresses()) != 0 {
+		t.Error("Destroyed wallet has active addresses")
+	}
+}
+
+func TestDestroyedAccessors(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.SetAddressComment(addr, "A comment."); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	txSha := btcwire.ShaHash{0x01}
+	if err := w.SetTxComment(&txSha, "A comment."); err != nil {
+		t.Errorf("Cannot set transaction comment: %v", err)
+		return
+	}
+	w.Destroy()
+
+	// Each accessor returns whether its result is empty.  None may panic.
+	tests := []struct {
+		name  string
+		empty func() bool
+	}{
+		{"ActiveAddresses", func() bool { return len(w.ActiveAddresses()) == 0 }},
+		{"SortedActiveAddresses", func() bool { return len(w.SortedActiveAddresses()) == 0 }},
+		{"LastChainedAddress", func() bool { return w.LastChainedAddress() == nil }},
+		{"RemainingKeypool", func() bool { return w.RemainingKeypool() == 0 }},
+		{"ChainIndexOf", func() bool { _, ok := w.ChainIndexOf(addr); return !ok }},
+		{"CanChainAddress", func() bool { ok, _ := w.CanChainAddress(addr); return !ok }},
+		{"FindReused", func() bool {
+			return len(w.FindReused(map[btcutil.Address]int{addr: 2})) == 0
+		}},
+		{"AddressMetadata", func() bool { return len(w.AddressMetadata()) == 0 }},
+		{"FirstBlockHistogram", func() bool { return len(w.FirstBlockHistogram(10)) == 0 }},
+		{"HasAddressComment", func() bool { return !w.HasAddressComment(addr) }},
+		{"SearchAddressComments", func() bool { return len(w.SearchAddressComments("comment")) == 0 }},
+		{"TxComment", func() bool { return w.TxComment(&txSha) == "" }},
+		{"HasTxComment", func() bool { return !w.HasTxComment(&txSha) }},
+		{"CommentedTxHashes", func() bool { return len(w.CommentedTxHashes()) == 0 }},
+		{"SearchTxComments", func() bool { return len(w.SearchTxComments("comment")) == 0 }},
+		{"Label", func() bool { return w.Label() == "" }},
+		{"NewIterateRecentBlocks", func() bool { return w.NewIterateRecentBlocks() == nil }},
+		{"RecentBlockHashAtHeight", func() bool { _, ok := w.RecentBlockHashAtHeight(0); return !ok }},
+		{"ConfirmationsAt", func() bool { return w.ConfirmationsAt(0) == 0 }},
+		{"TryDecryptAddress", func() bool {
+			_, ok := w.TryDecryptAddress(addr, make([]byte, 32))
+			return !ok
+		}},
+		{"SetSyncedWith", func() bool { w.SetSyncedWith(makeBS(5)); return w.SyncHeight() != 5 }},
+		{"ResetSyncState", func() bool { w.ResetSyncState(); return !w.IsDirty() }},
+		{"Touch", func() bool { w.Touch(); return w.LastSyncTime().IsZero() }},
+		{"MarkDirty", func() bool { w.MarkDirty(); return !w.IsDirty() }},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panic after destroy: %v", test.name, r)
+				}
+			}()
+			if !test.empty() {
+				t.Errorf("%s: non-empty result after destroy", test.name)
+			}
+		}()
+	}
+
+	if err := w.DebugDump(ioutil.Discard); err != ErrDestroyed {
+		t.Errorf("DebugDump: %v", err)
+	}
+	if err := w.UnlockAndVerify([]byte("banana")); err != ErrDestroyed {
+		t.Errorf("UnlockAndVerify: %v", err)
+	}
+}
+
+func TestUnlockAndVerify(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	var addrs []btcutil.Address
+	for i := 0; i < 3; i++ {
+		addr, err := w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w2.UnlockAndVerify([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock and verify: %v", err)
+		return
+	}
+
+	// Corrupt the encrypted private key of the second address.
+	w3 := new(Store)
+	if _, err := w3.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	wa, err := w3.Address(addrs[1])
+	if err != nil {
+		t.Errorf("Cannot find address: %v", err)
+		return
+	}
+	wa.(*btcAddress).privKey[0] ^= 1
+	err = w3.UnlockAndVerify([]byte("banana"))
+	if err == nil {
+		t.Error("Unlocking with a corrupt private key did not fail")
+		return
+	}
+	if !strings.Contains(err.Error(), addrs[1].EncodeAddress()) {
+		t.Errorf("Error does not identify corrupt address: %v", err)
+	}
+	if !w3.IsLocked() {
+		t.Error("Wallet with corrupt private key was left unlocked")
+	}
+}
+
+func TestGCM(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.EnableGCM(); err != ErrLocked {
+		t.Errorf("Enabling AES-GCM on a locked wallet did not fail correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	migrated, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.EnableGCM(); err != nil {
+		t.Errorf("Cannot enable AES-GCM: %v", err)
+		return
+	}
+	created, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	privKeys := make(map[btcutil.Address]*ecdsa.PrivateKey)
+	for _, addr := range []btcutil.Address{migrated, created} {
+		wa, err := w.Address(addr)
+		if err != nil {
+			t.Errorf("Cannot find address: %v", err)
+			return
+		}
+		if !wa.(*btcAddress).flags.gcm {
+			t.Errorf("Address %v is not encrypted with AES-GCM", addr)
+			return
+		}
+		if privKeys[addr], err = wa.(PubKeyAddress).PrivKey(); err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	w2 := new(Store)
+	if _, err := w2.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w2.Unlock([]byte("potato")); err != ErrWrongPassphrase {
+		t.Errorf("Unlocking with wrong passphrase did not fail correctly: %v", err)
+		return
+	}
+	if err := w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock read wallet: %v", err)
+		return
+	}
+	for addr, pk := range privKeys {
+		wa, err := w2.Address(addr)
+		if err != nil {
+			t.Errorf("Cannot find address: %v", err)
+			return
+		}
+		pk2, err := wa.(PubKeyAddress).PrivKey()
+		if err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(pk, pk2) {
+			t.Errorf("Private key for %v does not match after reading", addr)
+			return
+		}
+	}
+
+	// A modified encrypted private key must fail authentication.
+	w3 := new(Store)
+	if _, err := w3.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	wa, err := w3.Address(created)
+	if err != nil {
+		t.Errorf("Cannot find address: %v", err)
+		return
+	}
+	wa.(*btcAddress).privKey[0] ^= 1
+	if err := w3.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock read wallet: %v", err)
+		return
+	}
+	if _, err := wa.(PubKeyAddress).PrivKey(); err != ErrKeyAuthFailed {
+		t.Errorf("Modified private key did not fail authentication: %v", err)
+	}
+}
+
+func TestEncryptedExport(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := w.WriteEncrypted(buf, []byte("transport")); err != nil {
+		t.Errorf("Cannot write encrypted wallet: %v", err)
+		return
+	}
+	envelope := buf.Bytes()
+
+	w2, err := ReadEncrypted(bytes.NewReader(envelope), []byte("transport"))
+	if err != nil {
+		t.Errorf("Cannot read encrypted wallet: %v", err)
+		return
+	}
+	if !w.Equal(w2) {
+		t.Errorf("Decrypted wallet differs: %v", w.Diff(w2))
+		return
+	}
+
+	// The inner wallet is still encrypted by its own passphrase.
+	if err := w2.Unlock([]byte("transport")); err != ErrWrongPassphrase {
+		t.Errorf("Unlocking with transport passphrase: %v", err)
+		return
+	}
+	if err := w2.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock decrypted wallet: %v", err)
+		return
+	}
+
+	_, err = ReadEncrypted(bytes.NewReader(envelope), []byte("wrong"))
+	if err != ErrWrongPassphrase {
+		t.Errorf("Reading with wrong transport passphrase: %v", err)
+		return
+	}
+
+	tampered := append([]byte{}, envelope...)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err = ReadEncrypted(bytes.NewReader(tampered), []byte("transport"))
+	if err != ErrWrongPassphrase {
+		t.Errorf("Reading tampered envelope: %v", err)
+		return
+	}
+
+	// The salt header is used to derive the envelope key, so changing
+	// it must also prevent opening the envelope.
+	tampered = append([]byte{}, envelope...)
+	tampered[0] ^= 0x01
+	_, err = ReadEncrypted(bytes.NewReader(tampered), []byte("transport"))
+	if err != ErrWrongPassphrase {
+		t.Errorf("Reading envelope with tampered salt: %v", err)
+	}
+}
+
+func TestWriteToWithProgress(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.ExtendActiveAddresses(50); err != nil {
+		t.Errorf("Cannot extend active addresses: %v", err)
+		return
+	}
+
+	// Imported keys and comments are kept in maps, and must still be
+	// written in the same order by both writes.
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	for i := 0; i < 5; i++ {
+		pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+		if err != nil {
+			t.Errorf("Cannot generate key: %v", err)
+			return
+		}
+		wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+		if err != nil {
+			t.Errorf("Cannot create WIF: %v", err)
+			return
+		}
+		addr, err := w.ImportPrivateKey(wif, makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot import private key: %v", err)
+			return
+		}
+		if err := w.SetAddressComment(addr, "imported"); err != nil {
+			t.Errorf("Cannot set address comment: %v", err)
+			return
+		}
+		txSha := btcwire.ShaHash{byte(i)}
+		if err := w.SetTxComment(&txSha, "transaction"); err != nil {
+			t.Errorf("Cannot set transaction comment: %v", err)
+			return
+		}
+	}
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock: %v", err)
+		return
+	}
+
+	size, err := w.SerializedSize()
+	if err != nil {
+		t.Errorf("Cannot get serialized size: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("Serialized size %d does not match written %d", size, buf.Len())
+		return
+	}
+
+	var reports int
+	var last int64
+	progress := func(written, total int64) {
+		reports++
+		if total != size || written < last || written > total {
+			t.Errorf("Bad progress report %d/%d after %d", written,
+				total, last)
+		}
+		last = written
+	}
+	buf2 := new(bytes.Buffer)
+	n, err := w.WriteToWithProgress(buf2, progress)
+	if err != nil {
+		t.Errorf("Cannot write wallet with progress: %v", err)
+		return
+	}
+	if n != size || last != size {
+		t.Errorf("Wrote %d bytes and reported %d, expected %d", n, last, size)
+		return
+	}
+	if reports < 2 {
+		t.Errorf("Only %d progress reports", reports)
+		return
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("Serialization with progress differs from WriteTo")
+		return
+	}
+
+	// Map iteration order differs between writes, so compare several.
+	for i := 0; i < 10; i++ {
+		buf2.Reset()
+		if _, err := w.WriteToWithProgress(buf2, func(int64, int64) {}); err != nil {
+			t.Errorf("Cannot write wallet with progress: %v", err)
+			return
+		}
+		if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+			t.Errorf("Serialization %d with progress differs from WriteTo", i)
+			return
+		}
+	}
+}
+
+// stalledReader is an io.Reader which blocks until its channel is closed.
+type stalledReader chan struct{}
+
+func (r stalledReader) Read(p []byte) (int, error) {
+	<-r
+	return 0, io.EOF
+}
+
+func TestUnknownNet(t *testing.T) {
+	if _, err := New(dummyDir, "A wallet for testing.", []byte("banana"),
+		&btcnet.RegressionNetParams, makeBS(0)); err == nil {
+		t.Error("Creating a wallet for an unsupported network did not fail")
+		return
+	}
+
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+	binary.LittleEndian.PutUint32(serialized[12:16], 0xdeadbeef)
+	if _, err := new(Store).ReadFrom(bytes.NewReader(serialized)); err != ErrNetworkMismatch {
+		t.Errorf("Reading wallet for unknown network did not fail correctly: %v", err)
+	}
+}
+
+func TestReadFromExpectNet(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	w2, err := ReadFromExpectNet(bytes.NewReader(serialized), tstNetParams.Net)
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if !w.Equal(w2) {
+		t.Errorf("Read wallet differs: %v", w.Diff(w2))
+		return
+	}
+
+	// Only the header is read from a key store for another network.
+	r := bytes.NewReader(serialized)
+	if _, err := ReadFromExpectNet(r, btcwire.TestNet3); err != ErrNetworkMismatch {
+		t.Errorf("Reading wallet for another network did not fail correctly: %v", err)
+		return
+	}
+	if read := len(serialized) - r.Len(); read != 16 {
+		t.Errorf("Read %d bytes of wallet for another network", read)
+	}
+}
+
+func TestReadFromContext(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w2, n, err := ReadFromContext(ctx, bytes.NewReader(serialized))
+	cancel()
+	if err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if n != int64(len(serialized)) {
+		t.Errorf("Read %d bytes, expected %d", n, len(serialized))
+		return
+	}
+	if !w.Equal(w2) {
+		t.Errorf("Read wallet differs: %v", w.Diff(w2))
+		return
+	}
+
+	// A stalled read is aborted when the deadline passes.
+	stalled := make(stalledReader)
+	defer close(stalled)
+	r := io.MultiReader(bytes.NewReader(serialized[:100]), stalled)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w3, _, err := ReadFromContext(ctx, r)
+	if err != context.DeadlineExceeded || w3 != nil {
+		t.Errorf("Stalled read did not fail correctly: %v", err)
+	}
+}
+
+func TestInspectKDF(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	mem, nIter, err := InspectKDF(bytes.NewReader(serialized))
+	if err != nil {
+		t.Errorf("Cannot inspect KDF parameters: %v", err)
+		return
+	}
+	if mem != w.kdfParams.mem || nIter != w.kdfParams.nIter {
+		t.Errorf("Inspected KDF parameters (%d, %d) do not match wallet "+
+			"(%d, %d)", mem, nIter, w.kdfParams.mem, w.kdfParams.nIter)
+		return
+	}
+
+	// A truncated header must fail.
+	if _, _, err := InspectKDF(bytes.NewReader(serialized[:100])); err == nil {
+		t.Error("Inspecting a truncated header did not fail")
+		return
+	}
+
+	// A stream which is not a key store must fail.
+	bad := append([]byte{}, serialized...)
+	bad[0] ^= 0xff
+	if _, _, err := InspectKDF(bytes.NewReader(bad)); err == nil {
+		t.Error("Inspecting a bad file ID did not fail")
+	}
+}
+
+func TestFileMAC(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.EnableFileMAC(); err != ErrLocked {
+		t.Errorf("Enabling file MAC on a locked wallet did not fail correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock: %v", err)
+		return
+	}
+	if err := w.EnableFileMAC(); err != nil {
+		t.Errorf("Cannot enable file MAC: %v", err)
+		return
+	}
+
+	// Writing must still succeed after locking.
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+
+	// Changes made before the first unlock can not be written until the
+	// MAC key is known, but must not be lost.
+	if err := r.SetLabel("A label."); err != nil {
+		t.Errorf("Cannot set label: %v", err)
+		return
+	}
+	if _, err := r.WriteTo(new(bytes.Buffer)); err != ErrLocked {
+		t.Errorf("Writing before first unlock did not fail correctly: %v", err)
+		return
+	}
+	if !r.IsDirty() {
+		t.Error("Failed write cleared dirty flag")
+		return
+	}
+
+	// Addresses can not be handed out until they can be saved as used.
+	highest := r.HighestUsedIndex()
+	if _, err := r.NextChainedAddress(makeBS(0)); err != ErrLocked {
+		t.Errorf("Getting next address before first unlock did not "+
+			"fail correctly: %v", err)
+		return
+	}
+	if _, err := r.ChangeAddress(makeBS(0)); err != ErrLocked {
+		t.Errorf("Getting change address before first unlock did not "+
+			"fail correctly: %v", err)
+		return
+	}
+	if r.HighestUsedIndex() != highest {
+		t.Error("Highest used index advanced before first unlock")
+		return
+	}
+	c, err := r.ReencryptedCopy([]byte("banana"), []byte("potato"))
+	if err != nil {
+		t.Errorf("Cannot copy untampered wallet before first unlock: %v", err)
+		return
+	}
+	if _, err := c.WriteTo(new(bytes.Buffer)); err != nil {
+		t.Errorf("Cannot write copy of wallet: %v", err)
+		return
+	}
+	if err := r.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock untampered wallet: %v", err)
+		return
+	}
+	if _, err := r.WriteTo(new(bytes.Buffer)); err != nil {
+		t.Errorf("Cannot write wallet after first unlock: %v", err)
+		return
+	}
+	if _, err := r.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next address after first unlock: %v", err)
+		return
+	}
+
+	// Flip a bit in the description and check that unlocking fails.
+	tampered := append([]byte(nil), serialized...)
+	idx := bytes.Index(tampered, []byte("A wallet for testing."))
+	if idx < 0 {
+		t.Error("Cannot find description in serialized wallet")
+		return
+	}
+	tampered[idx] ^= 1
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(tampered)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if _, err := r.ReencryptedCopy([]byte("banana"), []byte("potato")); err != ErrTampered {
+		t.Errorf("Copying tampered wallet did not fail correctly: %v", err)
+		return
+	}
+	if err := r.Unlock([]byte("banana")); err != ErrTampered {
+		t.Errorf("Unlocking tampered wallet did not fail correctly: %v", err)
+		return
+	}
+	if !r.IsLocked() {
+		t.Error("Tampered wallet is unlocked")
+		return
+	}
+
+	// Stripping the MAC must also be detected.
+	r = new(Store)
+	stripped := serialized[:len(serialized)-1-sha256.Size]
+	if _, err := r.ReadFrom(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := r.Unlock([]byte("banana")); err != ErrTampered {
+		t.Errorf("Unlocking wallet without MAC did not fail correctly: %v", err)
+		return
+	}
+
+	// Clearing the header flag along with stripping the MAC is not
+	// detected by unlocking, but is by checking for the MAC.
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if !r.HasFileMAC() {
+		t.Error("Wallet read with MAC does not have a file MAC")
+		return
+	}
+	if _, err := ReadFromRequireMAC(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet requiring MAC: %v", err)
+		return
+	}
+	w.flags.fileMAC = false
+	buf.Reset()
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	downgraded := buf.Bytes()
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(downgraded)); err != nil {
+		t.Errorf("Cannot read downgraded wallet: %v", err)
+		return
+	}
+	if r.HasFileMAC() {
+		t.Error("Downgraded wallet has a file MAC")
+		return
+	}
+	_, err = ReadFromRequireMAC(bytes.NewReader(downgraded))
+	if err != ErrNoFileMAC {
+		t.Errorf("Reading downgraded wallet requiring MAC did not fail "+
+			"correctly: %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	var newAddrs []btcutil.Address
+	var changes []WalletAddress
+	w.OnNewAddress(func(wa WalletAddress) {
+		newAddrs = append(newAddrs, wa.Address())
+		if wa.Change() {
+			changes = append(changes, wa)
+		}
+	})
+	var synced []*BlockStamp
+	w.OnSyncChange(func(bs *BlockStamp) {
+		synced = append(synced, bs)
+	})
+
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	change, err := w.ChangeAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get change address: %v", err)
+		return
+	}
+	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
+		btcscript.OP_DROP}
+	imported, err := w.ImportScript(script, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	want := []btcutil.Address{addr, change, imported}
+	if len(newAddrs) != len(want) {
+		t.Errorf("Notified of %d new addresses, expected %d",
+			len(newAddrs), len(want))
+		return
+	}
+	for i := range want {
+		if newAddrs[i].EncodeAddress() != want[i].EncodeAddress() {
+			t.Errorf("Notified address %d is %v, expected %v", i,
+				newAddrs[i], want[i])
+			return
+		}
+	}
+	if len(changes) != 1 {
+		t.Errorf("Notified of %d change addresses, expected 1", len(changes))
+		return
+	}
+
+	bs1, bs2 := makeBS(1), makeBS(2)
+	w.SetSyncedWith(bs1)
+	if err := w.ConnectBlock(bs2, *bs1.Hash); err != nil {
+		t.Errorf("Cannot connect block: %v", err)
+		return
+	}
+	if err := w.ConnectBlock(makeBS(4), *bs2.Hash); err != ErrReorg {
+		t.Errorf("Connecting non-following block did not fail: %v", err)
+		return
+	}
+	if len(synced) != 2 || synced[0] != bs1 || synced[1] != bs2 {
+		t.Errorf("Unexpected sync notifications %v", synced)
+	}
+}
+
+func TestConnectBlock(t *testing.T) {
+	genesis := makeBS(0)
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, genesis)
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	block1 := &BlockStamp{Height: 1, Hash: &btcwire.ShaHash{0x01}}
+	block2 := &BlockStamp{Height: 2, Hash: &btcwire.ShaHash{0x02}}
+	if err := w.ConnectBlock(block1, *genesis.Hash); err != nil {
+		t.Errorf("Cannot connect block: %v", err)
+		return
+	}
+
+	// Neither a block with the wrong previous hash, a block at the wrong
+	// height, nor a re-fed tip may connect or clear the recent blocks.
+	tests := []struct {
+		bs   *BlockStamp
+		prev btcwire.ShaHash
+	}{
+		{block2, btcwire.ShaHash{0xff}},
+		{&BlockStamp{Height: 3, Hash: block2.Hash}, *block1.Hash},
+		{block1, *genesis.Hash},
+	}
+	for i, test := range tests {
+		if err := w.ConnectBlock(test.bs, test.prev); err != ErrReorg {
+			t.Errorf("Test %d: connecting block did not fail correctly: %v", i, err)
+			return
+		}
+	}
+	if hash, height := w.SyncedTo(); height != 1 || *hash != *block1.Hash {
+		t.Errorf("Synced to %v at height %d after rejected blocks", hash, height)
+		return
+	}
+	if _, ok := w.RecentBlockHashAtHeight(0); !ok {
+		t.Error("Recent blocks were cleared")
+		return
+	}
+
+	if err := w.ConnectBlock(block2, *block1.Hash); err != nil {
+		t.Errorf("Cannot connect block: %v", err)
+		return
+	}
+	if hash, height := w.SyncedTo(); height != 2 || *hash != *block2.Hash {
+		t.Errorf("Synced to %v at height %d, expected block 2", hash, height)
+	}
+}
+
+func TestRecentBlockHashAtHeight(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	// Record more blocks than the recent window holds.
+	for height := int32(1); height <= 30; height++ {
+		w.SetSyncedWith(&BlockStamp{
+			Height: height,
+			Hash:   &btcwire.ShaHash{byte(height)},
+		})
+	}
+
+	for height := int32(-1); height <= 31; height++ {
+		hash, ok := w.RecentBlockHashAtHeight(height)
+		inWindow := height > 10 && height <= 30
+		if ok != inWindow {
+			t.Errorf("Height %d: lookup success %v does not match expected %v",
+				height, ok, inWindow)
+			continue
+		}
+		if ok && *hash != (btcwire.ShaHash{byte(height)}) {
+			t.Errorf("Height %d: hash %v does not match expected", height, hash)
+		}
+	}
+}
+
+func benchmarkWallet(b *testing.B) *Store {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := w.ExtendActiveAddresses(100); err != nil {
+		b.Fatal(err)
+	}
+	return w
+}
+
+func BenchmarkSyncHeight(b *testing.B) {
+	w := benchmarkWallet(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = w.SyncHeight()
+	}
+}
+
+func BenchmarkSyncedTo(b *testing.B) {
+	w := benchmarkWallet(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = w.SyncedTo()
+	}
+}
+
+func TestEntriesLengthMismatch(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.SetLabel("label"); err != nil {
+		t.Errorf("Cannot set label: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+
+	// Drop the label entry, which is written last.
+	le := &labelEntry{label: comment("label")}
+	entryBuf := new(bytes.Buffer)
+	if _, err := le.WriteTo(entryBuf); err != nil {
+		t.Errorf("Cannot write label entry: %v", err)
+		return
+	}
+	truncated := serialized[:len(serialized)-entryBuf.Len()]
+	if _, err := new(Store).ReadFrom(bytes.NewReader(truncated)); err != ErrLengthMismatch {
+		t.Errorf("Reading truncated wallet did not fail correctly: %v", err)
+	}
+
+	_, errs, err := ReadFromRecover(bytes.NewReader(truncated))
+	if err != nil {
+		t.Errorf("Cannot recover truncated wallet: %v", err)
+		return
+	}
+	if len(errs) == 0 {
+		t.Error("Recovering truncated wallet reported no errors")
+	}
+
+	if _, err := new(Store).ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+	}
+}
+
+func TestImportPrivateKeyLabeled(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A label which is too long must prevent the import.
+	long := strings.Repeat("x", MaxCommentLen+1)
+	if _, err := w.ImportPrivateKeyLabeled(wif, long, makeBS(0)); err != ErrCommentTooLong {
+		t.Errorf("Importing with long label did not fail correctly: %v", err)
+		return
+	}
+	if n := len(w.SortedActiveAddresses()); n != 1 {
+		t.Errorf("Failed import added addresses: have %d active addresses", n)
+		return
+	}
+
+	addr, err := w.ImportPrivateKeyLabeled(wif, "cold storage #3", makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	c, err := w.AddressComment(addr)
+	if err != nil {
+		t.Errorf("Cannot get address comment: %v", err)
+		return
+	}
+	if c != "cold storage #3" {
+		t.Errorf("Imported address comment %q does not match label", c)
+	}
+}
+
+func TestResetSyncState(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(10))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(10))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.SetSyncStatus(addr, FullSync{}); err != nil {
+		t.Errorf("Cannot mark address synced: %v", err)
+		return
+	}
+	w.SetSyncedWith(makeBS(20))
+	nAddrs := len(w.SortedActiveAddresses())
+
+	w.ResetSyncState()
+
+	if _, h := w.SyncedTo(); h != -1 {
+		t.Errorf("Synced height %d after reset, expected -1", h)
+	}
+	if h := w.SyncHeight(); h != -1 {
+		t.Errorf("Last seen height %d after reset, expected -1", h)
+	}
+	if w.NewIterateRecentBlocks() != nil {
+		t.Error("Recent blocks remain after reset")
+	}
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot get address after reset: %v", err)
+		return
+	}
+	if ss, ok := wa.SyncStatus().(Unsynced); !ok || int32(ss) != wa.FirstBlock() {
+		t.Errorf("Address sync status %v after reset, expected unsynced "+
+			"from %d", wa.SyncStatus(), wa.FirstBlock())
+	}
+	if n := len(w.SortedActiveAddresses()); n != nAddrs {
+		t.Errorf("Reset changed active addresses from %d to %d", nAddrs, n)
+	}
+}
+
+func TestFileVersion(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if v := w.FileVersion(); !v.EQ(VersCurrent) {
+		t.Errorf("New key store version %v, expected %v", v, VersCurrent)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+
+	// Rewrite the file as an earlier version and check that it will
+	// be upgraded.
+	serialized := buf.Bytes()
+	v := VersLastSync
+	copy(serialized[8:12], []byte{v.major, v.minor, v.bugfix, v.autoincrement})
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if v := r.FileVersion(); !v.EQ(VersLastSync) || !v.LT(VersCurrent) {
+		t.Errorf("Read key store version %v, expected %v", v, VersLastSync)
+	}
+}
+
+func TestSetTxComments(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	var a, b, c btcwire.ShaHash
+	a[0], b[0], c[0] = 1, 2, 3
+	if err := w.SetTxComment(&c, "old"); err != nil {
+		t.Errorf("Cannot set tx comment: %v", err)
+		return
+	}
+
+	// A single long comment must prevent setting every comment.
+	err = w.SetTxComments(map[btcwire.ShaHash]string{
+		a: "first",
+		b: strings.Repeat("x", MaxCommentLen+1),
+		c: "",
+	})
+	txErr, ok := err.(*TxCommentError)
+	if !ok || txErr.Hash != b || txErr.Err != ErrCommentTooLong {
+		t.Errorf("Setting long comment did not fail correctly: %v", err)
+		return
+	}
+	if w.HasTxComment(&a) || w.TxComment(&c) != "old" {
+		t.Error("Comments changed after failed update")
+		return
+	}
+
+	err = w.SetTxComments(map[btcwire.ShaHash]string{
+		a: "first",
+		b: "second",
+		c: "",
+	})
+	if err != nil {
+		t.Errorf("Cannot set tx comments: %v", err)
+		return
+	}
+	if w.TxComment(&a) != "first" || w.TxComment(&b) != "second" {
+		t.Error("Tx comments were not set")
+	}
+	if w.HasTxComment(&c) {
+		t.Error("Empty tx comment did not remove previous comment")
+	}
+}
+
+func TestRootFingerprint(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	rootPubKey, _ := w.ChainParams()
+	fp := w.RootFingerprint()
+	if !bytes.Equal(fp[:], btcutil.Hash160(rootPubKey)[:4]) {
+		t.Errorf("Root fingerprint %x does not match root public key", fp)
+		return
+	}
+
+	// The fingerprint must be the same for a restored key store and
+	// differ for other key stores.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	restored := new(Store)
+	if _, err := restored.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if restored.RootFingerprint() != fp {
+		t.Error("Restored key store fingerprint does not match")
+	}
+	other, err := New(dummyDir, "Another wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if other.RootFingerprint() == fp {
+		t.Error("Different key stores have the same fingerprint")
+	}
+}
+
+func TestFindReused(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addrs := make([]btcutil.Address, 3)
+	for i := range addrs {
+		addrs[i], err = w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	foreign, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A separately decoded copy of an address must be counted with it.
+	copied, err := btcutil.NewAddressPubKeyHash(addrs[0].ScriptAddress(),
+		tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[btcutil.Address]int{
+		addrs[2]: 3,
+		addrs[1]: 1,
+		addrs[0]: 1,
+		copied:   1,
+		foreign:  5,
+	}
+	reused := w.FindReused(counts)
+	if len(reused) != 2 ||
+		reused[0].EncodeAddress() != addrs[0].EncodeAddress() ||
+		reused[1].EncodeAddress() != addrs[2].EncodeAddress() {
+		t.Errorf("Found reused addresses %v, expected %v and %v",
+			reused, addrs[0], addrs[2])
+	}
+}
+
+func TestEstimateUnlockTime(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if d := w.EstimateUnlockTime(); d <= 0 {
+		t.Errorf("Estimated unlock time %v is not positive", d)
+	}
+	if !w.IsLocked() {
+		t.Error("Estimating unlock time unlocked the key store")
+	}
+}
+
+func TestCanChainAddress(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+
+	chained, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := w.ImportPrivateKey(wif, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	script, err := w.ImportScript([]byte{0x51}, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	foreign, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		addr btcutil.Address
+		ok   bool
+	}{
+		{"chained", chained, true},
+		{"imported key", imported, false},
+		{"imported script", script, false},
+		{"foreign", foreign, false},
+	}
+	for _, test := range tests {
+		ok, reason := w.CanChainAddress(test.addr)
+		if ok != test.ok {
+			t.Errorf("%s: can chain %v, expected %v", test.name, ok,
+				test.ok)
+		}
+		if !ok && reason == "" {
+			t.Errorf("%s: no reason given", test.name)
+		}
+	}
+}
+
+func TestRootBackup(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(100))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addrs := make([]btcutil.Address, 5)
+	for i := range addrs {
+		addrs[i], err = w.NextChainedAddress(makeBS(200))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	if err := w.SetAddressComment(addrs[0], "not backed up"); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+
+	backup := new(bytes.Buffer)
+	if err := w.WriteRootBackup(backup); err != nil {
+		t.Errorf("Cannot write root backup: %v", err)
+		return
+	}
+	full := new(bytes.Buffer)
+	if _, err := w.WriteTo(full); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	if backup.Len() >= full.Len() {
+		t.Errorf("Root backup is %d bytes, not smaller than %d byte key store",
+			backup.Len(), full.Len())
+	}
+	serialized := backup.Bytes()
+
+	if _, err := ReadRootBackup(bytes.NewReader(serialized),
+		[]byte("potato"), 10); err != ErrWrongPassphrase {
+		t.Errorf("Reading backup with wrong passphrase did not fail "+
+			"correctly: %v", err)
+		return
+	}
+
+	r, err := ReadRootBackup(bytes.NewReader(serialized), []byte("banana"), 10)
+	if err != nil {
+		t.Errorf("Cannot read root backup: %v", err)
+		return
+	}
+	if !r.IsLocked() {
+		t.Error("Restored key store is not locked")
+	}
+	if r.RootFingerprint() != w.RootFingerprint() {
+		t.Error("Restored root key does not match")
+	}
+	for i, a := range addrs {
+		ra, err := r.AddressAtIndex(int64(i))
+		if err != nil {
+			t.Errorf("Cannot get restored address %d: %v", i, err)
+			return
+		}
+		if ra.Address().EncodeAddress() != a.EncodeAddress() {
+			t.Errorf("Restored address %d %v does not match %v", i,
+				ra.Address(), a)
+		}
+	}
+	if _, err := r.AddressAtIndex(9); err != nil {
+		t.Errorf("Restored keypool is too small: %v", err)
+	}
+	if _, h := r.SyncedTo(); h != 100 {
+		t.Errorf("Restored key store synced to %d, expected 100", h)
+	}
+	if c, _ := r.AddressComment(addrs[0]); c != "" {
+		t.Errorf("Restored address has comment %q", c)
+	}
+
+	// Private keys of restored addresses must be recoverable.
+	if err := r.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock restored key store: %v", err)
+		return
+	}
+	if _, err := r.PrivKeyBytes(addrs[4]); err != nil {
+		t.Errorf("Cannot get restored private key: %v", err)
+		return
+	}
+
+	// Backups from newer versions are rejected, and older backups keep
+	// their version until written.
+	newer := append([]byte(nil), serialized...)
+	copy(newer[8:12], []byte{1, 37, 0, 0})
+	if _, err := ReadRootBackup(bytes.NewReader(newer), []byte("banana"),
+		10); err != ErrNewerVersion {
+		t.Errorf("Reading newer backup did not fail correctly: %v", err)
+		return
+	}
+	older := append([]byte(nil), serialized...)
+	copy(older[8:12], []byte{1, 36, 9, 0})
+	r, err = ReadRootBackup(bytes.NewReader(older), []byte("banana"), 10)
+	if err != nil {
+		t.Errorf("Cannot read older root backup: %v", err)
+		return
+	}
+	if v := r.FileVersion(); !v.EQ(FileVersion{1, 36, 9, 0}) {
+		t.Errorf("Older backup restored with version %v", v)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write restored key store: %v", err)
+		return
+	}
+	var written FileVersion
+	if _, err := written.ReadFrom(bytes.NewReader(buf.Bytes()[8:12])); err != nil {
+		t.Fatal(err)
+	}
+	if !written.EQ(VersCurrent) {
+		t.Errorf("Restored key store written with version %v", written)
+	}
+}
+
+func TestAddressParams(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	params := w.AddressParams()
+	if params.Net != tstNetParams.Net {
+		t.Errorf("Address params network %v, expected %v", params.Net,
+			tstNetParams.Net)
+	}
+
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if decoded := btcutil.Base58Decode(addr.EncodeAddress()); decoded[0] != params.PubKeyHashAddrID {
+		t.Errorf("Address version %#x, expected %#x", decoded[0],
+			params.PubKeyHashAddrID)
+	}
+	script, err := w.ImportScript([]byte{0x51}, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	if decoded := btcutil.Base58Decode(script.EncodeAddress()); decoded[0] != params.ScriptHashAddrID {
+		t.Errorf("Script address version %#x, expected %#x", decoded[0],
+			params.ScriptHashAddrID)
+	}
+	wifs, err := w.DumpAllPrivKeys()
+	if err != nil || len(wifs) == 0 {
+		t.Errorf("Cannot dump private keys: %v", err)
+		return
+	}
+	if decoded := btcutil.Base58Decode(wifs[0].WIF.String()); decoded[0] != params.PrivateKeyID {
+		t.Errorf("WIF version %#x, expected %#x", decoded[0],
+			params.PrivateKeyID)
+	}
+}
+
+func TestPurgeKeypool(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	used := make([]btcutil.Address, 3)
+	for i := range used {
+		used[i], err = w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	lastIdx := w.highestUsed + 50
+	if err := w.extendTo(lastIdx, makeBS(0)); err != nil {
+		t.Errorf("Cannot extend keypool: %v", err)
+		return
+	}
+	last, err := w.AddressAtIndex(lastIdx)
+	if err != nil {
+		t.Errorf("Cannot get last keypool address: %v", err)
+		return
+	}
+	before := new(bytes.Buffer)
+	if _, err := w.WriteTo(before); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+
+	if err := w.PurgeKeypool(2); err != nil {
+		t.Errorf("Cannot purge keypool: %v", err)
+		return
+	}
+	if w.lastChainIdx != w.highestUsed+2 {
+		t.Errorf("Last chain index %d after purge, expected %d",
+			w.lastChainIdx, w.highestUsed+2)
+		return
+	}
+	for i, a := range used {
+		if _, err := w.Address(a); err != nil {
+			t.Errorf("Used address %d removed by purge", i)
+		}
+	}
+	if _, err := w.Address(last.Address()); err != ErrAddressNotFound {
+		t.Errorf("Purged address still found: %v", err)
+	}
+	after := new(bytes.Buffer)
+	if _, err := w.WriteTo(after); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	if after.Len() >= before.Len() {
+		t.Error("Purging keypool did not shrink the key store file")
+	}
+	if _, err := new(Store).ReadFrom(after); err != nil {
+		t.Errorf("Cannot read purged wallet: %v", err)
+		return
+	}
+
+	// Purging with a larger keepAhead is a no-op.
+	if err := w.PurgeKeypool(100); err != nil {
+		t.Errorf("Cannot purge keypool: %v", err)
+		return
+	}
+	if w.lastChainIdx != w.highestUsed+2 {
+		t.Error("Purge with large keepAhead changed the chain")
+		return
+	}
+
+	// Extending the chain again must recreate the purged addresses.
+	if err := w.extendTo(lastIdx, makeBS(0)); err != nil {
+		t.Errorf("Cannot extend keypool: %v", err)
+		return
+	}
+	a, err := w.AddressAtIndex(lastIdx)
+	if err != nil {
+		t.Errorf("Cannot recreate last purged address: %v", err)
+		return
+	}
+	if a.Address().EncodeAddress() != last.Address().EncodeAddress() {
+		t.Error("Recreated address does not match purged address")
+	}
+}
+
+func TestInvalidComment(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	var txSha btcwire.ShaHash
+
+	invalid := "bad \xff comment"
+	if err := w.SetAddressComment(addr, invalid); err != ErrInvalidComment {
+		t.Errorf("Setting invalid address comment did not fail "+
+			"correctly: %v", err)
+	}
+	if err := w.SetTxComment(&txSha, invalid); err != ErrInvalidComment {
+		t.Errorf("Setting invalid tx comment did not fail correctly: %v",
+			err)
+	}
+	if err := w.SetTxComment(&txSha, "héllo"); err != nil {
+		t.Errorf("Cannot set UTF-8 tx comment: %v", err)
+	}
+
+	// Invalid comments read from older key stores must still be
+	// displayed.
+	w.addrCommentMap[getAddressKey(addr)] = comment(invalid)
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	r := new(Store)
+	if _, err := r.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet with invalid comment: %v", err)
+		return
+	}
+	c, err := r.AddressComment(addr)
+	if err != nil {
+		t.Errorf("Cannot get address comment: %v", err)
+		return
+	}
+	if c != "bad � comment" {
+		t.Errorf("Invalid comment displayed as %q", c)
+	}
+}
+
+func TestChainIndexOf(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+
+	root, err := w.AddressAtIndex(rootKeyChainIdx)
+	if err != nil {
+		t.Errorf("Cannot get root address: %v", err)
+		return
+	}
+	chained := make([]btcutil.Address, 3)
+	for i := range chained {
+		chained[i], err = w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := w.ImportPrivateKey(wif, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	script, err := w.ImportScript([]byte{0x51}, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	foreign, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		addr btcutil.Address
+		idx  int64
+		ok   bool
+	}{
+		{"root", root.Address(), rootKeyChainIdx, true},
+		{"first chained", chained[0], 0, true},
+		{"last chained", chained[2], 2, true},
+		{"imported key", imported, importedKeyChainIdx, true},
+		{"imported script", script, importedKeyChainIdx, true},
+		{"foreign", foreign, 0, false},
+	}
+	for _, test := range tests {
+		idx, ok := w.ChainIndexOf(test.addr)
+		if idx != test.idx || ok != test.ok {
+			t.Errorf("%s: chain index %d (found %v), expected %d "+
+				"(found %v)", test.name, idx, ok, test.idx, test.ok)
+		}
+	}
+}
+
+func TestReadFromAt(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	// Serialize the key store after other archive data.
+	prefix := []byte("other archive data")
+	buf := bytes.NewBuffer(append([]byte(nil), prefix...))
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+
+	r, err := ReadFromAt(bytes.NewReader(buf.Bytes()), int64(len(prefix)))
+	if err != nil {
+		t.Errorf("Cannot read wallet at offset: %v", err)
+		return
+	}
+	if diffs := w.Diff(r); len(diffs) != 0 {
+		t.Errorf("Wallet read at offset differs: %v", diffs)
+	}
+
+	if _, err := ReadFromAt(bytes.NewReader(buf.Bytes()), 0); err == nil {
+		t.Error("Reading wallet at wrong offset did not fail")
+	}
+}
+
+func TestRedeemScript(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	script := []byte{0x52, 0x51, 0x52, 0xae}
+	addr, err := w.ImportScript(script, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	if _, ok := addr.(*btcutil.AddressScriptHash); !ok {
+		t.Errorf("Imported script address has type %T", addr)
+	}
+
+	redeem, err := w.RedeemScript(addr)
+	if err != nil {
+		t.Errorf("Cannot get redeem script: %v", err)
+		return
+	}
+	if !bytes.Equal(redeem, script) {
+		t.Errorf("Redeem script %x does not match imported %x", redeem,
+			script)
+	}
+
+	// Modifying the returned script must not modify the key store.
+	redeem[0] = 0x00
+	if redeem, _ := w.RedeemScript(addr); !bytes.Equal(redeem, script) {
+		t.Error("Redeem script modified through returned slice")
+	}
+
+	chained, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if _, err := w.RedeemScript(chained); err == nil {
+		t.Error("Got redeem script for pubkey hash address")
+	}
+}
+
+func TestReadFromLenient(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+
+	// Without any appended entries, the unused space holding the
+	// recently seen blocks ends the file.  Replace it with 25 blocks,
+	// as a later version saving more blocks might write.
+	serialized := buf.Bytes()
+	header := serialized[:len(serialized)-1024]
+	hashes := make([]*btcwire.ShaHash, 25)
+	for i := range hashes {
+		hashes[i] = new(btcwire.ShaHash)
+		hashes[i][0] = byte(i)
+	}
+	unused := new(bytes.Buffer)
+	binary.Write(unused, binary.LittleEndian, uint32(len(hashes)))
+	binary.Write(unused, binary.LittleEndian, int32(124))
+	for _, h := range hashes {
+		unused.Write(h[:])
+	}
+	unused.Write(make([]byte, 1024-unused.Len()))
+	file := append(append([]byte(nil), header...), unused.Bytes()...)
+
+	if _, err := new(Store).ReadFrom(bytes.NewReader(file)); err == nil {
+		t.Error("Reading key store with 25 recent blocks did not fail")
+	}
+
+	r, err := ReadFromLenient(bytes.NewReader(file))
+	if err != nil {
+		t.Errorf("Cannot leniently read key store: %v", err)
+		return
+	}
+	if len(r.recent.hashes) != 20 {
+		t.Errorf("Read %d recent blocks, expected 20", len(r.recent.hashes))
+		return
+	}
+	for i, h := range r.recent.hashes {
+		if *h != *hashes[i+5] {
+			t.Errorf("Recent block %d is %v, expected %v", i, h,
+				hashes[i+5])
+		}
+	}
+	hash, height := r.SyncedTo()
+	if height != 124 || hash == nil || *hash != *hashes[24] {
+		t.Errorf("Synced to %v at %d, expected %v at 124", hash, height,
+			hashes[24])
+	}
+
+	// The key store must be saved with at most 20 blocks.
+	if _, err := r.WriteTo(new(bytes.Buffer)); err != nil {
+		t.Errorf("Cannot write leniently read key store: %v", err)
+	}
+}
+
+func TestSignHash(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	hash := btcwire.DoubleSha256([]byte("data to sign"))
+
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	if _, _, err := w.SignHash(addr, hash[:31]); err == nil {
+		t.Error("Signing short hash did not fail")
+	}
+
+	r, s, err := w.SignHash(addr, hash)
+	if err != nil {
+		t.Errorf("Cannot sign hash: %v", err)
+		return
+	}
+	wa, err := w.Address(addr)
+	if err != nil {
+		t.Errorf("Cannot get address: %v", err)
+		return
+	}
+	pubKey := wa.(PubKeyAddress).PubKey().ToECDSA()
+	if !ecdsa.Verify(pubKey, hash, r, s) {
+		t.Error("Hash signature does not verify")
+	}
+
+	script, err := w.ImportScript([]byte{0x51}, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+	if _, _, err := w.SignHash(script, hash); err != ErrNoPrivKey {
+		t.Errorf("Signing with script address did not fail correctly: %v",
+			err)
+	}
+	foreign, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := w.SignHash(foreign, hash); err != ErrAddressNotFound {
+		t.Errorf("Signing with unknown address did not fail correctly: %v",
+			err)
+	}
+
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet: %v", err)
+		return
+	}
+	if _, _, err := w.SignHash(addr, hash); err != ErrLocked {
+		t.Errorf("Signing with locked key store did not fail correctly: %v",
+			err)
+	}
+}
+
+func TestGapReport(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	err = w.SetKeypoolPolicy(KeypoolPolicy{
+		TargetSize: 5,
+		BatchSize:  1,
+		AutoExtend: true,
+	})
+	if err != nil {
+		t.Errorf("Cannot set keypool policy: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name   string
+		used   []int64
+		maxGap int64
+		ok     bool
+	}{
+		{"none used", nil, 0, true},
+		{"contiguous", []int64{0, 1, 2}, 0, true},
+		{"unsorted", []int64{7, 0, 3, 3}, 3, true},
+		{"gap at limit", []int64{0, 6}, 5, true},
+		{"gap too large", []int64{0, 1, 8, 9}, 6, false},
+		{"gap before first", []int64{6}, 6, false},
+		{"ignores imported", []int64{-2, -1, 0, 2}, 1, true},
+	}
+	for _, test := range tests {
+		maxGap, ok := w.GapReport(test.used)
+		if maxGap != test.maxGap || ok != test.ok {
+			t.Errorf("%s: gap %d (ok %v), expected %d (ok %v)",
+				test.name, maxGap, ok, test.maxGap, test.ok)
+		}
+	}
+}
+
+func TestKdfParametersSize(t *testing.T) {
+	params := kdfParameters{mem: 1 << 20, nIter: 7}
+	for i := range params.salt {
+		params.salt[i] = byte(i)
+	}
+
+	buf := new(bytes.Buffer)
+	n, err := params.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Cannot write KDF parameters: %v", err)
+		return
+	}
+	if n != kdfParamsSize || buf.Len() != kdfParamsSize {
+		t.Errorf("KDF parameters serialized to %d bytes (reported %d), "+
+			"expected %d", buf.Len(), n, kdfParamsSize)
+		return
+	}
+
+	var read kdfParameters
+	n, err = read.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Cannot read KDF parameters: %v", err)
+		return
+	}
+	if n != kdfParamsSize {
+		t.Errorf("Read %d bytes of KDF parameters, expected %d", n,
+			kdfParamsSize)
+	}
+	if read != params {
+		t.Errorf("Read KDF parameters %+v do not match %+v", read, params)
+	}
+}
+
+func TestNewFromRoot(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	addrs := make([]btcutil.Address, 5)
+	for i := range addrs {
+		addrs[i], err = w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	root, err := w.AddressAtIndex(rootKeyChainIdx)
+	if err != nil {
+		t.Errorf("Cannot get root address: %v", err)
+		return
+	}
+	rootKey, err := w.PrivKeyBytes(root.Address())
+	if err != nil {
+		t.Errorf("Cannot get root private key: %v", err)
+		return
+	}
+	_, chaincode := w.ChainParams()
+
+	if _, err := NewFromRoot(dummyDir, "Restored.", make([]byte, 32),
+		chaincode, []byte("potato"), tstNetParams, makeBS(0), 10); err == nil {
+		t.Error("Created key store with zero root private key")
+	}
+
+	r, err := NewFromRoot(dummyDir, "Restored.", rootKey, chaincode,
+		[]byte("potato"), tstNetParams, makeBS(0), 10)
+	if err != nil {
+		t.Errorf("Cannot create key store from root: %v", err)
+		return
+	}
+	if !r.IsLocked() {
+		t.Error("Key store created from root is not locked")
+	}
+	if r.RootFingerprint() != w.RootFingerprint() {
+		t.Error("Root fingerprints do not match")
+	}
+	if _, err := r.AddressAtIndex(9); err != nil {
+		t.Errorf("Keypool was not filled: %v", err)
+	}
+	for i, a := range addrs {
+		ra, err := r.AddressAtIndex(int64(i))
+		if err != nil {
+			t.Errorf("Cannot get address %d: %v", i, err)
+			return
+		}
+		if ra.Address().EncodeAddress() != a.EncodeAddress() {
+			t.Errorf("Address %d %v does not match %v", i, ra.Address(), a)
+		}
+	}
+
+	// The key store is encrypted with the new passphrase.
+	if err := r.Unlock([]byte("banana")); err != ErrWrongPassphrase {
+		t.Errorf("Unlock with old passphrase did not fail correctly: %v", err)
+	}
+	if err := r.Unlock([]byte("potato")); err != nil {
+		t.Errorf("Cannot unlock with new passphrase: %v", err)
+		return
+	}
+	if _, err := r.PrivKeyBytes(addrs[4]); err != nil {
+		t.Errorf("Cannot get private key of recreated address: %v", err)
+	}
+}
+
+func TestHasAddressComment(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if w.HasAddressComment(addr) {
+		t.Error("New address has a comment")
+	}
+	if err := w.SetAddressComment(addr, "note"); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	if !w.HasAddressComment(addr) {
+		t.Error("Commented address has no comment")
+	}
+	if err := w.SetAddressComment(addr, ""); err != nil {
+		t.Errorf("Cannot remove address comment: %v", err)
+		return
+	}
+	if w.HasAddressComment(addr) {
+		t.Error("Address still has a removed comment")
+	}
+}
+
+func TestAddressMetadata(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	chained, err := w.NextChainedAddress(makeBS(10))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	if err := w.SetAddressComment(chained, "receive"); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	change, err := w.ChangeAddress(makeBS(20))
+	if err != nil {
+		t.Errorf("Cannot get change address: %v", err)
+		return
+	}
+	script, err := w.ImportScript([]byte{0x51}, makeBS(30))
+	if err != nil {
+		t.Errorf("Cannot import script: %v", err)
+		return
+	}
+
+	m := w.AddressMetadata()
+	if len(m) != len(w.addrMap) {
+		t.Errorf("Metadata for %d addresses, expected %d", len(m),
+			len(w.addrMap))
+	}
+	tests := []struct {
+		name string
+		addr btcutil.Address
+		meta AddressMetadata
+	}{
+		{"chained", chained, AddressMetadata{"receive", true, false, false, 10}},
+		{"change", change, AddressMetadata{"", true, false, true, 20}},
+		{"script", script, AddressMetadata{"", false, true, false, 30}},
+	}
+	for _, test := range tests {
+		meta, ok := m[test.addr.EncodeAddress()]
+		if !ok {
+			t.Errorf("%s: no metadata", test.name)
+			continue
+		}
+		if meta != test.meta {
+			t.Errorf("%s: metadata %+v, expected %+v", test.name, meta,
+				test.meta)
+		}
+	}
+}
+
+func TestStripPrivateKeys(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	addrs := make([]btcutil.Address, 3)
+	for i := range addrs {
+		addrs[i], err = w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Error("Error generating private key: " + err.Error())
+		return
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := w.ImportPrivateKey(wif, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	addrs = append(addrs, imported)
+
+	if err := w.StripPrivateKeys(false); err == nil {
+		t.Error("Stripped private keys without confirmation")
+		return
+	}
+	if _, err := w.PrivKeyBytes(addrs[0]); err != nil {
+		t.Errorf("Private key removed without confirmation: %v", err)
+		return
+	}
+
+	if err := w.StripPrivateKeys(true); err != nil {
+		t.Errorf("Cannot strip private keys: %v", err)
+		return
+	}
+	if err := w.StripPrivateKeys(true); err != ErrWatchingOnly {
+		t.Errorf("Stripping watching-only key store did not fail "+
+			"correctly: %v", err)
+	}
+	for i, a := range addrs {
+		if _, err := w.PrivKeyBytes(a); err == nil {
+			t.Errorf("Address %d still has a private key", i)
+		}
+	}
+	if err := w.Unlock([]byte("banana")); err != ErrWatchingOnly {
+		t.Errorf("Unlocking stripped key store did not fail correctly: %v",
+			err)
+	}
+
+	// The stripped key store must serialize without any private keys
+	// and read back as watching-only with the same addresses.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write stripped wallet: %v", err)
+		return
+	}
+	r := new(Store)
+	if _, err := r.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read stripped wallet: %v", err)
+		return
+	}
+	if !r.flags.watchingOnly {
+		t.Error("Read stripped key store is not watching-only")
+	}
+	for i, a := range addrs {
+		if _, err := r.Address(a); err != nil {
+			t.Errorf("Address %d missing from stripped key store", i)
+		}
+	}
+	if _, err := r.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot extend stripped key store: %v", err)
+	}
+}
+
+func TestDeriveAddressRange(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+	before := new(bytes.Buffer)
+	if _, err := w.WriteTo(before); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	lastIdx := w.lastChainIdx
+
+	derived, err := w.DeriveAddressRange(1, lastIdx+5)
+	if err != nil {
+		t.Errorf("Cannot derive address range: %v", err)
+		return
+	}
+	if int64(len(derived)) != lastIdx+5 {
+		t.Errorf("Derived %d addresses, expected %d", len(derived),
+			lastIdx+5)
+		return
+	}
+
+	// Deriving must not modify the key store.
+	after := new(bytes.Buffer)
+	if _, err := w.WriteTo(after); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	if w.lastChainIdx != lastIdx || !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Error("Deriving addresses modified the key store")
+		return
+	}
+
+	// Derived addresses must match those created by extending the chain.
+	if err := w.extendTo(lastIdx+5, makeBS(0)); err != nil {
+		t.Errorf("Cannot extend address chain: %v", err)
+		return
+	}
+	for i, d := range derived {
+		idx := int64(i) + 1
+		wa, err := w.AddressAtIndex(idx)
+		if err != nil {
+			t.Errorf("Cannot get address at index %d: %v", idx, err)
+			return
+		}
+		if d.Address().EncodeAddress() != wa.Address().EncodeAddress() {
+			t.Errorf("Derived address %d %v does not match %v", idx,
+				d.Address(), wa.Address())
+		}
+	}
+
+	if _, err := w.DeriveAddressRange(5, 4); err == nil {
+		t.Error("Derived addresses for an invalid range")
+	}
+
+	// Ranges are bounded, both in the number of addresses returned and
+	// in how far past the address chain they may be derived.
+	if _, err := w.DeriveAddressRange(0, MaxDeriveAddresses); err == nil {
+		t.Error("Derived more than the maximum number of addresses")
+	}
+	if _, err := w.DeriveAddressRange(math.MaxInt64-1, math.MaxInt64); err == nil {
+		t.Error("Derived addresses far past the end of the address chain")
+	}
+}
+
+func TestIntegrityReport(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+	}
+
+	// Without a file MAC, the file MAC check is skipped.
+	report, err := w.IntegrityReport([]byte("banana"))
+	if err != nil {
+		t.Errorf("Cannot create integrity report: %v", err)
+		return
+	}
+	for _, c := range report.Checks {
+		if c.Name == "file MAC" && !c.Skipped {
+			t.Errorf("File MAC check was not skipped: %+v", c)
+			return
+		}
+	}
+
+	// Every check is run on a key store read from a file with a MAC.
+	if err := w.EnableFileMAC(); err != nil {
+		t.Errorf("Cannot enable file MAC: %v", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+	w = new(Store)
+	if _, err := w.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+
+	if _, err := w.IntegrityReport([]byte("potato")); err != ErrWrongPassphrase {
+		t.Errorf("Report with wrong passphrase did not fail correctly: %v",
+			err)
+	}
+
+	report, err = w.IntegrityReport([]byte("banana"))
+	if err != nil {
+		t.Errorf("Cannot create integrity report: %v", err)
+		return
+	}
+	if !report.Passed() {
+		t.Errorf("Integrity checks failed: %+v", report.Checks)
+	}
+	if len(report.Checks) != 6 {
+		t.Errorf("Report has %d checks, expected 6", len(report.Checks))
+	}
+	for _, c := range report.Checks {
+		if c.Skipped {
+			t.Errorf("Check %q was skipped", c.Name)
+		}
+	}
+
+	// Without a passphrase, the checks requiring it are skipped.
+	report, err = w.IntegrityReport(nil)
+	if err != nil {
+		t.Errorf("Cannot create integrity report: %v", err)
+		return
+	}
+	var skipped int
+	for _, c := range report.Checks {
+		if c.Skipped {
+			skipped++
+		}
+	}
+	if !report.Passed() || skipped != 3 {
+		t.Errorf("Report without passphrase passed %v with %d skipped "+
+			"checks", report.Passed(), skipped)
+	}
+
+	// Break the address chain.
+	a, err := w.AddressAtIndex(1)
+	if err != nil {
+		t.Errorf("Cannot get chained address: %v", err)
+		return
+	}
+	a.(*btcAddress).chainIndex = 2
+	report, err = w.IntegrityReport([]byte("banana"))
+	if err != nil {
+		t.Errorf("Cannot create integrity report: %v", err)
+		return
+	}
+	if report.Passed() {
+		t.Error("Integrity checks passed for broken chain")
+	}
+	for _, c := range report.Checks {
+		if c.Name == "chain indexes" && (c.Passed || len(c.Details) == 0) {
+			t.Errorf("Chain index check did not report failure: %+v", c)
+		}
+	}
+
+	// A tampered file fails the file MAC check, without the key store
+	// being modified.
+	tampered := append([]byte(nil), serialized...)
+	idx := bytes.Index(tampered, []byte("A wallet for testing."))
+	if idx < 0 {
+		t.Error("Cannot find description in serialized wallet")
+		return
+	}
+	tampered[idx] ^= 1
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(tampered)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	report, err = r.IntegrityReport([]byte("banana"))
+	if err != nil {
+		t.Errorf("Cannot create integrity report: %v", err)
+		return
+	}
+	for _, c := range report.Checks {
+		if c.Name == "file MAC" && (c.Passed || c.Skipped) {
+			t.Errorf("File MAC check did not report failure: %+v", c)
+		}
+	}
+	if err := r.Unlock([]byte("banana")); err != ErrTampered {
+		t.Errorf("Unlocking tampered wallet did not fail correctly: %v", err)
+	}
+}
+
+func TestRotateSalt(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	privKey, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet: %v", err)
+		return
+	}
+	oldParams := w.kdfParams
+
+	if err := w.RotateSalt([]byte("potato")); err != ErrWrongPassphrase {
+		t.Errorf("Rotating salt with wrong passphrase did not fail "+
+			"correctly: %v", err)
+		return
+	}
+	if err := w.RotateSalt([]byte("banana")); err != nil {
+		t.Errorf("Cannot rotate salt: %v", err)
+		return
+	}
+	if !w.IsLocked() {
+		t.Error("Rotating salt unlocked the key store")
+	}
+	if w.kdfParams.salt == oldParams.salt {
+		t.Error("Salt was not changed")
+	}
+	if w.kdfParams.mem != oldParams.mem || w.kdfParams.nIter != oldParams.nIter {
+		t.Error("KDF cost parameters were changed")
+	}
+
+	// The key store must still unlock with the same passphrase after
+	// being saved and read back.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	r := new(Store)
+	if _, err := r.ReadFrom(buf); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if err := r.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Cannot unlock wallet after rotating salt: %v", err)
+		return
+	}
+	rotated, err := r.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
+	}
+	if !bytes.Equal(rotated, privKey) {
+		t.Error("Private key changed after rotating salt")
+		return
+	}
+
+	// Rotating the salt of a locked key store must not leave any private
+	// keys decrypted.
+	for _, wa := range w.addrMap {
+		if a, ok := wa.(*btcAddress); ok && a.privKeyCT != nil {
+			t.Errorf("Address %v unlocked after rotating salt", a.address)
+			return
+		}
+	}
+
+	// The file MAC of a key store read from a tampered file must be
+	// checked before rotating, rather than replaced with a new MAC.
+	if err := r.EnableFileMAC(); err != nil {
+		t.Errorf("Cannot enable file MAC: %v", err)
+		return
+	}
+	buf.Reset()
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	tampered := buf.Bytes()
+	idx := bytes.Index(tampered, []byte("A wallet for testing."))
+	if idx < 0 {
+		t.Error("Cannot find description in serialized wallet")
+		return
+	}
+	tampered[idx] ^= 1
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(tampered)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	salt := r.kdfParams.salt
+	if err := r.RotateSalt([]byte("banana")); err != ErrTampered {
+		t.Errorf("Rotating salt of tampered wallet did not fail "+
+			"correctly: %v", err)
+		return
+	}
+	if r.kdfParams.salt != salt {
+		t.Error("Salt of tampered wallet was changed")
+	}
+	if err := r.Unlock([]byte("banana")); err != ErrTampered {
+		t.Errorf("Unlocking tampered wallet did not fail correctly: %v", err)
+	}
+}
+
+func TestAddressSeenTimes(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	before := time.Now().Add(-time.Second)
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	firstSeen, err := w.AddressFirstSeen(addr)
+	if err != nil {
+		t.Errorf("Cannot get first seen time: %v", err)
+		return
+	}
+	if firstSeen.Before(before) || firstSeen.After(time.Now()) {
+		t.Errorf("First seen time %v is not the creation time", firstSeen)
+	}
+
+	lastSeen, err := w.AddressLastSeen(addr)
+	if err != nil {
+		t.Errorf("Cannot get last seen time: %v", err)
+		return
+	}
+	if !lastSeen.IsZero() {
+		t.Errorf("Unseen address has last seen time %v", lastSeen)
+	}
+
+	w.addrMap[getAddressKey(addr)].(*btcAddress).lastSeen = 1400000000
+	lastSeen, err = w.AddressLastSeen(addr)
+	if err != nil {
+		t.Errorf("Cannot get last seen time: %v", err)
+		return
+	}
+	if !lastSeen.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("Last seen time %v does not match", lastSeen)
+	}
+
+	unknown, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), tstNetParams)
+	if err != nil {
+		t.Errorf("Cannot create address: %v", err)
+		return
+	}
+	if _, err := w.AddressFirstSeen(unknown); err != ErrAddressNotFound {
+		t.Errorf("Unknown address did not fail correctly: %v", err)
+	}
+	if _, err := w.AddressLastSeen(unknown); err != ErrAddressNotFound {
+		t.Errorf("Unknown address did not fail correctly: %v", err)
+	}
+}
+
+func TestVerifyPassphrase(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+
+	ok, err := w.VerifyPassphrase([]byte("banana"))
+	if err != nil {
+		t.Errorf("Cannot verify passphrase: %v", err)
+		return
+	}
+	if !ok {
+		t.Error("Correct passphrase did not verify")
+	}
+	if !w.IsLocked() {
+		t.Error("Verifying passphrase unlocked the key store")
+	}
+	if w.secret != nil {
+		t.Error("Verifying passphrase saved the secret key")
+	}
+
+	ok, err = w.VerifyPassphrase([]byte("potato"))
+	if err != nil {
+		t.Errorf("Cannot verify passphrase: %v", err)
+		return
+	}
+	if ok {
+		t.Error("Wrong passphrase verified")
+	}
+
+	// An unlocked key store must remain unlocked.
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	if ok, err := w.VerifyPassphrase([]byte("potato")); err != nil || ok {
+		t.Errorf("Wrong passphrase verified on unlocked key store: %v %v",
+			ok, err)
+	}
+	if w.IsLocked() {
+		t.Error("Verifying passphrase locked the key store")
+	}
+}
+
+func TestMaxCommentBytes(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+
+	defer func(n int) { MaxCommentLen = n }(MaxCommentLen)
+	if n := w.MaxCommentBytes(); n != maxChunkedCommentLen {
+		t.Errorf("Max comment bytes %v does not match format limit %v",
+			n, maxChunkedCommentLen)
+	}
+	MaxCommentLen = 10
+	if n := w.MaxCommentBytes(); n != 10 {
+		t.Errorf("Max comment bytes %v does not match MaxCommentLen", n)
+	}
+
+	left, err := w.AddressCommentBytesLeft(addr)
+	if err != nil {
+		t.Errorf("Cannot get remaining comment bytes: %v", err)
+		return
+	}
+	if left != 10 {
+		t.Errorf("Address without comment has %v bytes left", left)
+	}
+
+	if err := w.SetAddressComment(addr, "abcd"); err != nil {
+		t.Errorf("Cannot set address comment: %v", err)
+		return
+	}
+	left, err = w.AddressCommentBytesLeft(addr)
+	if err != nil {
+		t.Errorf("Cannot get remaining comment bytes: %v", err)
+		return
+	}
+	if left != 5 {
+		t.Errorf("Address with comment has %v bytes left, expected 5", left)
+	}
+
+	// Appending exactly the remaining bytes must succeed, and leave none.
+	if err := w.AppendAddressComment(addr, strings.Repeat("e", left)); err != nil {
+		t.Errorf("Cannot append remaining bytes: %v", err)
+		return
+	}
+	left, err = w.AddressCommentBytesLeft(addr)
+	if err != nil {
+		t.Errorf("Cannot get remaining comment bytes: %v", err)
+		return
+	}
+	if left != 0 {
+		t.Errorf("Full comment has %v bytes left", left)
+	}
+}
+
+func TestSignMessageCompact(t *testing.T) {
+	// Test vector from bitcoind's signmessage tests.
+	const (
+		privKeyWIF = "cUeKHd5orzT3mz8P9pxyREHfsWtVfgsfDjiZZBcjUBAaGk1BTj7N"
+		address    = "mpLQjfK79b7CCV4VMJWEWAj5Mpx8Up5zxB"
+		message    = "This is just a test message"
+		signature  = "INbVnW4e6PeRmsv2Qgu8NuopvrVjkcxob+sX8OcZG0SALhWybUjzMLPdAsXI46YZGb0KQTRii+wWIQzRpG/U+S0="
+	)
+
+	// The vector must verify using the same message hash, independently
+	// of any signing.
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, wasCompressed, err := btcec.RecoverCompact(btcec.S256(), sig,
+		bitcoindMessageHash(message))
+	if err != nil {
+		t.Errorf("Cannot recover public key: %v", err)
+		return
+	}
+	if !wasCompressed {
+		t.Error("Recovered public key is not compressed")
+	}
+	recovered, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(pk.SerializeCompressed()), &btcnet.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.EncodeAddress() != address {
+		t.Errorf("Recovered address %v, expected %v", recovered, address)
+		return
+	}
+
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), &btcnet.TestNet3Params, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	wif, err := btcutil.DecodeWIF(privKeyWIF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.ImportPrivateKey(wif, makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
+		return
+	}
+	if addr.EncodeAddress() != address {
+		t.Errorf("Imported address %v, expected %v", addr, address)
+		return
+	}
+
+	// Signatures need not use deterministic nonces, so rather than
+	// comparing with bitcoind's signature, check that the signing address
+	// is recovered from the signature as bitcoind would.
+	got, err := w.SignMessageCompact(addr, message)
+	if err != nil {
+		t.Errorf("Cannot sign message: %v", err)
+		return
+	}
+	sig, err = base64.StdEncoding.DecodeString(got)
+	if err != nil {
+		t.Errorf("Signature %q is not base64: %v", got, err)
+		return
+	}
+	pk, wasCompressed, err = btcec.RecoverCompact(btcec.S256(), sig,
+		bitcoindMessageHash(message))
+	if err != nil {
+		t.Errorf("Cannot recover public key from signature: %v", err)
+		return
+	}
+	if !wasCompressed {
+		t.Error("Signature does not mark public key compressed")
+	}
+	recovered, err = btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(pk.SerializeCompressed()), &btcnet.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.EncodeAddress() != address {
+		t.Errorf("Signature recovers address %v, expected %v",
+			recovered, address)
+	}
+
+	// Signing requires an unlocked key store.
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet: %v", err)
+		return
+	}
+	if _, err := w.SignMessageCompact(addr, message); err != ErrLocked {
+		t.Errorf("Signing with locked key store did not fail correctly: %v", err)
+	}
+}
+
+func TestReadCorruptHighestUsed(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
+		return
+	}
+	valid := w.highestUsed
+
+	tests := []struct {
+		name        string
+		highestUsed int64
+		recovered   int64
+	}{
+		{"below root", -5, rootKeyChainIdx},
+		{"beyond chain", int64(len(w.chainIdxMap)) + 5, w.lastChainIdx},
+	}
+	for _, test := range tests {
+		w.highestUsed = test.highestUsed
+		buf := new(bytes.Buffer)
+		_, err := w.WriteTo(buf)
+		w.highestUsed = valid
+		if err != nil {
+			t.Errorf("%s: Cannot write wallet: %v", test.name, err)
+			continue
+		}
+		serialized := buf.Bytes()
+
+		r := new(Store)
+		if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != ErrCorruptIndex {
+			t.Errorf("%s: Reading corrupt highest used index did not "+
+				"fail correctly: %v", test.name, err)
+			continue
+		}
+
+		r, errs, err := ReadFromRecover(bytes.NewReader(serialized))
+		if err != nil {
+			t.Errorf("%s: Cannot recover wallet: %v", test.name, err)
+			continue
+		}
+		if len(errs) != 1 {
+			t.Errorf("%s: Recovered with %d errors, expected 1",
+				test.name, len(errs))
+		}
+		if r.highestUsed != test.recovered {
+			t.Errorf("%s: Recovered highest used index %d, expected %d",
+				test.name, r.highestUsed, test.recovered)
+		}
+	}
+}
+
+func TestAppTag(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if tag := w.AppTag(); len(tag) != 0 {
+		t.Errorf("New key store has application tag %x", tag)
+	}
+
+	if err := w.SetAppTag(make([]byte, 17)); err != ErrAppTagTooLong {
+		t.Errorf("Setting long application tag did not fail correctly: %v", err)
+		return
+	}
+	tag := []byte("savings\x00account")
+	if err := w.SetAppTag(tag); err != nil {
+		t.Errorf("Cannot set application tag: %v", err)
+		return
+	}
+	if got := w.AppTag(); !bytes.Equal(got, tag) {
+		t.Errorf("Application tag %q does not match %q", got, tag)
+	}
+
+	// The tag must round trip through serialization.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
+		return
+	}
+	if got := r.AppTag(); !bytes.Equal(got, tag) {
+		t.Errorf("Read application tag %q does not match %q", got, tag)
+	}
+
+	// Files from before the application tag was saved are read with an
+	// empty tag.
+	old := append([]byte(nil), serialized...)
+	copy(old[8:12], []byte{1, 36, 8, 0})
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(old)); err != nil {
+		t.Errorf("Cannot read old wallet: %v", err)
+		return
+	}
+	if got := r.AppTag(); len(got) != 0 {
+		t.Errorf("Old key store has application tag %q", got)
+	}
+
+	// An empty tag removes the tag.
+	if err := w.SetAppTag(nil); err != nil {
+		t.Errorf("Cannot remove application tag: %v", err)
+		return
+	}
+	if got := w.AppTag(); len(got) != 0 {
+		t.Errorf("Removed application tag is %q", got)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	ww, err := w.ExportWatchingWallet()
+	if err != nil {
+		t.Errorf("Cannot export watching wallet: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name         string
+		store        *Store
+		watchingOnly bool
+	}{
+		{"normal", w, false},
+		{"watching-only", ww, true},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if _, err := test.store.WriteTo(buf); err != nil {
+			t.Errorf("%s: Cannot write wallet: %v", test.name, err)
+			continue
+		}
+
+		// Only the header is read, so the rest of the file is not
+		// required.
+		const headerSize = 8 + 4 + 4 + 8 + 6 + 8 + 32 + 256
+		h, err := ReadHeader(bytes.NewReader(buf.Bytes()[:headerSize]))
+		if err != nil {
+			t.Errorf("%s: Cannot read header: %v", test.name, err)
+			continue
+		}
+		if !h.Version.EQ(VersCurrent) {
+			t.Errorf("%s: Header version %v, expected %v", test.name,
+				h.Version, VersCurrent)
+		}
+		if h.Net.Net != tstNetParams.Net {
+			t.Errorf("%s: Header network %v, expected %v", test.name,
+				h.Net.Name, tstNetParams.Name)
+		}
+		if h.WatchingOnly != test.watchingOnly {
+			t.Errorf("%s: Header watching-only %v, expected %v",
+				test.name, h.WatchingOnly, test.watchingOnly)
+		}
+		if h.CreateDate != w.CreateDate() {
+			t.Errorf("%s: Header creation date %d, expected %d",
+				test.name, h.CreateDate, w.CreateDate())
+		}
+		if h.Description != "A wallet for testing." {
+			t.Errorf("%s: Header description %q does not match",
+				test.name, h.Description)
+		}
+		if h.Name != "" {
+			t.Errorf("%s: Header name %q is not empty", test.name, h.Name)
+		}
+	}
+
+	if _, err := ReadHeader(bytes.NewReader(make([]byte, 400))); err == nil {
+		t.Error("Reading header with unknown file ID did not fail")
+	}
+}
+
+func TestEncryptedTxComment(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	var plainSha, encSha btcwire.ShaHash
+	plainSha[0] = 1
+	encSha[0] = 2
+	const memo = "rent for march"
+
+	if err := w.SetEncryptedTxComment(&encSha, memo); err != ErrLocked {
+		t.Errorf("Setting encrypted comment while locked did not fail "+
+			"correctly: %v", err)
+		return
+	}
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
+		return
+	}
+	if err := w.SetTxComment(&plainSha, "plain"); err != nil {
+		t.Errorf("Cannot set comment: %v", err)
+		return
+	}
+	if err := w.SetEncryptedTxComment(&encSha, memo); err != nil {
+		t.Errorf("Cannot set encrypted comment: %v", err)
+		return
+	}
+	long := strings.Repeat("a", MaxEncryptedCommentLen+1)
+	if err := w.SetEncryptedTxComment(&encSha, long); err != ErrCommentTooLong {
+		t.Errorf("Setting long encrypted comment did not fail correctly: %v",
+			err)
+		return
+	}
+	if !w.IsTxCommentEncrypted(&encSha) || w.IsTxCommentEncrypted(&plainSha) {
+		t.Error("Encrypted comment flags do not match")
+	}
+	if c := w.TxComment(&encSha); c != memo {
+		t.Errorf("Encrypted comment %q does not match %q", c, memo)
+	}
+
+	// The comment must not be saved in plaintext.
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
+		return
+	}
+	serialized := buf.Bytes()
+	if bytes.Contains(serialized, []byte(memo)) {
+		t.Error("Encrypted comment saved in plaintext")
+	}
+
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
 		return
 	}
-	pka := addr.(PubKeyAddress)
-
-	// lookup address
-	pk2, err := pka.PrivKey()
-	if err != nil {
-		t.Error("error looking up key: " + err.Error())
+	if c := r.TxComment(&encSha); c != EncryptedCommentPlaceholder {
+		t.Errorf("Locked key store returned encrypted comment %q", c)
 	}
-
-	if !reflect.DeepEqual(pk, pk2) {
-		t.Error("original and looked-up private keys do not match.")
+	if c := r.TxComment(&plainSha); c != "plain" {
+		t.Errorf("Plaintext comment %q does not match", c)
+	}
+	if err := r.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
 		return
 	}
+	if c := r.TxComment(&encSha); c != memo {
+		t.Errorf("Read encrypted comment %q does not match %q", c, memo)
+	}
 
-	// verify that the sync height now match the (smaller) import height.
-	if _, h := w.SyncedTo(); h != importHeight {
-		t.Errorf("After import sync height %v does not match expected %v.", h, importHeight)
+	// Encrypted comments remain readable after changing the passphrase.
+	if err := r.ChangePassphrase([]byte("potato")); err != nil {
+		t.Errorf("Cannot change passphrase: %v", err)
 		return
 	}
+	if c := r.TxComment(&encSha); c != memo {
+		t.Errorf("Encrypted comment %q does not match %q after changing "+
+			"passphrase", c, memo)
+	}
 
-	// serialise and deseralise and check still there.
+	// Setting a plaintext comment replaces the encrypted comment.
+	if err := r.SetTxComment(&encSha, "replaced"); err != nil {
+		t.Errorf("Cannot set comment: %v", err)
+		return
+	}
+	if r.IsTxCommentEncrypted(&encSha) {
+		t.Error("Plaintext comment is marked encrypted")
+	}
+	if c := r.TxComment(&encSha); c != "replaced" {
+		t.Errorf("Replaced comment %q does not match", c)
+	}
+}
 
-	// Test (de)serialization of wallet.
-	buf := new(bytes.Buffer)
-	_, err = w.WriteTo(buf)
+func TestIsDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
 	if err != nil {
-		t.Errorf("Cannot write wallet: %v", err)
+		t.Errorf("Cannot create temporary directory: %v", err)
 		return
 	}
-	w2 := new(Store)
-	_, err = w2.ReadFrom(buf)
+	defer os.RemoveAll(dir)
+
+	w, err := New(dir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Errorf("Cannot read wallet: %v", err)
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
+	if !w.IsDirty() {
+		t.Error("New key store is not dirty")
+	}
 
-	// Verify that the  sync height match expected after the reserialization.
-	if _, h := w2.SyncedTo(); h != importHeight {
-		t.Errorf("After reserialization sync height %v does not match expected %v.", h, importHeight)
+	// write writes the key store file, which must then be clean.
+	write := func(name string) bool {
+		if err := w.WriteIfDirty(); err != nil {
+			t.Errorf("%s: Cannot write wallet: %v", name, err)
+			return false
+		}
+		if w.IsDirty() {
+			t.Errorf("%s: Key store is dirty after write", name)
+			return false
+		}
+		return true
+	}
+	if !write("new") {
 		return
 	}
 
-	// Mark imported address as partially synced with a block somewhere inbetween
-	// the import height and the chain height.
-	partialHeight := (createHeight-importHeight)/2 + importHeight
-	if err := w2.SetSyncStatus(address, PartialSync(partialHeight)); err != nil {
-		t.Errorf("Cannot mark address partially synced: %v", err)
+	addr, err := w.NextChainedAddress(makeBS(0))
+	if err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-	if _, h := w2.SyncedTo(); h != partialHeight {
-		t.Errorf("After address partial sync, sync height %v does not match expected %v.", h, partialHeight)
-		return
+	var txSha btcwire.ShaHash
+	tests := []struct {
+		name   string
+		mutate func() error
+	}{
+		{"SetSyncedWith", func() error {
+			w.SetSyncedWith(makeBS(1))
+			return nil
+		}},
+		{"NextChainedAddress", func() error {
+			_, err := w.NextChainedAddress(makeBS(1))
+			return err
+		}},
+		{"SetAddressComment", func() error {
+			return w.SetAddressComment(addr, "comment")
+		}},
+		{"SetTxComment", func() error {
+			return w.SetTxComment(&txSha, "comment")
+		}},
+		{"SetLabel", func() error {
+			return w.SetLabel("label")
+		}},
+		{"ImportPrivateKey", func() error {
+			if err := w.Unlock([]byte("banana")); err != nil {
+				return err
+			}
+			defer w.Lock()
+			pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+			if err != nil {
+				return err
+			}
+			wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk),
+				tstNetParams, true)
+			if err != nil {
+				return err
+			}
+			_, err = w.ImportPrivateKey(wif, makeBS(1))
+			return err
+		}},
+	}
+	for _, test := range tests {
+		if !write(test.name) {
+			return
+		}
+		if err := test.mutate(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			return
+		}
+		if !w.IsDirty() {
+			t.Errorf("%s: Key store is not dirty", test.name)
+		}
 	}
 
-	// Test serialization with the partial sync.
-	buf.Reset()
-	_, err = w2.WriteTo(buf)
-	if err != nil {
-		t.Errorf("Cannot write wallet: %v", err)
+	// Reading and failed changes do not make the key store dirty.
+	if !write("final") {
 		return
 	}
-	w3 := new(Store)
-	_, err = w3.ReadFrom(buf)
-	if err != nil {
-		t.Errorf("Cannot read wallet: %v", err)
+	if _, err := w.AddressComment(addr); err != nil {
+		t.Errorf("Cannot get address comment: %v", err)
 		return
 	}
-
-	// Test correct partial height after serialization.
-	if _, h := w3.SyncedTo(); h != partialHeight {
-		t.Errorf("After address partial sync and reserialization, sync height %v does not match expected %v.",
-			h, partialHeight)
+	if err := w.SetLabel(string([]byte{0xff})); err != ErrInvalidComment {
+		t.Errorf("Setting invalid label did not fail correctly: %v", err)
+		return
+	}
+	if w.IsDirty() {
+		t.Error("Key store is dirty without changes")
 		return
 	}
 
-	// Mark imported address as not synced at all, and verify sync height is now
-	// the import height.
-	if err := w3.SetSyncStatus(address, Unsynced(0)); err != nil {
-		t.Errorf("Cannot mark address synced: %v", err)
+	// Serializing the key store anywhere but its file, such as for a
+	// backup, leaves it dirty.
+	w.MarkDirty()
+	if _, err := w.WriteTo(ioutil.Discard); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
-	if _, h := w3.SyncedTo(); h != importHeight {
-		t.Errorf("After address unsync, sync height %v does not match expected %v.", h, importHeight)
+	if _, err := w.WriteToWithProgress(ioutil.Discard, func(int64, int64) {}); err != nil {
+		t.Errorf("Cannot write wallet with progress: %v", err)
 		return
 	}
-
-	// Mark imported address as synced with the recently-seen blocks, and verify
-	// that the sync height now equals the most recent block (the one at wallet
-	// creation).
-	if err := w3.SetSyncStatus(address, FullSync{}); err != nil {
-		t.Errorf("Cannot mark address synced: %v", err)
+	if err := w.WriteEncrypted(ioutil.Discard, []byte("transport")); err != nil {
+		t.Errorf("Cannot write encrypted wallet: %v", err)
 		return
 	}
-	if _, h := w3.SyncedTo(); h != createHeight {
-		t.Errorf("After address sync, sync height %v does not match expected %v.", h, createHeight)
+	if !w.IsDirty() {
+		t.Error("Key store is not dirty after writing a backup")
 		return
 	}
 
-	if err = w3.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Can't unlock deserialised wallet: %v", err)
+	// Copies have never been written, so they start dirty.
+	c, err := w.ReencryptedCopy([]byte("banana"), []byte("potato"))
+	if err != nil {
+		t.Errorf("Cannot make reencrypted copy: %v", err)
 		return
 	}
-
-	addr3, err := w3.Address(address)
+	if !c.IsDirty() {
+		t.Error("Reencrypted copy is not dirty")
+	}
+	c, err = w.ChangeNetwork(btcwire.TestNet3)
 	if err != nil {
-		t.Error("privkey in deserialised wallet missing : " +
-			err.Error())
+		t.Errorf("Cannot change network: %v", err)
 		return
 	}
-	pka3 := addr3.(PubKeyAddress)
-
-	// lookup address
-	pk2, err = pka3.PrivKey()
+	if !c.IsDirty() {
+		t.Error("Copy for another network is not dirty")
+	}
+	c, err = w.ExportWatchingWallet()
 	if err != nil {
-		t.Error("error looking up key in deserialized wallet: " + err.Error())
+		t.Errorf("Cannot export watching wallet: %v", err)
+		return
+	}
+	if !c.IsDirty() {
+		t.Error("Watching-only copy is not dirty")
 	}
+}
 
-	if !reflect.DeepEqual(pk, pk2) {
-		t.Error("original and deserialized private keys do not match.")
+func TestNextUnusedAddress(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if err := w.SetKeypoolPolicy(KeypoolPolicy{
+		TargetSize: 5,
+		BatchSize:  1,
+		AutoExtend: true,
+	}); err != nil {
+		t.Errorf("Cannot set keypool policy: %v", err)
+		return
+	}
+	if err := w.TopUpKeypool(makeBS(0)); err != nil {
+		t.Errorf("Cannot top up keypool: %v", err)
 		return
 	}
+	addrAt := func(idx int64) btcutil.Address {
+		wa, err := w.AddressAtIndex(idx)
+		if err != nil {
+			t.Fatalf("Cannot get address at index %d: %v", idx, err)
+		}
+		return wa.Address()
+	}
 
+	tests := []struct {
+		used []btcutil.Address
+		want int64
+	}{
+		{nil, 0},
+		{[]btcutil.Address{addrAt(1), addrAt(2)}, 3},
+		{[]btcutil.Address{addrAt(4)}, 5},
+		{nil, 6},
+	}
+	for i, test := range tests {
+		wa, err := w.NextUnusedAddress(makeBS(0), test.used)
+		if err != nil {
+			t.Errorf("Test %d: Cannot get next unused address: %v", i, err)
+			return
+		}
+		if !bytes.Equal(wa.Address().ScriptAddress(),
+			addrAt(test.want).ScriptAddress()) {
+			t.Errorf("Test %d: Address does not match chain index %d",
+				i, test.want)
+		}
+		if idx := w.HighestUsedIndex(); idx != test.want {
+			t.Errorf("Test %d: Highest used index %d, expected %d",
+				i, idx, test.want)
+		}
+	}
 }
 
-func TestImportScript(t *testing.T) {
-	createHeight := int32(100)
-	createdAt := makeBS(createHeight)
+func TestDebugDump(t *testing.T) {
 	w, err := New(dummyDir, "A wallet for testing.",
-		[]byte("banana"), tstNetParams, createdAt)
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
 		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	if err = w.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Can't unlock original wallet: %v", err)
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
 		return
 	}
-
-	// verify that the entire wallet's sync height matches the
-	// expected createHeight.
-	if _, h := w.SyncedTo(); h != createHeight {
-		t.Errorf("Initial sync height %v does not match expected %v.", h, createHeight)
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-
-	script := []byte{btcscript.OP_TRUE, btcscript.OP_DUP,
-		btcscript.OP_DROP}
-	importHeight := int32(50)
-	stamp := makeBS(importHeight)
-	address, err := w.ImportScript(script, stamp)
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
 	if err != nil {
-		t.Error("error importing script: " + err.Error())
-		return
+		t.Fatal(err)
 	}
-
-	// lookup address
-	ainfo, err := w.Address(address)
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
 	if err != nil {
-		t.Error("error looking up script: " + err.Error())
+		t.Fatal(err)
 	}
-
-	sinfo := ainfo.(ScriptAddress)
-
-	if !bytes.Equal(script, sinfo.Script()) {
-		t.Error("original and looked-up script do not match.")
+	if _, err := w.ImportPrivateKey(wif, makeBS(0)); err != nil {
+		t.Errorf("Cannot import private key: %v", err)
 		return
 	}
-
-	if sinfo.ScriptClass() != btcscript.NonStandardTy {
-		t.Error("script type incorrect.")
+	if _, err := w.ImportScript([]byte{btcscript.OP_TRUE}, makeBS(0)); err != nil {
+		t.Errorf("Cannot import script: %v", err)
 		return
 	}
 
-	if sinfo.RequiredSigs() != 0 {
-		t.Error("required sigs funny number")
-		return
+	buf := new(bytes.Buffer)
+	if err := w.DebugDump(buf); err != nil {
+		t.Errorf("Cannot dump key store: %v", err)
+		return
+	}
+	dump := buf.Bytes()
+
+	for _, want := range []string{
+		"version: " + VersCurrent.String(),
+		"network: " + tstNetParams.Name,
+		"highest used index: 0",
+		"imported addresses: 2",
+		"addresses: 4",
+		"  script index=-2",
+	} {
+		if !bytes.Contains(dump, []byte(want)) {
+			t.Errorf("Dump does not contain %q:\n%s", want, dump)
+		}
 	}
 
-	if len(sinfo.Addresses()) != 0 {
-		t.Error("addresses in bogus script.")
-		return
+	// No secret may appear in the dump, either as raw bytes or hex.
+	secrets := [][]byte{w.secret, w.passphrase, w.kdfParams.salt[:]}
+	for _, wa := range w.addrMap {
+		a, ok := wa.(*btcAddress)
+		if !ok {
+			continue
+		}
+		privKeyCT, err := a.privKeyBytes()
+		if err != nil {
+			t.Errorf("Cannot get private key: %v", err)
+			return
+		}
+		secrets = append(secrets, privKeyCT, a.privKey[:])
+	}
+	for _, secret := range secrets {
+		if bytes.Contains(dump, secret) ||
+			bytes.Contains(dump, []byte(hex.EncodeToString(secret))) {
+			t.Errorf("Dump contains secret %x", secret)
+		}
 	}
+}
 
-	if sinfo.Address().EncodeAddress() != address.EncodeAddress() {
-		t.Error("script address doesn't match entry.")
+func TestImportPrivateKeyReplace(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	if string(sinfo.Address().ScriptAddress()) != sinfo.AddrHash() {
-		t.Error("script hash doesn't match address.")
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
 		return
 	}
+	pk, err := ecdsa.GenerateKey(btcec.S256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF((*btcec.PrivateKey)(pk), tstNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if sinfo.FirstBlock() != importHeight {
-		t.Error("funny first block")
+	addr, err := w.ImportPrivateKeyReplace(wif, makeBS(100))
+	if err != nil {
+		t.Errorf("Cannot import private key: %v", err)
 		return
 	}
-
-	if !sinfo.Imported() {
-		t.Error("imported script info not imported.")
+	if _, err := w.ImportPrivateKey(wif, makeBS(100)); err != ErrDuplicate {
+		t.Errorf("Duplicate import did not fail correctly: %v", err)
 		return
 	}
 
-	if sinfo.Change() {
-		t.Error("imported script is change.")
-		return
+	tests := []struct {
+		height     int32
+		firstBlock int32
+	}{
+		{200, 100}, // first block is never raised
+		{50, 50},
+	}
+	for _, test := range tests {
+		a, err := w.ImportPrivateKeyReplace(wif, makeBS(test.height))
+		if err != nil {
+			t.Errorf("Cannot replace private key at height %d: %v",
+				test.height, err)
+			return
+		}
+		if a.EncodeAddress() != addr.EncodeAddress() {
+			t.Errorf("Replaced address %v, expected %v", a, addr)
+		}
+		wa, err := w.Address(addr)
+		if err != nil {
+			t.Errorf("Cannot get address: %v", err)
+			return
+		}
+		if fb := wa.FirstBlock(); fb != test.firstBlock {
+			t.Errorf("First block %d after import at height %d, "+
+				"expected %d", fb, test.height, test.firstBlock)
+		}
+	}
+	if ss, ok := w.addrMap[getAddressKey(addr)].SyncStatus().(Unsynced); !ok || ss != 50 {
+		t.Errorf("Address sync status %v is not unsynced from 50",
+			w.addrMap[getAddressKey(addr)].SyncStatus())
+	}
+	if n := len(w.SortedActiveAddresses()); n != 2 {
+		t.Errorf("Key store has %d active addresses, expected 2", n)
 	}
 
-	if sinfo.Compressed() {
-		t.Error("imported script is compressed.")
+	// The re-encrypted private key must still be readable after the key
+	// store is locked and unlocked.
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet: %v", err)
 		return
 	}
-
-	// verify that the sync height now match the (smaller) import height.
-	if _, h := w.SyncedTo(); h != importHeight {
-		t.Errorf("After import sync height %v does not match expected %v.", h, importHeight)
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
 		return
 	}
-
-	// Check that it's included along with the active payment addresses.
-	found := false
-	for _, wa := range w.SortedActiveAddresses() {
-		if wa.Address() == address {
-			found = true
-			break
-		}
+	privKey, err := w.PrivKeyBytes(addr)
+	if err != nil {
+		t.Errorf("Cannot get private key: %v", err)
+		return
 	}
-	if !found {
-		t.Errorf("Imported script address was not returned with sorted active payment addresses.")
+	if !bytes.Equal(privKey, wif.PrivKey.Serialize()) {
+		t.Error("Replaced private key does not match")
+	}
+
+	// Chained addresses are never replaced.
+	rootWIF, err := w.keyGenerator.ExportPrivKey()
+	if err != nil {
+		t.Errorf("Cannot export root private key: %v", err)
 		return
 	}
-	if _, ok := w.ActiveAddresses()[address]; !ok {
-		t.Errorf("Imported script address was not returned with unsorted active payment addresses.")
+	if _, err := w.ImportPrivateKeyReplace(rootWIF, makeBS(0)); err != ErrDuplicate {
+		t.Errorf("Replacing chained address did not fail correctly: %v", err)
+	}
+}
+
+func TestKDFFingerprint(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
+	fp := w.KDFFingerprint()
 
-	// serialise and deseralise and check still there.
-
-	// Test (de)serialization of wallet.
+	// Fingerprints must survive serialization.
 	buf := new(bytes.Buffer)
-	_, err = w.WriteTo(buf)
-	if err != nil {
+	if _, err := w.WriteTo(buf); err != nil {
 		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
-	w2 := new(Store)
-	_, err = w2.ReadFrom(buf)
-	if err != nil {
+	r := new(Store)
+	if _, err := r.ReadFrom(buf); err != nil {
 		t.Errorf("Cannot read wallet: %v", err)
 		return
 	}
-
-	// Verify that the sync height matches expected after the reserialization.
-	if _, h := w2.SyncedTo(); h != importHeight {
-		t.Errorf("After reserialization sync height %v does not match expected %v.", h, importHeight)
-		return
+	if r.KDFFingerprint() != fp {
+		t.Error("Fingerprint changed after serialization")
 	}
 
-	// lookup address
-	ainfo2, err := w2.Address(address)
+	// A different salt or cost parameter must change the fingerprint.
+	other, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Error("error looking up info in deserialized wallet: " + err.Error())
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	if other.KDFFingerprint() == fp {
+		t.Error("Key stores with different salts have the same fingerprint")
+	}
+	other.kdfParams = w.kdfParams
+	if other.KDFFingerprint() != fp {
+		t.Error("Key stores with the same parameters have different " +
+			"fingerprints")
+	}
+	other.kdfParams.nIter++
+	if other.KDFFingerprint() == fp {
+		t.Error("Changing iterations did not change the fingerprint")
 	}
 
-	sinfo2 := ainfo2.(ScriptAddress)
-	// Check all the same again. We can't use reflect.DeepEquals since
-	// the internals have pointers back to the wallet struct.
-	if sinfo2.Address().EncodeAddress() != address.EncodeAddress() {
-		t.Error("script address doesn't match entry.")
+	if err := w.RotateSalt([]byte("banana")); err != nil {
+		t.Errorf("Cannot rotate salt: %v", err)
 		return
 	}
+	if w.KDFFingerprint() == fp {
+		t.Error("Rotating salt did not change the fingerprint")
+	}
+}
 
-	if string(sinfo2.Address().ScriptAddress()) != sinfo2.AddrHash() {
-		t.Error("script hash doesn't match address.")
+func TestReadNonRootKeyGenerator(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	if sinfo2.FirstBlock() != importHeight {
-		t.Error("funny first block")
+	if _, err := w.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot get next chained address: %v", err)
 		return
 	}
-
-	if !sinfo2.Imported() {
-		t.Error("imported script info not imported.")
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
+	serialized := buf.Bytes()
 
-	if sinfo2.Change() {
-		t.Error("imported script is change.")
+	// Find the serialized root address and change its chain index, which
+	// follows the address hash and checksum, version, flags, and chaincode
+	// and checksum.
+	root := new(bytes.Buffer)
+	if _, err := w.keyGenerator.WriteTo(root); err != nil {
+		t.Errorf("Cannot write root address: %v", err)
 		return
 	}
-
-	if sinfo2.Compressed() {
-		t.Error("imported script is compressed.")
+	off := bytes.Index(serialized, root.Bytes())
+	if off == -1 {
+		t.Error("Cannot find root address in serialized key store")
 		return
 	}
+	const chainIndexOff = 20 + 4 + 4 + 8 + 32 + 4
+	corrupt := append([]byte(nil), serialized...)
+	binary.LittleEndian.PutUint64(corrupt[off+chainIndexOff:], 5)
 
-	if !bytes.Equal(sinfo.Script(), sinfo2.Script()) {
-		t.Error("original and serailised scriptinfo scripts "+
-			"don't match %s != %s", spew.Sdump(sinfo.Script()),
-			spew.Sdump(sinfo2.Script()))
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(corrupt)); err != ErrMalformedEntry {
+		t.Errorf("Reading non-root key generator did not fail correctly: %v",
+			err)
+		return
 	}
 
-	if sinfo.ScriptClass() != sinfo2.ScriptClass() {
-		t.Error("original and serailised scriptinfo class "+
-			"don't match: %s != %s", sinfo.ScriptClass(),
-			sinfo2.ScriptClass())
+	r, errs, err := ReadFromRecover(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Errorf("Cannot recover wallet: %v", err)
 		return
 	}
+	if len(errs) != 1 {
+		t.Errorf("Recovered with %d errors, expected 1", len(errs))
+	}
+	if r.keyGenerator.chainIndex != rootKeyChainIdx {
+		t.Errorf("Recovered root chain index %d", r.keyGenerator.chainIndex)
+	}
+	if _, err := r.NextChainedAddress(makeBS(0)); err != nil {
+		t.Errorf("Cannot extend recovered wallet: %v", err)
+	}
+}
 
-	if !reflect.DeepEqual(sinfo.Addresses(), sinfo2.Addresses()) {
-		t.Error("original and serailised scriptinfo addresses "+
-			"don't match (%s) != (%s)", spew.Sdump(sinfo.Addresses),
-			spew.Sdump(sinfo2.Addresses()))
+func TestSearchComments(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	if sinfo.RequiredSigs() != sinfo.RequiredSigs() {
-		t.Errorf("original and serailised scriptinfo requiredsigs "+
-			"don't match %d != %d", sinfo.RequiredSigs(),
-			sinfo2.RequiredSigs())
+	if err := w.Unlock([]byte("banana")); err != nil {
+		t.Errorf("Can't unlock wallet: %v", err)
 		return
 	}
 
-	// Check that it's included along with the active payment addresses.
-	found = false
-	for _, wa := range w.SortedActiveAddresses() {
-		if wa.Address() == address {
-			found = true
-			break
+	var addrs []btcutil.Address
+	for i := 0; i < 3; i++ {
+		addr, err := w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
 		}
+		addrs = append(addrs, addr)
 	}
-	if !found {
-		t.Errorf("After reserialiation, imported script address was not returned with sorted " +
-			"active payment addresses.")
-		return
+	addrComments := []string{"Rent deposit", "groceries", "RENT refund"}
+	for i, c := range addrComments {
+		if err := w.SetAddressComment(addrs[i], c); err != nil {
+			t.Errorf("Cannot set address comment: %v", err)
+			return
+		}
 	}
-	if _, ok := w.ActiveAddresses()[address]; !ok {
-		t.Errorf("After reserialiation, imported script address was not returned with unsorted " +
-			"active payment addresses.")
+
+	var hashes [4]btcwire.ShaHash
+	for i := range hashes {
+		hashes[i][0] = byte(len(hashes) - i)
+	}
+	txComments := []string{"rent for May", "coffee", "Rent for June"}
+	for i, c := range txComments {
+		if err := w.SetTxComment(&hashes[i], c); err != nil {
+			t.Errorf("Cannot set tx comment: %v", err)
+			return
+		}
+	}
+	if err := w.SetEncryptedTxComment(&hashes[3], "secret rent"); err != nil {
+		t.Errorf("Cannot set encrypted tx comment: %v", err)
 		return
 	}
 
-	// Mark imported address as partially synced with a block somewhere inbetween
-	// the import height and the chain height.
-	partialHeight := (createHeight-importHeight)/2 + importHeight
-	if err := w2.SetSyncStatus(address, PartialSync(partialHeight)); err != nil {
-		t.Errorf("Cannot mark address partially synced: %v", err)
+	am := w.SearchAddressComments("rent")
+	if len(am) != 2 {
+		t.Errorf("Found %d address comments, expected 2", len(am))
 		return
 	}
-	if _, h := w2.SyncedTo(); h != partialHeight {
-		t.Errorf("After address partial sync, sync height %v does not match expected %v.", h, partialHeight)
-		return
+	if am[0].Address.EncodeAddress() != addrs[0].EncodeAddress() ||
+		am[1].Address.EncodeAddress() != addrs[2].EncodeAddress() ||
+		am[0].Comment != addrComments[0] || am[1].Comment != addrComments[2] {
+		t.Errorf("Address comment matches %v are not in chain order", am)
 	}
 
-	// Test serialization with the partial sync.
-	buf.Reset()
-	_, err = w2.WriteTo(buf)
-	if err != nil {
-		t.Errorf("Cannot write wallet: %v", err)
-		return
+	// Matches are sorted by hash, so the encrypted comment, with the
+	// lowest hash, is first.
+	tm := w.SearchTxComments("RENT")
+	want := []TxCommentMatch{
+		{hashes[3], "secret rent"},
+		{hashes[2], txComments[2]},
+		{hashes[0], txComments[0]},
 	}
-	w3 := new(Store)
-	_, err = w3.ReadFrom(buf)
-	if err != nil {
-		t.Errorf("Cannot read wallet: %v", err)
-		return
+	if !reflect.DeepEqual(tm, want) {
+		t.Errorf("Tx comment matches %v, expected %v", tm, want)
 	}
 
-	// Test correct partial height after serialization.
-	if _, h := w3.SyncedTo(); h != partialHeight {
-		t.Errorf("After address partial sync and reserialization, sync height %v does not match expected %v.",
-			h, partialHeight)
+	// Encrypted comments are not searched while locked.
+	if err := w.Lock(); err != nil {
+		t.Errorf("Cannot lock wallet: %v", err)
 		return
 	}
+	if tm := w.SearchTxComments("secret"); len(tm) != 0 {
+		t.Errorf("Found encrypted comments while locked: %v", tm)
+	}
+	if tm := w.SearchTxComments("none"); tm != nil {
+		t.Errorf("Found unexpected comments: %v", tm)
+	}
+}
 
-	// Mark imported address as not synced at all, and verify sync height is now
-	// the import height.
-	if err := w3.SetSyncStatus(address, Unsynced(0)); err != nil {
-		t.Errorf("Cannot mark address synced: %v", err)
-		return
+func TestFileVersionUint32(t *testing.T) {
+	tests := []struct {
+		v    FileVersion
+		want uint32
+	}{
+		{FileVersion{0, 0, 0, 0}, 0},
+		{FileVersion{0, 0, 0, 255}, 0x000000ff},
+		{VersArmory, 0x01230000},
+		{Vers20LastBlocks, 0x01240000},
+		{VersUnsetNeedsPrivkeyFlag, 0x01240100},
+		{FileVersion{1, 36, 10, 0}, 0x01240a00},
+		{FileVersion{255, 255, 255, 255}, 0xffffffff},
 	}
-	if _, h := w3.SyncedTo(); h != importHeight {
-		t.Errorf("After address unsync, sync height %v does not match expected %v.", h, importHeight)
-		return
+	for _, test := range tests {
+		if got := test.v.Uint32(); got != test.want {
+			t.Errorf("Version %v packed to %#08x, expected %#08x",
+				test.v, got, test.want)
+		}
 	}
 
-	// Mark imported address as synced with the recently-seen blocks, and verify
-	// that the sync height now equals the most recent block (the one at wallet
-	// creation).
-	if err := w3.SetSyncStatus(address, FullSync{}); err != nil {
-		t.Errorf("Cannot mark address synced: %v", err)
-		return
+	// Versions which collided with the previous packing must pack to
+	// distinct integers, in version order.
+	if VersArmory.Uint32() >= Vers20LastBlocks.Uint32() {
+		t.Errorf("Armory version %#08x does not pack below %#08x",
+			VersArmory.Uint32(), Vers20LastBlocks.Uint32())
 	}
-	if _, h := w3.SyncedTo(); h != createHeight {
-		t.Errorf("After address sync, sync height %v does not match expected %v.", h, createHeight)
-		return
+	if (FileVersion{1, 0, 0, 0}).Uint32() == (FileVersion{0, 4, 0, 0}).Uint32() {
+		t.Error("Versions 1.0 and 0.4 pack to the same integer")
 	}
+}
 
-	if err = w3.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Can't unlock deserialised wallet: %v", err)
-		return
+func TestFileVersionCompare(t *testing.T) {
+	tests := []struct {
+		name       string
+		v, v2      FileVersion
+		lt, eq, gt bool
+	}{
+		{"equal", Vers20LastBlocks, Vers20LastBlocks, false, true, false},
+		{"major wins over minor", FileVersion{2, 0, 0, 0}, FileVersion{1, 36, 0, 0}, false, false, true},
+		{"minor loses to major", FileVersion{1, 36, 0, 0}, FileVersion{2, 0, 0, 0}, true, false, false},
+		{"major wins over minor 2", FileVersion{2, 0, 0, 0}, FileVersion{1, 5, 0, 0}, false, false, true},
+		{"minor wins over bugfix", FileVersion{1, 36, 0, 0}, FileVersion{1, 35, 9, 0}, false, false, true},
+		{"bugfix wins over autoincrement", FileVersion{1, 36, 1, 0}, FileVersion{1, 36, 0, 9}, false, false, true},
+		{"autoincrement only", FileVersion{1, 36, 1, 1}, FileVersion{1, 36, 1, 2}, true, false, false},
+		{"armory before last blocks", VersArmory, Vers20LastBlocks, true, false, false},
+		{"current after armory", VersCurrent, VersArmory, false, false, true},
+	}
+	for _, test := range tests {
+		if got := test.v.LT(test.v2); got != test.lt {
+			t.Errorf("%s: %v.LT(%v) = %v, expected %v", test.name,
+				test.v, test.v2, got, test.lt)
+		}
+		if got := test.v.EQ(test.v2); got != test.eq {
+			t.Errorf("%s: %v.EQ(%v) = %v, expected %v", test.name,
+				test.v, test.v2, got, test.eq)
+		}
+		if got := test.v.GT(test.v2); got != test.gt {
+			t.Errorf("%s: %v.GT(%v) = %v, expected %v", test.name,
+				test.v, test.v2, got, test.gt)
+		}
 	}
 }
 
-func TestChangePassphrase(t *testing.T) {
-	createdAt := makeBS(0)
+func TestReservedBlockRoundTrip(t *testing.T) {
 	w, err := New(dummyDir, "A wallet for testing.",
-		[]byte("banana"), tstNetParams, createdAt)
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
 		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
-
-	// Changing the passphrase with a locked wallet must fail with ErrWalletLocked.
-	if err := w.ChangePassphrase([]byte("potato")); err != ErrLocked {
-		t.Errorf("Changing passphrase on a locked wallet did not fail correctly: %v", err)
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
+	serialized := buf.Bytes()
 
-	// Unlock wallet so the passphrase can be changed.
-	if err := w.Unlock([]byte("banana")); err != nil {
-		t.Errorf("Cannot unlock: %v", err)
+	// The reserved block follows the file ID, version, network, flags,
+	// unique ID, creation date, name, description, highest used index,
+	// and KDF parameters.
+	const reservedOffset = 8 + 4 + 4 + 8 + 6 + 8 + 32 + 256 + 8 + 256
+	block := serialized[reservedOffset : reservedOffset+256]
+	if !bytes.Equal(block, make([]byte, 256)) {
+		t.Errorf("New key store wrote non-zero reserved block %x", block)
 		return
 	}
+	for i := range block {
+		block[i] = byte(i) ^ 0xa5
+	}
+	want := append([]byte(nil), block...)
 
-	// Get root address and its private key.  This is compared to the private
-	// key post passphrase change.
-	rootAddr := w.LastChainedAddress()
-
-	rootAddrInfo, err := w.Address(rootAddr)
-	if err != nil {
-		t.Error("can't find root address: " + err.Error())
+	r := new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(serialized)); err != nil {
+		t.Errorf("Cannot read wallet: %v", err)
 		return
 	}
-	rapka := rootAddrInfo.(PubKeyAddress)
+	if !bytes.Equal(r.reserved[:], want) {
+		t.Errorf("Read reserved block %x does not match %x",
+			r.reserved[:], want)
+	}
 
-	rootPrivKey, err := rapka.PrivKey()
-	if err != nil {
-		t.Errorf("Cannot get root address' private key: %v", err)
+	// Rewriting the key store must preserve the reserved bytes rather
+	// than zeroing them.
+	buf.Reset()
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Errorf("Cannot rewrite wallet: %v", err)
 		return
 	}
+	rewritten := buf.Bytes()
+	if got := rewritten[reservedOffset : reservedOffset+256]; !bytes.Equal(got, want) {
+		t.Errorf("Rewrote reserved block %x, expected %x", got, want)
+	}
+	if diffs := r.Diff(w); len(diffs) != 1 || diffs[0] != "reserved block differs" {
+		t.Errorf("Unexpected differences from original: %v", diffs)
+	}
+}
 
-	// Change passphrase.
-	if err := w.ChangePassphrase([]byte("potato")); err != nil {
-		t.Errorf("Changing passhprase failed: %v", err)
+func TestConfirmationsAt(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
+	w.SetSyncedWith(makeBS(20))
 
-	// Wallet should still be unlocked.
-	if w.IsLocked() {
-		t.Errorf("Wallet should be unlocked after passphrase change.")
-		return
+	tests := []struct {
+		seenHeight int32
+		want       int32
+	}{
+		{0, 21},
+		{1, 20},
+		{19, 2},
+		{20, 1},
+		{21, 0},
+		{100, 0},
+		{-1, 0},
+	}
+	for _, test := range tests {
+		if got := w.ConfirmationsAt(test.seenHeight); got != test.want {
+			t.Errorf("Confirmations at height %d: got %d, expected %d",
+				test.seenHeight, got, test.want)
+		}
 	}
 
-	// Lock it.
-	if err := w.Lock(); err != nil {
-		t.Errorf("Cannot lock wallet after passphrase change: %v", err)
-		return
+	// Without a known tip, nothing is confirmed.
+	w.ResetSyncState()
+	if got := w.ConfirmationsAt(0); got != 0 {
+		t.Errorf("Confirmations without sync state: got %d, expected 0", got)
 	}
+}
 
-	// Unlock with old passphrase.  This must fail with ErrWrongPassphrase.
-	if err := w.Unlock([]byte("banana")); err != ErrWrongPassphrase {
-		t.Errorf("Unlocking with old passphrases did not fail correctly: %v", err)
+func TestWriteCommentsDeterministic(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
+	if err != nil {
+		t.Error("Error creating new wallet: " + err.Error())
 		return
 	}
+	for i := 0; i < 8; i++ {
+		addr, err := w.NextChainedAddress(makeBS(0))
+		if err != nil {
+			t.Errorf("Cannot get next chained address: %v", err)
+			return
+		}
+		if err := w.SetAddressComment(addr, "address "+string(rune('a'+i))); err != nil {
+			t.Errorf("Cannot set address comment: %v", err)
+			return
+		}
+		txSha := btcwire.ShaHash{byte(i)}
+		if err := w.SetTxComment(&txSha, "tx "+string(rune('a'+i))); err != nil {
+			t.Errorf("Cannot set transaction comment: %v", err)
+			return
+		}
+	}
 
-	// Unlock with new passphrase.  This must succeed.
-	if err := w.Unlock([]byte("potato")); err != nil {
-		t.Errorf("Unlocking with new passphrase failed: %v", err)
+	first := new(bytes.Buffer)
+	if _, err := w.WriteTo(first); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
+	for i := 0; i < 10; i++ {
+		buf := new(bytes.Buffer)
+		if _, err := w.WriteTo(buf); err != nil {
+			t.Errorf("Cannot write wallet: %v", err)
+			return
+		}
+		if !bytes.Equal(buf.Bytes(), first.Bytes()) {
+			t.Errorf("Write %d differs from the first write", i)
+			return
+		}
+	}
+}
 
-	// Get root address' private key again.
-	rootAddrInfo2, err := w.Address(rootAddr)
+func TestReadNewerVersion(t *testing.T) {
+	w, err := New(dummyDir, "A wallet for testing.",
+		[]byte("banana"), tstNetParams, makeBS(0))
 	if err != nil {
-		t.Error("can't find root address: " + err.Error())
+		t.Error("Error creating new wallet: " + err.Error())
+		return
+	}
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Errorf("Cannot write wallet: %v", err)
 		return
 	}
-	rapka2 := rootAddrInfo2.(PubKeyAddress)
 
-	rootPrivKey2, err := rapka2.PrivKey()
-	if err != nil {
-		t.Errorf("Cannot get root address' private key after passphrase change: %v", err)
+	// Append an entry with a header unknown to this version.
+	unknown := append(buf.Bytes(), 0x7f)
+	r := new(Store)
+	_, err = r.ReadFrom(bytes.NewReader(unknown))
+	if err == nil || err == ErrNewerVersion {
+		t.Errorf("Reading unknown entry of current version did not fail "+
+			"correctly: %v", err)
 		return
 	}
 
-	// Private keys must match.
-	if !reflect.DeepEqual(rootPrivKey, rootPrivKey2) {
-		t.Errorf("Private keys before and after unlock differ.")
+	// The same entry in a file of a newer version is reported as such.
+	// The version follows the 8 byte file ID.
+	newer := append([]byte(nil), unknown...)
+	newer[8] = VersCurrent.major + 1
+	r = new(Store)
+	if _, err := r.ReadFrom(bytes.NewReader(newer)); err != ErrNewerVersion {
+		t.Errorf("Reading unknown entry of newer version did not fail "+
+			"correctly: %v", err)
 		return
 	}
+
+	// A file of a newer version without unknown entries is still read.
+	newer = append([]byte(nil), buf.Bytes()...)
+	newer[8] = VersCurrent.major + 1
+	if _, err := ReadFromLenient(bytes.NewReader(newer)); err != nil {
+		t.Errorf("Cannot read wallet of newer version: %v", err)
+	}
 }
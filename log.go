@@ -22,6 +22,7 @@ import (
 
 	"github.com/conformal/btclog"
 	"github.com/conformal/btcwallet/chain"
+	"github.com/conformal/btcwallet/keystore"
 	"github.com/conformal/btcwallet/txstore"
 	"github.com/conformal/seelog"
 )
@@ -43,6 +44,7 @@ var (
 	backendLog = seelog.Disabled
 	log        = btclog.Disabled
 	txstLog    = btclog.Disabled
+	kstrLog    = btclog.Disabled
 	chainLog   = btclog.Disabled
 )
 
@@ -50,6 +52,7 @@ var (
 var subsystemLoggers = map[string]btclog.Logger{
 	"BTCW": log,
 	"TXST": txstLog,
+	"KSTR": kstrLog,
 	"CHNS": chainLog,
 }
 
@@ -83,6 +86,9 @@ func useLogger(subsystemID string, logger btclog.Logger) {
 	case "TXST":
 		txstLog = logger
 		txstore.UseLogger(logger)
+	case "KSTR":
+		kstrLog = logger
+		keystore.UseLogger(logger)
 	case "CHNS":
 		chainLog = logger
 		chain.UseLogger(logger)
@@ -1714,6 +1714,8 @@ func GetInfo(w *Wallet, chainSvr *chain.Client, icmd btcjson.Cmd) (interface{},
 		return nil, err
 	}
 
+	// Each version component is packed into its own byte, so this fits
+	// in an int32 for any major version below 128.
 	info.WalletVersion = int32(keystore.VersCurrent.Uint32())
 	info.Balance = bal.ToUnit(btcutil.AmountBTC)
 	// Keypool times are not tracked. set to current time.
@@ -1840,6 +1842,11 @@ func GetNewAddress(w *Wallet, chainSvr *chain.Client, icmd btcjson.Cmd) (interfa
 	}
 
 	addr, err := w.NewAddress()
+	if err == keystore.ErrLocked {
+		// A keystore with a file MAC can not hand out addresses
+		// until it is first unlocked.
+		return nil, btcjson.ErrWalletUnlockNeeded
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1855,6 +1862,9 @@ func GetNewAddress(w *Wallet, chainSvr *chain.Client, icmd btcjson.Cmd) (interfa
 // but ignores the parameter.
 func GetRawChangeAddress(w *Wallet, chainSvr *chain.Client, icmd btcjson.Cmd) (interface{}, error) {
 	addr, err := w.NewChangeAddress()
+	if err == keystore.ErrLocked {
+		return nil, btcjson.ErrWalletUnlockNeeded
+	}
 	if err != nil {
 		return nil, err
 	}
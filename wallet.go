@@ -703,7 +703,13 @@ func (w *Wallet) diskWriter() {
 		wg.Add(2)
 		go func() {
 			err := w.KeyStore.WriteIfDirty()
-			if err != nil {
+			switch {
+			case err == keystore.ErrLocked && !done:
+				// A keystore with a file MAC can not be
+				// written until it is first unlocked.  It
+				// remains dirty and is written after unlock.
+				log.Trace("Deferring keystore write until unlock")
+			case err != nil:
 				log.Errorf("Cannot write keystore: %v",
 					err)
 			}